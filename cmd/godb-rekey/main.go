@@ -0,0 +1,61 @@
+// godb-rekey 离线更换数据库的加密密钥, 也可以给没有加密的数据库加密或者去掉加密.
+// 密钥以十六进制保存在文件中, 不通过命令行参数传递, 避免出现在进程列表里.
+//
+//	godb-rekey -path /data/godb -old-key-file old.key -new-key-file new.key
+//
+// 执行前必须关闭数据库, 中途失败时用同样的参数重新执行即可
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/herveyleaf/GoDB/internal/backend/dm"
+)
+
+func main() {
+	path := flag.String("path", "", "数据库文件的路径, 不带后缀")
+	oldKeyFile := flag.String("old-key-file", "", "当前密钥所在的文件, 为空表示数据库没有加密")
+	newKeyFile := flag.String("new-key-file", "", "新密钥所在的文件, 为空表示去掉加密")
+	flag.Parse()
+
+	if *path == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	oldKey, err := readKey(*oldKeyFile)
+	if err != nil {
+		fail(err)
+	}
+	newKey, err := readKey(*newKeyFile)
+	if err != nil {
+		fail(err)
+	}
+	if err := dm.Rekey(*path, dm.Config{EncryptionKey: oldKey}, newKey); err != nil {
+		fail(err)
+	}
+}
+
+// readKey 读出文件中十六进制的密钥, name为空时返回nil
+func readKey(name string) ([]byte, error) {
+	if name == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return key, nil
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "godb-rekey: %v\n", err)
+	os.Exit(1)
+}
@@ -1,75 +1,162 @@
 package cache
 
 import (
+	"context"
 	"sync"
 
 	"github.com/herveyleaf/GoDB/pkg/common"
 )
 
+// CacheLoader 由具体的缓存实现提供, 相当于AbstractCache的两个抽象方法
+type CacheLoader[T any] interface {
+	// 资源不在缓存时的获取行为
+	GetForCache(key int64) (T, error)
+	// 资源被驱逐时的写回行为
+	ReleaseForCache(obj T)
+}
+
+// ContextLoader 可选实现, 支持在获取资源的过程中响应ctx的取消
+type ContextLoader[T any] interface {
+	GetForCacheContext(ctx context.Context, key int64) (T, error)
+}
+
 type AbstractCache[T any] struct {
-	cache      map[int64]T        // 实际缓存的数据
-	references map[int64]int      // 元素的引用个数
-	getting    map[int64]struct{} // 正在获取某资源的线程
+	cache      map[int64]T             // 实际缓存的数据
+	references map[int64]int           // 元素的引用个数
+	getting    map[int64]chan struct{} // 正在获取某资源的goroutine, 获取结束时关闭对应的channel
 
 	maxResource int // 缓存的最大缓存资源数
 	count       int // 缓存中元素的个数
 	lock        *sync.Mutex
-	cond        *sync.Cond // 条件变量，用于等待getting中的资源释放
+	loader      CacheLoader[T]
 }
 
-func NewAbstractCache[T any](maxCount int) *AbstractCache[T] {
-	c := &AbstractCache[T]{
+func NewAbstractCache[T any](maxCount int, loader CacheLoader[T]) *AbstractCache[T] {
+	return &AbstractCache[T]{
 		maxResource: maxCount,
 		cache:       make(map[int64]T),
 		references:  make(map[int64]int),
-		getting:     make(map[int64]struct{}),
+		getting:     make(map[int64]chan struct{}),
+		lock:        &sync.Mutex{},
+		loader:      loader,
 	}
-	c.cond = sync.NewCond(c.lock)
-	return c
 }
 
 func (ac *AbstractCache[T]) Get(key int64) (T, error) {
+	return ac.GetContext(context.Background(), key)
+}
+
+// GetContext 与Get相同, 但在等待其它goroutine获取资源或自身进行IO时可以被ctx取消
+func (ac *AbstractCache[T]) GetContext(ctx context.Context, key int64) (T, error) {
+	var zero T
 	ac.lock.Lock()
-	defer ac.lock.Unlock()
 
 	// 等待其它goroutine完成获取
-	for _, exists := ac.getting[key]; exists; _, exists = ac.getting[key] {
-		ac.cond.Wait()
+	for {
+		if err := ctx.Err(); err != nil {
+			ac.lock.Unlock()
+			return zero, err
+		}
+		done, exists := ac.getting[key]
+		if !exists {
+			break
+		}
+		ac.lock.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return zero, ctx.Err()
+		}
+		ac.lock.Lock()
 	}
 
 	// 检查缓存是否存在
 	if obj, exists := ac.cache[key]; exists {
 		ac.references[key]++
+		ac.lock.Unlock()
 		return obj, nil
 	}
 
 	// 检查缓存容量
 	if ac.maxResource > 0 && ac.count >= ac.maxResource {
-		var zero T
+		ac.lock.Unlock()
 		return zero, common.ErrCacheFull
 	}
 
 	// 标记正在获取
-	ac.getting[key] = struct{}{}
+	done := make(chan struct{})
+	ac.getting[key] = done
 	ac.count++
 
 	// 释放锁进行IO操作
 	ac.lock.Unlock()
-	obj, err := ac.GetForCache(key)
+	obj, err := ac.load(ctx, key, done)
+	if err != nil {
+		return zero, err
+	}
+	return obj, nil
+}
+
+// load 在不持有锁的情况下获取资源, 如果ctx先于IO结束, 获取结果会在后台被丢弃
+func (ac *AbstractCache[T]) load(ctx context.Context, key int64, done chan struct{}) (T, error) {
+	if ctx.Done() == nil {
+		obj, err := ac.getForCache(ctx, key)
+		ac.finishLoad(key, done, obj, err, true)
+		return obj, err
+	}
+
+	type result struct {
+		obj T
+		err error
+	}
+	resCh := make(chan result, 1)
+	go func() {
+		obj, err := ac.getForCache(ctx, key)
+		resCh <- result{obj, err}
+	}()
+
+	select {
+	case res := <-resCh:
+		ac.finishLoad(key, done, res.obj, res.err, true)
+		return res.obj, res.err
+	case <-ctx.Done():
+		// 调用方已经放弃, 等IO结束后再清理获取标记, 避免同一资源被并发加载
+		go func() {
+			res := <-resCh
+			ac.finishLoad(key, done, res.obj, res.err, false)
+		}()
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
+func (ac *AbstractCache[T]) getForCache(ctx context.Context, key int64) (T, error) {
+	if cl, ok := ac.loader.(ContextLoader[T]); ok {
+		return cl.GetForCacheContext(ctx, key)
+	}
+	return ac.loader.GetForCache(key)
+}
+
+// finishLoad 结束一次获取, keep为false时表示调用方已放弃该资源
+func (ac *AbstractCache[T]) finishLoad(key int64, done chan struct{}, obj T, err error, keep bool) {
 	ac.lock.Lock()
+	defer ac.lock.Unlock()
 
 	delete(ac.getting, key)
+	defer close(done)
 	if err != nil {
 		ac.count--
-		ac.cond.Broadcast()
-		return obj, err
+		return
+	}
+	if !keep {
+		ac.count--
+		ac.loader.ReleaseForCache(obj)
+		return
 	}
 
 	// 成功获取后加入缓存
 	ac.cache[key] = obj
 	ac.references[key] = 1
-	ac.cond.Broadcast()
-	return obj, nil
 }
 
 func (ac *AbstractCache[T]) Release(key int64) {
@@ -80,7 +167,7 @@ func (ac *AbstractCache[T]) Release(key int64) {
 		ref--
 		if ref == 0 {
 			obj := ac.cache[key]
-			ac.ReleaseForCache(obj)
+			ac.loader.ReleaseForCache(obj)
 			delete(ac.references, key)
 			delete(ac.cache, key)
 			ac.count--
@@ -90,23 +177,27 @@ func (ac *AbstractCache[T]) Release(key int64) {
 	}
 }
 
+// Keys 返回当前缓存中所有资源的key
+func (ac *AbstractCache[T]) Keys() []int64 {
+	ac.lock.Lock()
+	defer ac.lock.Unlock()
+
+	keys := make([]int64, 0, len(ac.cache))
+	for key := range ac.cache {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
 func (ac *AbstractCache[T]) Close() {
 	ac.lock.Lock()
 	defer ac.lock.Unlock()
 
 	for key, obj := range ac.cache {
-		ac.ReleaseForCache(obj)
+		ac.loader.ReleaseForCache(obj)
 		delete(ac.cache, key)
 		delete(ac.references, key)
 	}
-	ac.count = 0
-}
-
-// 抽象方法
-func (ac *AbstractCache[T]) GetForCache(key int64) (T, error) {
-	panic("GetForCache must be implemented")
-}
-
-func (ac *AbstractCache[T]) ReleaseForCache(obj T) {
-	panic("ReleaseForCache must be implemented")
+	// 仍在获取中的资源会在获取结束时自行扣减计数
+	ac.count = len(ac.getting)
 }
@@ -0,0 +1,105 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 测试用的加载器, 在unblock关闭前所有加载都会卡住
+type blockingLoader struct {
+	unblock  chan struct{}
+	mu       sync.Mutex
+	loads    int
+	released int
+}
+
+func (bl *blockingLoader) GetForCache(key int64) (int64, error) {
+	<-bl.unblock
+	bl.mu.Lock()
+	bl.loads++
+	bl.mu.Unlock()
+	return key * 10, nil
+}
+
+func (bl *blockingLoader) ReleaseForCache(obj int64) {
+	bl.mu.Lock()
+	bl.released++
+	bl.mu.Unlock()
+}
+
+func TestGetDispatchesToLoader(t *testing.T) {
+	bl := &blockingLoader{unblock: make(chan struct{})}
+	close(bl.unblock)
+	c := NewAbstractCache[int64](0, bl)
+
+	v, err := c.Get(3)
+	if err != nil || v != 30 {
+		t.Fatalf("Get returned %v, %v", v, err)
+	}
+	if v, _ := c.Get(3); v != 30 || bl.loads != 1 {
+		t.Fatalf("Expected cached value, loads = %d", bl.loads)
+	}
+	c.Release(3)
+	c.Release(3)
+	if bl.released != 1 {
+		t.Fatalf("Expected one release, got %d", bl.released)
+	}
+}
+
+func TestGetContextTimeoutWhileLoading(t *testing.T) {
+	bl := &blockingLoader{unblock: make(chan struct{})}
+	c := NewAbstractCache[int64](0, bl)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := c.GetContext(ctx, 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected DeadlineExceeded, got %v", err)
+	}
+
+	// 加载结束后结果被丢弃, 后续的Get可以重新加载
+	close(bl.unblock)
+	v, err := c.Get(1)
+	if err != nil || v != 10 {
+		t.Fatalf("Get after abandoned load returned %v, %v", v, err)
+	}
+}
+
+func TestGetContextTimeoutWaitingForOtherLoader(t *testing.T) {
+	bl := &blockingLoader{unblock: make(chan struct{})}
+	c := NewAbstractCache[int64](0, bl)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if _, err := c.Get(7); err != nil {
+			t.Errorf("Get failed: %v", err)
+		}
+	}()
+
+	// 等待第一个goroutine开始加载
+	for {
+		c.lock.Lock()
+		_, loading := c.getting[7]
+		c.lock.Unlock()
+		if loading {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.GetContext(ctx, 7); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected Canceled, got %v", err)
+	}
+
+	close(bl.unblock)
+	wg.Wait()
+	if bl.loads != 1 {
+		t.Fatalf("Expected a single load, got %d", bl.loads)
+	}
+}
@@ -0,0 +1,154 @@
+package dm
+
+import (
+	"encoding/binary"
+
+	"github.com/herveyleaf/GoDB/internal/backend/tm"
+	"github.com/herveyleaf/GoDB/internal/backend/utils"
+	"github.com/herveyleaf/GoDB/pkg/common"
+)
+
+// track 记住事务写下的插入、更新和批量插入日志, 回滚时倒序撤销. 第一次记录一个事务时顺便去掉已经结束的事务,
+// 读不出事务状态时保留
+func (dm *DataManagerImpl) track(xid int64, logs ...[]byte) {
+	if xid == tm.SUPER_XID {
+		return
+	}
+	dm.undoLock.Lock()
+	defer dm.undoLock.Unlock()
+	if _, ok := dm.undoLogs[xid]; !ok {
+		for x := range dm.undoLogs {
+			if active, err := dm.tm.IsActive(x); !active && err == nil {
+				delete(dm.undoLogs, x)
+			}
+		}
+	}
+	for _, log := range logs {
+		if t := log[OF_TYPE]; t == LOG_TYPE_INSERT || t == LOG_TYPE_UPDATE || t == LOG_TYPE_BATCH {
+			dm.undoLogs[xid] = append(dm.undoLogs[xid], log)
+		}
+	}
+}
+
+// touched 是否有还没有结束的事务在页面pgno上写过日志, 它们回滚时要在原来的位置撤销
+func (dm *DataManagerImpl) touched(pgno int) bool {
+	dm.undoLock.Lock()
+	defer dm.undoLock.Unlock()
+	for xid, logs := range dm.undoLogs {
+		if active, err := dm.tm.IsActive(xid); !active && err == nil {
+			continue
+		}
+		for _, log := range logs {
+			if _, p := parseLogTarget(log); p == pgno {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Abort 和恢复时一样倒序撤销事务的日志, 以超级事务的名义写补偿日志, 补偿日志落盘之后返回.
+// 撤销之后页面上腾出来的空间和被撤销的大数据的溢出页在事务结束之后由reclaim回收
+func (dm *DataManagerImpl) Abort(xid int64) error {
+	if dm.readOnly {
+		return common.ErrReadOnly
+	}
+	dm.undoLock.Lock()
+	logs := dm.undoLogs[xid]
+	delete(dm.undoLogs, xid)
+	dm.undoLock.Unlock()
+
+	var pending []pendingDelete
+	for i := len(logs) - 1; i >= 0; i-- {
+		p, err := dm.undo(xid, logs[i])
+		if err != nil {
+			return err
+		}
+		pending = append(pending, p...)
+	}
+	if err := dm.logger.Flush(); err != nil {
+		return err
+	}
+	// 事务删掉的大数据已经放回, 它的溢出页不能再回收
+	dm.spaceLock.Lock()
+	rest := dm.deletes[:0]
+	for _, p := range dm.deletes {
+		if p.xid != xid || p.overflow == 0 {
+			rest = append(rest, p)
+		}
+	}
+	dm.deletes = append(rest, pending...)
+	dm.spaceLock.Unlock()
+	return nil
+}
+
+// undo 撤销一条日志. 撤销更新时旧的内容放不回原处要整理页面, 页面上有DataItem被持有时先放开追加锁,
+// 等它们都释放之后再试
+func (dm *DataManagerImpl) undo(xid int64, log []byte) ([]pendingDelete, error) {
+	_, pgno := parseLogTarget(log)
+	pg, err := dm.pc.GetPage(pgno)
+	if err != nil {
+		return nil, err
+	}
+	defer pg.Release()
+	for {
+		var done bool
+		dm.locked(pgno, func() {
+			done, err = dm.compensate(pg, log)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if done {
+			break
+		}
+		dm.pinLock.Lock()
+		for dm.pins[pgno] > 0 {
+			dm.unpinned.Wait()
+		}
+		dm.pinLock.Unlock()
+	}
+
+	pending := []pendingDelete{{xid: xid, pgno: pgno}}
+	if log[OF_TYPE] == LOG_TYPE_INSERT {
+		if li := parseInsertLog(log); li.raw[OF_VALID]&DATAITEM_OVERFLOW != 0 {
+			first := int(binary.BigEndian.Uint32(li.raw[OF_DATA_DATAITEM+OF_STUB_PGNO:]))
+			owner := utils.AddressToUid(li.pgno, li.slot)
+			pending = append(pending, pendingDelete{xid: xid, overflow: first, owner: owner})
+		}
+	}
+	return pending, nil
+}
+
+// compensate 写补偿日志并修改页面, 调用方持有页面的追加锁. 撤销插入只把DataItem标记为无效, 位置不变;
+// 撤销更新时其它DataItem可能被挪动, 页面上有DataItem被持有时返回false
+func (dm *DataManagerImpl) compensate(pg Page, log []byte) (bool, error) {
+	if log[OF_TYPE] == LOG_TYPE_UPDATE {
+		xi := parseUpdateLog(log)
+		offset, ok := itemOffset(pg.GetData(), xi.slot)
+		if !ok || dataItemLength(pg.GetData(), offset) < len(xi.oldRaw) {
+			dm.pinLock.Lock()
+			defer dm.pinLock.Unlock()
+			if dm.pins[pg.GetPageNumber()] > 0 {
+				return false, nil
+			}
+		}
+	}
+	_, keep := dm.reservedSpace(pg.GetPageNumber())
+	clr, err := compensationLog(dm.pc, log, keep)
+	if err != nil {
+		return false, err
+	}
+	release := dm.logger.Hold()
+	defer release()
+	if err := dm.logger.Log(clr); err != nil {
+		return false, err
+	}
+	if clr[OF_TYPE] != LOG_TYPE_COMPACT {
+		return true, redoLog(dm.pc, clr, 0)
+	}
+	pg.BeginUpdate()
+	copy(pg.GetData(), clr[LEN_PAGE_LOG:])
+	pg.EndUpdate()
+	return true, nil
+}
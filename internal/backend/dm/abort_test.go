@@ -0,0 +1,133 @@
+package dm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/herveyleaf/GoDB/internal/backend/tm"
+	"github.com/herveyleaf/GoDB/internal/backend/vfs/vfstest"
+)
+
+func TestAbort(t *testing.T) {
+	fsys := vfstest.NewCrashFS(1)
+	tmCfg := tm.Config{FS: fsys, Locked: true}
+	cfg := Config{PageSize: MIN_PAGE_SIZE, FS: fsys}
+	tmgr, err := tm.CreateWithConfig("abort", tmCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := CreateDMWithConfig("abort", MIN_PAGE_SIZE*MEM_MIN_LIM, tmgr, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstOverflow := func(uid int64) int {
+		di, _ := d.Read(uid)
+		defer di.Release()
+		return int(binary.BigEndian.Uint32(di.(*DataItemImpl).raw()[OF_DATA_DATAITEM+OF_STUB_PGNO:]))
+	}
+
+	base := map[int64][]byte{}
+	xid, _ := tmgr.Begin()
+	for _, data := range [][]byte{
+		[]byte("shrink"),
+		[]byte("move"),
+		[]byte("delete"),
+		bytes.Repeat([]byte{1}, MIN_PAGE_SIZE*2),
+	} {
+		uid, err := d.Insert(xid, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		base[uid] = data
+	}
+	tmgr.Commit(xid)
+	var uids []int64
+	for uid := range base {
+		uids = append(uids, uid)
+	}
+	large := uids[0]
+	for _, uid := range uids {
+		if len(base[uid]) > MIN_PAGE_SIZE {
+			large = uid
+		}
+	}
+	kept := firstOverflow(large)
+
+	// 回滚的事务插入的数据读不到, 更新和删除的数据换回原来的内容, 搬走的数据回到原处
+	xid, _ = tmgr.Begin()
+	inserted, _ := d.Insert(xid, []byte("inserted"))
+	insertedLarge, err := d.Insert(xid, bytes.Repeat([]byte{2}, MIN_PAGE_SIZE*2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	freed := firstOverflow(insertedLarge)
+	for uid, data := range base {
+		switch string(data) {
+		case "shrink":
+			err = d.Update(xid, uid, []byte("s"))
+		case "move":
+			if err = d.Update(xid, uid, bytes.Repeat([]byte{3}, MaxFreeSpace(MIN_PAGE_SIZE)-OF_DATA_DATAITEM)); err == nil {
+				di, _ := d.Read(uid)
+				if di.(*DataItemImpl).loc == uid {
+					t.Fatalf("Item %d should be moved to another page", uid)
+				}
+				di.Release()
+			}
+		default:
+			err = d.Delete(xid, uid)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Abort(xid); err != nil {
+		t.Fatal(err)
+	}
+	tmgr.Abort(xid)
+
+	check := func() {
+		for _, uid := range []int64{inserted, insertedLarge} {
+			if di, _ := d.Read(uid); di != nil {
+				di.Release()
+				t.Fatalf("Item %d inserted by an aborted transaction is still readable", uid)
+			}
+		}
+		for uid, data := range base {
+			di, err := d.Read(uid)
+			if err != nil || di == nil || !bytes.Equal(di.Data(), data) {
+				t.Fatalf("Item %d was not restored: %v", uid, err)
+			}
+			if loc := di.(*DataItemImpl).loc; loc != uid {
+				t.Fatalf("Item %d is still forwarded to %d", uid, loc)
+			}
+			di.Release()
+		}
+	}
+	check()
+	dm := d.(*DataManagerImpl)
+	if err := dm.reclaim(); err != nil {
+		t.Fatal(err)
+	}
+	if !dm.free.contains(freed) || dm.free.contains(kept) {
+		t.Fatalf("Overflow pages of the aborted insert should be freed and the restored ones kept")
+	}
+
+	// 补偿日志在恢复时重做, 撤销的结果不会丢失
+	fsys.Crash()
+	if err := d.Close(); !errors.Is(err, vfstest.ErrPowerLoss) {
+		t.Fatalf("Expected ErrPowerLoss from Close after a crash, got %v", err)
+	}
+	tmgr.Close()
+	fsys.Restart()
+	if tmgr, err = tm.OpenWithConfig("abort", tmCfg); err != nil {
+		t.Fatal(err)
+	}
+	defer tmgr.Close()
+	if d, err = OpenDMWithConfig("abort", MIN_PAGE_SIZE*MEM_MIN_LIM, tmgr, cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	check()
+}
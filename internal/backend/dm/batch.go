@@ -0,0 +1,253 @@
+package dm
+
+import (
+	"slices"
+	"sync"
+
+	"github.com/herveyleaf/GoDB/internal/backend/tm"
+	"github.com/herveyleaf/GoDB/internal/backend/utils"
+	"github.com/herveyleaf/GoDB/pkg/common"
+)
+
+const (
+	// 批量插入时一组最多持有的页面数, 页面缓存至少能放下MEM_MIN_LIM个页面, 留一半给溢出页和其它事务
+	BATCH_MAX_PAGES = MEM_MIN_LIM / 2
+)
+
+// batchPage 批量插入时装入同一个页面的数据. 先在页面数据的拷贝data上依次放入每条数据, 算出槽和位置,
+// 日志写入之后再修改页面. 从PageIndex中取出的已有页面在这期间持有追加锁, 新分配的页面不在索引中, 不需要加锁
+type batchPage struct {
+	pg       Page
+	lock     *sync.Mutex
+	data     []byte
+	reserved int
+	slots    []int
+	offsets  []int
+	raws     [][]byte
+}
+
+// fits 和insertInto一样不能占用为未结束的事务预留的空间, 但不整理页面, 只使用FSO之后连续的空间
+func (bp *batchPage) fits(raw []byte) bool {
+	return freeSpace(bp.data)-bp.reserved >= len(raw) && contiguousSpace(bp.data) >= len(raw)
+}
+
+func (bp *batchPage) add(raw []byte) int {
+	slot, offset := appendItem(bp.data, raw)
+	bp.slots = append(bp.slots, slot)
+	bp.offsets = append(bp.offsets, offset)
+	bp.raws = append(bp.raws, raw)
+	return slot
+}
+
+// InsertBatch 把一批数据依次装入页面, 每个页面写一条批量插入日志, 一组页面的日志一起写入后只fsync一次.
+// 和逐条插入一样先按PageIndex的策略使用已有页面的空闲空间, 不整理页面, 已有页面的追加锁被别人持有时跳过它,
+// 没有合适的页面时才分配新页. 一组页面在日志写入之前都被持有, 攒够BATCH_MAX_PAGES个页面就先写入这一组.
+// 返回的UID和data一一对应. 放不进一页的数据仍然逐条存放到溢出页中. 其中一组或者一条大数据失败时返回已经插入的部分,
+// 之后的数据没有插入, UID为0
+func (dm *DataManagerImpl) InsertBatch(xid int64, data [][]byte) ([]int64, error) {
+	if dm.readOnly {
+		return nil, common.ErrReadOnly
+	}
+	if err := dm.reclaim(); err != nil {
+		return nil, err
+	}
+	pageSize := dm.pc.PageSize()
+	uids := make([]int64, len(data))
+	var logs [][]byte
+	var pages []*batchPage
+	// 出错时去掉这一组和之后的UID, 没有插入任何数据时只返回错误
+	fail := func(from int, err error) ([]int64, error) {
+		clear(uids[from:])
+		if from == 0 {
+			return nil, err
+		}
+		return uids, err
+	}
+	group := 0
+	var cur *batchPage
+	for i, d := range data {
+		raw := WrapDataItemRaw(d)
+		if len(raw) > MaxFreeSpace(pageSize) {
+			continue
+		}
+		if cur == nil || !cur.fits(raw) {
+			if len(pages) == BATCH_MAX_PAGES {
+				if err := dm.writeBatch(xid, pages, logs); err != nil {
+					return fail(group, err)
+				}
+				group, pages, logs = i, nil, nil
+			}
+			next, err := dm.batchPage(raw, func(log []byte) error {
+				logs = append(logs, log)
+				return nil
+			})
+			if err != nil {
+				dm.returnBatchPages(pages)
+				return fail(group, err)
+			}
+			cur = next
+			pages = append(pages, cur)
+		}
+		uids[i] = utils.AddressToUid(cur.pg.GetPageNumber(), cur.add(raw))
+	}
+	if err := dm.writeBatch(xid, pages, logs); err != nil {
+		return fail(group, err)
+	}
+
+	for i, d := range data {
+		if len(WrapDataItemRaw(d)) <= MaxFreeSpace(pageSize) {
+			continue
+		}
+		uid, err := dm.insertOverflow(xid, d, 0)
+		if err != nil {
+			for j := i; j < len(data); j++ {
+				if len(WrapDataItemRaw(data[j])) > MaxFreeSpace(pageSize) {
+					uids[j] = 0
+				}
+			}
+			return uids, err
+		}
+		uids[i] = uid
+	}
+	return uids, nil
+}
+
+// writeBatch 先写入一组页面的批量插入日志和取出空闲页的日志, 之后才修改页面, 最后把页面放回PageIndex
+func (dm *DataManagerImpl) writeBatch(xid int64, pages []*batchPage, logs [][]byte) error {
+	defer dm.returnBatchPages(pages)
+	for _, bp := range pages {
+		logs = append(logs, batchLogRaw(xid, bp.pg.GetPageNumber(), bp.slots, bp.offsets, bp.raws))
+	}
+	if len(logs) == 0 {
+		return nil
+	}
+	release := dm.logger.Hold()
+	defer release()
+	if err := dm.logger.LogBatch(logs); err != nil {
+		return err
+	}
+	dm.track(xid, logs...)
+	for _, bp := range pages {
+		for j, raw := range bp.raws {
+			RecoverInsert(bp.pg, bp.slots[j], raw, bp.offsets[j])
+		}
+	}
+	return nil
+}
+
+// batchPage 返回能放下raw的下一个页面. 先从PageIndex中选择, 只尝试获取追加锁, 不会和持有追加锁再等其它锁的插入、
+// 更新互相等待; 拿不到锁或者连续的空间不够时放回索引, 分配新页, 取出空闲页的日志交给log
+func (dm *DataManagerImpl) batchPage(raw []byte, log func([]byte) error) (*batchPage, error) {
+	if pi := dm.pIndex.Select(len(raw)); pi != (PageInfo{}) {
+		lock := dm.appendLock(pi.Pgno)
+		if !lock.TryLock() {
+			dm.addPage(pi.Pgno, pi.FreeSpace)
+		} else {
+			pg, err := dm.pc.GetPage(pi.Pgno)
+			if err != nil {
+				lock.Unlock()
+				dm.addPage(pi.Pgno, pi.FreeSpace)
+				return nil, err
+			}
+			reserved, _ := dm.reservedSpace(pi.Pgno)
+			bp := &batchPage{pg: pg, lock: lock, data: slices.Clone(pg.GetData()), reserved: reserved}
+			if bp.fits(raw) {
+				return bp, nil
+			}
+			free := dm.available(pg)
+			lock.Unlock()
+			dm.addPage(pi.Pgno, free)
+			pg.Release()
+		}
+	}
+	pgno, err := dm.free.allocLogged(log)
+	if err != nil {
+		return nil, err
+	}
+	pg, err := dm.pc.GetPage(pgno)
+	if err != nil {
+		dm.addPage(pgno, MaxFreeSpace(dm.pc.PageSize()))
+		return nil, err
+	}
+	return &batchPage{pg: pg, data: slices.Clone(pg.GetData())}, nil
+}
+
+// returnBatchPages 释放页面的追加锁, 把页面连同现在的空闲空间放回PageIndex. 出错时页面没有被修改,
+// 新分配的页面仍然是空页
+func (dm *DataManagerImpl) returnBatchPages(pages []*batchPage) {
+	for _, bp := range pages {
+		free := dm.available(bp.pg)
+		if bp.lock != nil {
+			bp.lock.Unlock()
+		}
+		dm.addPage(bp.pg.GetPageNumber(), free)
+		bp.pg.Release()
+	}
+}
+
+// batchLogRaw 批量插入日志: [LogType][XID][Pgno]后面依次是每条数据的[Slot][Offset][Raw],
+// Raw的长度由DataItem自己的Size得出
+func batchLogRaw(xid int64, pgno int, slots []int, offsets []int, raws [][]byte) []byte {
+	log := append([]byte{LOG_TYPE_BATCH}, utils.Long2Byte(xid)...)
+	log = append(log, utils.Int2Byte(pgno)...)
+	for i, raw := range raws {
+		log = append(log, utils.Short2Byte(int16(slots[i]))...)
+		log = append(log, utils.Short2Byte(int16(offsets[i]))...)
+		log = append(log, raw...)
+	}
+	return log
+}
+
+// parseBatchLog 把批量插入日志拆成每条数据的插入日志信息
+func parseBatchLog(log []byte) []*InsertLogInfo {
+	xid := utils.ParseLong(log[OF_XID:OF_INSERT_PGNO])
+	pgno := utils.ParseInt(log[OF_INSERT_PGNO:OF_INSERT_SLOT])
+	var lis []*InsertLogInfo
+	for pos := OF_INSERT_SLOT; pos < len(log); {
+		li := NewInsertLogInfo()
+		li.xid, li.pgno = xid, pgno
+		li.slot = int(uint16(utils.ParseShort(log[pos : pos+2])))
+		li.offset = int(uint16(utils.ParseShort(log[pos+2 : pos+4])))
+		pos += 4
+		li.raw = log[pos : pos+dataItemLength(log, pos)]
+		pos += len(li.raw)
+		lis = append(lis, li)
+	}
+	return lis
+}
+
+func doBatchLog(pc PageCache, log []byte) error {
+	lis := parseBatchLog(log)
+	pg, err := pc.GetPage(lis[0].pgno)
+	if err != nil {
+		return err
+	}
+	defer pg.Release()
+	for _, li := range lis {
+		RecoverInsert(pg, li.slot, li.raw, li.offset)
+	}
+	return nil
+}
+
+// batchCompensationLog 撤销批量插入时把其中每条数据都标记为无效, 位置取自槽现在指向的地方
+func batchCompensationLog(pc PageCache, log []byte) ([]byte, error) {
+	lis := parseBatchLog(log)
+	pg, err := pc.GetPage(lis[0].pgno)
+	if err != nil {
+		return nil, err
+	}
+	defer pg.Release()
+	slots := make([]int, len(lis))
+	offsets := make([]int, len(lis))
+	raws := make([][]byte, len(lis))
+	for i, li := range lis {
+		slots[i], offsets[i] = li.slot, li.offset
+		if current, ok := itemOffset(pg.GetData(), li.slot); ok {
+			offsets[i] = current
+		}
+		raws[i] = make([]byte, len(li.raw))
+		copy(raws[i], li.raw)
+		SetDataItemRawInvalid(raws[i])
+	}
+	return batchLogRaw(tm.SUPER_XID, lis[0].pgno, slots, offsets, raws), nil
+}
@@ -0,0 +1,169 @@
+package dm
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/herveyleaf/GoDB/internal/backend/tm"
+	"github.com/herveyleaf/GoDB/internal/backend/utils"
+	"github.com/herveyleaf/GoDB/internal/backend/vfs/vfstest"
+)
+
+func TestInsertBatch(t *testing.T) {
+	fsys := vfstest.NewCrashFS(1)
+	tmCfg := tm.Config{FS: fsys, Locked: true}
+	cfg := Config{PageSize: MIN_PAGE_SIZE, FS: fsys}
+	tmgr, err := tm.CreateWithConfig("batch", tmCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := CreateDMWithConfig("batch", MIN_PAGE_SIZE*MEM_MIN_LIM, tmgr, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	batch := func() [][]byte {
+		var data [][]byte
+		for i := 0; i < 50; i++ {
+			data = append(data, bytes.Repeat([]byte{byte(i)}, i*20))
+		}
+		return append(data, bytes.Repeat([]byte{50}, MIN_PAGE_SIZE*2))
+	}
+	check := func(uids []int64, data [][]byte, valid bool) {
+		for i, uid := range uids {
+			di, err := d.Read(uid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !valid {
+				if di != nil {
+					t.Fatalf("Uncommitted item %d survived recovery", i)
+				}
+				continue
+			}
+			if di == nil || !bytes.Equal(di.Data(), data[i]) {
+				t.Fatalf("Item %d read back wrong", i)
+			}
+			di.Release()
+		}
+	}
+
+	xid, _ := tmgr.Begin()
+	data := batch()
+	committed, err := d.InsertBatch(xid, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmgr.Commit(xid)
+	check(committed, data, true)
+
+	// 没有提交的一批在恢复时整批撤销
+	xid, _ = tmgr.Begin()
+	aborted, err := d.InsertBatch(xid, batch())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys.Crash()
+	if err := d.Close(); !errors.Is(err, vfstest.ErrPowerLoss) {
+		t.Fatalf("Expected ErrPowerLoss from Close after a crash, got %v", err)
+	}
+	tmgr.Close()
+	fsys.Restart()
+
+	if tmgr, err = tm.OpenWithConfig("batch", tmCfg); err != nil {
+		t.Fatal(err)
+	}
+	defer tmgr.Close()
+	if d, err = OpenDMWithConfig("batch", MIN_PAGE_SIZE*MEM_MIN_LIM, tmgr, cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	check(committed, data, true)
+	check(aborted, nil, false)
+}
+
+// 批量插入先使用已有页面的空闲空间, 超过页面缓存能同时持有的页面数时分组写入
+func TestInsertBatchPages(t *testing.T) {
+	fsys := vfstest.NewCrashFS(1)
+	tmgr, err := tm.CreateWithConfig("batch", tm.Config{FS: fsys, Locked: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tmgr.Close()
+	d, err := CreateDMWithConfig("batch", MIN_PAGE_SIZE*MEM_MIN_LIM, tmgr, Config{PageSize: MIN_PAGE_SIZE, FS: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	xid, _ := tmgr.Begin()
+	first, err := d.Insert(xid, []byte("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data [][]byte
+	for i := 0; i < MIN_PAGE_SIZE/100*BATCH_MAX_PAGES*2; i++ {
+		data = append(data, bytes.Repeat([]byte{byte(i)}, 90))
+	}
+	uids, err := d.InsertBatch(xid, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmgr.Commit(xid)
+	firstPgno, _ := utils.UidToAddress(first)
+	if pgno, _ := utils.UidToAddress(uids[0]); pgno != firstPgno {
+		t.Fatalf("Batch started on page %d instead of the page %d with free space", pgno, firstPgno)
+	}
+	pages := map[int]bool{}
+	for i, uid := range uids {
+		pgno, _ := utils.UidToAddress(uid)
+		pages[pgno] = true
+		di, err := d.Read(uid)
+		if err != nil || di == nil || !bytes.Equal(di.Data(), data[i]) {
+			t.Fatalf("Item %d read back wrong: %v", i, err)
+		}
+		di.Release()
+	}
+	if len(pages) <= BATCH_MAX_PAGES {
+		t.Fatalf("Expected the batch to span more than %d pages, got %d", BATCH_MAX_PAGES, len(pages))
+	}
+}
+
+// 批量插入日志写入之后大数据插入失败时, 已经插入的数据的UID仍然返回给调用方
+func TestInsertBatchPartial(t *testing.T) {
+	data := [][]byte{{1}, bytes.Repeat([]byte{2}, MIN_PAGE_SIZE*2), {3}, bytes.Repeat([]byte{4}, MIN_PAGE_SIZE*2)}
+	partial := false
+	for n := 1; ; n++ {
+		fsys := vfstest.NewCrashFS(1)
+		tmgr, err := tm.CreateWithConfig("batch", tm.Config{FS: fsys, Locked: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := CreateDMWithConfig("batch", MIN_PAGE_SIZE*MEM_MIN_LIM, tmgr, Config{PageSize: MIN_PAGE_SIZE, FS: fsys})
+		if err != nil {
+			t.Fatal(err)
+		}
+		xid, _ := tmgr.Begin()
+		fsys.CrashAfter(n)
+		uids, err := d.InsertBatch(xid, data)
+		// 插入成功时断电点可能还在后面, 关闭时才遇到
+		if closeErr := d.Close(); (err != nil || closeErr != nil) && !errors.Is(closeErr, vfstest.ErrPowerLoss) {
+			t.Fatalf("Crash after %d ops: expected ErrPowerLoss from Close, got %v", n, closeErr)
+		}
+		tmgr.Close()
+		if err == nil {
+			break
+		}
+		if uids == nil {
+			continue
+		}
+		partial = true
+		if uids[0] == 0 || uids[2] == 0 || uids[3] != 0 {
+			t.Fatalf("Crash after %d ops: unexpected partial uids %v", n, uids)
+		}
+	}
+	if !partial {
+		t.Fatal("No crash point produced a partial batch")
+	}
+}
@@ -4,19 +4,31 @@ import (
 	"sync"
 
 	"github.com/herveyleaf/GoDB/internal/backend/utils"
+	"github.com/herveyleaf/GoDB/pkg/common"
 )
 
 const (
 	OF_VALID         int = 0
 	OF_SIZE_DATAITEM int = 1
 	OF_DATA_DATAITEM int = 3
+
+	// ValidFlag的各位: DATAITEM_INVALID表示数据已经无效, DATAITEM_OVERFLOW表示Data是溢出页链表的描述,
+	// DATAITEM_FORWARD表示Data是数据搬到的新位置的UID, DATAITEM_MOVED表示这是从别的页面搬过来的数据
+	DATAITEM_INVALID  byte = 1
+	DATAITEM_OVERFLOW byte = 2
+	DATAITEM_FORWARD  byte = 4
+	DATAITEM_MOVED    byte = 8
+
+	// 转发项: [ValidFlag][DataSize=8][Uid]
+	LEN_FORWARD = OF_DATA_DATAITEM + 8
 )
 
 type DataItem interface {
 	Data() []byte
-	Before()
+	Before() error
 	UnBefore()
-	After(xid int64)
+	// After 写日志失败时撤销这次修改并返回错误
+	After(xid int64) error
 	Release()
 	Lock()
 	Unlock()
@@ -29,65 +41,132 @@ type DataItem interface {
 }
 
 type DataItemImpl struct {
-	raw    []byte
+	length int // DataItem在页面中的长度, raw每次从页面中重新取
 	oldRaw []byte
 	lock   sync.RWMutex
-	dm     DataManagerImpl
+	dm     *DataManagerImpl
 	uid    int64
 	pg     Page
+	// 数据实际所在的位置, 数据被搬到别的页面之后和uid不同
+	loc    int64
+	offset int
+	// 存放在溢出页中的数据, 读入时拼接好, 不能原地修改
+	overflow []byte
 }
 
-func NewDataItemImpl(raw []byte, oldRaw []byte, pg Page, uid int64, dm DataManagerImpl) *DataItemImpl {
+func NewDataItemImpl(offset int, length int, pg Page, uid int64, dm *DataManagerImpl) *DataItemImpl {
 	return &DataItemImpl{
-		raw:    raw,
-		oldRaw: oldRaw,
+		length: length,
+		offset: offset,
+		oldRaw: make([]byte, length),
 		lock:   sync.RWMutex{},
 		dm:     dm,
 		uid:    uid,
 		pg:     pg,
+		loc:    uid,
 	}
 }
 
+// WrapDataItemRaw 很短的数据后面补0, 让每个DataItem都至少能原地改写成一个转发项
 func WrapDataItemRaw(raw []byte) []byte {
 	valid := make([]byte, 1)
 	size := utils.Short2Byte(int16(len(raw)))
-	return append(append(valid, size...), raw...)
+	item := append(append(valid, size...), raw...)
+	if len(item) < LEN_FORWARD {
+		item = append(item, make([]byte, LEN_FORWARD-len(item))...)
+	}
+	return item
 }
 
-func ParseDataItem(pg Page, offset int16, dm DataManagerImpl) DataItem {
-	raw := pg.GetData()
-	size := utils.ParseShort(raw[offset+int16(OF_SIZE_DATAITEM) : offset+int16(OF_DATA_DATAITEM)])
-	length := int16(size + int16(OF_DATA_DATAITEM))
-	uid := utils.AddressToUid(pg.GetPageNumber(), offset)
-	return NewDataItemImpl(raw[offset:offset+length], make([]byte, length), pg, uid, dm)
+// ParseDataItem offset是槽slot当前指向的位置, DataItem被持有时页面不会整理, 这个位置不会改变
+func ParseDataItem(pg Page, slot int, offset int, dm *DataManagerImpl) DataItem {
+	length := dataItemLength(pg.GetData(), offset)
+	uid := utils.AddressToUid(pg.GetPageNumber(), slot)
+	return NewDataItemImpl(offset, length, pg, uid, dm)
+}
+
+// ForwardRaw 数据搬到loc之后留在原来位置的转发项
+func ForwardRaw(loc int64) []byte {
+	raw := WrapDataItemRaw(utils.Long2Byte(loc))
+	raw[OF_VALID] = DATAITEM_FORWARD
+	return raw
+}
+
+// dataItemLength 页面中offset处的DataItem的总长度, 包括补齐的部分
+func dataItemLength(raw []byte, offset int) int {
+	return max(dataItemSize(raw, offset)+OF_DATA_DATAITEM, LEN_FORWARD)
+}
+
+func dataItemSize(raw []byte, offset int) int {
+	// size按无符号数解析, 64K的页面中数据长度可能超过int16的范围
+	return int(uint16(utils.ParseShort(raw[offset+OF_SIZE_DATAITEM : offset+OF_DATA_DATAITEM])))
 }
 
 func SetDataItemRawInvalid(raw []byte) {
-	raw[OF_VALID] = byte(1)
+	raw[OF_VALID] |= DATAITEM_INVALID
+}
+
+// raw DataItem在页面中的内容. 内存映射的页面第一次修改时换成私有的拷贝, 所以不能保存页面数据的切片
+func (di *DataItemImpl) raw() []byte {
+	return di.pg.GetData()[di.offset : di.offset+di.length]
 }
 
 func (di *DataItemImpl) IsValid() bool {
-	return di.raw[OF_VALID] == byte(0)
+	return di.raw()[OF_VALID]&DATAITEM_INVALID == 0
+}
+
+func (di *DataItemImpl) isOverflow() bool {
+	return di.raw()[OF_VALID]&DATAITEM_OVERFLOW != 0
+}
+
+func (di *DataItemImpl) isForward() bool {
+	return di.raw()[OF_VALID]&DATAITEM_FORWARD != 0
+}
+
+// setLocation 让DataItem指向数据现在的位置, 调用方持有写锁
+func (di *DataItemImpl) setLocation(pg Page, loc int64, offset int) {
+	length := dataItemLength(pg.GetData(), offset)
+	di.pg, di.loc, di.offset, di.length = pg, loc, offset, length
+	di.oldRaw = make([]byte, length)
 }
 
 func (di *DataItemImpl) Data() []byte {
-	return di.raw[OF_DATA_DATAITEM:]
+	if di.overflow != nil {
+		return di.overflow
+	}
+	raw := di.raw()
+	return raw[OF_DATA_DATAITEM : OF_DATA_DATAITEM+dataItemSize(raw, 0)]
 }
 
-func (di *DataItemImpl) Before() {
+// Before 存放在溢出页中的数据只能整体重新插入, 不能原地修改
+func (di *DataItemImpl) Before() error {
+	if di.overflow != nil {
+		return common.ErrOverflowUpdate
+	}
+	if di.dm != nil && di.dm.readOnly {
+		return common.ErrReadOnly
+	}
 	di.lock.Lock()
-	di.pg.SetDirty(true)
-	copy(di.oldRaw, di.raw[:len(di.oldRaw)])
+	di.pg.BeginUpdate()
+	copy(di.oldRaw, di.raw())
+	return nil
 }
 
 func (di *DataItemImpl) UnBefore() {
-	copy(di.raw, di.oldRaw[:len(di.oldRaw)])
+	copy(di.raw(), di.oldRaw)
+	di.pg.EndUpdate()
 	di.lock.Unlock()
 }
 
-func (di *DataItemImpl) After(xid int64) {
-	di.dm.LogDataItem(xid, di)
+// 修改在写入日志之前不能落盘, 所以日志写完才结束页面的修改
+func (di *DataItemImpl) After(xid int64) error {
+	if err := di.dm.LogDataItem(xid, di); err != nil {
+		di.UnBefore()
+		return err
+	}
+	di.pg.EndUpdate()
 	di.lock.Unlock()
+	return nil
 }
 
 func (di *DataItemImpl) Release() {
@@ -123,5 +202,5 @@ func (di *DataItemImpl) GetOldRaw() []byte {
 }
 
 func (di *DataItemImpl) GetRaw() []byte {
-	return di.raw
+	return di.raw()
 }
@@ -1,158 +1,704 @@
 package dm
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
 	"github.com/herveyleaf/GoDB/internal/backend/cache"
 	"github.com/herveyleaf/GoDB/internal/backend/tm"
 	"github.com/herveyleaf/GoDB/internal/backend/utils"
+	"github.com/herveyleaf/GoDB/internal/backend/vfs"
 	"github.com/herveyleaf/GoDB/pkg/common"
 )
 
 type DataManager interface {
 	Read(uid int64) (DataItem, error)
 	Insert(xid int64, data []byte) (int64, error)
-	Close()
+	// InsertNear 尽量把数据插入到离near所在页面最近的页面中, 用来把相关的数据放在一起
+	InsertNear(xid int64, data []byte, near int64) (int64, error)
+	// InsertBatch 批量插入数据, 返回的UID和data一一对应, 每组页面只fsync一次, 先使用已有页面的空闲空间.
+	// 返回错误时已经插入的数据仍然有UID, 没有插入的为0, 由事务回滚时撤销
+	InsertBatch(xid int64, data [][]byte) ([]int64, error)
+	// Update 把uid的内容换成data, 长度可以和原来不同, uid不变
+	Update(xid int64, uid int64, data []byte) error
+	// Delete 删除uid处的数据, 之后Read返回nil. 数据占用的空间在事务结束之后才能重新使用
+	Delete(xid int64, uid int64) error
+	// Scan 按页面顺序遍历所有有效的数据
+	Scan() *Scanner
+	Checkpoint() error
+	// SyncLog 让已经写入的日志都落盘, 提交事务之前调用
+	SyncLog() error
+	// Abort 撤销事务xid的所有修改, 之后调用方在TM中把它标记为回滚. 出错时事务仍然是活跃的,
+	// 下次打开时由恢复撤销
+	Abort(xid int64) error
+	// Shrink 先把文件末尾的页面上从别的页面搬过来的数据搬到前面, 再释放文件末尾连续的空闲页并截断数据库文件,
+	// 返回释放的页数. UID中记录了页号, 存放UID本身的页面和溢出页不能移动, 截到这样的页面为止
+	Shrink() (int, error)
+	Close() error
 }
 
 type DataManagerImpl struct {
-	tm      tm.TransactionManagerImpl
+	tm      tm.TransactionManager
 	pc      PageCache
 	logger  Logger
 	pIndex  *PageIndex
 	pageOne Page
+	free    *freeList
+	fsm     *freeSpaceMap
+
+	readOnly bool
+	logf     func(format string, args ...any)
+	fileLock io.Closer // 数据库的锁, 防止被多个进程同时打开. 调用方已经持有锁时为nil
+
+	// 检查点互相排斥. 当前的日志段写满时由后台的goroutine做检查点, 它遇到的第一个错误由Close返回
+	ckptLock sync.Mutex
+	stop     chan struct{}
+	stopped  chan struct{}
+	ckptErr  error
 
-	parent *cache.AbstractCache[DataItemImpl]
+	// 每个页面上被持有的DataItem个数, DataItem直接引用页面中的数据, 有DataItem被持有的页面不能整理
+	pinLock  sync.Mutex
+	pins     map[int]int
+	unpinned *sync.Cond // 页面不再被持有时通知
+	// 每个页面一把追加锁, 在FSO处追加数据和整理页面时持有
+	appendLocks sync.Map
+	// 未结束的事务在页面上预留的空间, 撤销这些事务时要用它放回旧的内容
+	spaceLock sync.Mutex
+	reserved  map[int][]reservation
+	deletes   []pendingDelete
+	// 未结束的事务写下的需要撤销的日志, 回滚时使用
+	undoLock sync.Mutex
+	undoLogs map[int64][][]byte
+
+	parent *cache.AbstractCache[DataItem]
 }
 
-func NewDataManaerImpl(pc PageCache, logger Logger, tm tm.TransactionManagerImpl) *DataManagerImpl {
-	parent := cache.NewAbstractCache[DataItemImpl](0)
-	return &DataManagerImpl{
+func NewDataManaerImpl(pc PageCache, logger Logger, tm tm.TransactionManager) *DataManagerImpl {
+	dm := &DataManagerImpl{
 		tm:     tm,
 		pc:     pc,
 		logger: logger,
-		pIndex: NewPageIndex(),
-		parent: parent,
+		pIndex: NewPageIndex(pc.PageSize()),
+		pins:   make(map[int]int),
+	}
+	dm.reserved = make(map[int][]reservation)
+	dm.undoLogs = make(map[int64][][]byte)
+	dm.unpinned = sync.NewCond(&dm.pinLock)
+	dm.parent = cache.NewAbstractCache[DataItem](0, dm)
+	pc.SetFlushLog(logger.Flush)
+	return dm
+}
+
+// Config 创建或打开DM时的可选配置, 零值字段使用默认值
+type Config struct {
+	// 页面大小, 只在创建数据库时生效, 打开时以文件头中记录的为准
+	PageSize int
+	// 通过内存映射访问数据库文件, 适合读多写少的场景, 只在Linux上可用
+	Mmap bool
+	// 数据库文件和日志文件所在的文件系统, 为nil时使用操作系统的文件系统
+	FS vfs.FS
+	// 不为nil时加密页面和日志, 长度必须是16、24或32字节, 打开时必须提供创建时的密钥.
+	// XID文件由TM负责, 需要在tm.Config中设置同一个密钥. AES-GCM的96位随机数随机选取时一个密钥最多只能加密约2^32次,
+	// 所以每次打开和每加密2^32次都用随机的盐派生新的密钥, 随机数是盐和计数, 不受这个限制
+	EncryptionKey []byte
+	// 压缩除第一页以外的页面, 只在创建数据库时生效, 打开时以文件头中记录的为准
+	Compress bool
+	// 插入时选择页面的策略, 默认是SELECT_FIRST_FIT
+	Select SelectStrategy
+	// 只读打开, 持有共享锁, 可以和其它只读打开同时存在. 所有文件都以只读方式打开, 不修改任何文件.
+	// 没有正常关闭、有写了一半的页面或者日志需要修复的数据库返回common.ErrReadOnly, 需要先读写打开一次
+	ReadOnly bool
+	// 日志落盘的时机, 默认是SYNC_FULL
+	Sync SyncMode
+	// 不为nil时用来输出恢复的进度
+	Logf func(format string, args ...any)
+	// 日志段的大小, 当前的日志段超过这个大小时在检查点换新的日志段并删除不再需要的旧日志段, 默认是64MB
+	LogSegmentSize int64
+	// 调用方已经用vfs.LockDatabase锁住了数据库, DM不再加锁. 为false时DM自己锁住数据库, 关闭时释放
+	Locked bool
+}
+
+// lock cfg.Locked为false时锁住数据库, 否则返回nil
+func (cfg Config) lock(path string, shared bool) (io.Closer, error) {
+	if cfg.Locked {
+		return nil, nil
+	}
+	return vfs.LockDatabase(vfs.Or(cfg.FS), path, shared)
+}
+
+func (cfg Config) pageSize() int {
+	if cfg.PageSize == 0 {
+		return DEFAULT_PAGE_SIZE
+	}
+	return cfg.PageSize
+}
+
+func CreateDM(path string, mem int64, tm tm.TransactionManager) (DataManager, error) {
+	return CreateDMWithConfig(path, mem, tm, Config{})
+}
+
+func CreateDMWithConfig(path string, mem int64, tm tm.TransactionManager, cfg Config) (DataManager, error) {
+	if cfg.ReadOnly {
+		return nil, fmt.Errorf("%w: cannot create a database", common.ErrReadOnly)
+	}
+	fsys := vfs.Or(cfg.FS)
+	fileLock, err := cfg.lock(path, false)
+	if err != nil {
+		return nil, err
 	}
+	for _, suffix := range []string{DB_SUFFIX, LOG_SUFFIX} {
+		if _, err := fsys.Stat(path + suffix); err == nil {
+			closeLock(fileLock)
+			return nil, common.ErrFileExists
+		}
+	}
+	dm, err := createDM(path, mem, tm, cfg)
+	if err != nil {
+		// 没有创建完的数据库不能打开, 删掉已经创建的文件, 之后可以重新创建
+		for _, suffix := range dmFiles {
+			fsys.Remove(path + suffix)
+		}
+		closeLock(fileLock)
+		return nil, err
+	}
+	dm.fileLock = fileLock
+	dm.startCheckpointer()
+	return dm, nil
 }
 
-func CreateDM(path string, mem int64, tm tm.TransactionManagerImpl) DataManager {
-	pc, _ := Create(path, mem)
-	lg, _ := CreateLogger(path)
+// DM创建的所有文件
+var dmFiles = []string{DB_SUFFIX, DWB_SUFFIX, PMAP_SUFFIX, LOG_SUFFIX, FSM_SUFFIX}
+
+func createDM(path string, mem int64, tm tm.TransactionManager, cfg Config) (*DataManagerImpl, error) {
+	var pc PageCache
+	var err error
+	if cfg.Mmap {
+		pc, err = CreateMmap(path, mem, cfg)
+	} else {
+		pc, err = CreateWithConfig(path, mem, cfg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	lg, err := CreateLoggerWithConfig(path, cfg)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
 
 	dm := NewDataManaerImpl(pc, lg, tm)
-	dm.InitPageOne()
-	return dm
+	dm.pIndex.SetStrategy(cfg.Select)
+	if dm.fsm, err = newFreeSpaceMap(vfs.Or(cfg.FS), path, pc.PageSize(), cfg.EncryptionKey); err != nil {
+		lg.Close()
+		pc.Close()
+		return nil, err
+	}
+	if err = dm.InitPageOne(); err != nil {
+		lg.Close()
+		pc.Close()
+		return nil, err
+	}
+	dm.free = newFreeList(pc, lg, dm.pageOne)
+	return dm, nil
+}
+
+func OpenDM(path string, mem int64, tm tm.TransactionManager) (DataManager, error) {
+	return OpenDMWithConfig(path, mem, tm, Config{})
+}
+
+// OpenDMWithConfig 打开DM, cfg中的PageSize会被忽略
+func OpenDMWithConfig(path string, mem int64, tm tm.TransactionManager, cfg Config) (DataManager, error) {
+	fileLock, err := cfg.lock(path, cfg.ReadOnly)
+	if err != nil {
+		return nil, err
+	}
+	dm, err := openDM(path, mem, tm, cfg)
+	if err != nil {
+		closeLock(fileLock)
+		return nil, err
+	}
+	dm.fileLock = fileLock
+	if !dm.readOnly {
+		dm.startCheckpointer()
+	}
+	return dm, nil
 }
 
-func OpenDM(path string, mem int64, tm tm.TransactionManagerImpl) DataManager {
-	pc, _ := Open(path, mem)
-	lg, _ := OpenLogger(path)
+func openDM(path string, mem int64, tm tm.TransactionManager, cfg Config) (*DataManagerImpl, error) {
+	var pc PageCache
+	var err error
+	if cfg.Mmap {
+		pc, err = OpenMmap(path, mem, cfg)
+	} else {
+		pc, err = OpenWithConfig(path, mem, cfg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	lg, err := OpenLoggerWithConfig(path, cfg)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
 	dm := NewDataManaerImpl(pc, lg, tm)
-	if !dm.LoadCheckPageOne() {
-		Recover(&tm, lg, pc)
+	dm.readOnly = cfg.ReadOnly
+	dm.logf = cfg.Logf
+	dm.pIndex.SetStrategy(cfg.Select)
+	if dm.fsm, err = newFreeSpaceMap(vfs.Or(cfg.FS), path, pc.PageSize(), cfg.EncryptionKey); err != nil {
+		lg.Close()
+		pc.Close()
+		return nil, err
 	}
-	dm.FillPageIndex()
-	SetVcOpenPage(dm.pageOne)
-	dm.pc.FlushPage(dm.pageOne)
+	if err = dm.open(); err != nil {
+		if dm.pageOne != nil {
+			dm.pageOne.Release()
+		}
+		lg.Close()
+		pc.Close()
+		return nil, err
+	}
+	return dm, nil
+}
 
-	return dm
+// open 需要时先进行恢复, 再建立空闲页链表和PageIndex
+func (dm *DataManagerImpl) open() error {
+	clean, err := dm.LoadCheckPageOne()
+	if err != nil {
+		return err
+	}
+	if !clean {
+		if dm.readOnly {
+			return fmt.Errorf("%w: database was not closed cleanly and needs recovery", common.ErrReadOnly)
+		}
+		if err := Recover(dm.tm, dm.logger, dm.pc, dm.logf); err != nil {
+			return err
+		}
+		// 第一页中的空闲页链表没有写日志, 由FillPageIndex按重做出的空闲页重建
+		dm.free = newFreeList(dm.pc, dm.logger, dm.pageOne)
+	} else if dm.free, err = loadFreeList(dm.pc, dm.logger, dm.pageOne); err != nil {
+		return err
+	}
+	// 先让VC落盘, 之后再修改页面时如果崩溃, 下次打开一定会进行恢复. 只读时不修改页面
+	if !dm.readOnly {
+		SetVcOpenPage(dm.pageOne)
+		if err := dm.pc.FlushPage(dm.pageOne); err != nil {
+			return err
+		}
+	}
+	if clean && dm.fsm.load(dm.pc.GetPageNumber()) {
+		dm.LoadPageIndex()
+		return nil
+	}
+	return dm.FillPageIndex()
 }
 
 func (dm *DataManagerImpl) Read(uid int64) (DataItem, error) {
-	newdi, err := dm.parent.Get(uid)
-	if !newdi.IsValid() {
-		newdi.Release()
+	di, err := dm.parent.Get(uid)
+	if errors.Is(err, common.ErrNullEntry) {
+		return nil, nil
+	}
+	if err != nil {
 		return nil, err
 	}
-	return &newdi, nil
+	if !di.(*DataItemImpl).IsValid() {
+		di.Release()
+		return nil, nil
+	}
+	return di, nil
 }
 
 func (dm *DataManagerImpl) Insert(xid int64, data []byte) (int64, error) {
+	return dm.insert(xid, data, 0)
+}
+
+func (dm *DataManagerImpl) InsertNear(xid int64, data []byte, near int64) (int64, error) {
+	return dm.insert(xid, data, int(uint64(near)>>32))
+}
+
+// insert 放不进一页的数据存放在溢出页中. 先处理已经结束的事务删掉的数据, 让腾出来的空间可以被这次插入使用
+func (dm *DataManagerImpl) insert(xid int64, data []byte, near int) (int64, error) {
+	if dm.readOnly {
+		return 0, common.ErrReadOnly
+	}
+	if err := dm.reclaim(); err != nil {
+		return 0, err
+	}
 	raw := WrapDataItemRaw(data)
-	if len(raw) > MAX_FREE_SPACE {
-		panic(common.ErrDataTooLarge)
+	if len(raw) > MaxFreeSpace(dm.pc.PageSize()) {
+		return dm.insertOverflow(xid, data, near)
 	}
+	return dm.insertRaw(xid, raw, near, nil)
+}
+
+// insertRaw near为0时按PageIndex设置的策略选择页面. prepare不为nil时, 在确定了UID之后、写插入日志之前调用,
+// 返回错误时不插入
+func (dm *DataManagerImpl) insertRaw(xid int64, raw []byte, near int, prepare func(uid int64) error) (int64, error) {
+	maxFreeSpace := MaxFreeSpace(dm.pc.PageSize())
 
-	var pi PageInfo = PageInfo{}
-	for i := 0; i < 5; i++ {
+	var pi PageInfo
+	if near > 0 {
+		pi = dm.pIndex.SelectNear(len(raw), near)
+	} else {
 		pi = dm.pIndex.Select(len(raw))
-		if pi != (PageInfo{}) {
-			break
-		} else {
-			newPgno := dm.pc.NewPage(InitRawO())
-			dm.pIndex.Add(newPgno, MAX_FREE_SPACE)
-		}
 	}
+	// 没有合适的页面时直接使用新分配的页面, 新页面还没有放入索引, 不会被其它插入抢走
 	if pi == (PageInfo{}) {
-		panic(common.ErrDatabaseBusy)
+		newPgno, err := dm.free.alloc()
+		if err != nil {
+			return 0, err
+		}
+		pi = NewPageInfo(newPgno, maxFreeSpace)
+	}
+
+	pg, err := dm.pc.GetPage(pi.Pgno)
+	if err != nil {
+		dm.addPage(pi.Pgno, pi.FreeSpace)
+		return 0, err
+	}
+	if uid, ok, err := dm.insertInto(xid, pg, raw, prepare); ok || err != nil {
+		return uid, err
+	}
+	// 索引中记录的空闲空间可能已经被更新用掉了, 或者页面上有DataItem被持有而不能整理, 换一个新页面
+	newPgno, err := dm.free.alloc()
+	if err != nil {
+		return 0, err
+	}
+	if pg, err = dm.pc.GetPage(newPgno); err != nil {
+		dm.addPage(newPgno, maxFreeSpace)
+		return 0, err
 	}
+	uid, _, err := dm.insertInto(xid, pg, raw, prepare)
+	return uid, err
+}
 
-	var pg Page = nil
-	freeSpace := 0
+// insertInto 持有页面的追加锁插入raw, 空闲空间分散在页面中时先整理页面. 结束后把页面放回索引并释放,
+// 页面上放不下时返回false. 持有追加锁时槽号不会被别人用掉, 所以可以先把UID交给prepare
+func (dm *DataManagerImpl) insertInto(xid int64, pg Page, raw []byte, prepare func(uid int64) error) (int64, bool, error) {
+	lock := dm.appendLock(pg.GetPageNumber())
+	lock.Lock()
 	defer func() {
-		if pg != nil {
-			dm.pIndex.Add(pi.Pgno, GetFreeSpace(pg))
-		} else {
-			dm.pIndex.Add(pi.Pgno, freeSpace)
-		}
+		free := dm.available(pg)
+		lock.Unlock()
+		dm.addPage(pg.GetPageNumber(), free)
+		pg.Release()
 	}()
-	pg, _ = dm.pc.GetPage(pi.Pgno)
+	if dm.available(pg) < len(raw) {
+		return 0, false, nil
+	}
+	if contiguousSpace(pg.GetData()) < len(raw) {
+		if ok, err := dm.compact(pg, 0); !ok || err != nil || contiguousSpace(pg.GetData()) < len(raw) {
+			return 0, false, err
+		}
+	}
+	uid := utils.AddressToUid(pg.GetPageNumber(), nextSlot(pg.GetData()))
+	release := dm.logger.Hold()
+	defer release()
+	if prepare != nil {
+		if err := prepare(uid); err != nil {
+			return 0, false, err
+		}
+	}
 	log := InsertLog(xid, pg, raw)
-	dm.logger.Log(log)
-	offset := Insert(pg, raw)
-	pg.Release()
-	return utils.AddressToUid(pi.Pgno, offset), nil
+	if err := dm.logger.Log(log); err != nil {
+		return 0, false, err
+	}
+	dm.track(xid, log)
+	Insert(pg, raw)
+	return uid, true, nil
 }
 
-func (dm *DataManagerImpl) Close() {
-	dm.parent.Close()
-	dm.logger.Close()
+// compact 整理页面, 让所有空闲空间连续, 调用方持有页面的追加锁. 页面上被持有的DataItem不超过pinned个时才整理,
+// 持有pinLock, 整理期间不会有新的DataItem引用这个页面. 未结束的事务删掉的DataItem在撤销时还要放回原来的槽, 不能丢弃
+func (dm *DataManagerImpl) compact(pg Page, pinned int) (bool, error) {
+	dm.pinLock.Lock()
+	defer dm.pinLock.Unlock()
+	if dm.pins[pg.GetPageNumber()] > pinned {
+		return false, nil
+	}
+	_, keep := dm.reservedSpace(pg.GetPageNumber())
+	image := compactPage(pg.GetData(), keep)
+	release := dm.logger.Hold()
+	defer release()
+	if err := dm.logger.Log(CompactLog(pg.GetPageNumber(), image)); err != nil {
+		return false, err
+	}
+	pg.BeginUpdate()
+	copy(pg.GetData(), image)
+	pg.EndUpdate()
+	return true, nil
+}
+
+func (dm *DataManagerImpl) pin(pgno int) {
+	dm.pinLock.Lock()
+	defer dm.pinLock.Unlock()
+	dm.pins[pgno]++
+}
+
+func (dm *DataManagerImpl) unpin(pgno int) {
+	dm.pinLock.Lock()
+	defer dm.pinLock.Unlock()
+	if dm.pins[pgno]--; dm.pins[pgno] == 0 {
+		delete(dm.pins, pgno)
+		dm.unpinned.Broadcast()
+	}
+}
+
+// Checkpoint 将所有脏页写回磁盘, 整批只fsync一次. 当前的日志段写满时先换新的日志段,
+// 写回之后旧日志段中的修改都已经在磁盘上, 只有撤销仍然活跃的事务还需要它们
+func (dm *DataManagerImpl) Checkpoint() error {
+	// 只读时没有修改过页面, 也不能换日志段
+	if dm.readOnly {
+		return nil
+	}
+	dm.ckptLock.Lock()
+	defer dm.ckptLock.Unlock()
+	if err := dm.reclaim(); err != nil {
+		return err
+	}
+	if _, err := dm.logger.Rotate(func() []byte {
+		return PageLog(LOG_TYPE_SEGMENT, dm.pc.GetPageNumber())
+	}); err != nil {
+		return err
+	}
+	if err := dm.pc.FlushAll(); err != nil {
+		return err
+	}
+	return dm.logger.RemoveSegments(func(log []byte) (bool, error) {
+		xid, _ := parseLogTarget(log)
+		return dm.tm.IsActive(xid)
+	})
+}
+
+func (dm *DataManagerImpl) startCheckpointer() {
+	dm.stop = make(chan struct{})
+	dm.stopped = make(chan struct{})
+	go dm.checkpointer()
+}
+
+// checkpointer 当前的日志段写满时做检查点, 出错之后不再继续, 错误由Close返回
+func (dm *DataManagerImpl) checkpointer() {
+	defer close(dm.stopped)
+	for {
+		select {
+		case <-dm.stop:
+			return
+		case <-dm.logger.Full():
+			if err := dm.Checkpoint(); err != nil {
+				dm.ckptErr = err
+				return
+			}
+		}
+	}
+}
 
-	SetVcClosePage(dm.pageOne)
+func (dm *DataManagerImpl) SyncLog() error {
+	return dm.logger.Flush()
+}
+
+// Close 出错时仍然释放所有资源, 返回遇到的第一个错误. 回收空间或写日志失败时不标记正常关闭,
+// 下次打开时进行恢复
+func (dm *DataManagerImpl) Close() error {
+	var err error
+	if dm.stop != nil {
+		close(dm.stop)
+		<-dm.stopped
+		err = dm.ckptErr
+	}
+	dm.parent.Close()
+	if reclaimErr := dm.reclaim(); err == nil {
+		err = reclaimErr
+	}
+	if closeErr := dm.logger.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && !dm.readOnly {
+		// 映射文件写失败时不标记正常关闭, 下次打开会扫描所有页面重建, 不影响数据
+		if err = dm.fsm.save(dm.pc.GetPageNumber()); err == nil {
+			SetVcClosePage(dm.pageOne)
+		}
+	}
 	dm.pageOne.Release()
-	dm.pc.Close()
+	if closeErr := dm.pc.Close(); err == nil {
+		err = closeErr
+	}
+	closeLock(dm.fileLock)
+	return err
+}
+
+func closeLock(l io.Closer) {
+	if l != nil {
+		l.Close()
+	}
 }
 
-func (dm *DataManagerImpl) LogDataItem(xid int64, di DataItem) {
+func (dm *DataManagerImpl) LogDataItem(xid int64, di DataItem) error {
+	if dm.readOnly {
+		return common.ErrReadOnly
+	}
 	log := UpdateLog(xid, di)
-	dm.logger.Log(log)
+	if err := dm.logger.Log(log); err != nil {
+		return err
+	}
+	dm.track(xid, log)
+	return nil
 }
 
 func (dm *DataManagerImpl) ReleaseDataItem(di DataItem) {
 	dm.parent.Release(di.GetUid())
 }
 
-func (dm *DataManagerImpl) GetForCache(uid int64) DataItem {
-	offset := int16(uid & ((int64(1) << 32) - 1))
-	uid = int64(uint64(uid) >> 32)
-	pgno := int(uid & ((int64(1) << 32) - 1))
-	pg, _ := dm.pc.GetPage(pgno)
-	return ParseDataItem(pg, offset, *dm)
+// GetForCache 先标记页面被持有, 再按槽找到DataItem, 之后页面不会被整理, DataItem的位置不会改变
+func (dm *DataManagerImpl) GetForCache(uid int64) (DataItem, error) {
+	pgno, slot := utils.UidToAddress(uid)
+	pg, err := dm.pc.GetPage(pgno)
+	if err != nil {
+		return nil, err
+	}
+	dm.pin(pgno)
+	// 页面已经被释放或者重新使用时, 原来的槽可能已经不存在
+	offset, ok := dm.lookup(pg, slot)
+	if !ok {
+		dm.unpin(pgno)
+		pg.Release()
+		return nil, common.ErrNullEntry
+	}
+	di := ParseDataItem(pg, slot, offset, dm).(*DataItemImpl)
+	if di.IsValid() && di.isForward() {
+		if err = dm.follow(di); err != nil {
+			return nil, err
+		}
+		pgno = di.pg.GetPageNumber()
+		pg = di.pg
+	}
+	if di.IsValid() && di.isOverflow() {
+		if di.overflow, err = dm.readOverflow(di.uid, di.raw()[OF_DATA_DATAITEM:]); err != nil {
+			dm.unpin(pgno)
+			pg.Release()
+			return nil, err
+		}
+	}
+	return di, nil
+}
+
+// lookup 读出槽现在指向的位置, 追加数据和整理页面都会修改槽目录, 要持有页面的追加锁
+func (dm *DataManagerImpl) lookup(pg Page, slot int) (offset int, ok bool) {
+	dm.locked(pg.GetPageNumber(), func() {
+		offset, ok = itemOffset(pg.GetData(), slot)
+	})
+	return
+}
+
+// follow 让DataItem指向转发项记录的位置, 原来的页面不再被持有. 出错时两个页面都已经释放
+func (dm *DataManagerImpl) follow(di *DataItemImpl) error {
+	home := di.pg
+	defer func() {
+		dm.unpin(home.GetPageNumber())
+		home.Release()
+	}()
+	loc := utils.ParseLong(di.raw()[OF_DATA_DATAITEM:])
+	pgno, slot := utils.UidToAddress(loc)
+	pg, err := dm.pc.GetPage(pgno)
+	if err != nil {
+		return err
+	}
+	dm.pin(pgno)
+	offset, ok := dm.lookup(pg, slot)
+	if !ok {
+		dm.unpin(pgno)
+		pg.Release()
+		return fmt.Errorf("%w: %d is forwarded to a missing item %d", common.ErrBadDBFile, di.uid, loc)
+	}
+	di.setLocation(pg, loc, offset)
+	return nil
 }
 
 func (dm *DataManagerImpl) ReleaseForCache(di DataItem) {
+	dm.unpin(di.Page().GetPageNumber())
 	di.Page().Release()
 }
 
-func (dm *DataManagerImpl) InitPageOne() {
-	pgno := dm.pc.NewPage(InitRawO())
+func (dm *DataManagerImpl) InitPageOne() error {
+	pgno, err := dm.pc.NewPage(InitRawO(dm.pc.PageSize()))
+	if err != nil {
+		return err
+	}
 	if pgno != 1 {
 		panic("pgno must be 1")
 	}
-	dm.pageOne, _ = dm.pc.GetPage(pgno)
-	dm.pc.FlushPage(dm.pageOne)
+	if dm.pageOne, err = dm.pc.GetPage(pgno); err != nil {
+		return err
+	}
+	return dm.pc.FlushPage(dm.pageOne)
 }
 
-func (dm *DataManagerImpl) LoadCheckPageOne() bool {
-	dm.pageOne, _ = dm.pc.GetPage(1)
-	return CheckVcPage(dm.pageOne)
+func (dm *DataManagerImpl) LoadCheckPageOne() (bool, error) {
+	var err error
+	if dm.pageOne, err = dm.pc.GetPage(1); err != nil {
+		return false, err
+	}
+	return CheckVcPage(dm.pageOne), nil
 }
 
-func (dm *DataManagerImpl) FillPageIndex() {
+// FillPageIndex 扫描所有页面建立PageIndex, 同时把没有有效数据的页面放入空闲页链表
+func (dm *DataManagerImpl) FillPageIndex() error {
+	linked := make(map[int]bool)
+	for _, pgno := range dm.free.pages {
+		linked[pgno] = true
+	}
 	pageNumber := dm.pc.GetPageNumber()
+	dm.pc.Prefetch(2, READ_AHEAD_PAGES)
 	for i := 2; i <= pageNumber; i++ {
-		var pg Page = nil
-		pg, _ = dm.pc.GetPage(i)
-		dm.pIndex.Add(pg.GetPageNumber(), GetFreeSpace(pg))
+		if linked[i] {
+			continue
+		}
+		pg, err := dm.pc.GetPage(i)
+		if err != nil {
+			return err
+		}
+		free, overflow := isFreePage(pg.GetData()), isOverflowPage(pg.GetData())
+		empty := false
+		if overflow {
+			// 描述已经失效的溢出页没有人再引用
+			empty = dm.overflowOrphaned(pg.GetData())
+			dm.fsm.set(i, 0)
+		} else if !free {
+			empty = pageEmpty(pg.GetData())
+		}
+		if !free && !overflow && !empty {
+			dm.addPage(pg.GetPageNumber(), GetFreeSpace(pg))
+		}
 		pg.Release()
+		if free {
+			err = dm.free.relink(i)
+		} else if empty {
+			err = dm.free.free(i)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadPageIndex 用上次正常关闭时保存的空闲空间映射建立PageIndex, 不需要读入页面.
+// 溢出页和几乎写满的页面记录的空闲空间都是0, 不放入索引
+func (dm *DataManagerImpl) LoadPageIndex() {
+	linked := make(map[int]bool)
+	for _, pgno := range dm.free.pages {
+		linked[pgno] = true
+	}
+	pageNumber := dm.pc.GetPageNumber()
+	for i := 2; i <= pageNumber; i++ {
+		if space := dm.fsm.get(i); !linked[i] && space > 0 {
+			dm.pIndex.Add(i, space)
+		}
 	}
 }
+
+// addPage 把页面放回PageIndex, 同时更新空闲空间映射
+func (dm *DataManagerImpl) addPage(pgno int, freeSpace int) {
+	dm.fsm.set(pgno, freeSpace)
+	dm.pIndex.Add(pgno, freeSpace)
+}
@@ -0,0 +1,256 @@
+package dm
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/herveyleaf/GoDB/internal/backend/tm"
+	"github.com/herveyleaf/GoDB/internal/backend/vfs"
+	"github.com/herveyleaf/GoDB/internal/backend/vfs/vfstest"
+	"github.com/herveyleaf/GoDB/pkg/common"
+)
+
+func TestLockAndReadOnly(t *testing.T) {
+	fsys := vfstest.NewCrashFS(1)
+	cfg := Config{PageSize: MIN_PAGE_SIZE, FS: fsys}
+	roCfg := Config{FS: fsys, ReadOnly: true}
+	mem := int64(MIN_PAGE_SIZE * MEM_MIN_LIM)
+	// TM和DM共用数据库的锁, 由DM加锁
+	tmgr, err := tm.CreateWithConfig("lock", tm.Config{FS: fsys, Locked: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { tmgr.Close() }()
+	d, err := CreateDMWithConfig("lock", mem, tmgr, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xid, _ := tmgr.Begin()
+	uid, _ := d.Insert(xid, []byte("data"))
+	tmgr.Commit(xid)
+
+	// 打开期间不能再次打开, 只读也不行, 也不能换密钥. 单独打开TM也要锁住同一个锁文件
+	for _, c := range []Config{cfg, roCfg} {
+		if _, err := OpenDMWithConfig("lock", mem, tmgr, c); !errors.Is(err, common.ErrDatabaseLocked) {
+			t.Fatalf("Expected ErrDatabaseLocked, got %v", err)
+		}
+	}
+	if _, err := tm.OpenWithConfig("lock", tm.Config{FS: fsys}); !errors.Is(err, common.ErrDatabaseLocked) {
+		t.Fatalf("Expected ErrDatabaseLocked from the TM, got %v", err)
+	}
+	if err := Rekey("lock", Config{FS: fsys}, nil); !errors.Is(err, common.ErrDatabaseLocked) {
+		t.Fatalf("Expected ErrDatabaseLocked from Rekey, got %v", err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 只读打开可以同时存在, 能读不能写
+	ro1, err := OpenDMWithConfig("lock", mem, tmgr, roCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ro2, err := OpenDMWithConfig("lock", mem, tmgr, roCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenDMWithConfig("lock", mem, tmgr, cfg); !errors.Is(err, common.ErrDatabaseLocked) {
+		t.Fatalf("Expected ErrDatabaseLocked while opened read-only, got %v", err)
+	}
+	di, err := ro1.Read(uid)
+	if err != nil || di == nil || string(di.Data()) != "data" {
+		t.Fatalf("Read-only open cannot read the data: %v", err)
+	}
+	if err := di.Before(); !errors.Is(err, common.ErrReadOnly) {
+		t.Fatalf("Expected ErrReadOnly from Before, got %v", err)
+	}
+	di.Release()
+	if _, err := ro1.Insert(tm.SUPER_XID, []byte("x")); !errors.Is(err, common.ErrReadOnly) {
+		t.Fatalf("Expected ErrReadOnly from Insert, got %v", err)
+	}
+	if err := ro2.Delete(tm.SUPER_XID, uid); !errors.Is(err, common.ErrReadOnly) {
+		t.Fatalf("Expected ErrReadOnly from Delete, got %v", err)
+	}
+	ro1.Close()
+	ro2.Close()
+
+	// 没有正常关闭的数据库不能只读打开, 读写打开恢复之后才可以
+	if d, err = OpenDMWithConfig("lock", mem, tmgr, cfg); err != nil {
+		t.Fatal(err)
+	}
+	fsys.Crash()
+	d.Close()
+	tmgr.Close()
+	fsys.Restart()
+	if tmgr, err = tm.OpenWithConfig("lock", tm.Config{FS: fsys, Locked: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenDMWithConfig("lock", mem, tmgr, roCfg); !errors.Is(err, common.ErrReadOnly) {
+		t.Fatalf("Expected ErrReadOnly for a database that needs recovery, got %v", err)
+	}
+	// 恢复的进度通过Logf输出
+	var logs []string
+	logCfg := cfg
+	logCfg.Logf = func(format string, args ...any) { logs = append(logs, fmt.Sprintf(format, args...)) }
+	if d, err = OpenDMWithConfig("lock", mem, tmgr, logCfg); err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) == 0 || logs[len(logs)-1] != "recovery over" {
+		t.Fatalf("Recovery should report its progress through Logf, got %q", logs)
+	}
+	d.Close()
+	// 只读打开不创建文件
+	if err := fsys.Remove("lock" + DWB_SUFFIX); err != nil {
+		t.Fatal(err)
+	}
+	if d, err = OpenDMWithConfig("lock", mem, tmgr, roCfg); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+	if _, err := fsys.Stat("lock" + DWB_SUFFIX); !os.IsNotExist(err) {
+		t.Fatalf("Read-only open should not create the double-write file, got %v", err)
+	}
+
+	// 需要截掉日志末尾或者完成换日志段时不能只读打开, 文件保持不变
+	f, _ := fsys.OpenFile("lock"+LOG_SUFFIX, os.O_RDWR, 0)
+	fi, _ := f.Stat()
+	f.WriteAt([]byte("tail"), fi.Size())
+	f.Close()
+	if _, err := OpenDMWithConfig("lock", mem, tmgr, roCfg); !errors.Is(err, common.ErrReadOnly) {
+		t.Fatalf("Expected ErrReadOnly for a log tail to truncate, got %v", err)
+	}
+	if after, _ := fsys.Stat("lock" + LOG_SUFFIX); after.Size() != fi.Size()+4 {
+		t.Fatalf("Read-only open truncated the log")
+	}
+	f, _ = fsys.OpenFile("lock"+LOG_SUFFIX, os.O_RDWR, 0)
+	f.Truncate(fi.Size())
+	f.Close()
+	f, _ = fsys.OpenFile("lock"+LOG_NEXT_SUFFIX, os.O_RDWR|os.O_CREATE, 0600)
+	f.Close()
+	if _, err := OpenDMWithConfig("lock", mem, tmgr, roCfg); !errors.Is(err, common.ErrReadOnly) {
+		t.Fatalf("Expected ErrReadOnly for an unfinished log segment switch, got %v", err)
+	}
+	if _, err := fsys.Stat("lock" + LOG_NEXT_SUFFIX); err != nil {
+		t.Fatalf("Read-only open removed the next log segment: %v", err)
+	}
+
+	// 共享锁不创建锁文件
+	fsys.Remove("lock" + LOG_NEXT_SUFFIX)
+	if err := fsys.Remove("lock" + vfs.LOCK_SUFFIX); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenDMWithConfig("lock", mem, tmgr, roCfg); !errors.Is(err, common.ErrReadOnly) {
+		t.Fatalf("Expected ErrReadOnly without a lock file, got %v", err)
+	}
+	if _, err := fsys.Stat("lock" + vfs.LOCK_SUFFIX); !os.IsNotExist(err) {
+		t.Fatalf("Read-only open should not create the lock file, got %v", err)
+	}
+}
+
+// 检查点换日志段之后, 只有还有活跃事务的日志的旧日志段被保留, 换密钥时所有日志段合并成一个.
+// 内存映射的方式写回页面时同样经过双写文件, 旧的日志段也能删除
+func TestLogSegments(t *testing.T) {
+	t.Run("file", func(t *testing.T) { testLogSegments(t, false) })
+	t.Run("mmap", func(t *testing.T) {
+		mapRegion = mapTestRegion
+		defer func() { mapRegion = mapFileRegion }()
+		testLogSegments(t, true)
+	})
+}
+
+func testLogSegments(t *testing.T, mmap bool) {
+	fsys := vfstest.NewCrashFS(1)
+	cfg := Config{PageSize: MIN_PAGE_SIZE, FS: fsys, LogSegmentSize: 1 << 10, Mmap: mmap}
+	mem := int64(MIN_PAGE_SIZE * MEM_MIN_LIM)
+	tmgr, err := tm.CreateWithConfig("seg", tm.Config{FS: fsys, Locked: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := CreateDMWithConfig("seg", mem, tmgr, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exists := func(no int64) bool {
+		_, err := fsys.Stat(segmentPath("seg", no))
+		return err == nil
+	}
+
+	active, _ := tmgr.Begin()
+	var uids []int64
+	for i := 0; i < 200; i++ {
+		xid, _ := tmgr.Begin()
+		if i == 0 {
+			xid = active
+		}
+		uid, err := d.Insert(xid, []byte(fmt.Sprintf("data%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		uids = append(uids, uid)
+		if i > 0 {
+			tmgr.Commit(xid)
+		}
+		if err := d.Checkpoint(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !exists(0) {
+		t.Fatalf("Log segment with an active transaction was removed")
+	}
+	tmgr.Commit(active)
+	if err := d.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if exists(0) {
+		t.Fatalf("Log segment not needed any more was kept")
+	}
+	// 关闭时留下一个活跃事务, 它所在的日志段在换密钥时删除
+	active, _ = tmgr.Begin()
+	for i := 0; i < 50; i++ {
+		uid, err := d.Insert(active, []byte(fmt.Sprintf("data%d", len(uids))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		uids = append(uids, uid)
+		if err := d.Checkpoint(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tmgr.Close()
+
+	kept := false
+	for no := int64(0); no < 200; no++ {
+		kept = kept || exists(no)
+	}
+	if !kept {
+		t.Fatalf("Expected old log segments before rekey")
+	}
+	if err := Rekey("seg", Config{FS: fsys}, nil); err != nil {
+		t.Fatal(err)
+	}
+	for no := int64(0); no < 200; no++ {
+		if exists(no) {
+			t.Fatalf("Log segment %d was kept after rekey", no)
+		}
+	}
+	if tmgr, err = tm.OpenWithConfig("seg", tm.Config{FS: fsys, Locked: true}); err != nil {
+		t.Fatal(err)
+	}
+	defer tmgr.Close()
+	if d, err = OpenDMWithConfig("seg", mem, tmgr, cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	for i, uid := range uids {
+		di, err := d.Read(uid)
+		if err != nil || di == nil || string(di.Data()) != fmt.Sprintf("data%d", i) {
+			t.Fatalf("Read %d after rekey failed: %v", i, err)
+		}
+		di.Release()
+	}
+}
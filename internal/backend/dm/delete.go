@@ -0,0 +1,161 @@
+package dm
+
+import (
+	"encoding/binary"
+
+	"github.com/herveyleaf/GoDB/internal/backend/utils"
+	"github.com/herveyleaf/GoDB/pkg/common"
+)
+
+// pendingDelete 事务删除数据时涉及的页面, 事务结束之后由reclaim处理.
+// overflow不为0时是被删掉的大数据的第一个溢出页, owner是它的描述的UID
+type pendingDelete struct {
+	xid      int64
+	pgno     int
+	overflow int
+	owner    int64
+}
+
+// Delete 删除数据: 数据所在的位置、转发项和溢出页的描述都通过更新日志标记为无效, 由恢复负责重做和撤销.
+// 腾出来的空间在事务结束之前预留给它, 撤销时才能放回原处
+func (dm *DataManagerImpl) Delete(xid int64, uid int64) error {
+	if dm.readOnly {
+		return common.ErrReadOnly
+	}
+	obj, err := dm.parent.Get(uid)
+	if err != nil {
+		return err
+	}
+	di := obj.(*DataItemImpl)
+	defer di.Release()
+	di.Lock()
+	defer di.Unlock()
+	if !di.IsValid() {
+		return common.ErrNullEntry
+	}
+
+	pgno, slot := utils.UidToAddress(di.loc)
+	dm.locked(pgno, func() {
+		err = dm.invalidate(xid, di.pg, slot)
+	})
+	if err != nil {
+		return err
+	}
+	pending := []pendingDelete{{xid: xid, pgno: pgno}}
+
+	if di.loc != di.uid {
+		homePgno, homeSlot := utils.UidToAddress(di.uid)
+		home, err := dm.pc.GetPage(homePgno)
+		if err != nil {
+			return err
+		}
+		dm.locked(homePgno, func() {
+			err = dm.invalidate(xid, home, homeSlot)
+		})
+		home.Release()
+		if err != nil {
+			return err
+		}
+		pending = append(pending, pendingDelete{xid: xid, pgno: homePgno})
+	}
+	if di.overflow != nil {
+		first := int(binary.BigEndian.Uint32(di.raw()[OF_DATA_DATAITEM+OF_STUB_PGNO:]))
+		pending = append(pending, pendingDelete{xid: xid, overflow: first, owner: di.uid})
+	}
+
+	dm.spaceLock.Lock()
+	dm.deletes = append(dm.deletes, pending...)
+	dm.spaceLock.Unlock()
+	return nil
+}
+
+// reclaim 处理已经结束的事务删除的数据: 页面的空闲空间放回PageIndex, 没有数据的页面和被删掉的大数据的溢出页
+// 放回空闲页链表. 回滚的事务由Abort撤销, 被放回的大数据的溢出页不在这里
+func (dm *DataManagerImpl) reclaim() error {
+	for _, p := range dm.finishedDeletes() {
+		var err error
+		if p.overflow != 0 {
+			err = dm.freeOverflow(p.overflow, p.owner)
+		} else {
+			err = dm.returnPage(p.pgno)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finishedDeletes 取出事务已经结束的删除. 读不出事务状态时当作还没有结束, 下次再处理
+func (dm *DataManagerImpl) finishedDeletes() []pendingDelete {
+	dm.spaceLock.Lock()
+	defer dm.spaceLock.Unlock()
+	var done []pendingDelete
+	rest := dm.deletes[:0]
+	for _, p := range dm.deletes {
+		if active, err := dm.tm.IsActive(p.xid); active || err != nil {
+			rest = append(rest, p)
+		} else {
+			done = append(done, p)
+		}
+	}
+	dm.deletes = rest
+	return done
+}
+
+// returnPage 用页面现在的空闲空间更新PageIndex, 页面已经没有数据时放入空闲页链表.
+// 正在被插入的页面不在索引中, 由插入方放回
+func (dm *DataManagerImpl) returnPage(pgno int) error {
+	if _, ok := dm.pIndex.Remove(pgno); !ok {
+		return nil
+	}
+	pg, err := dm.pc.GetPage(pgno)
+	if err != nil {
+		return err
+	}
+	defer pg.Release()
+	_, err = dm.freeIfEmpty(pg)
+	return err
+}
+
+// freeIfEmpty 页面已经没有数据、也没有人持有其中的DataItem时放入空闲页链表, 否则连同现在的空闲空间放回PageIndex.
+// 调用方已经把页面从索引中取出
+func (dm *DataManagerImpl) freeIfEmpty(pg Page) (bool, error) {
+	pgno := pg.GetPageNumber()
+	lock := dm.appendLock(pgno)
+	lock.Lock()
+	defer lock.Unlock()
+	reserved, _ := dm.reservedSpace(pgno)
+	dm.pinLock.Lock()
+	pinned := dm.pins[pgno] > 0
+	dm.pinLock.Unlock()
+	if reserved == 0 && !pinned && pageEmpty(pg.GetData()) {
+		// 持有追加锁, 之后再来找DataItem的人会看到空闲页
+		dm.fsm.set(pgno, 0)
+		return true, dm.free.free(pgno)
+	}
+	dm.addPage(pgno, max(GetFreeSpace(pg)-reserved, 0))
+	return false, nil
+}
+
+// freeOverflow 沿着链表释放仍然属于owner的溢出页
+func (dm *DataManagerImpl) freeOverflow(pgno int, owner int64) error {
+	for pgno != 0 {
+		pg, err := dm.pc.GetPage(pgno)
+		if err != nil {
+			return err
+		}
+		raw := pg.GetData()
+		if !isOverflowPage(raw) || getOverflowOwner(raw) != owner {
+			pg.Release()
+			return nil
+		}
+		next := int(binary.BigEndian.Uint32(raw[OF_OVERFLOW_NEXT:]))
+		pg.Release()
+		if err = dm.free.free(pgno); err != nil {
+			return err
+		}
+		pgno = next
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package dm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/herveyleaf/GoDB/internal/backend/tm"
+	"github.com/herveyleaf/GoDB/internal/backend/utils"
+	"github.com/herveyleaf/GoDB/internal/backend/vfs/vfstest"
+)
+
+func TestDelete(t *testing.T) {
+	fsys := vfstest.NewCrashFS(1)
+	tmCfg := tm.Config{FS: fsys, Locked: true}
+	cfg := Config{PageSize: MIN_PAGE_SIZE, FS: fsys}
+	tmgr, err := tm.CreateWithConfig("delete", tmCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := CreateDMWithConfig("delete", MIN_PAGE_SIZE*MEM_MIN_LIM, tmgr, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dm := d.(*DataManagerImpl)
+
+	xid, _ := tmgr.Begin()
+	small, _ := d.Insert(xid, []byte("abc"))
+	large, _ := d.Insert(xid, bytes.Repeat([]byte{1}, MIN_PAGE_SIZE*2))
+	keep, _ := d.Insert(xid, []byte("keep"))
+	tmgr.Commit(xid)
+	di, _ := d.Read(large)
+	first := int(binary.BigEndian.Uint32(di.(*DataItemImpl).raw()[OF_DATA_DATAITEM+OF_STUB_PGNO:]))
+	di.Release()
+
+	// 提交的删除在事务结束之后回收: 溢出页放回空闲页链表, 数据读不到
+	xid, _ = tmgr.Begin()
+	if err := d.Delete(xid, small); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete(xid, large); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete(xid, large); err == nil {
+		t.Fatalf("Deleting an item twice should fail")
+	}
+	tmgr.Commit(xid)
+	if err := d.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	for _, uid := range []int64{small, large} {
+		if di, _ := d.Read(uid); di != nil {
+			t.Fatalf("Deleted item %d is still readable", uid)
+		}
+	}
+	if !dm.free.contains(first) {
+		t.Fatalf("Overflow page %d was not freed", first)
+	}
+
+	// 没有提交的删除在恢复时被撤销
+	xid, _ = tmgr.Begin()
+	if err := d.Delete(xid, keep); err != nil {
+		t.Fatal(err)
+	}
+	fsys.Crash()
+	if err := d.Close(); !errors.Is(err, vfstest.ErrPowerLoss) {
+		t.Fatalf("Expected ErrPowerLoss from Close after a crash, got %v", err)
+	}
+	tmgr.Close()
+	fsys.Restart()
+
+	if tmgr, err = tm.OpenWithConfig("delete", tmCfg); err != nil {
+		t.Fatal(err)
+	}
+	defer tmgr.Close()
+	if d, err = OpenDMWithConfig("delete", MIN_PAGE_SIZE*MEM_MIN_LIM, tmgr, cfg); err != nil {
+		t.Fatal(err)
+	}
+	di, _ = d.Read(keep)
+	if di == nil || !bytes.Equal(di.Data(), []byte("keep")) {
+		t.Fatalf("Uncommitted delete was not undone")
+	}
+	di.Release()
+
+	// 页面上最后一个DataItem被删掉之后, 页面放回空闲页链表
+	xid, _ = tmgr.Begin()
+	d.Delete(xid, keep)
+	tmgr.Commit(xid)
+	dm = d.(*DataManagerImpl)
+	if err := dm.reclaim(); err != nil {
+		t.Fatal(err)
+	}
+	if pgno, _ := utils.UidToAddress(keep); !dm.free.contains(pgno) {
+		t.Fatalf("Empty page %d was not freed", pgno)
+	}
+	d.Close()
+}
@@ -0,0 +1,176 @@
+package dm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/herveyleaf/GoDB/internal/backend/utils"
+	"github.com/herveyleaf/GoDB/internal/backend/vfs"
+	"github.com/herveyleaf/GoDB/pkg/common"
+)
+
+const (
+	DWB_SUFFIX = ".dwb"
+
+	// 双写文件的格式: [Magic][PageSize][Count][Pgno1][Page1]...[Pgnon][Pagen]
+	DWB_MAGIC        = "GDWB"
+	OF_DWB_PAGE_SIZE = 4
+	OF_DWB_COUNT     = OF_DWB_PAGE_SIZE + 4
+	LEN_DWB_HEADER   = OF_DWB_COUNT + 4
+	LEN_DWB_PGNO     = 4
+
+	// 每一批最多写入双写文件的页数, 更大的批次会被拆开
+	DWB_MAX_PAGES = 128
+)
+
+// doubleWriteBuffer 页面在原地写入之前先整批写入双写文件并fsync,
+// 崩溃时原地写了一半的页面可以用双写文件中完整的副本恢复
+type doubleWriteBuffer struct {
+	file     vfs.File // 只读打开时双写文件可能不存在, 这时为nil
+	pageSize int
+	readOnly bool
+}
+
+func createDoubleWrite(fsys vfs.FS, path string, pageSize int) (*doubleWriteBuffer, error) {
+	f, err := fsys.OpenFile(path+DWB_SUFFIX, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, err
+	}
+	dwb := &doubleWriteBuffer{file: f, pageSize: pageSize}
+	if err := dwb.reset(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return dwb, nil
+}
+
+// openDoubleWrite 打开双写文件, 文件不存在时会新建一个空的. readOnly为true时只读打开, 不新建文件
+func openDoubleWrite(fsys vfs.FS, path string, readOnly bool) (*doubleWriteBuffer, error) {
+	if readOnly {
+		f, err := fsys.OpenFile(path+DWB_SUFFIX, os.O_RDONLY, 0)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return &doubleWriteBuffer{file: f, readOnly: true}, nil
+	}
+	f, err := fsys.OpenFile(path+DWB_SUFFIX, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return &doubleWriteBuffer{file: f}, nil
+}
+
+// write 把一批页面写入双写文件, 返回时这批页面已经落盘
+func (dwb *doubleWriteBuffer) write(batch []dirtyPage) error {
+	entry := LEN_DWB_PGNO + dwb.pageSize
+	buf := make([]byte, LEN_DWB_HEADER+len(batch)*entry)
+	dwb.putHeader(buf, len(batch))
+	for i, dp := range batch {
+		pos := LEN_DWB_HEADER + i*entry
+		binary.BigEndian.PutUint32(buf[pos:], uint32(dp.pgno))
+		copy(buf[pos+LEN_DWB_PGNO:], dp.data)
+	}
+	if _, err := dwb.file.WriteAt(buf, 0); err != nil {
+		return err
+	}
+	return dwb.file.Sync()
+}
+
+// reset 清空双写文件中的页面, 用于数据库文件被截断之后, 避免恢复出已经被丢弃的页面
+func (dwb *doubleWriteBuffer) reset() error {
+	buf := make([]byte, LEN_DWB_HEADER)
+	dwb.putHeader(buf, 0)
+	if _, err := dwb.file.WriteAt(buf, 0); err != nil {
+		return err
+	}
+	if err := dwb.file.Truncate(LEN_DWB_HEADER); err != nil {
+		return err
+	}
+	return dwb.file.Sync()
+}
+
+func (dwb *doubleWriteBuffer) putHeader(buf []byte, count int) {
+	copy(buf, DWB_MAGIC)
+	binary.BigEndian.PutUint32(buf[OF_DWB_PAGE_SIZE:], uint32(dwb.pageSize))
+	binary.BigEndian.PutUint32(buf[OF_DWB_COUNT:], uint32(count))
+}
+
+// restore 用双写文件中完整的副本覆盖数据库文件中损坏或缺失的页面, 返回被恢复的页号.
+// 双写文件中保存的是页面在磁盘上的数据, codec为nil时只恢复第一页, 用于在读出文件头之前修复文件头.
+// 只读时不修改数据库文件, 有需要恢复的页面时返回common.ErrReadOnly
+func (dwb *doubleWriteBuffer) restore(db vfs.File, codec pageCodec) ([]int, error) {
+	if dwb.file == nil {
+		return nil, nil
+	}
+	header := make([]byte, LEN_DWB_HEADER)
+	if _, err := dwb.file.ReadAt(header, 0); err != nil {
+		if err == io.EOF {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if string(header[:len(DWB_MAGIC)]) != DWB_MAGIC {
+		return nil, nil
+	}
+	slotSize := int(binary.BigEndian.Uint32(header[OF_DWB_PAGE_SIZE:]))
+	count := int(binary.BigEndian.Uint32(header[OF_DWB_COUNT:]))
+	// 大小和当前的格式不一致的副本不是这个数据库文件写出的
+	if slotSize < MIN_PAGE_SIZE || slotSize > MAX_PAGE_SIZE+utils.SEAL_OVERHEAD || (codec != nil && slotSize != codec.slotSize()) {
+		return nil, nil
+	}
+	dwb.pageSize = slotSize
+
+	restored := []int{}
+	entry := make([]byte, LEN_DWB_PGNO+slotSize)
+	current := make([]byte, slotSize)
+	for i := 0; i < count; i++ {
+		// 双写文件本身写了一半时, 后面的副本校验不通过, 对应的页面也还没有开始原地写入
+		pos := int64(LEN_DWB_HEADER + i*len(entry))
+		if _, err := dwb.file.ReadAt(entry, pos); err != nil {
+			break
+		}
+		pgno := int(binary.BigEndian.Uint32(entry))
+		copyData := entry[LEN_DWB_PGNO:]
+		if pgno < 1 || (codec == nil && pgno != 1) || !validSlot(codec, pgno, copyData) {
+			continue
+		}
+
+		offset := int64(pgno-1) * int64(slotSize)
+		n, err := db.ReadAt(current, offset)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if n == slotSize && validSlot(codec, pgno, current) {
+			continue
+		}
+		if dwb.readOnly {
+			return nil, fmt.Errorf("%w: page %d needs to be restored from the double-write file", common.ErrReadOnly, pgno)
+		}
+		if _, err := db.WriteAt(copyData, offset); err != nil {
+			return nil, err
+		}
+		restored = append(restored, pgno)
+	}
+	if len(restored) > 0 {
+		if err := db.Sync(); err != nil {
+			return nil, err
+		}
+	}
+	return restored, nil
+}
+
+func validSlot(codec pageCodec, pgno int, raw []byte) bool {
+	if pgno == 1 {
+		return validPageOne(raw)
+	}
+	_, ok := codec.decode(pgno, raw)
+	return ok
+}
+
+func (dwb *doubleWriteBuffer) close() {
+	if dwb.file != nil {
+		dwb.file.Close()
+	}
+}
@@ -0,0 +1,186 @@
+package dm
+
+import (
+	"encoding/binary"
+	"sort"
+	"sync"
+)
+
+// freeList 完全空闲的页面组成的链表, 表头和长度记录在第一页中, 每个空闲页中记录下一个空闲页的页号.
+// 页面放入和取出链表时先写页面级日志, 重做时由日志重建页面的内容;
+// 第一页中的表头不写日志, 崩溃恢复之后按重做出的空闲页重新建立整个链表
+type freeList struct {
+	lock    sync.Mutex
+	pc      PageCache
+	lg      Logger
+	pageOne Page
+	pages   []int // 链表中的页号, 第一个是表头
+}
+
+// loadFreeList 沿着第一页中的表头读出整个链表
+func loadFreeList(pc PageCache, lg Logger, pageOne Page) (*freeList, error) {
+	fl := &freeList{pc: pc, lg: lg, pageOne: pageOne}
+	raw := pageOne.GetData()
+	next := int(binary.BigEndian.Uint32(raw[OF_FREE_LIST_HEAD:]))
+	count := int(binary.BigEndian.Uint32(raw[OF_FREE_LIST_COUNT:]))
+	for next != 0 && len(fl.pages) < count {
+		pg, err := pc.GetPage(next)
+		if err != nil {
+			return nil, err
+		}
+		fl.pages = append(fl.pages, next)
+		next = getFreeNext(pg.GetData())
+		pg.Release()
+	}
+	return fl, nil
+}
+
+// newFreeList 丢弃第一页中记录的链表, 由调用方重新加入空闲页
+func newFreeList(pc PageCache, lg Logger, pageOne Page) *freeList {
+	fl := &freeList{pc: pc, lg: lg, pageOne: pageOne}
+	fl.writeHead()
+	return fl
+}
+
+func (fl *freeList) contains(pgno int) bool {
+	fl.lock.Lock()
+	defer fl.lock.Unlock()
+	for _, p := range fl.pages {
+		if p == pgno {
+			return true
+		}
+	}
+	return false
+}
+
+// free 把一个没有有效数据的页面放入链表, 调用方需要保证没有人再引用这个页面
+func (fl *freeList) free(pgno int) error {
+	fl.lock.Lock()
+	defer fl.lock.Unlock()
+	release := fl.lg.Hold()
+	defer release()
+	if err := fl.lg.Log(PageLog(LOG_TYPE_FREE, pgno)); err != nil {
+		return err
+	}
+	return fl.link(pgno)
+}
+
+// relink 把一个已经是空闲页的页面重新链入链表, 不写日志, 只在恢复之后重建链表时使用
+func (fl *freeList) relink(pgno int) error {
+	fl.lock.Lock()
+	defer fl.lock.Unlock()
+	return fl.link(pgno)
+}
+
+func (fl *freeList) link(pgno int) error {
+	pg, err := fl.pc.GetPage(pgno)
+	if err != nil {
+		return err
+	}
+	pg.BeginUpdate()
+	copy(pg.GetData(), InitRawFree(fl.pc.PageSize(), fl.head()))
+	pg.EndUpdate()
+	pg.Release()
+	fl.pages = append([]int{pgno}, fl.pages...)
+	fl.writeHead()
+	return nil
+}
+
+// alloc 取出一个空闲页并初始化为空的普通页, 链表为空时在文件末尾追加
+func (fl *freeList) alloc() (int, error) {
+	return fl.allocLogged(fl.lg.Log)
+}
+
+// allocLogged 和alloc相同, 取出空闲页时的日志交给log写入. 日志落盘之前崩溃时,
+// 恢复时重做这个页面之前的空闲页日志, 它仍然是空闲页
+func (fl *freeList) allocLogged(log func([]byte) error) (int, error) {
+	fl.lock.Lock()
+	defer fl.lock.Unlock()
+	if len(fl.pages) == 0 {
+		return fl.pc.NewPage(InitRawX(fl.pc.PageSize()))
+	}
+	pgno := fl.pages[0]
+	pg, err := fl.pc.GetPage(pgno)
+	if err != nil {
+		return 0, err
+	}
+	defer pg.Release()
+	release := fl.lg.Hold()
+	defer release()
+	if err := log(PageLog(LOG_TYPE_ALLOC, pgno)); err != nil {
+		return 0, err
+	}
+	pg.BeginUpdate()
+	copy(pg.GetData(), InitRawX(fl.pc.PageSize()))
+	pg.EndUpdate()
+	fl.pages = fl.pages[1:]
+	fl.writeHead()
+	return pgno, nil
+}
+
+// shrink 释放文件末尾连续的空闲页并截断文件, 返回释放的页数.
+// 其余的空闲页按页号从小到大重新链接, 之后分配时优先使用靠前的页面, 下次能截掉更多
+func (fl *freeList) shrink() (int, error) {
+	fl.lock.Lock()
+	defer fl.lock.Unlock()
+	free := make(map[int]bool, len(fl.pages))
+	for _, pgno := range fl.pages {
+		free[pgno] = true
+	}
+	pageNumber := fl.pc.GetPageNumber()
+	maxPgno := pageNumber
+	for maxPgno > 1 && free[maxPgno] {
+		maxPgno--
+	}
+	if maxPgno == pageNumber {
+		return 0, nil
+	}
+
+	release := fl.lg.Hold()
+	defer release()
+	if err := fl.lg.Log(PageLog(LOG_TYPE_TRUNCATE, maxPgno)); err != nil {
+		return 0, err
+	}
+	rest := make([]int, 0, len(fl.pages))
+	for _, pgno := range fl.pages {
+		if pgno <= maxPgno {
+			rest = append(rest, pgno)
+		}
+	}
+	sort.Ints(rest)
+	for i, pgno := range rest {
+		next := 0
+		if i+1 < len(rest) {
+			next = rest[i+1]
+		}
+		pg, err := fl.pc.GetPage(pgno)
+		if err != nil {
+			return 0, err
+		}
+		pg.BeginUpdate()
+		setFreeNext(pg.GetData(), next)
+		pg.EndUpdate()
+		pg.Release()
+	}
+	fl.pages = rest
+	fl.writeHead()
+	if err := fl.pc.TruncateByPgno(maxPgno); err != nil {
+		return 0, err
+	}
+	return pageNumber - maxPgno, nil
+}
+
+func (fl *freeList) head() int {
+	if len(fl.pages) == 0 {
+		return 0
+	}
+	return fl.pages[0]
+}
+
+func (fl *freeList) writeHead() {
+	fl.pageOne.BeginUpdate()
+	defer fl.pageOne.EndUpdate()
+	raw := fl.pageOne.GetData()
+	binary.BigEndian.PutUint32(raw[OF_FREE_LIST_HEAD:], uint32(fl.head()))
+	binary.BigEndian.PutUint32(raw[OF_FREE_LIST_COUNT:], uint32(len(fl.pages)))
+}
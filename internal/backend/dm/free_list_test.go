@@ -0,0 +1,211 @@
+package dm
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/herveyleaf/GoDB/internal/backend/tm"
+	"github.com/herveyleaf/GoDB/internal/backend/utils"
+	"github.com/herveyleaf/GoDB/internal/backend/vfs/vfstest"
+)
+
+func TestFreeListAndShrink(t *testing.T) {
+	fsys := vfstest.NewCrashFS(1)
+	tmCfg := tm.Config{FS: fsys, Locked: true}
+	cfg := Config{PageSize: MIN_PAGE_SIZE, FS: fsys}
+	open := func() (tm.TransactionManager, *DataManagerImpl) {
+		tmgr, err := tm.OpenWithConfig("free", tmCfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := OpenDMWithConfig("free", MIN_PAGE_SIZE*MEM_MIN_LIM, tmgr, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tmgr, d.(*DataManagerImpl)
+	}
+
+	tmgr, err := tm.CreateWithConfig("free", tmCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := CreateDMWithConfig("free", MIN_PAGE_SIZE*MEM_MIN_LIM, tmgr, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xid, _ := tmgr.Begin()
+	keep, _ := d.Insert(xid, []byte("keep"))
+	tmgr.Commit(xid)
+	// 没有提交的事务写满若干页, 崩溃恢复之后这些页面上没有有效数据
+	xid, _ = tmgr.Begin()
+	for i := 0; i < 20; i++ {
+		d.Insert(xid, make([]byte, 1000))
+	}
+	if err := d.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	fsys.Crash()
+	if err := d.Close(); !errors.Is(err, vfstest.ErrPowerLoss) {
+		t.Fatalf("Expected ErrPowerLoss from Close after a crash, got %v", err)
+	}
+	tmgr.Close()
+	fsys.Restart()
+
+	tmgr, dmi := open()
+	freed := len(dmi.free.pages)
+	if freed == 0 {
+		t.Fatalf("Expected empty pages on the free list after recovery")
+	}
+	dmi.Close()
+	tmgr.Close()
+
+	// 正常关闭之后链表从第一页读出, 不再重新释放
+	tmgr, dmi = open()
+	if len(dmi.free.pages) != freed {
+		t.Fatalf("Expected %d free pages after reopen, got %d", freed, len(dmi.free.pages))
+	}
+	pages := dmi.pc.GetPageNumber()
+	n, err := dmi.Shrink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != freed || dmi.pc.GetPageNumber() != pages-n {
+		t.Fatalf("Shrink released %d of %d free pages, %d pages left", n, freed, dmi.pc.GetPageNumber())
+	}
+	di, err := dmi.Read(keep)
+	if err != nil || di == nil || !bytes.Equal(di.Data(), []byte("keep")) {
+		t.Fatalf("Committed item lost after shrink: %v", err)
+	}
+	di.Release()
+
+	xid, _ = tmgr.Begin()
+	uids := []int64{}
+	for i := 0; i < 10; i++ {
+		uid, err := dmi.Insert(xid, bytes.Repeat([]byte{byte(i)}, 1000))
+		if err != nil {
+			t.Fatal(err)
+		}
+		uids = append(uids, uid)
+	}
+	tmgr.Commit(xid)
+	pages = dmi.pc.GetPageNumber()
+	// 崩溃后重做截断之前的日志, 被截掉又重新追加的页面只能包含截断之后的数据
+	fsys.Crash()
+	if err := dmi.Close(); !errors.Is(err, vfstest.ErrPowerLoss) {
+		t.Fatalf("Expected ErrPowerLoss from Close after a crash, got %v", err)
+	}
+	tmgr.Close()
+	fsys.Restart()
+
+	tmgr, dmi = open()
+	defer tmgr.Close()
+	defer dmi.Close()
+	for i, uid := range uids {
+		di, err := dmi.Read(uid)
+		if err != nil || di == nil || !bytes.Equal(di.Data(), bytes.Repeat([]byte{byte(i)}, 1000)) {
+			t.Fatalf("Item %d inserted after shrink is wrong: %v", i, err)
+		}
+		di.Release()
+	}
+	if dmi.pc.GetPageNumber() != pages || len(dmi.free.pages) != 0 {
+		t.Fatalf("Expected %d pages and no free pages after recovery, got %d and %d", pages, dmi.pc.GetPageNumber(), len(dmi.free.pages))
+	}
+}
+
+// 搬到文件末尾的数据在Shrink时搬回前面的页面, UID不变, 腾空的页面被截掉
+func TestShrinkMovesTrailingItems(t *testing.T) {
+	fsys := vfstest.NewCrashFS(1)
+	tmCfg := tm.Config{FS: fsys, Locked: true}
+	cfg := Config{PageSize: MIN_PAGE_SIZE, FS: fsys}
+	tmgr, err := tm.CreateWithConfig("shrink", tmCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := CreateDMWithConfig("shrink", MIN_PAGE_SIZE*MEM_MIN_LIM, tmgr, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dmi := d.(*DataManagerImpl)
+
+	xid, _ := tmgr.Begin()
+	uid, _ := d.Insert(xid, []byte("home"))
+	var fillers []int64
+	for i := 0; i < 3; i++ {
+		filler, err := d.Insert(xid, make([]byte, 1000))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fillers = append(fillers, filler)
+	}
+	tmgr.Commit(xid)
+	// 页面放不下更新后的数据, 它被搬到新分配的最后一页
+	data := bytes.Repeat([]byte{7}, 2500)
+	xid, _ = tmgr.Begin()
+	if err := d.Update(xid, uid, data); err != nil {
+		t.Fatal(err)
+	}
+	tmgr.Commit(xid)
+	pages := dmi.pc.GetPageNumber()
+	homePgno, _ := utils.UidToAddress(uid)
+	di, _ := d.Read(uid)
+	if movedPgno, _ := utils.UidToAddress(di.(*DataItemImpl).loc); movedPgno != pages || homePgno == pages {
+		t.Fatalf("Expected the item to be moved to the last page %d, got %d", pages, movedPgno)
+	}
+	di.Release()
+
+	// 前面的页面腾出空间之后, 还有未结束的事务写过最后一页时仍然不搬
+	xid, _ = tmgr.Begin()
+	for _, filler := range fillers[:2] {
+		if err := d.Delete(xid, filler); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tmgr.Commit(xid)
+	xid, _ = tmgr.Begin()
+	if err := d.Update(xid, uid, bytes.Repeat([]byte{8}, 2500)); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := d.Shrink(); err != nil || n != 0 {
+		t.Fatalf("Shrink released %d pages touched by an active transaction: %v", n, err)
+	}
+	if err := d.Abort(xid); err != nil {
+		t.Fatal(err)
+	}
+	tmgr.Abort(xid)
+	n, err := d.Shrink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || dmi.pc.GetPageNumber() != pages-1 {
+		t.Fatalf("Shrink released %d pages, %d of %d left", n, dmi.pc.GetPageNumber(), pages)
+	}
+	check := func() {
+		di, err := d.Read(uid)
+		if err != nil || di == nil || !bytes.Equal(di.Data(), data) {
+			t.Fatalf("Item moved by shrink read back wrong: %v", err)
+		}
+		if movedPgno, _ := utils.UidToAddress(di.(*DataItemImpl).loc); movedPgno >= pages {
+			t.Fatalf("Item is still on page %d", movedPgno)
+		}
+		di.Release()
+	}
+	check()
+
+	// 搬动以超级事务的名义写日志, 崩溃之后重做
+	fsys.Crash()
+	if err := d.Close(); !errors.Is(err, vfstest.ErrPowerLoss) {
+		t.Fatalf("Expected ErrPowerLoss from Close after a crash, got %v", err)
+	}
+	tmgr.Close()
+	fsys.Restart()
+	if tmgr, err = tm.OpenWithConfig("shrink", tmCfg); err != nil {
+		t.Fatal(err)
+	}
+	defer tmgr.Close()
+	if d, err = OpenDMWithConfig("shrink", MIN_PAGE_SIZE*MEM_MIN_LIM, tmgr, cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	check()
+}
@@ -0,0 +1,121 @@
+package dm
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/herveyleaf/GoDB/internal/backend/utils"
+	"github.com/herveyleaf/GoDB/internal/backend/vfs"
+)
+
+const (
+	FSM_SUFFIX    = ".fsm"
+	FSM_KEY_LABEL = "GoDB fsm"
+
+	// 空闲空间映射文件: [Checksum][PageNumber][Space1]...[Spacen], Checksum是之后所有内容的CRC32C.
+	// 每页用1个字节记录空闲空间, 单位是页面大小的1/256, 向下取整, 所以记录的值不会超过实际的空闲空间
+	OF_FSM_CHECKSUM = 0
+	OF_FSM_PAGES    = OF_FSM_CHECKSUM + 4
+	OF_FSM_SPACE    = OF_FSM_PAGES + 4
+	FSM_LEVELS      = 256
+)
+
+// freeSpaceMap 每一页的空闲空间, 和PageIndex一起更新, 正常关闭时写入文件.
+// 打开时只有第一页的VC表明上次正常关闭时才使用文件中的记录, 否则扫描所有页面重建
+type freeSpaceMap struct {
+	lock  sync.Mutex
+	fsys  vfs.FS
+	path  string
+	aead  *utils.GCM // 数据库加密时用来加密映射文件, 否则为nil
+	unit  int
+	space []byte // 下标是页号
+}
+
+func newFreeSpaceMap(fsys vfs.FS, path string, pageSize int, key []byte) (*freeSpaceMap, error) {
+	fsm := &freeSpaceMap{fsys: fsys, path: path, unit: pageSize / FSM_LEVELS}
+	if key != nil {
+		aead, err := utils.NewGCM(key, FSM_KEY_LABEL)
+		if err != nil {
+			return nil, err
+		}
+		fsm.aead = aead
+	}
+	return fsm, nil
+}
+
+func (fsm *freeSpaceMap) set(pgno int, freeSpace int) {
+	fsm.lock.Lock()
+	defer fsm.lock.Unlock()
+	if pgno >= len(fsm.space) {
+		fsm.space = append(fsm.space, make([]byte, pgno+1-len(fsm.space))...)
+	}
+	fsm.space[pgno] = byte(min(freeSpace/fsm.unit, FSM_LEVELS-1))
+}
+
+// get 返回记录的空闲空间, 不大于页面实际的空闲空间
+func (fsm *freeSpaceMap) get(pgno int) int {
+	fsm.lock.Lock()
+	defer fsm.lock.Unlock()
+	if pgno >= len(fsm.space) {
+		return 0
+	}
+	return int(fsm.space[pgno]) * fsm.unit
+}
+
+// load 读入映射文件, 文件不存在、损坏或者页数和数据库文件不一致时返回false
+func (fsm *freeSpaceMap) load(pageNumber int) bool {
+	f, err := fsm.fsys.OpenFile(fsm.path+FSM_SUFFIX, os.O_RDONLY, 0600)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	raw := make([]byte, fi.Size())
+	if _, err := f.ReadAt(raw, 0); err != nil && err != io.EOF {
+		return false
+	}
+	if fsm.aead != nil {
+		if raw, err = utils.Open(fsm.aead, raw, nil); err != nil {
+			return false
+		}
+	}
+	if len(raw) < OF_FSM_SPACE || binary.BigEndian.Uint32(raw[OF_FSM_CHECKSUM:]) != crc32.Checksum(raw[OF_FSM_PAGES:], crcTable) {
+		return false
+	}
+	if int(binary.BigEndian.Uint32(raw[OF_FSM_PAGES:])) != pageNumber || len(raw)-OF_FSM_SPACE != pageNumber+1 {
+		return false
+	}
+	fsm.lock.Lock()
+	defer fsm.lock.Unlock()
+	fsm.space = raw[OF_FSM_SPACE:]
+	return true
+}
+
+// save 把前pageNumber页的记录写入映射文件并fsync
+func (fsm *freeSpaceMap) save(pageNumber int) error {
+	fsm.lock.Lock()
+	raw := make([]byte, OF_FSM_SPACE+pageNumber+1)
+	copy(raw[OF_FSM_SPACE:], fsm.space)
+	fsm.lock.Unlock()
+	binary.BigEndian.PutUint32(raw[OF_FSM_PAGES:], uint32(pageNumber))
+	binary.BigEndian.PutUint32(raw[OF_FSM_CHECKSUM:], crc32.Checksum(raw[OF_FSM_PAGES:], crcTable))
+	if fsm.aead != nil {
+		raw = utils.Seal(fsm.aead, raw, nil)
+	}
+
+	f, err := fsm.fsys.OpenFile(fsm.path+FSM_SUFFIX, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.WriteAt(raw, 0); err != nil {
+		return err
+	}
+	return f.Sync()
+}
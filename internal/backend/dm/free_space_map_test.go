@@ -0,0 +1,70 @@
+package dm
+
+import (
+	"os"
+	"testing"
+
+	"github.com/herveyleaf/GoDB/internal/backend/tm"
+	"github.com/herveyleaf/GoDB/internal/backend/vfs"
+)
+
+func TestFreeSpaceMap(t *testing.T) {
+	fsys := vfs.NewMemFS()
+	cfg := Config{PageSize: MIN_PAGE_SIZE, FS: fsys, EncryptionKey: make([]byte, 16)}
+	tmCfg := tm.Config{FS: fsys, EncryptionKey: cfg.EncryptionKey, Locked: true}
+	tmgr, err := tm.CreateWithConfig("fsm", tmCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := CreateDMWithConfig("fsm", MIN_PAGE_SIZE*MEM_MIN_LIM, tmgr, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xid, _ := tmgr.Begin()
+	for i := 0; i < 40; i++ {
+		d.Insert(xid, make([]byte, 50+i*20))
+	}
+	tmgr.Commit(xid)
+	d.Close()
+	tmgr.Close()
+
+	// checkSpace 检查映射中记录的空闲空间不超过页面实际的空闲空间, 并且误差小于一个单位
+	checkSpace := func(loaded bool) {
+		tmgr, err := tm.OpenWithConfig("fsm", tmCfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tmgr.Close()
+		d, err := OpenDMWithConfig("fsm", MIN_PAGE_SIZE*MEM_MIN_LIM, tmgr, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer d.Close()
+		dmi := d.(*DataManagerImpl)
+		if got := dmi.fsm.load(dmi.pc.GetPageNumber()); got != loaded {
+			t.Fatalf("Expected the free space map to be loadable: %v, got %v", loaded, got)
+		}
+		for pgno := 2; pgno <= dmi.pc.GetPageNumber(); pgno++ {
+			pg, err := dmi.pc.GetPage(pgno)
+			if err != nil {
+				t.Fatal(err)
+			}
+			actual := GetFreeSpace(pg)
+			pg.Release()
+			if recorded := dmi.fsm.get(pgno); recorded > actual || actual-recorded >= dmi.fsm.unit {
+				t.Fatalf("Page %d has %d bytes free, map records %d", pgno, actual, recorded)
+			}
+		}
+	}
+	checkSpace(true)
+
+	// 映射文件损坏时打开数据库会扫描页面重建, 关闭时重新写入
+	f, err := fsys.OpenFile("fsm"+FSM_SUFFIX, os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte{0xff}, 20)
+	f.Close()
+	checkSpace(false)
+	checkSpace(true)
+}
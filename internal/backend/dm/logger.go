@@ -2,11 +2,12 @@ package dm
 
 import (
 	"encoding/binary"
-	"io"
+	"fmt"
 	"os"
 	"sync"
 
 	"github.com/herveyleaf/GoDB/internal/backend/utils"
+	"github.com/herveyleaf/GoDB/internal/backend/vfs"
 	"github.com/herveyleaf/GoDB/pkg/common"
 )
 
@@ -16,165 +17,618 @@ const (
 	OF_CHECKSUM = OF_SIZE + 4
 	OF_LOG_DATA = OF_CHECKSUM + 4
 	LOG_SUFFIX  = ".log"
+	// 换日志段时先把下一个日志段完整地写到这里, 再替换当前的日志段
+	LOG_NEXT_SUFFIX = LOG_SUFFIX + ".next"
+
+	// 文件头: [SegmentNo] 8字节, 后面是两个存放总校验和的槽位. 每次落盘时写到上一次落盘没有用的槽位,
+	// 写了一半时另一个槽位中仍然是上一次落盘的总校验和
+	OF_LOG_SEGMENT = 0
+	OF_LOG_XCHECK  = OF_LOG_SEGMENT + 8
+	LEN_LOG_HEADER = OF_LOG_XCHECK + 8
+
+	// 日志段的默认大小
+	DEFAULT_LOG_SEGMENT_SIZE = 64 << 20
+
+	// 从主密钥派生日志密钥时使用的标签
+	LOG_KEY_LABEL = "GoDB log"
+)
+
+// SyncMode 日志落盘的时机
+type SyncMode int
+
+const (
+	// 每次写日志都fsync
+	SYNC_FULL SyncMode = iota
+	// 只在提交事务、写回页面和关闭之前fsync. 崩溃时最近的日志可能丢失, 但丢失的日志对应的修改不会出现在磁盘上,
+	// 已经提交的事务也不会丢失
+	SYNC_COMMIT
 )
 
+// 写日志失败时返回错误, 这条日志是否落盘不确定, 调用方不能再修改日志对应的页面
 type Logger interface {
-	Log(data []byte)
-	Truncate(x int64)
-	Next() []byte
+	Log(data []byte) error
+	// LogBatch 依次写入多条日志, SYNC_FULL时最后只fsync一次
+	LogBatch(logs [][]byte) error
+	// Flush 让已经写入的日志都落盘, 写回页面之前必须调用
+	Flush() error
+	// Hold 从写日志到修改完对应的页面期间持有, 返回的函数用来释放. 持有期间不能再次调用Hold
+	Hold() func()
+	// Full 当前的日志段超过设置的大小时收到通知
+	Full() <-chan struct{}
+	// Rotate 当前的日志段超过设置的大小时, 等待所有的Hold释放之后换成新的日志段并返回true.
+	// 新日志段的第一条日志由first生成, 这时所有旧日志段中的修改都已经在页面缓存中
+	Rotate(first func() []byte) (bool, error)
+	// RemoveSegments 从最旧的日志段开始删除, 直到遇到有needed返回true的日志的段, 当前的日志段不会被删除.
+	// 调用之前旧日志段中的修改必须都已经写回磁盘
+	RemoveSegments(needed func(log []byte) (bool, error)) error
+	Truncate(x int64) error
+	// Next 从最旧的日志段开始依次返回下一条日志, 没有更多日志时返回nil
+	Next() ([]byte, error)
 	Rewind()
-	Close()
+	Close() error
 }
 
+// LoggerImpl 日志由若干个日志段组成, 当前的日志段是path.log, 之前的是path.log.N, N是日志段的编号.
+// 只有当前的日志段会被写入, 旧的日志段都是完整落盘的
 type LoggerImpl struct {
-	file      *os.File
-	lock      sync.Mutex
-	position  int64
-	fileSize  int64
-	xChecksum int
+	fsys        vfs.FS
+	path        string
+	file        vfs.File // 当前的日志段
+	lock        sync.Mutex
+	hold        sync.RWMutex // 写日志并修改页面的过程持有读锁, 换日志段时持有写锁
+	segment     int64        // 当前日志段的编号
+	oldest      int64        // 最旧的日志段的编号
+	segmentSize int64        // 为0时不换日志段
+	full        chan struct{}
+	fileSize    int64
+	xChecksum   int
+	slot        int  // 最近一次落盘的总校验和所在的槽位
+	unsynced    bool // 有还没有落盘的日志
+	mode        SyncMode
+	aead        *utils.GCM // 不为nil时每条日志的数据都被加密
+	readOnly    bool       // 只读打开时不换日志段, 也不删除旧的日志段
+	// 写日志失败之后日志文件的状态不确定, 之后的写入都返回这个错误, 重新打开时由恢复处理
+	err error
+
+	// Next读到的日志段和位置, 读旧的日志段时reader是打开的旧日志段
+	readNo   int64
+	reader   vfs.File
+	readSize int64
+	position int64
 }
 
-func NewLoggerImpl(file *os.File) *LoggerImpl {
+func NewLoggerImpl(file vfs.File) *LoggerImpl {
 	return &LoggerImpl{
 		file: file,
 		lock: sync.Mutex{},
+		full: make(chan struct{}, 1),
 	}
 }
 
-func NewLoggerImplWithChecksum(file *os.File, xChecksum int) *LoggerImpl {
+func NewLoggerImplWithChecksum(file vfs.File, xChecksum int) *LoggerImpl {
 	return &LoggerImpl{
 		file:      file,
 		lock:      sync.Mutex{},
+		full:      make(chan struct{}, 1),
+		fileSize:  LEN_LOG_HEADER,
 		xChecksum: xChecksum,
 	}
 }
 
 func CreateLogger(path string) (Logger, error) {
-	filePath := path + LOG_SUFFIX
-	f, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	return CreateLoggerWithConfig(path, Config{})
+}
+
+// CreateLoggerWithConfig 按cfg创建日志文件, 设置了EncryptionKey时每条日志的数据都用AES-GCM加密, 按cfg.Sync落盘
+func CreateLoggerWithConfig(path string, cfg Config) (Logger, error) {
+	return createLogger(path, 0, cfg)
+}
+
+// createLogger 创建编号为segment的日志段作为当前的日志段
+func createLogger(path string, segment int64, cfg Config) (*LoggerImpl, error) {
+	aead, err := newLogAEAD(cfg.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	fsys := vfs.Or(cfg.FS)
+	f, err := fsys.OpenFile(path+LOG_SUFFIX, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
 	if err != nil {
 		if os.IsExist(err) {
 			return nil, common.ErrFileExists
 		}
-	} else {
 		return nil, err
 	}
-	if fi, err := f.Stat(); err != nil {
-		mode := fi.Mode()
-		if mode.Perm()&0400 == 0 || mode.Perm()&0200 == 0 {
-			return nil, common.ErrFileCannotRW
-		} else {
-			return nil, err
-		}
+	if err := checkLogFileMode(f, false); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := writeLogHeader(f, segment); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return nil, err
 	}
-	data := make([]byte, 4)
-	binary.BigEndian.PutUint32(data, 0)
-	f.Seek(0, 0)
-	f.Write(data)
-	f.Sync()
 
-	return NewLoggerImplWithChecksum(f, 0), nil
+	lg := NewLoggerImplWithChecksum(f, 0)
+	lg.setup(fsys, path, aead, cfg)
+	lg.segment, lg.oldest = segment, segment
+	return lg, nil
 }
 
 func OpenLogger(path string) (Logger, error) {
-	filePath := path + LOG_SUFFIX
-	f, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	return OpenLoggerWithConfig(path, Config{})
+}
+
+// OpenLoggerWithConfig 按cfg打开日志文件, 加密的日志需要提供创建时的密钥. 换日志段时崩溃的话先完成或者放弃这次替换.
+// cfg.ReadOnly为true时只读打开, 需要完成替换或者截掉末尾没有落盘的日志时返回common.ErrReadOnly
+func OpenLoggerWithConfig(path string, cfg Config) (Logger, error) {
+	return openLogger(path, cfg)
+}
+
+func openLogger(path string, cfg Config) (*LoggerImpl, error) {
+	aead, err := newLogAEAD(cfg.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	fsys := vfs.Or(cfg.FS)
+	if err := finishRotate(fsys, path, cfg.ReadOnly); err != nil {
+		return nil, err
+	}
+	flag := os.O_RDWR
+	if cfg.ReadOnly {
+		flag = os.O_RDONLY
+	}
+	f, err := fsys.OpenFile(path+LOG_SUFFIX, flag, 0600)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil, common.ErrFileNotExists
 		}
-	} else {
 		return nil, err
 	}
-	if fi, err := f.Stat(); err != nil {
-		mode := fi.Mode()
-		if mode.Perm()&0400 == 0 || mode.Perm()&0200 == 0 {
-			return nil, common.ErrFileCannotRW
-		} else {
-			return nil, err
-		}
+	if err := checkLogFileMode(f, cfg.ReadOnly); err != nil {
+		f.Close()
+		return nil, err
 	}
 	lg := NewLoggerImpl(f)
-	lg.init()
+	lg.setup(fsys, path, aead, cfg)
+	if err := lg.init(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := lg.checkKey(); err != nil {
+		lg.closeReader()
+		f.Close()
+		return nil, err
+	}
 	return lg, nil
 }
 
-func (li *LoggerImpl) init() {
-	size := int64(0)
-	fi, _ := li.file.Stat()
-	size = fi.Size()
-	if size < 4 {
-		panic("BADLOGFILE")
+func (li *LoggerImpl) setup(fsys vfs.FS, path string, aead *utils.GCM, cfg Config) {
+	li.fsys, li.path, li.aead, li.mode = fsys, path, aead, cfg.Sync
+	li.readOnly = cfg.ReadOnly
+	li.segmentSize = cfg.LogSegmentSize
+	if li.segmentSize == 0 {
+		li.segmentSize = DEFAULT_LOG_SEGMENT_SIZE
+	}
+}
+
+// finishRotate 下一个日志段已经写好时当前的日志段才会被改名, 所以只有下一个日志段存在而当前的日志段不存在时,
+// 下一个日志段是完整的, 完成替换; 两个都存在时还没有开始替换, 删除可能不完整的下一个日志段.
+// 只读时不能改名或者删除文件, 返回common.ErrReadOnly
+func finishRotate(fsys vfs.FS, path string, readOnly bool) error {
+	if _, err := fsys.Stat(path + LOG_NEXT_SUFFIX); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if readOnly {
+		return fmt.Errorf("%w: an interrupted log segment switch needs to be finished", common.ErrReadOnly)
+	}
+	if _, err := fsys.Stat(path + LOG_SUFFIX); os.IsNotExist(err) {
+		return fsys.Rename(path+LOG_NEXT_SUFFIX, path+LOG_SUFFIX)
+	} else if err != nil {
+		return err
+	}
+	return fsys.Remove(path + LOG_NEXT_SUFFIX)
+}
+
+func segmentPath(path string, no int64) string {
+	return fmt.Sprintf("%s%s.%d", path, LOG_SUFFIX, no)
+}
+
+// oldestSegment 旧的日志段总是从最旧的开始删除, 所以它们的编号是连续的, 从segment往前找到最旧的一个
+func oldestSegment(fsys vfs.FS, path string, segment int64) (int64, error) {
+	for segment > 0 {
+		if _, err := fsys.Stat(segmentPath(path, segment-1)); os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+		segment--
+	}
+	return segment, nil
+}
+
+// RemoveOldSegments 删除path.log之前的所有日志段, 从最旧的开始删除
+func RemoveOldSegments(fsys vfs.FS, path string) error {
+	f, err := fsys.OpenFile(path+LOG_SUFFIX, os.O_RDONLY, 0)
+	if err != nil {
+		return err
 	}
-	raw := make([]byte, 4)
-	_, err := li.file.ReadAt(raw, 0)
+	segment, err := readLogSegmentNo(f)
+	f.Close()
 	if err != nil {
-		panic(err)
+		return err
 	}
-	xChecksum := int(binary.BigEndian.Uint32(raw))
-	li.fileSize = size
-	li.xChecksum = xChecksum
+	oldest, err := oldestSegment(fsys, path, segment)
+	if err != nil {
+		return err
+	}
+	for no := oldest; no < segment; no++ {
+		if err := fsys.Remove(segmentPath(path, no)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeLogHeader(f vfs.File, segment int64) error {
+	header := make([]byte, LEN_LOG_HEADER)
+	binary.BigEndian.PutUint64(header[OF_LOG_SEGMENT:], uint64(segment))
+	_, err := f.WriteAt(header, 0)
+	return err
+}
 
-	li.checkAndRemoveTail()
+func readLogSegmentNo(f vfs.File) (int64, error) {
+	raw := make([]byte, 8)
+	if _, err := f.ReadAt(raw, OF_LOG_SEGMENT); err != nil {
+		return 0, common.ErrBadLogFile
+	}
+	return int64(binary.BigEndian.Uint64(raw)), nil
+}
+
+func newLogAEAD(key []byte) (*utils.GCM, error) {
+	if key == nil {
+		return nil, nil
+	}
+	return utils.NewGCM(key, LOG_KEY_LABEL)
 }
 
-func (li *LoggerImpl) checkAndRemoveTail() {
+// checkKey 用第一条日志检查密钥是否正确, 日志为空时无法检查, 也不需要检查
+func (li *LoggerImpl) checkKey() error {
+	if li.aead == nil {
+		return nil
+	}
+	defer li.Rewind()
 	li.Rewind()
+	_, err := li.Next()
+	return err
+}
+
+// checkLogFileMode 检查日志文件可以读写, 只读打开时只要求可以读
+func checkLogFileMode(f vfs.File, readOnly bool) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if mode := fi.Mode(); mode.Perm()&0400 == 0 || (!readOnly && mode.Perm()&0200 == 0) {
+		return common.ErrFileCannotRW
+	}
+	return nil
+}
+
+func (li *LoggerImpl) init() error {
+	fi, err := li.file.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+	if size < LEN_LOG_HEADER {
+		return common.ErrBadLogFile
+	}
+	raw := make([]byte, LEN_LOG_HEADER)
+	if _, err := li.file.ReadAt(raw, 0); err != nil {
+		return err
+	}
+	li.fileSize = size
+	li.segment = int64(binary.BigEndian.Uint64(raw[OF_LOG_SEGMENT:]))
+	if li.oldest, err = oldestSegment(li.fsys, li.path, li.segment); err != nil {
+		return err
+	}
+	check0 := int(binary.BigEndian.Uint32(raw[OF_LOG_XCHECK:]))
+	check1 := int(binary.BigEndian.Uint32(raw[OF_LOG_XCHECK+4:]))
+	return li.checkAndRemoveTail(check0, check1)
+}
+
+// checkAndRemoveTail 截掉当前日志段中最后一次落盘之后的日志. 日志先追加到文件末尾, 落盘时才把总校验和写入一个槽位并fsync,
+// 崩溃时没有落盘的日志可能只有一部分写入了文件, 中间还可能缺少几条. 所以从头计算总校验和,
+// 和某个槽位相同的最后一个位置就是最后一次落盘时日志的末尾, 之后的日志都没有完成落盘, 对应的修改也不在磁盘上.
+// 没有这样的位置说明已经落盘的日志损坏了
+func (li *LoggerImpl) checkAndRemoveTail(check0 int, check1 int) error {
+	li.position = LEN_LOG_HEADER
 
+	end, slot := int64(-1), 0
 	xCheck := 0
 	for {
-		log := li.internNext()
+		if xCheck == check0 || xCheck == check1 {
+			end, li.xChecksum = li.position, xCheck
+			if slot = 0; xCheck != check0 {
+				slot = 1
+			}
+		}
+		log, err := readLog(li.file, li.fileSize, li.position)
+		if err != nil {
+			return err
+		}
 		if log == nil {
 			break
 		}
+		li.position += int64(len(log))
 		xCheck = li.calChecksum(xCheck, log)
 	}
-	if xCheck != li.xChecksum {
-		panic("BADLOGFILE")
+	if end < 0 {
+		return common.ErrBadLogFile
+	}
+	li.slot = slot
+	if end < li.fileSize {
+		if li.readOnly {
+			return fmt.Errorf("%w: the log has an unsynced tail that needs to be truncated", common.ErrReadOnly)
+		}
+		if err := li.Truncate(end); err != nil {
+			return err
+		}
+		// 截掉的日志不能在再次崩溃后重新出现在新的日志中间
+		if err := li.file.Sync(); err != nil {
+			return err
+		}
 	}
-	li.Truncate(li.position)
-	li.file.Seek(li.position, 0)
 	li.Rewind()
+	return nil
 }
 
+// calChecksum 校验和按32位无符号数回绕, 与写入文件的4个字节一致
 func (li *LoggerImpl) calChecksum(xCheck int, log []byte) int {
+	sum := uint32(xCheck)
 	for _, b := range log {
-		xCheck = xCheck*SEED + int(b)
+		sum = sum*SEED + uint32(b)
 	}
-	return xCheck
+	return int(sum)
 }
 
-func (li *LoggerImpl) Log(data []byte) {
-	log := li.warpLog(data)
+func (li *LoggerImpl) Log(data []byte) error {
+	return li.LogBatch([][]byte{data})
+}
+
+// LogBatch 把所有日志拼在一起用一次写入追加, 崩溃时落盘的只能是它的前缀, 不会出现中间缺一条而后面的日志完整的情况
+func (li *LoggerImpl) LogBatch(logs [][]byte) error {
 	li.lock.Lock()
 	defer li.lock.Unlock()
-	_, err := li.file.Seek(0, io.SeekEnd)
+	if li.err != nil {
+		return li.err
+	}
+	var buf []byte
+	xChecksum := li.xChecksum
+	for _, data := range logs {
+		// 加密时日志所在的日志段和位置参与认证, 日志不能被挪到别的位置
+		if li.aead != nil {
+			data = utils.Seal(li.aead, data, logAD(li.segment, li.fileSize+int64(len(buf))))
+		}
+		log := li.warpLog(data)
+		xChecksum = li.calChecksum(xChecksum, log)
+		buf = append(buf, log...)
+	}
+	// 写入失败时文件末尾可能留下残缺的日志, 打开时会被截掉
+	if _, err := li.file.WriteAt(buf, li.fileSize); err != nil {
+		li.err = fmt.Errorf("append log: %w", err)
+		return li.err
+	}
+	li.fileSize += int64(len(buf))
+	li.xChecksum = xChecksum
+	li.unsynced = true
+	if li.mode == SYNC_FULL {
+		li.err = li.flush()
+	}
+	if li.segmentSize > 0 && li.fileSize >= li.segmentSize {
+		select {
+		case li.full <- struct{}{}:
+		default:
+		}
+	}
+	return li.err
+}
+
+func (li *LoggerImpl) Flush() error {
+	li.lock.Lock()
+	defer li.lock.Unlock()
+	if li.err != nil {
+		return li.err
+	}
+	li.err = li.flush()
+	return li.err
+}
+
+// flush 有没有落盘的日志时把总校验和写入另一个槽位并fsync, 调用方需要持有lock
+func (li *LoggerImpl) flush() error {
+	if !li.unsynced {
+		return nil
+	}
+	if err := li.writeXChecksum(); err != nil {
+		return err
+	}
+	li.unsynced = false
+	return nil
+}
+
+func (li *LoggerImpl) Hold() func() {
+	li.hold.RLock()
+	return li.hold.RUnlock
+}
+
+func (li *LoggerImpl) Full() <-chan struct{} {
+	return li.full
+}
+
+func (li *LoggerImpl) Rotate(first func() []byte) (bool, error) {
+	li.hold.Lock()
+	defer li.hold.Unlock()
+	li.lock.Lock()
+	defer li.lock.Unlock()
+	if li.err != nil {
+		return false, li.err
+	}
+	if li.readOnly {
+		return false, common.ErrReadOnly
+	}
+	if li.segmentSize == 0 || li.fileSize < li.segmentSize {
+		return false, nil
+	}
+	// 改名失败时当前的日志段可能已经不在path.log, 不能再追加, 打开时完成或者放弃这次替换
+	if li.err = li.rotate(first()); li.err != nil {
+		return false, li.err
+	}
+	return true, nil
+}
+
+// rotate 先把下一个日志段完整地写好并落盘, 再把当前的日志段改名为path.log.N, 最后把下一个日志段改名为path.log.
+// 调用方需要持有lock
+func (li *LoggerImpl) rotate(first []byte) error {
+	if err := li.flush(); err != nil {
+		return err
+	}
+	f, err := li.fsys.OpenFile(li.path+LOG_NEXT_SUFFIX, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	_, err = li.file.Write(log)
+	next := NewLoggerImplWithChecksum(f, 0)
+	next.segment, next.aead = li.segment+1, li.aead
+	if err := writeLogHeader(f, next.segment); err != nil {
+		f.Close()
+		return err
+	}
+	log, err := next.appendLog(first)
 	if err != nil {
-		panic(err)
+		f.Close()
+		return err
+	}
+	next.xChecksum = next.calChecksum(0, log)
+	if err := next.writeXChecksum(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := li.fsys.Rename(li.path+LOG_SUFFIX, segmentPath(li.path, li.segment)); err != nil {
+		f.Close()
+		return err
 	}
-	li.updateXChecksm(log)
+	if err := li.fsys.Rename(li.path+LOG_NEXT_SUFFIX, li.path+LOG_SUFFIX); err != nil {
+		f.Close()
+		return err
+	}
+	li.file.Close()
+	li.file, li.segment = f, next.segment
+	li.fileSize, li.xChecksum, li.slot = next.fileSize, next.xChecksum, next.slot
+	return nil
+}
+
+func (li *LoggerImpl) RemoveSegments(needed func(log []byte) (bool, error)) error {
+	if li.readOnly {
+		return common.ErrReadOnly
+	}
+	li.lock.Lock()
+	oldest, segment := li.oldest, li.segment
+	li.lock.Unlock()
+	for no := oldest; no < segment; no++ {
+		keep, err := li.segmentNeeded(no, needed)
+		if err != nil || keep {
+			return err
+		}
+		if err := li.fsys.Remove(segmentPath(li.path, no)); err != nil {
+			return err
+		}
+		li.lock.Lock()
+		li.oldest = no + 1
+		li.lock.Unlock()
+	}
+	return nil
 }
 
-func (li *LoggerImpl) updateXChecksm(log []byte) {
-	li.xChecksum = li.calChecksum(li.xChecksum, log)
-	_, err := li.file.Seek(0, io.SeekStart)
+// segmentNeeded 旧的日志段中是否有needed返回true的日志
+func (li *LoggerImpl) segmentNeeded(no int64, needed func(log []byte) (bool, error)) (bool, error) {
+	f, size, err := li.openSegment(no)
 	if err != nil {
-		panic(err)
+		return false, err
 	}
-	buf := make([]byte, 4)
-	binary.BigEndian.PutUint32(buf, uint32(li.xChecksum))
-	n, err := li.file.Write(buf)
+	defer f.Close()
+	for position := int64(LEN_LOG_HEADER); position < size; {
+		log, err := readLog(f, size, position)
+		if err != nil {
+			return false, err
+		}
+		if log == nil {
+			return false, common.ErrBadLogFile
+		}
+		data, err := li.open(no, position, log)
+		if err != nil {
+			return false, err
+		}
+		if keep, err := needed(data); keep || err != nil {
+			return keep, err
+		}
+		position += int64(len(log))
+	}
+	return false, nil
+}
+
+// openSegment 打开编号为no的旧日志段, 返回文件和长度
+func (li *LoggerImpl) openSegment(no int64) (vfs.File, int64, error) {
+	f, err := li.fsys.OpenFile(segmentPath(li.path, no), os.O_RDONLY, 0)
 	if err != nil {
-		if n != len(buf) {
-			panic("INCOMPLETEWRITE")
+		if os.IsNotExist(err) {
+			return nil, 0, fmt.Errorf("%w: log segment %d is missing", common.ErrBadLogFile, no)
 		}
-		panic(err)
+		return nil, 0, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	if segment, err := readLogSegmentNo(f); err != nil || segment != no {
+		f.Close()
+		return nil, 0, fmt.Errorf("%w: log segment %d has a wrong header", common.ErrBadLogFile, no)
+	}
+	return f, fi.Size(), nil
+}
+
+// appendLog 把一条日志追加到文件末尾并返回写入的内容, 调用方需要持有lock.
+// 写入失败时文件末尾可能留下残缺的日志, 打开时会被截掉
+func (li *LoggerImpl) appendLog(data []byte) ([]byte, error) {
+	// 加密时日志所在的日志段和位置参与认证, 日志不能被挪到别的位置
+	if li.aead != nil {
+		data = utils.Seal(li.aead, data, logAD(li.segment, li.fileSize))
+	}
+	log := li.warpLog(data)
+	if _, err := li.file.WriteAt(log, li.fileSize); err != nil {
+		return nil, fmt.Errorf("append log: %w", err)
+	}
+	li.fileSize += int64(len(log))
+	return log, nil
+}
+
+// writeXChecksum 把总校验和写入上一次没有用的槽位并fsync, 成功之后这个槽位成为最近一次落盘的槽位
+func (li *LoggerImpl) writeXChecksum() error {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, uint32(li.xChecksum))
+	slot := 1 - li.slot
+	if _, err := li.file.WriteAt(buf, int64(OF_LOG_XCHECK+slot*4)); err != nil {
+		return fmt.Errorf("write log checksum: %w", err)
 	}
-	li.file.Sync()
+	if err := li.file.Sync(); err != nil {
+		return fmt.Errorf("sync log: %w", err)
+	}
+	li.slot = slot
+	return nil
 }
 
 func (li *LoggerImpl) warpLog(data []byte) []byte {
@@ -183,56 +637,116 @@ func (li *LoggerImpl) warpLog(data []byte) []byte {
 	return append(append(size, checksum...), data...)
 }
 
-func (li *LoggerImpl) Truncate(x int64) {
+func (li *LoggerImpl) Truncate(x int64) error {
 	li.lock.Lock()
 	defer li.lock.Unlock()
 
-	li.file.Truncate(x)
+	if err := li.file.Truncate(x); err != nil {
+		return fmt.Errorf("truncate log: %w", err)
+	}
+	li.fileSize = x
+	return nil
 }
 
-func (li *LoggerImpl) internNext() []byte {
-	if li.position+OF_LOG_DATA >= li.fileSize {
-		return nil
+// readLog 读出f中position处的一条完整的日志, 日志残缺或者校验和不对时返回nil
+func readLog(f vfs.File, size int64, position int64) ([]byte, error) {
+	if position+OF_LOG_DATA >= size {
+		return nil, nil
 	}
 	tmp := make([]byte, 4)
-	_, err := li.file.ReadAt(tmp, li.position)
-	if err != nil {
-		panic(err)
+	if _, err := f.ReadAt(tmp, position); err != nil {
+		return nil, fmt.Errorf("read log: %w", err)
 	}
-	size := utils.ParseInt(tmp)
-	if li.position+int64(size)+OF_LOG_DATA > li.fileSize {
-		return nil
+	length := utils.ParseInt(tmp)
+	// 日志不会是空的, 长度为0的是崩溃时没有写入的空洞
+	if length <= 0 || position+int64(length)+OF_LOG_DATA > size {
+		return nil, nil
 	}
-	buf := make([]byte, OF_LOG_DATA+size)
-	_, err = li.file.ReadAt(buf, li.position)
-	if err != nil {
-		panic(err)
+	log := make([]byte, OF_LOG_DATA+length)
+	if _, err := f.ReadAt(log, position); err != nil {
+		return nil, fmt.Errorf("read log: %w", err)
 	}
-	log := buf
+	var li LoggerImpl
 	checkSum1 := li.calChecksum(0, log[OF_LOG_DATA:])
 	checkSum2 := utils.ParseInt(log[OF_CHECKSUM:OF_LOG_DATA])
 	if checkSum1 != checkSum2 {
-		return nil
+		return nil, nil
 	}
-	li.position += int64(len(log))
-	return log
+	return log, nil
 }
 
-func (li *LoggerImpl) Next() []byte {
+// Next 当前读的日志段读完之后接着读下一个日志段. 旧的日志段都是完整落盘的, 没有读到末尾说明日志损坏了
+func (li *LoggerImpl) Next() ([]byte, error) {
 	li.lock.Lock()
 	defer li.lock.Unlock()
 
-	log := li.internNext()
-	if log == nil {
-		return nil
+	for {
+		if li.readNo < li.segment && li.reader == nil {
+			f, size, err := li.openSegment(li.readNo)
+			if err != nil {
+				return nil, err
+			}
+			li.reader, li.readSize = f, size
+		}
+		f, size := li.file, li.fileSize
+		if li.reader != nil {
+			f, size = li.reader, li.readSize
+		}
+		position := li.position
+		log, err := readLog(f, size, position)
+		if err != nil {
+			return nil, err
+		}
+		if log != nil {
+			li.position += int64(len(log))
+			return li.open(li.readNo, position, log)
+		}
+		if li.reader == nil {
+			return nil, nil
+		}
+		if position != size {
+			return nil, fmt.Errorf("%w: log segment %d is damaged at %d", common.ErrBadLogFile, li.readNo, position)
+		}
+		li.closeReader()
+		li.readNo++
+		li.position = LEN_LOG_HEADER
+	}
+}
+
+// open 返回日志中的数据. 日志的校验和是对密文计算的, 校验通过但解密失败说明密钥不对或者日志被篡改
+func (li *LoggerImpl) open(no int64, position int64, log []byte) ([]byte, error) {
+	if li.aead == nil {
+		return log[OF_LOG_DATA:], nil
 	}
-	return log[OF_LOG_DATA:]
+	return utils.Open(li.aead, log[OF_LOG_DATA:], logAD(no, position))
+}
+
+func logAD(segment int64, position int64) []byte {
+	ad := make([]byte, 16)
+	binary.BigEndian.PutUint64(ad, uint64(segment))
+	binary.BigEndian.PutUint64(ad[8:], uint64(position))
+	return ad
 }
 
 func (li *LoggerImpl) Rewind() {
-	li.position = 4
+	li.closeReader()
+	li.readNo = li.oldest
+	li.position = LEN_LOG_HEADER
 }
 
-func (li *LoggerImpl) Close() {
-	li.file.Close()
+func (li *LoggerImpl) closeReader() {
+	if li.reader != nil {
+		li.reader.Close()
+		li.reader = nil
+	}
+}
+
+// Close 先让还没有落盘的日志落盘, 出错时仍然关闭文件
+func (li *LoggerImpl) Close() error {
+	err := li.Flush()
+	li.closeReader()
+	if closeErr := li.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
 }
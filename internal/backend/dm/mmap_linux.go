@@ -0,0 +1,66 @@
+//go:build linux
+
+package dm
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/herveyleaf/GoDB/internal/backend/vfs"
+	"github.com/herveyleaf/GoDB/pkg/common"
+)
+
+// osRegion 用mmap映射的一段文件
+type osRegion struct {
+	b []byte
+}
+
+// mapFileRegion 映射文件的一段, 只有能提供文件描述符的文件才能被映射. 只读打开的文件不能映射成可写的
+func mapFileRegion(f vfs.File, offset int64, length int, writable bool) (mmapRegion, error) {
+	fd, ok := f.(interface{ Fd() uintptr })
+	if !ok {
+		return nil, common.ErrMmapUnsupported
+	}
+	prot := syscall.PROT_READ
+	if writable {
+		prot |= syscall.PROT_WRITE
+	}
+	b, err := syscall.Mmap(int(fd.Fd()), offset, length, prot, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	return &osRegion{b: b}, nil
+}
+
+func (r *osRegion) bytes() []byte {
+	return r.b
+}
+
+func (r *osRegion) write(off int, b []byte) error {
+	copy(r.b[off:], b)
+	return nil
+}
+
+// sync 同步写回映射中被修改过的内存页, 起始地址按内存页对齐
+func (r *osRegion) sync(off int, length int) error {
+	if length == 0 {
+		return nil
+	}
+	start := off - off%os.Getpagesize()
+	b := r.b[start : off+length]
+	_, _, errno := syscall.Syscall(syscall.SYS_MSYNC, uintptr(unsafe.Pointer(&b[0])), uintptr(len(b)), syscall.MS_SYNC)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (r *osRegion) willNeed(off int, length int) {
+	start := off - off%os.Getpagesize()
+	syscall.Madvise(r.b[start:off+length], syscall.MADV_WILLNEED)
+}
+
+func (r *osRegion) unmap() error {
+	return syscall.Munmap(r.b)
+}
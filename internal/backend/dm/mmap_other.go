@@ -0,0 +1,12 @@
+//go:build !linux
+
+package dm
+
+import (
+	"github.com/herveyleaf/GoDB/internal/backend/vfs"
+	"github.com/herveyleaf/GoDB/pkg/common"
+)
+
+func mapFileRegion(f vfs.File, offset int64, length int, writable bool) (mmapRegion, error) {
+	return nil, common.ErrMmapUnsupported
+}
@@ -0,0 +1,191 @@
+package dm
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/herveyleaf/GoDB/internal/backend/utils"
+	"github.com/herveyleaf/GoDB/pkg/common"
+)
+
+const (
+	// 放不进一页的数据存放在溢出页链表中, 普通页中只保存一个描述: [Length][FirstPgno]
+	OF_STUB_LENGTH    = 0
+	OF_STUB_PGNO      = OF_STUB_LENGTH + 4
+	LEN_OVERFLOW_STUB = OF_STUB_PGNO + 4
+
+	// 溢出页: [Checksum][FSO=1][SlotCount][Next][Owner][Length][Data], Owner是描述的UID,
+	// 描述失效之后, 恢复时扫描页面会把Owner指向的不再是有效描述的溢出页放回空闲页链表
+	OVERFLOW_PAGE_MARK = 1
+	OF_OVERFLOW_NEXT   = OF_DATA
+	OF_OVERFLOW_OWNER  = OF_OVERFLOW_NEXT + 4
+	OF_OVERFLOW_LENGTH = OF_OVERFLOW_OWNER + 8
+	OF_OVERFLOW_DATA   = OF_OVERFLOW_LENGTH + 4
+)
+
+func isOverflowPage(raw []byte) bool {
+	return getFSO(raw) == OVERFLOW_PAGE_MARK
+}
+
+// overflowCapacity 一个溢出页能存放的数据长度
+func overflowCapacity(pageSize int) int {
+	return pageSize - OF_OVERFLOW_DATA
+}
+
+// overflowImage 溢出页从OF_OVERFLOW_NEXT开始的内容, 也是溢出页日志中记录的内容
+func overflowImage(next int, owner int64, data []byte) []byte {
+	image := make([]byte, OF_OVERFLOW_DATA-OF_OVERFLOW_NEXT+len(data))
+	binary.BigEndian.PutUint32(image, uint32(next))
+	binary.BigEndian.PutUint64(image[OF_OVERFLOW_OWNER-OF_OVERFLOW_NEXT:], uint64(owner))
+	binary.BigEndian.PutUint32(image[OF_OVERFLOW_LENGTH-OF_OVERFLOW_NEXT:], uint32(len(data)))
+	copy(image[OF_OVERFLOW_DATA-OF_OVERFLOW_NEXT:], data)
+	return image
+}
+
+// InitRawOverflow 用日志中记录的内容还原出整个溢出页
+func InitRawOverflow(pageSize int, image []byte) []byte {
+	raw := make([]byte, pageSize)
+	setFSO(raw, OVERFLOW_PAGE_MARK)
+	copy(raw[OF_OVERFLOW_NEXT:], image)
+	return raw
+}
+
+func getOverflowOwner(raw []byte) int64 {
+	return int64(binary.BigEndian.Uint64(raw[OF_OVERFLOW_OWNER:]))
+}
+
+// OverflowLog 溢出页日志: [LogType][XID][Pgno][Image], 重做时整页重建.
+// 事务被撤销时只需要让描述失效, 溢出页本身不用撤销
+func OverflowLog(xid int64, pgno int, image []byte) []byte {
+	logTypeRaw := []byte{LOG_TYPE_OVERFLOW}
+	xidRaw := utils.Long2Byte(xid)
+	pgnoRaw := utils.Int2Byte(pgno)
+	return append(append(append(logTypeRaw, xidRaw...), pgnoRaw...), image...)
+}
+
+func doOverflowLog(pc PageCache, log []byte) {
+	_, pgno := parseLogTarget(log)
+	pc.ResetPage(pgno, InitRawOverflow(pc.PageSize(), log[LEN_PAGE_LOG:]))
+}
+
+// insertOverflow 把数据写入新分配的溢出页, 最后才插入指向它们的描述. 描述的UID在持有它所在页面的追加锁时确定,
+// 这时先把分配页面和各个溢出页的日志一起写入并只fsync一次, 再写溢出页, 最后写描述的日志并插入描述.
+// 崩溃时没有描述的溢出页在恢复后扫描页面时被放回空闲页链表
+func (dm *DataManagerImpl) insertOverflow(xid int64, data []byte, near int) (int64, error) {
+	capacity := overflowCapacity(dm.pc.PageSize())
+	var logs [][]byte
+	pgnos := make([]int, 0, (len(data)+capacity-1)/capacity)
+	for len(pgnos) < cap(pgnos) {
+		pgno, err := dm.free.allocLogged(func(log []byte) error {
+			logs = append(logs, log)
+			return nil
+		})
+		if err != nil {
+			dm.returnOverflowPages(pgnos, false)
+			return 0, err
+		}
+		dm.fsm.set(pgno, 0)
+		pgnos = append(pgnos, pgno)
+	}
+
+	written := false
+	writeChain := func(uid int64) error {
+		images := make([][]byte, len(pgnos))
+		for i, pgno := range pgnos {
+			next := 0
+			if i+1 < len(pgnos) {
+				next = pgnos[i+1]
+			}
+			images[i] = overflowImage(next, uid, data[i*capacity:min((i+1)*capacity, len(data))])
+			logs = append(logs, OverflowLog(xid, pgno, images[i]))
+		}
+		if err := dm.logger.LogBatch(logs); err != nil {
+			return err
+		}
+		// 日志已经落盘, 之后失败时由恢复重做溢出页
+		written = true
+		for i, pgno := range pgnos {
+			pg, err := dm.pc.GetPage(pgno)
+			if err != nil {
+				return err
+			}
+			pg.BeginUpdate()
+			copy(pg.GetData(), InitRawOverflow(dm.pc.PageSize(), images[i]))
+			pg.EndUpdate()
+			pg.Release()
+		}
+		return nil
+	}
+
+	stub := make([]byte, LEN_OVERFLOW_STUB)
+	binary.BigEndian.PutUint32(stub[OF_STUB_LENGTH:], uint32(len(data)))
+	binary.BigEndian.PutUint32(stub[OF_STUB_PGNO:], uint32(pgnos[0]))
+	raw := WrapDataItemRaw(stub)
+	raw[OF_VALID] = DATAITEM_OVERFLOW
+	uid, err := dm.insertRaw(xid, raw, near, writeChain)
+	if err != nil {
+		dm.returnOverflowPages(pgnos, written)
+		return 0, err
+	}
+	return uid, nil
+}
+
+// returnOverflowPages 插入失败时归还分配的页面. 还没有写入的页面仍然是空的普通页, 放回PageIndex;
+// 已经写成溢出页的要作为空闲页放回链表, 失败时留给下次恢复后扫描页面时回收
+func (dm *DataManagerImpl) returnOverflowPages(pgnos []int, written bool) {
+	for _, pgno := range pgnos {
+		if !written {
+			dm.addPage(pgno, MaxFreeSpace(dm.pc.PageSize()))
+		} else if dm.free.free(pgno) != nil {
+			return
+		}
+	}
+}
+
+// readOverflow 沿着描述中的页号读出并拼接溢出页中的数据
+func (dm *DataManagerImpl) readOverflow(uid int64, stub []byte) ([]byte, error) {
+	length := int(binary.BigEndian.Uint32(stub[OF_STUB_LENGTH:]))
+	pgno := int(binary.BigEndian.Uint32(stub[OF_STUB_PGNO:]))
+	data := make([]byte, 0, length)
+	for len(data) < length {
+		if pgno == 0 {
+			return nil, fmt.Errorf("%w: overflow chain of %d is too short", common.ErrBadDBFile, uid)
+		}
+		pg, err := dm.pc.GetPage(pgno)
+		if err != nil {
+			return nil, err
+		}
+		raw := pg.GetData()
+		if !isOverflowPage(raw) || getOverflowOwner(raw) != uid {
+			pg.Release()
+			return nil, fmt.Errorf("%w: page %d does not belong to %d", common.ErrBadDBFile, pgno, uid)
+		}
+		n := int(binary.BigEndian.Uint32(raw[OF_OVERFLOW_LENGTH:]))
+		data = append(data, raw[OF_OVERFLOW_DATA:OF_OVERFLOW_DATA+min(n, overflowCapacity(len(raw)))]...)
+		pgno = int(binary.BigEndian.Uint32(raw[OF_OVERFLOW_NEXT:]))
+		pg.Release()
+	}
+	return data[:length], nil
+}
+
+// overflowOrphaned 溢出页的Owner已经不是有效的描述时返回true
+func (dm *DataManagerImpl) overflowOrphaned(raw []byte) bool {
+	pgno, slot := utils.UidToAddress(getOverflowOwner(raw))
+	if pgno < 2 || pgno > dm.pc.GetPageNumber() {
+		return true
+	}
+	pg, err := dm.pc.GetPage(pgno)
+	if err != nil {
+		return true
+	}
+	defer pg.Release()
+	stub := pg.GetData()
+	if isFreePage(stub) || isOverflowPage(stub) {
+		return true
+	}
+	offset, ok := itemOffset(stub, slot)
+	if !ok {
+		return true
+	}
+	return stub[offset+OF_VALID] != DATAITEM_OVERFLOW
+}
@@ -0,0 +1,72 @@
+package dm
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+
+	"github.com/herveyleaf/GoDB/internal/backend/tm"
+	"github.com/herveyleaf/GoDB/internal/backend/vfs/vfstest"
+	"github.com/herveyleaf/GoDB/pkg/common"
+)
+
+func TestOverflowItems(t *testing.T) {
+	fsys := vfstest.NewCrashFS(1)
+	tmCfg := tm.Config{FS: fsys, Locked: true}
+	cfg := Config{PageSize: MIN_PAGE_SIZE, FS: fsys}
+	tmgr, err := tm.CreateWithConfig("overflow", tmCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := CreateDMWithConfig("overflow", MIN_PAGE_SIZE*MEM_MIN_LIM, tmgr, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	large := make([]byte, 5*MIN_PAGE_SIZE+123)
+	rand.New(rand.NewSource(1)).Read(large)
+	xid, _ := tmgr.Begin()
+	uid, err := d.Insert(xid, large)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmgr.Commit(xid)
+	di, err := d.Read(uid)
+	if err != nil || di == nil || !bytes.Equal(di.Data(), large) {
+		t.Fatalf("Large item read back wrong: %v", err)
+	}
+	if err := di.Before(); !errors.Is(err, common.ErrOverflowUpdate) {
+		t.Fatalf("Expected Before on an overflow item to fail, got %v", err)
+	}
+	di.Release()
+
+	// 没有提交的大数据在恢复之后被撤销, 它的溢出页被放回空闲页链表
+	xid, _ = tmgr.Begin()
+	lost, _ := d.Insert(xid, large)
+	fsys.Crash()
+	if err := d.Close(); !errors.Is(err, vfstest.ErrPowerLoss) {
+		t.Fatalf("Expected ErrPowerLoss from Close after a crash, got %v", err)
+	}
+	tmgr.Close()
+	fsys.Restart()
+
+	if tmgr, err = tm.OpenWithConfig("overflow", tmCfg); err != nil {
+		t.Fatal(err)
+	}
+	defer tmgr.Close()
+	if d, err = OpenDMWithConfig("overflow", MIN_PAGE_SIZE*MEM_MIN_LIM, tmgr, cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if di, err = d.Read(uid); err != nil || di == nil || !bytes.Equal(di.Data(), large) {
+		t.Fatalf("Committed large item lost after recovery: %v", err)
+	}
+	di.Release()
+	if di, err = d.Read(lost); err != nil || di != nil {
+		t.Fatalf("Uncommitted large item survived recovery: %v", err)
+	}
+	if n := len(d.(*DataManagerImpl).free.pages); n < 6 {
+		t.Fatalf("Expected the orphaned overflow pages to be freed, got %d free pages", n)
+	}
+}
@@ -4,17 +4,56 @@ import (
 	"bytes"
 	"crypto/rand"
 	"encoding/binary"
+	"hash/crc32"
+	"slices"
 	"sync"
+
+	"github.com/herveyleaf/GoDB/internal/backend/utils"
+	"github.com/herveyleaf/GoDB/pkg/common"
 )
 
 const (
-	OF_VC          = 100
-	LEN_VC         = 8
-	OF_FREE        = 0
-	OF_DATA        = 2
-	MAX_FREE_SPACE = PAGE_SIZE - OF_DATA
+	// 每一页都以4字节的校验和开头, 校验范围是校验和之后的整页数据
+	OF_PAGE_CHECKSUM  = 0
+	LEN_PAGE_CHECKSUM = 4
+
+	// 第一页的文件头: [Checksum][Magic][Version][PageSize][Flags][KeyCheck]
+	// Flags和KeyCheck使用的是以前一直为0的字节, 没有加密的文件格式不变
+	DB_MAGIC          = "GoDB"
+	DB_FORMAT_VERSION = 4
+	OF_DB_MAGIC       = OF_PAGE_CHECKSUM + LEN_PAGE_CHECKSUM
+	OF_DB_VERSION     = OF_DB_MAGIC + 4
+	OF_DB_PAGE_SIZE   = OF_DB_VERSION + 2
+	OF_DB_FLAGS       = OF_DB_PAGE_SIZE + 4
+	OF_DB_KEY_CHECK   = OF_DB_FLAGS + 2
+	LEN_DB_HEADER     = OF_DB_KEY_CHECK + LEN_DB_KEY_CHECK
+
+	DB_FLAG_ENCRYPTED   = 1
+	DB_FLAG_COMPRESSED  = 2
+	LEN_KEY_CHECK_PLAIN = 16
+	LEN_DB_KEY_CHECK    = LEN_KEY_CHECK_PLAIN + utils.SEAL_OVERHEAD
+
+	OF_VC  = 100
+	LEN_VC = 8
+
+	// 空闲页链表的表头和长度记录在第一页的VC之后
+	OF_FREE_LIST_HEAD  = OF_VC + 2*LEN_VC
+	OF_FREE_LIST_COUNT = OF_FREE_LIST_HEAD + 4
+
+	// 普通页: [Checksum][FSO][SlotCount][Data]...[Slotn]...[Slot0], FSO占4个字节, 64K的页面写满时FSO等于65536, 2个字节存不下.
+	// 槽目录从页尾向前增长, 每个槽记录一个DataItem在页内的偏移, 0表示槽是空的. UID中记录的是槽号,
+	// 所以整理页面时DataItem可以在页内移动而UID不变
+	OF_FREE       = OF_PAGE_CHECKSUM + LEN_PAGE_CHECKSUM
+	OF_SLOT_COUNT = OF_FREE + 4
+	OF_DATA       = OF_SLOT_COUNT + 2
+	LEN_SLOT      = 2
+
+	// 空闲页: [Checksum][FSO=0][Next], 普通页的FSO至少是OF_DATA, 所以用0标记空闲页
+	OF_FREE_NEXT = OF_DATA
 )
 
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
 type Page interface {
 	Lock()
 	Unlock()
@@ -23,23 +62,37 @@ type Page interface {
 	IsDirty() bool
 	GetPageNumber() int
 	GetData() []byte
+	// 修改页面数据前后调用, 修改期间页面不会被刷盘
+	BeginUpdate()
+	EndUpdate()
 }
 
 type PageImpl struct {
 	pageNumber int
 	data       []byte
+	shared     bool // data是内存映射中的只读视图, 第一次修改之前换成私有的拷贝
 	dirty      bool
+	updating   int // 正在进行中的修改个数
 	lock       sync.Mutex
+	updateDone *sync.Cond
 	pc         PageCache
 }
 
 func NewPageImpl(pageNumber int, data []byte, pc PageCache) *PageImpl {
-	return &PageImpl{
+	pgi := &PageImpl{
 		pageNumber: pageNumber,
 		data:       data,
 		pc:         pc,
-		lock:       sync.Mutex{},
 	}
+	pgi.updateDone = sync.NewCond(&pgi.lock)
+	return pgi
+}
+
+// newSharedPage 页面的数据直接引用内存映射, 修改时才拷贝, 映射中的内容在写回之前不会被修改
+func newSharedPage(pageNumber int, view []byte, pc PageCache) *PageImpl {
+	pgi := NewPageImpl(pageNumber, view, pc)
+	pgi.shared = true
+	return pgi
 }
 
 func (pgi *PageImpl) Lock() {
@@ -55,31 +108,124 @@ func (pgi *PageImpl) Release() {
 }
 
 func (pgi *PageImpl) SetDirty(dirty bool) {
+	pgi.lock.Lock()
+	defer pgi.lock.Unlock()
 	pgi.dirty = dirty
 }
 
 func (pgi *PageImpl) IsDirty() bool {
+	pgi.lock.Lock()
+	defer pgi.lock.Unlock()
 	return pgi.dirty
 }
 
+// BeginUpdate 修改共享的页面之前先拷贝, 之后GetData返回拷贝. 调用方要在BeginUpdate之后重新调用GetData
+func (pgi *PageImpl) BeginUpdate() {
+	pgi.lock.Lock()
+	defer pgi.lock.Unlock()
+	if pgi.shared {
+		pgi.data = slices.Clone(pgi.data)
+		pgi.shared = false
+	}
+	pgi.updating++
+	pgi.dirty = true
+}
+
+func (pgi *PageImpl) EndUpdate() {
+	pgi.lock.Lock()
+	defer pgi.lock.Unlock()
+	pgi.updating--
+	if pgi.updating == 0 {
+		pgi.updateDone.Broadcast()
+	}
+}
+
+// snapshot 等待进行中的修改结束后拷贝一份脏页数据并清除脏标记, 页面不脏时返回nil
+func (pgi *PageImpl) snapshot() []byte {
+	pgi.lock.Lock()
+	defer pgi.lock.Unlock()
+	for pgi.updating > 0 {
+		pgi.updateDone.Wait()
+	}
+	if !pgi.dirty {
+		return nil
+	}
+	data := make([]byte, len(pgi.data))
+	copy(data, pgi.data)
+	pgi.dirty = false
+	return data
+}
+
 func (pgi *PageImpl) GetPageNumber() int {
 	return pgi.pageNumber
 }
 
 func (pgi *PageImpl) GetData() []byte {
+	pgi.lock.Lock()
+	defer pgi.lock.Unlock()
 	return pgi.data
 }
 
+// 页面校验和, 在页面写回磁盘前计算, 从磁盘读入时校验
+
+func pageChecksum(raw []byte) uint32 {
+	return crc32.Checksum(raw[OF_PAGE_CHECKSUM+LEN_PAGE_CHECKSUM:], crcTable)
+}
+
+func setPageChecksum(raw []byte) {
+	binary.BigEndian.PutUint32(raw[OF_PAGE_CHECKSUM:], pageChecksum(raw))
+}
+
+func checkPageChecksum(raw []byte) bool {
+	return binary.BigEndian.Uint32(raw[OF_PAGE_CHECKSUM:]) == pageChecksum(raw)
+}
+
 // 特殊管理第一页
 
-func InitRawO() []byte {
-	raw := make([]byte, PAGE_SIZE)
+func InitRawO(pageSize int) []byte {
+	raw := make([]byte, pageSize)
+	copy(raw[OF_DB_MAGIC:], DB_MAGIC)
+	binary.BigEndian.PutUint16(raw[OF_DB_VERSION:], DB_FORMAT_VERSION)
+	binary.BigEndian.PutUint32(raw[OF_DB_PAGE_SIZE:], uint32(pageSize))
 	setVcOpenByte(raw)
 	return raw
 }
 
+// dbHeader 第一页文件头中记录的信息
+type dbHeader struct {
+	pageSize int
+	flags    int
+	keyCheck []byte
+}
+
+// parseDBHeader 校验第一页的文件头并返回其中记录的信息
+func parseDBHeader(raw []byte) (dbHeader, error) {
+	if len(raw) < LEN_DB_HEADER || string(raw[OF_DB_MAGIC:OF_DB_MAGIC+len(DB_MAGIC)]) != DB_MAGIC {
+		return dbHeader{}, common.ErrBadDBFile
+	}
+	if binary.BigEndian.Uint16(raw[OF_DB_VERSION:]) != DB_FORMAT_VERSION {
+		return dbHeader{}, common.ErrBadDBFile
+	}
+	pageSize := int(binary.BigEndian.Uint32(raw[OF_DB_PAGE_SIZE:]))
+	if !ValidPageSize(pageSize) {
+		return dbHeader{}, common.ErrInvalidPageSize
+	}
+	return dbHeader{
+		pageSize: pageSize,
+		flags:    int(binary.BigEndian.Uint16(raw[OF_DB_FLAGS:])),
+		keyCheck: raw[OF_DB_KEY_CHECK:LEN_DB_HEADER:LEN_DB_HEADER],
+	}, nil
+}
+
+// validPageOne 第一页总是明文, 不需要密钥就能校验
+func validPageOne(raw []byte) bool {
+	h, err := parseDBHeader(raw)
+	return err == nil && len(raw) >= h.pageSize && checkPageChecksum(raw[:h.pageSize])
+}
+
 func SetVcOpenPage(pg Page) {
-	pg.SetDirty(true)
+	pg.BeginUpdate()
+	defer pg.EndUpdate()
 	setVcOpenByte(pg.GetData())
 }
 
@@ -88,7 +234,8 @@ func setVcOpenByte(raw []byte) {
 }
 
 func SetVcClosePage(pg Page) {
-	pg.SetDirty(true)
+	pg.BeginUpdate()
+	defer pg.EndUpdate()
 	setVcCloseByte(pg.GetData())
 }
 
@@ -105,46 +252,243 @@ func checkVcByte(raw []byte) bool {
 }
 
 // 管理普通页
-func InitRawX() []byte {
-	raw := make([]byte, PAGE_SIZE)
+func InitRawX(pageSize int) []byte {
+	raw := make([]byte, pageSize)
 	setFSO(raw, OF_DATA)
 	return raw
 }
 
-func setFSO(raw []byte, ofData uint) {
+// MaxFreeSpace 一个空的普通页能存放的最大的DataItem, 还要留出一个槽的位置
+func MaxFreeSpace(pageSize int) int {
+	return pageSize - OF_DATA - LEN_SLOT
+}
+
+func setFSO(raw []byte, ofData int) {
 	binary.BigEndian.PutUint32(raw[OF_FREE:], uint32(ofData))
 }
 
-func GetFSO(pg Page) int16 {
+func GetFSO(pg Page) int {
 	return getFSO(pg.GetData())
 }
 
-func getFSO(raw []byte) int16 {
-	return int16(binary.BigEndian.Uint16(raw[0:2]))
+func getFSO(raw []byte) int {
+	return int(binary.BigEndian.Uint32(raw[OF_FREE:OF_SLOT_COUNT]))
+}
+
+func getSlotCount(raw []byte) int {
+	return int(binary.BigEndian.Uint16(raw[OF_SLOT_COUNT:]))
+}
+
+func setSlotCount(raw []byte, count int) {
+	binary.BigEndian.PutUint16(raw[OF_SLOT_COUNT:], uint16(count))
+}
+
+func slotPosition(raw []byte, slot int) int {
+	return len(raw) - (slot+1)*LEN_SLOT
 }
 
-func Insert(pg Page, raw []byte) int16 {
-	pg.SetDirty(true)
-	offset := getFSO(pg.GetData())
-	copy(pg.GetData()[offset:], raw)
-	setFSO(pg.GetData(), (uint(offset) + uint(len(raw))))
+func getSlot(raw []byte, slot int) int {
+	return int(binary.BigEndian.Uint16(raw[slotPosition(raw, slot):]))
+}
+
+func setSlot(raw []byte, slot int, offset int) {
+	binary.BigEndian.PutUint16(raw[slotPosition(raw, slot):], uint16(offset))
+}
+
+// itemOffset 返回槽中记录的DataItem的偏移, 槽不存在、是空的或者指向的数据不完整时返回false
+func itemOffset(raw []byte, slot int) (int, bool) {
+	if slot >= getSlotCount(raw) {
+		return 0, false
+	}
+	offset, fso := getSlot(raw, slot), getFSO(raw)
+	if offset < OF_DATA || offset+OF_DATA_DATAITEM > fso || offset+dataItemLength(raw, offset) > fso {
+		return 0, false
+	}
+	return offset, true
+}
+
+// nextSlot 下一次插入使用的槽, 优先使用空的槽
+func nextSlot(raw []byte) int {
+	count := getSlotCount(raw)
+	for slot := 0; slot < count; slot++ {
+		if getSlot(raw, slot) == 0 {
+			return slot
+		}
+	}
+	return count
+}
+
+// contiguousSpace 不整理页面时, FSO之后能放下的最大的DataItem
+func contiguousSpace(raw []byte) int {
+	space := appendSpace(raw)
+	if nextSlot(raw) == getSlotCount(raw) {
+		space -= LEN_SLOT
+	}
+	return max(space, 0)
+}
+
+// appendSpace FSO和槽目录之间的空间, 移动已有的DataItem时不需要新的槽
+func appendSpace(raw []byte) int {
+	return slotPosition(raw, getSlotCount(raw)-1) - getFSO(raw)
+}
+
+// Insert 把raw写入FSO处, 调用方需要保证连续的空闲空间足够, 返回使用的槽号
+func Insert(pg Page, raw []byte) int {
+	pg.BeginUpdate()
+	defer pg.EndUpdate()
+	slot, _ := appendItem(pg.GetData(), raw)
+	return slot
+}
+
+// appendItem 在页面数据data上把raw写入FSO处, 返回使用的槽号和偏移
+func appendItem(data []byte, raw []byte) (int, int) {
+	slot, offset := nextSlot(data), getFSO(data)
+	copy(data[offset:], raw)
+	setFSO(data, offset+len(raw))
+	setSlot(data, slot, offset)
+	if slot == getSlotCount(data) {
+		setSlotCount(data, slot+1)
+	}
+	return slot, offset
+}
+
+// Move 把槽slot的新内容写入FSO处并让槽指向它, 原来的位置留下的空洞在整理页面时回收.
+// 调用方需要保证appendSpace足够, 返回新的偏移
+func Move(pg Page, slot int, raw []byte) int {
+	pg.BeginUpdate()
+	defer pg.EndUpdate()
+	data := pg.GetData()
+	offset := getFSO(data)
+	copy(data[offset:], raw)
+	setFSO(data, offset+len(raw))
+	setSlot(data, slot, offset)
 	return offset
 }
 
+// GetFreeSpace 整理页面之后能放下的最大的DataItem
 func GetFreeSpace(pg Page) int {
-	return PAGE_SIZE - int(getFSO(pg.GetData()))
+	return freeSpace(pg.GetData())
+}
+
+// freeSpace 已经失效的DataItem在整理时会被丢弃, 不计入占用的空间. 没有空槽时还要留出一个新槽的位置
+func freeSpace(raw []byte) int {
+	count := getSlotCount(raw)
+	used := 0
+	for slot := 0; slot < count; slot++ {
+		if offset, ok := itemOffset(raw, slot); ok && raw[offset+OF_VALID]&DATAITEM_INVALID == 0 {
+			used += dataItemLength(raw, offset)
+		}
+	}
+	space := len(raw) - OF_DATA - count*LEN_SLOT - used
+	if nextSlot(raw) == count {
+		space -= LEN_SLOT
+	}
+	return max(space, 0)
 }
 
-func RecoverInsert(pg Page, raw []byte, offset int16) {
-	pg.SetDirty(true)
-	copy(pg.GetData()[offset:], raw)
-	rawFSO := getFSO(pg.GetData())
-	if rawFSO < offset+int16(len(raw)) {
-		setFSO(pg.GetData(), (uint(offset) + uint(len(raw))))
+// compactPage 返回整理之后的页面: DataItem按槽号顺序紧密排列, 槽号不变; 失效的DataItem除了keep要求保留的
+// 都被丢弃, 它们的槽被清空, 末尾的空槽被去掉; 空闲的部分都是0
+func compactPage(raw []byte, keep func(slot int) bool) []byte {
+	page := make([]byte, len(raw))
+	count, fso := 0, OF_DATA
+	for slot := 0; slot < getSlotCount(raw); slot++ {
+		offset, ok := itemOffset(raw, slot)
+		if !ok || raw[offset+OF_VALID]&DATAITEM_INVALID != 0 && (keep == nil || !keep(slot)) {
+			continue
+		}
+		length := dataItemLength(raw, offset)
+		copy(page[fso:], raw[offset:offset+length])
+		setSlot(page, slot, fso)
+		fso += length
+		count = slot + 1
 	}
+	setSlotCount(page, count)
+	setFSO(page, fso)
+	return page
 }
 
-func RecoverUpdate(pg Page, raw []byte, offset int16) {
-	pg.SetDirty(true)
-	copy(pg.GetData()[offset:], raw)
+// pageEmpty 页面中没有有效的DataItem
+func pageEmpty(raw []byte) bool {
+	count := getSlotCount(raw)
+	for slot := 0; slot < count; slot++ {
+		if offset, ok := itemOffset(raw, slot); ok && raw[offset+OF_VALID]&DATAITEM_INVALID == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// 管理空闲页
+
+func InitRawFree(pageSize int, next int) []byte {
+	raw := make([]byte, pageSize)
+	setFreeNext(raw, next)
+	return raw
+}
+
+func isFreePage(raw []byte) bool {
+	return getFSO(raw) == 0
+}
+
+func getFreeNext(raw []byte) int {
+	return int(binary.BigEndian.Uint32(raw[OF_FREE_NEXT:]))
+}
+
+func setFreeNext(raw []byte, next int) {
+	binary.BigEndian.PutUint32(raw[OF_FREE_NEXT:], uint32(next))
+}
+
+// RecoverInsert 把raw写回日志中记录的位置, 并让槽指向它. 槽目录需要变长时, 中间新增的槽先清空,
+// 它们会由之后的日志重新设置
+func RecoverInsert(pg Page, slot int, raw []byte, offset int) {
+	pg.BeginUpdate()
+	defer pg.EndUpdate()
+	data := pg.GetData()
+	copy(data[offset:], raw)
+	if getFSO(data) < offset+len(raw) {
+		setFSO(data, offset+len(raw))
+	}
+	if count := getSlotCount(data); slot >= count {
+		for s := count; s < slot; s++ {
+			setSlot(data, s, 0)
+		}
+		setSlotCount(data, slot+1)
+	}
+	setSlot(data, slot, offset)
+}
+
+// RecoverUpdate 更新后的内容可能换了位置, 和恢复插入一样写回日志中记录的位置并让槽指向它
+func RecoverUpdate(pg Page, slot int, raw []byte, offset int) {
+	RecoverInsert(pg, slot, raw, offset)
+}
+
+// restoreItem 撤销更新时把槽slot的内容换回item, 返回新的页面. 放不下时先去掉现在的内容整理页面,
+// 再追加到FSO处, keep的含义和compactPage相同. 页面上的空间不够时返回false
+func restoreItem(raw []byte, slot int, item []byte, keep func(slot int) bool) ([]byte, bool) {
+	page := make([]byte, len(raw))
+	copy(page, raw)
+	if offset, ok := itemOffset(page, slot); ok && dataItemLength(page, offset) >= len(item) {
+		copy(page[offset:], item)
+		return page, true
+	}
+	if slot < getSlotCount(page) {
+		setSlot(page, slot, 0)
+	}
+	page = compactPage(page, keep)
+	count := getSlotCount(page)
+	need := len(item)
+	if slot >= count {
+		need += (slot - count + 1) * LEN_SLOT
+	}
+	if appendSpace(page) < need {
+		return nil, false
+	}
+	offset := getFSO(page)
+	copy(page[offset:], item)
+	setFSO(page, offset+len(item))
+	if slot >= count {
+		setSlotCount(page, slot+1)
+	}
+	setSlot(page, slot, offset)
+	return page, true
 }
@@ -1,58 +1,136 @@
 package dm
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"os"
 	"sync"
+	"sync/atomic"
 
 	"github.com/herveyleaf/GoDB/internal/backend/cache"
+	"github.com/herveyleaf/GoDB/internal/backend/vfs"
 	"github.com/herveyleaf/GoDB/pkg/common"
 )
 
 const (
-	PAGE_SIZE   = 1 << 13
-	MEM_MIN_LIM = 10
-	DB_SUFFIX   = ".db"
+	DEFAULT_PAGE_SIZE = 1 << 13
+	MIN_PAGE_SIZE     = 1 << 12
+	MAX_PAGE_SIZE     = 1 << 16
+	MEM_MIN_LIM       = 10
+	DB_SUFFIX         = ".db"
 )
 
 type PageCache interface {
-	NewPage(initData []byte) int
+	NewPage(initData []byte) (int, error)
 	GetPage(pgno int) (Page, error)
-	Close()
+	GetPageContext(ctx context.Context, pgno int) (Page, error)
+	Close() error
 	Release(page Page)
-	TruncateByPgno(maxPgno int)
+	TruncateByPgno(maxPgno int) error
 	GetPageNumber() int
-	FlushPage(pg Page)
+	PageSize() int
+	FlushPage(pg Page) error
+	FlushAll() error
+	VerifyPages() ([]int, error)
+	Prefetch(pgno int, count int)
+	// ResetPage 用initData覆盖一个无法读出的页面, 只在恢复时使用
+	ResetPage(pgno int, initData []byte)
+	// SetFlushLog 设置写回页面之前调用的函数, 用来让页面上的修改对应的日志先落盘
+	SetFlushLog(flush func() error)
 }
 
 type PageCacheImpl struct {
 	*cache.AbstractCache[Page]
-	file        *os.File
+	store       pageStore
+	codec       pageCodec
 	fileLock    sync.Mutex
 	pageNumbers int64
+	pageSize    int
+	writer      *pageWriter
+	readAhead   *readAhead
+	flushLog    func() error
 }
 
-func NewPageCacheImpl(file *os.File, maxResource int) (*PageCacheImpl, error) {
-	parent := cache.NewAbstractCache[Page](maxResource)
+func NewPageCacheImpl(store pageStore, maxResource int, codec pageCodec) (*PageCacheImpl, error) {
 	if maxResource < MEM_MIN_LIM {
+		store.close()
 		return nil, common.ErrMemTooSmall
 	}
-	fileInfo, err := file.Stat()
+
+	pc := &PageCacheImpl{
+		store:       store,
+		codec:       codec,
+		fileLock:    sync.Mutex{},
+		pageNumbers: int64(store.pages()),
+		pageSize:    codec.pageSize(),
+	}
+	pc.AbstractCache = cache.NewAbstractCache[Page](maxResource, pc)
+	pc.readAhead = newReadAhead(pc)
+	pc.writer = newPageWriter(pc, maxResource)
+	return pc, nil
+}
+
+// Create 创建数据库文件, 页面大小在创建后就不能再改变, 会被记录在第一页的文件头中
+func Create(path string, memory int64, pageSize int) (*PageCacheImpl, error) {
+	// Config中为0的页面大小表示默认值, 这里必须明确指定
+	if !ValidPageSize(pageSize) {
+		return nil, common.ErrInvalidPageSize
+	}
+	return CreateWithConfig(path, memory, Config{PageSize: pageSize})
+}
+
+// CreateWithConfig 按cfg创建数据库文件, 设置了EncryptionKey时除第一页以外的页面都会被加密,
+// 设置了Compress时除第一页以外的页面都会被压缩
+func CreateWithConfig(path string, memory int64, cfg Config) (*PageCacheImpl, error) {
+	pageSize := cfg.pageSize()
+	codec, err := newPageCodec(pageSize, cfg.EncryptionKey)
 	if err != nil {
 		return nil, err
 	}
-	length := fileInfo.Size()
+	store, err := createPageStore(vfs.Or(cfg.FS), path, codec, cfg.Compress)
+	if err != nil {
+		return nil, err
+	}
+	return NewPageCacheImpl(store, int(memory/int64(pageSize)), codec)
+}
 
-	return &PageCacheImpl{
-		AbstractCache: parent,
-		file:          file,
-		fileLock:      sync.Mutex{},
-		pageNumbers:   length / PAGE_SIZE,
-	}, nil
+// createPageStore 创建数据库文件、双写文件, 压缩时还有页面映射文件
+func createPageStore(fsys vfs.FS, path string, codec pageCodec, compress bool) (pageStore, error) {
+	f, err := createDBFile(fsys, path, codec.pageSize())
+	if err != nil {
+		return nil, err
+	}
+	dwb, err := createDoubleWrite(fsys, path, codec.slotSize())
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !compress {
+		return newSlotStore(f, dwb, codec), nil
+	}
+	pm, err := createPageMap(fsys, path)
+	if err != nil {
+		dwb.close()
+		f.Close()
+		return nil, err
+	}
+	store, err := newCompressedStore(f, dwb, codec, pm)
+	if err != nil {
+		pm.close()
+		dwb.close()
+		f.Close()
+		return nil, err
+	}
+	return store, nil
 }
 
-func Create(path string, memory int64) (*PageCacheImpl, error) {
+func createDBFile(fsys vfs.FS, path string, pageSize int) (vfs.File, error) {
+	if !ValidPageSize(pageSize) {
+		return nil, common.ErrInvalidPageSize
+	}
 	filePath := path + DB_SUFFIX
-	f, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	f, err := fsys.OpenFile(filePath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
 	if err != nil {
 		if os.IsExist(err) {
 			return nil, common.ErrFileExists
@@ -62,20 +140,74 @@ func Create(path string, memory int64) (*PageCacheImpl, error) {
 	}
 
 	if fi, err := f.Stat(); err != nil {
-		mode := fi.Mode()
-		if mode.Perm()&0400 == 0 || mode.Perm()&0200 == 0 {
-			return nil, common.ErrFileCannotRW
-		} else {
-			return nil, err
-		}
+		f.Close()
+		return nil, err
+	} else if mode := fi.Mode(); mode.Perm()&0400 == 0 || mode.Perm()&0200 == 0 {
+		f.Close()
+		return nil, common.ErrFileCannotRW
 	}
-
-	return NewPageCacheImpl(f, int(memory/PAGE_SIZE))
+	return f, nil
 }
 
+// Open 打开数据库文件, 页面大小从第一页的文件头中读取
 func Open(path string, memory int64) (*PageCacheImpl, error) {
+	return OpenWithConfig(path, memory, Config{})
+}
+
+// OpenWithConfig 按cfg打开数据库文件, 加密的数据库需要提供创建时的密钥, 是否压缩以文件头为准
+func OpenWithConfig(path string, memory int64, cfg Config) (*PageCacheImpl, error) {
+	store, codec, err := openPageStore(vfs.Or(cfg.FS), path, cfg.EncryptionKey, cfg.ReadOnly)
+	if err != nil {
+		return nil, err
+	}
+	return NewPageCacheImpl(store, int(memory/int64(codec.pageSize())), codec)
+}
+
+// openPageStore 打开数据库文件, 按文件头选择页面的存放方式. readOnly为true时以只读方式打开所有文件
+func openPageStore(fsys vfs.FS, path string, key []byte, readOnly bool) (pageStore, pageCodec, error) {
+	db, err := openDBFile(fsys, path, key, readOnly)
+	if err != nil {
+		return nil, nil, err
+	}
+	if db.header.flags&DB_FLAG_COMPRESSED == 0 {
+		return newSlotStore(db.file, db.dwb, db.codec), db.codec, nil
+	}
+	pm, err := openPageMap(fsys, path, readOnly)
+	if err != nil {
+		db.close()
+		return nil, nil, err
+	}
+	store, err := newCompressedStore(db.file, db.dwb, db.codec, pm)
+	if err != nil {
+		pm.close()
+		db.close()
+		return nil, nil, err
+	}
+	return store, db.codec, nil
+}
+
+// dbFile 打开的数据库文件和双写文件, 以及从文件头中读出的信息
+type dbFile struct {
+	file   vfs.File
+	dwb    *doubleWriteBuffer
+	codec  pageCodec
+	header dbHeader
+}
+
+func (db *dbFile) close() {
+	db.dwb.close()
+	db.file.Close()
+}
+
+// openDBFile 打开数据库文件和双写文件, 修复写了一半的页面, 并按文件头和密钥确定页面的转换方式.
+// readOnly为true时不修复页面, 有需要修复的页面时返回common.ErrReadOnly
+func openDBFile(fsys vfs.FS, path string, key []byte, readOnly bool) (*dbFile, error) {
 	filePath := path + DB_SUFFIX
-	f, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	flag := os.O_RDWR
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+	f, err := fsys.OpenFile(filePath, flag, 0666)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil, common.ErrFileNotExists
@@ -85,43 +217,112 @@ func Open(path string, memory int64) (*PageCacheImpl, error) {
 	}
 
 	if fi, err := f.Stat(); err != nil {
-		mode := fi.Mode()
-		if mode.Perm()&0400 == 0 || mode.Perm()&0200 == 0 {
-			return nil, common.ErrFileCannotRW
-		} else {
-			return nil, err
+		f.Close()
+		return nil, err
+	} else if mode := fi.Mode(); mode.Perm()&0400 == 0 || (!readOnly && mode.Perm()&0200 == 0) {
+		f.Close()
+		return nil, common.ErrFileCannotRW
+	}
+
+	dwb, err := openDoubleWrite(fsys, path, readOnly)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	db := &dbFile{file: f, dwb: dwb}
+	// 第一页的文件头也可能写了一半, 先单独用双写文件修复第一页, 读出文件头之后再修复其它页面
+	if _, err := dwb.restore(f, nil); err != nil {
+		db.close()
+		return nil, err
+	}
+	if db.codec, db.header, err = readPageCodec(f, key); err != nil {
+		db.close()
+		return nil, err
+	}
+	if _, err := dwb.restore(f, db.codec); err != nil {
+		db.close()
+		return nil, err
+	}
+	dwb.pageSize = db.codec.slotSize()
+	return db, nil
+}
+
+// readPageCodec 读出第一页的文件头, 返回对应的页面转换方式
+func readPageCodec(f io.ReaderAt, key []byte) (pageCodec, dbHeader, error) {
+	header := make([]byte, LEN_DB_HEADER)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		if err == io.EOF {
+			return nil, dbHeader{}, common.ErrBadDBFile
 		}
+		return nil, dbHeader{}, err
 	}
+	h, err := parseDBHeader(header)
+	if err != nil {
+		return nil, dbHeader{}, err
+	}
+	codec, err := openPageCodec(h, key)
+	return codec, h, err
+}
 
-	return NewPageCacheImpl(f, int(memory/PAGE_SIZE))
+// ValidPageSize 页面大小必须是4K到64K之间的2的幂
+func ValidPageSize(pageSize int) bool {
+	return pageSize >= MIN_PAGE_SIZE && pageSize <= MAX_PAGE_SIZE && pageSize&(pageSize-1) == 0
 }
 
-func (pc *PageCacheImpl) NewPage(initData []byte) int {
-	pgno := pc.pageNumbers + 1
-	pg := NewPageImpl(int(pgno), initData, nil)
-	pc.FlushPage(pg)
-	return int(pgno)
+// NewPage 在文件末尾追加一页, 新页和其它脏页一样由后台写回
+func (pc *PageCacheImpl) NewPage(initData []byte) (int, error) {
+	pgno := int(atomic.AddInt64(&pc.pageNumbers, 1))
+	if pgno == 1 {
+		pc.store.initHeader(initData)
+	}
+	pc.writer.enqueue(pgno, initData)
+	return pgno, nil
+}
+
+func (pc *PageCacheImpl) ResetPage(pgno int, initData []byte) {
+	pc.writer.enqueue(pgno, initData)
 }
 
 func (pc *PageCacheImpl) GetPage(pgno int) (Page, error) {
 	return pc.AbstractCache.Get(int64(pgno))
 }
 
+// GetPageContext 获取页面, ctx被取消或超时时放弃等待并返回ctx的错误
+func (pc *PageCacheImpl) GetPageContext(ctx context.Context, pgno int) (Page, error) {
+	return pc.AbstractCache.GetContext(ctx, int64(pgno))
+}
+
 func (pc *PageCacheImpl) GetForCache(key int64) (Page, error) {
+	return pc.GetForCacheContext(context.Background(), key)
+}
+
+func (pc *PageCacheImpl) GetForCacheContext(ctx context.Context, key int64) (Page, error) {
 	pgno := int(key)
-	offset := pageOffset(pgno)
-	data := make([]byte, PAGE_SIZE)
+	// 还没有写回的脏页以缓冲中的数据为准
+	if data := pc.writer.lookup(pgno); data != nil {
+		return NewPageImpl(pgno, data, pc), nil
+	}
+	pc.readAhead.onMiss(pgno)
+	if data := pc.readAhead.take(pgno); data != nil {
+		return NewPageImpl(pgno, data, pc), nil
+	}
 	pc.fileLock.Lock()
 	defer pc.fileLock.Unlock()
-	if _, err := pc.file.ReadAt(data, offset); err != nil {
+	// 排队等待文件锁期间调用方可能已经放弃
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	data, err := pc.store.read(pgno)
+	if err != nil {
 		return nil, err
 	}
 	return NewPageImpl(pgno, data, pc), nil
 }
 
+// ReleaseForCache 页面被驱逐时不再直接刷盘, 而是交给后台批量写回
 func (pc *PageCacheImpl) ReleaseForCache(pg Page) {
 	if pg.IsDirty() {
-		pc.FlushPage(pg)
+		pc.writer.enqueue(pg.GetPageNumber(), pg.GetData())
 		pg.SetDirty(false)
 	}
 }
@@ -130,38 +331,152 @@ func (pc *PageCacheImpl) Release(page Page) {
 	pc.AbstractCache.Release(int64(page.GetPageNumber()))
 }
 
-func (pc *PageCacheImpl) FlushPage(pg Page) {
-	pgno := pg.GetPageNumber()
-	offset := pageOffset(pgno)
+// FlushPage 强制将一页写入磁盘, 缓冲中的其它脏页会在同一批中一起写回
+func (pc *PageCacheImpl) FlushPage(pg Page) error {
+	if data := pg.(*PageImpl).snapshot(); data != nil {
+		pc.writer.enqueue(pg.GetPageNumber(), data)
+	}
+	return pc.writer.flush()
+}
+
+// FlushAll 即checkpoint, 把缓存中仍被引用的脏页和所有等待写回的脏页一起落盘
+func (pc *PageCacheImpl) FlushAll() error {
+	for _, key := range pc.AbstractCache.Keys() {
+		pg, err := pc.GetPage(int(key))
+		if err != nil {
+			return err
+		}
+		if data := pg.(*PageImpl).snapshot(); data != nil {
+			pc.writer.enqueue(int(key), data)
+		}
+		pg.Release()
+	}
+	if err := pc.writer.flush(); err != nil {
+		return err
+	}
+	return pc.writer.takeErr()
+}
+
+// Prefetch 提示之后将会访问从pgno开始的count页, 在后台提前读入
+func (pc *PageCacheImpl) Prefetch(pgno int, count int) {
+	pc.readAhead.prefetch(pgno, count)
+}
+
+// readRange 读入[start, end]范围内的页面, 跳过有未落盘新版本的页面
+func (pc *PageCacheImpl) readRange(start int, end int) map[int][]byte {
 	pc.fileLock.Lock()
 	defer pc.fileLock.Unlock()
 
-	if _, err := pc.file.WriteAt(pg.GetData(), offset); err != nil {
-		panic(err)
+	pages := pc.store.readRange(start, end)
+	for pgno := range pages {
+		// 持有文件锁时检查, 保证后台写回不会穿插在读取和检查之间
+		if pc.writer.contains(pgno) {
+			delete(pages, pgno)
+		}
 	}
+	return pages
+}
 
-	if err := pc.file.Sync(); err != nil {
-		panic(err)
+// VerifyPages 即fsck, 逐页校验磁盘上的数据并返回校验和不匹配的页号
+func (pc *PageCacheImpl) VerifyPages() ([]int, error) {
+	pc.fileLock.Lock()
+	defer pc.fileLock.Unlock()
+	return verifyPages(pc.store, pc.GetPageNumber())
+}
+
+// Fsck 离线检查数据库文件, 返回所有损坏的页号
+func Fsck(path string) ([]int, error) {
+	return FsckWithConfig(path, Config{})
+}
+
+// FsckWithConfig 离线检查cfg.FS中的数据库文件, 加密的数据库需要提供密钥. 只读打开, 不修复任何文件
+func FsckWithConfig(path string, cfg Config) ([]int, error) {
+	fsys := vfs.Or(cfg.FS)
+	f, err := fsys.OpenFile(path+DB_SUFFIX, os.O_RDONLY, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, common.ErrFileNotExists
+		}
+		return nil, err
+	}
+
+	codec, header, err := readPageCodec(f, cfg.EncryptionKey)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	var store pageStore = newSlotStore(f, nil, codec)
+	if header.flags&DB_FLAG_COMPRESSED != 0 {
+		pm, err := openPageMap(fsys, path, true)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if store, err = newCompressedStore(f, nil, codec, pm); err != nil {
+			pm.close()
+			f.Close()
+			return nil, err
+		}
+	}
+	defer store.close()
+	return verifyPages(store, store.pages())
+}
+
+func corruptedPageError(pgno int) error {
+	return fmt.Errorf("%w: page %d", common.ErrPageCorrupted, pgno)
+}
+
+func (pc *PageCacheImpl) SetFlushLog(flush func() error) {
+	pc.flushLog = flush
+}
+
+// writePages 写入一批按页号排好序的页面, 页面的快照都是在对应的日志写入之后取的, 先让这些日志落盘
+func (pc *PageCacheImpl) writePages(batch []dirtyPage) error {
+	if pc.flushLog != nil {
+		if err := pc.flushLog(); err != nil {
+			return err
+		}
 	}
+	pc.fileLock.Lock()
+	defer pc.fileLock.Unlock()
+	return pc.store.write(batch)
 }
 
-func (pc *PageCacheImpl) TruncateByPgno(maxPgno int) {
-	size := pageOffset(maxPgno + 1)
+func (pc *PageCacheImpl) TruncateByPgno(maxPgno int) error {
+	if pc.flushLog != nil {
+		if err := pc.flushLog(); err != nil {
+			return err
+		}
+	}
+	pc.writer.discardAfter(maxPgno)
+	pc.readAhead.reset()
 	pc.fileLock.Lock()
 	defer pc.fileLock.Unlock()
-	pc.file.Truncate(size)
-	pc.pageNumbers = int64(maxPgno)
+	if err := pc.store.truncate(maxPgno); err != nil {
+		return err
+	}
+	atomic.StoreInt64(&pc.pageNumbers, int64(maxPgno))
+	return nil
 }
 
-func (pc *PageCacheImpl) Close() {
+// Close 写回所有脏页并关闭文件, 写回失败时文件仍然会被关闭
+func (pc *PageCacheImpl) Close() error {
 	pc.AbstractCache.Close()
-	pc.file.Close()
+	pc.readAhead.close()
+	err := pc.writer.close()
+	pc.store.close()
+	return err
 }
 
 func (pc *PageCacheImpl) GetPageNumber() int {
-	return int(pc.pageNumbers)
+	return int(atomic.LoadInt64(&pc.pageNumbers))
+}
+
+func (pc *PageCacheImpl) PageSize() int {
+	return pc.pageSize
 }
 
-func pageOffset(pgno int) int64 {
-	return int64(pgno-1) * PAGE_SIZE
+// pageOffset 页面在固定位置存放时的文件偏移
+func (pc *PageCacheImpl) pageOffset(pgno int) int64 {
+	return int64(pgno-1) * int64(pc.codec.slotSize())
 }
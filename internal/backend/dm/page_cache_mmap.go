@@ -0,0 +1,437 @@
+package dm
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/herveyleaf/GoDB/internal/backend/cache"
+	"github.com/herveyleaf/GoDB/internal/backend/vfs"
+	"github.com/herveyleaf/GoDB/pkg/common"
+)
+
+const (
+	// 每段映射的大小, 文件增长时只映射新的段, 已经交出去的页面切片在关闭前始终有效
+	MMAP_CHUNK_SIZE = 1 << 26
+)
+
+// MmapPageCacheImpl 通过内存映射访问数据库文件, 读入页面时直接交出映射中的切片, 没有拷贝也没有系统调用,
+// 只校验页面的校验和. 内核可能在msync之前的任意时刻把映射中的修改写回文件, 所以映射只用来读:
+// 页面第一次修改时在BeginUpdate中换成私有的拷贝, 修改都在拷贝上进行, 只有等页面上的修改都写完日志之后才写回,
+// 和普通的页面缓存写回时一样遵守先写日志的规则. 写回的页面先攒成一批写入双写文件并fsync, 之后才拷回映射并msync,
+// 所以内核写了一半的页面可以在打开时用双写文件修复, 不需要保留旧的日志段
+type MmapPageCacheImpl struct {
+	*cache.AbstractCache[Page]
+	file        vfs.File
+	dwb         *doubleWriteBuffer // 只读打开时为nil
+	lock        sync.Mutex         // 保护chunks、pending和err, 以及文件大小的变化
+	chunks      []mmapRegion
+	pending     map[int][]byte // 等待经过双写文件拷回映射的页面
+	err         error          // 写回时遇到的第一个错误, 在下一次刷盘时返回
+	pageNumbers int64
+	pageSize    int
+	readOnly    bool // 只读打开时文件没有写权限, 只能映射成只读的
+	flushLog    func() error
+}
+
+// mmapRegion 数据库文件中被映射的一段
+type mmapRegion interface {
+	// bytes 返回映射的内容, 只用来读, 修改必须通过write
+	bytes() []byte
+	write(off int, b []byte) error
+	// sync 同步写回[off, off+length)中被修改过的部分
+	sync(off int, length int) error
+	willNeed(off int, length int)
+	unmap() error
+}
+
+// mapRegion 映射文件的一段, 测试中替换成不依赖文件描述符的实现
+var mapRegion = mapFileRegion
+
+func NewMmapPageCacheImpl(file vfs.File, dwb *doubleWriteBuffer, maxResource int, pageSize int) (*MmapPageCacheImpl, error) {
+	return newMmapPageCache(file, dwb, maxResource, pageSize, false)
+}
+
+func newMmapPageCache(file vfs.File, dwb *doubleWriteBuffer, maxResource int, pageSize int, readOnly bool) (*MmapPageCacheImpl, error) {
+	if maxResource < MEM_MIN_LIM {
+		return nil, common.ErrMemTooSmall
+	}
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	pc := &MmapPageCacheImpl{
+		file:        file,
+		dwb:         dwb,
+		pending:     make(map[int][]byte),
+		pageNumbers: fileInfo.Size() / int64(pageSize),
+		pageSize:    pageSize,
+		readOnly:    readOnly,
+	}
+	if pc.pageNumbers > 0 {
+		if err := pc.mapUpTo(int(pc.pageNumbers)); err != nil {
+			pc.unmapAll()
+			return nil, err
+		}
+	}
+	pc.AbstractCache = cache.NewAbstractCache[Page](maxResource, pc)
+	return pc, nil
+}
+
+// CreateMmap 创建数据库文件并以内存映射的方式访问, 文件系统必须能提供文件描述符.
+// 映射中的页面就是磁盘上的数据, 所以不能和加密或者压缩一起使用
+func CreateMmap(path string, memory int64, cfg Config) (*MmapPageCacheImpl, error) {
+	if cfg.EncryptionKey != nil {
+		return nil, fmt.Errorf("%w: database is encrypted", common.ErrMmapIncompatible)
+	}
+	if cfg.Compress {
+		return nil, fmt.Errorf("%w: database is compressed", common.ErrMmapIncompatible)
+	}
+	pageSize := cfg.pageSize()
+	f, err := createDBFile(vfs.Or(cfg.FS), path, pageSize)
+	if err != nil {
+		return nil, err
+	}
+	dwb, err := createDoubleWrite(vfs.Or(cfg.FS), path, pageSize)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	pc, err := NewMmapPageCacheImpl(f, dwb, int(memory/int64(pageSize)), pageSize)
+	if err != nil {
+		dwb.close()
+		f.Close()
+		return nil, err
+	}
+	return pc, nil
+}
+
+// OpenMmap 以内存映射的方式打开数据库文件, 加密的数据库会在校验文件头时被拒绝
+func OpenMmap(path string, memory int64, cfg Config) (*MmapPageCacheImpl, error) {
+	if cfg.EncryptionKey != nil {
+		return nil, fmt.Errorf("%w: database is encrypted", common.ErrMmapIncompatible)
+	}
+	db, err := openDBFile(vfs.Or(cfg.FS), path, nil, cfg.ReadOnly)
+	if err != nil {
+		return nil, err
+	}
+	if db.header.flags&DB_FLAG_COMPRESSED != 0 {
+		db.close()
+		return nil, fmt.Errorf("%w: database is compressed", common.ErrMmapIncompatible)
+	}
+	// 写了一半的页面已经在openDBFile中用双写文件修复, 只读时不写双写文件
+	dwb := db.dwb
+	if cfg.ReadOnly {
+		dwb.close()
+		dwb = nil
+	}
+	pageSize := db.codec.pageSize()
+	pc, err := newMmapPageCache(db.file, dwb, int(memory/int64(pageSize)), pageSize, cfg.ReadOnly)
+	if err != nil {
+		db.close()
+		return nil, err
+	}
+	return pc, nil
+}
+
+// NewPage 把文件扩展一页, 初始数据和其它写回的页面一样经过双写文件拷回映射
+func (pc *MmapPageCacheImpl) NewPage(initData []byte) (int, error) {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+
+	pgno := pc.GetPageNumber() + 1
+	if err := pc.file.Truncate(pc.pageOffset(pgno + 1)); err != nil {
+		return 0, err
+	}
+	if err := pc.mapUpTo(pgno); err != nil {
+		return 0, err
+	}
+	if err := pc.writeBack(pgno, pc.initPage(initData)); err != nil {
+		return 0, err
+	}
+	atomic.StoreInt64(&pc.pageNumbers, int64(pgno))
+	return pgno, nil
+}
+
+func (pc *MmapPageCacheImpl) ResetPage(pgno int, initData []byte) {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	pc.writeBack(pgno, pc.initPage(initData))
+}
+
+// initPage 返回用initData填充的一整页
+func (pc *MmapPageCacheImpl) initPage(initData []byte) []byte {
+	data := make([]byte, pc.pageSize)
+	copy(data, initData)
+	return data
+}
+
+// writeBack 接管data, 计算校验和之后等待写回, 攒满双写文件的一批时立即写回. 调用方需要持有lock
+func (pc *MmapPageCacheImpl) writeBack(pgno int, data []byte) error {
+	setPageChecksum(data)
+	pc.pending[pgno] = data
+	if len(pc.pending) < DWB_MAX_PAGES {
+		return nil
+	}
+	if err := pc.flushPending(); err != nil {
+		if pc.err == nil {
+			pc.err = err
+		}
+		return err
+	}
+	return nil
+}
+
+// flushPending 等待写回的页面先写入双写文件并fsync, 再拷回映射, 按段msync之后才能被下一批覆盖.
+// 失败时页面留在pending中, 调用方需要持有lock
+func (pc *MmapPageCacheImpl) flushPending() error {
+	if len(pc.pending) == 0 {
+		return nil
+	}
+	batch := make([]dirtyPage, 0, len(pc.pending))
+	for pgno, data := range pc.pending {
+		batch = append(batch, dirtyPage{pgno: pgno, data: data})
+	}
+	sort.Slice(batch, func(i, j int) bool {
+		return batch[i].pgno < batch[j].pgno
+	})
+	if err := pc.dwb.write(batch); err != nil {
+		return err
+	}
+	for _, dp := range batch {
+		start := int(pc.pageOffset(dp.pgno) % MMAP_CHUNK_SIZE)
+		if err := pc.chunks[pc.chunkIndex(dp.pgno)].write(start, dp.data); err != nil {
+			return err
+		}
+	}
+	// 同一段内从第一页到最后一页只msync一次, 内核只会写回其中真正被修改的内存页
+	for i := 0; i < len(batch); {
+		j := i
+		for j+1 < len(batch) && pc.chunkIndex(batch[j+1].pgno) == pc.chunkIndex(batch[i].pgno) {
+			j++
+		}
+		start, length := pc.span(batch[i].pgno, batch[j].pgno-batch[i].pgno+1)
+		if err := pc.chunks[pc.chunkIndex(batch[i].pgno)].sync(start, length); err != nil {
+			return err
+		}
+		i = j + 1
+	}
+	pc.pending = make(map[int][]byte)
+	return nil
+}
+
+// writeBackPage 页面上进行中的修改都写完日志之后才拷回映射, 页面不脏时什么都不做.
+// 拷回之前先让日志落盘, 失败时不拷回, 错误在下一次刷盘时返回
+func (pc *MmapPageCacheImpl) writeBackPage(pg Page) {
+	data := pg.(*PageImpl).snapshot()
+	if data == nil {
+		return
+	}
+	var err error
+	if pc.flushLog != nil {
+		err = pc.flushLog()
+	}
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	if err != nil {
+		if pc.err == nil {
+			pc.err = err
+		}
+		return
+	}
+	pc.writeBack(pg.GetPageNumber(), data)
+}
+
+func (pc *MmapPageCacheImpl) SetFlushLog(flush func() error) {
+	pc.flushLog = flush
+}
+
+func (pc *MmapPageCacheImpl) GetPage(pgno int) (Page, error) {
+	return pc.AbstractCache.Get(int64(pgno))
+}
+
+func (pc *MmapPageCacheImpl) GetPageContext(ctx context.Context, pgno int) (Page, error) {
+	return pc.AbstractCache.GetContext(ctx, int64(pgno))
+}
+
+func (pc *MmapPageCacheImpl) GetForCache(key int64) (Page, error) {
+	pgno := int(key)
+	if pgno < 1 || pgno > pc.GetPageNumber() {
+		return nil, io.EOF
+	}
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	// 还没有拷回映射的页面交出一份拷贝
+	if data, ok := pc.pending[pgno]; ok {
+		return NewPageImpl(pgno, slices.Clone(data), pc), nil
+	}
+	// 崩溃前还没有写回过的页面全是0, 撕裂的页面校验和不匹配
+	data := pc.pageData(pgno)
+	if !checkPageChecksum(data) {
+		return nil, corruptedPageError(pgno)
+	}
+	return newSharedPage(pgno, data, pc), nil
+}
+
+// ReleaseForCache 被驱逐的脏页等待写回
+func (pc *MmapPageCacheImpl) ReleaseForCache(pg Page) {
+	pc.writeBackPage(pg)
+}
+
+func (pc *MmapPageCacheImpl) Release(page Page) {
+	pc.AbstractCache.Release(int64(page.GetPageNumber()))
+}
+
+// FlushPage 强制将一页写入磁盘, 其它等待写回的页面也会一起写回
+func (pc *MmapPageCacheImpl) FlushPage(pg Page) error {
+	pc.writeBackPage(pg)
+	return pc.syncDirty()
+}
+
+// FlushAll 把缓存中所有脏页和等待写回的页面写入磁盘
+func (pc *MmapPageCacheImpl) FlushAll() error {
+	for _, key := range pc.AbstractCache.Keys() {
+		pg, err := pc.GetPage(int(key))
+		if err != nil {
+			return err
+		}
+		pc.writeBackPage(pg)
+		pg.Release()
+	}
+	return pc.syncDirty()
+}
+
+// syncDirty 写回所有等待写回的页面
+func (pc *MmapPageCacheImpl) syncDirty() error {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+
+	if pc.err != nil {
+		return pc.err
+	}
+	return pc.flushPending()
+}
+
+// Prefetch 提示内核提前读入从pgno开始的count页
+func (pc *MmapPageCacheImpl) Prefetch(pgno int, count int) {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+
+	end := min(pgno+count-1, pc.GetPageNumber())
+	for pgno <= end {
+		last := pgno
+		for last+1 <= end && pc.chunkIndex(last+1) == pc.chunkIndex(pgno) {
+			last++
+		}
+		start, length := pc.span(pgno, last-pgno+1)
+		pc.chunks[pc.chunkIndex(pgno)].willNeed(start, length)
+		pgno = last + 1
+	}
+}
+
+// VerifyPages 先把映射中的修改连同校验和落盘, 再逐页校验磁盘上的数据
+func (pc *MmapPageCacheImpl) VerifyPages() ([]int, error) {
+	if err := pc.FlushAll(); err != nil {
+		return nil, err
+	}
+	return verifyPages(newSlotStore(pc.file, nil, plainCodec{size: pc.pageSize}), pc.GetPageNumber())
+}
+
+func (pc *MmapPageCacheImpl) TruncateByPgno(maxPgno int) error {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+
+	for pgno := range pc.pending {
+		if pgno > maxPgno {
+			delete(pc.pending, pgno)
+		}
+	}
+	size := pc.pageOffset(maxPgno + 1)
+	// 完全落在新文件末尾之后的段不再需要, 访问它们会触发SIGBUS
+	for len(pc.chunks) > 0 && int64(len(pc.chunks)-1)*MMAP_CHUNK_SIZE >= size {
+		last := len(pc.chunks) - 1
+		if err := pc.chunks[last].unmap(); err != nil {
+			return err
+		}
+		pc.chunks = pc.chunks[:last]
+	}
+	if err := pc.file.Truncate(size); err != nil {
+		return err
+	}
+	atomic.StoreInt64(&pc.pageNumbers, int64(maxPgno))
+	return nil
+}
+
+func (pc *MmapPageCacheImpl) Close() error {
+	pc.AbstractCache.Close()
+	err := pc.syncDirty()
+	pc.lock.Lock()
+	if unmapErr := pc.unmapAll(); err == nil {
+		err = unmapErr
+	}
+	pc.lock.Unlock()
+	if pc.dwb != nil {
+		pc.dwb.close()
+	}
+	if closeErr := pc.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (pc *MmapPageCacheImpl) GetPageNumber() int {
+	return int(atomic.LoadInt64(&pc.pageNumbers))
+}
+
+func (pc *MmapPageCacheImpl) PageSize() int {
+	return pc.pageSize
+}
+
+func (pc *MmapPageCacheImpl) pageOffset(pgno int) int64 {
+	return int64(pgno-1) * int64(pc.pageSize)
+}
+
+func (pc *MmapPageCacheImpl) chunkIndex(pgno int) int {
+	return int(pc.pageOffset(pgno) / MMAP_CHUNK_SIZE)
+}
+
+// mapUpTo 保证前pgno页都已经被映射, 调用方需要持有lock
+func (pc *MmapPageCacheImpl) mapUpTo(pgno int) error {
+	for len(pc.chunks) <= pc.chunkIndex(pgno) {
+		chunk, err := mapRegion(pc.file, int64(len(pc.chunks))*MMAP_CHUNK_SIZE, MMAP_CHUNK_SIZE, !pc.readOnly)
+		if err != nil {
+			return err
+		}
+		pc.chunks = append(pc.chunks, chunk)
+	}
+	return nil
+}
+
+// pageData 返回页面在映射中的切片, 只用来读, 调用方需要持有lock
+func (pc *MmapPageCacheImpl) pageData(pgno int) []byte {
+	start := int(pc.pageOffset(pgno) % MMAP_CHUNK_SIZE)
+	end := start + pc.pageSize
+	return pc.chunks[pc.chunkIndex(pgno)].bytes()[start:end:end]
+}
+
+// span 返回同一段内从pgno开始的count页在段中的位置和长度
+func (pc *MmapPageCacheImpl) span(pgno int, count int) (int, int) {
+	start := int(pc.pageOffset(pgno) % MMAP_CHUNK_SIZE)
+	return start, count * pc.pageSize
+}
+
+func (pc *MmapPageCacheImpl) unmapAll() error {
+	var firstErr error
+	for _, chunk := range pc.chunks {
+		if err := chunk.unmap(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	pc.chunks = nil
+	return firstErr
+}
@@ -0,0 +1,537 @@
+package dm
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/herveyleaf/GoDB/internal/backend/vfs"
+	"github.com/herveyleaf/GoDB/pkg/common"
+)
+
+func newTestPageCache(t *testing.T) (*PageCacheImpl, string) {
+	return newTestPageCacheWithSize(t, DEFAULT_PAGE_SIZE)
+}
+
+// 创建一个只有第一页的页面缓存
+func newTestPageCacheWithSize(t *testing.T, pageSize int) (*PageCacheImpl, string) {
+	dir, err := os.MkdirTemp("", "dm_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "test")
+	pc, err := Create(path, int64(pageSize*MEM_MIN_LIM), pageSize)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	pc.NewPage(InitRawO(pageSize))
+	return pc, path
+}
+
+func fillPage(pc PageCache, pgno int, b byte) {
+	pg, err := pc.GetPage(pgno)
+	if err != nil {
+		panic(err)
+	}
+	pg.BeginUpdate()
+	for i := OF_DATA; i < 64; i++ {
+		pg.GetData()[i] = b
+	}
+	pg.EndUpdate()
+	pg.Release()
+}
+
+func TestDirtyPagesReadBackBeforeFlush(t *testing.T) {
+	pc, _ := newTestPageCache(t)
+	defer pc.Close()
+
+	pgno, _ := pc.NewPage(InitRawX(DEFAULT_PAGE_SIZE))
+	fillPage(pc, pgno, 0x5a)
+
+	// 脏页还在缓冲中时, 重新获取到的必须是最新的数据
+	pg, err := pc.GetPage(pgno)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pg.Release()
+	if pg.GetData()[OF_DATA] != 0x5a {
+		t.Fatal("Released dirty page was not read back from the write buffer")
+	}
+}
+
+func TestFlushAllPersistsPages(t *testing.T) {
+	pc, path := newTestPageCache(t)
+
+	var pgnos []int
+	for i := 0; i < 3*DIRTY_BATCH_SIZE; i++ {
+		pgno, _ := pc.NewPage(InitRawX(DEFAULT_PAGE_SIZE))
+		pgnos = append(pgnos, pgno)
+	}
+	for i, pgno := range pgnos {
+		fillPage(pc, pgno, byte(i))
+	}
+
+	// 仍被引用的脏页也要写回
+	pinned, _ := pc.GetPage(pgnos[0])
+	pinned.BeginUpdate()
+	pinned.GetData()[OF_DATA] = 0xff
+	pinned.EndUpdate()
+
+	if err := pc.FlushAll(); err != nil {
+		t.Fatalf("FlushAll failed: %v", err)
+	}
+	if pinned.IsDirty() {
+		t.Fatal("Checkpointed page should be clean")
+	}
+
+	raw, err := os.ReadFile(path + DB_SUFFIX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(raw) != (len(pgnos)+1)*DEFAULT_PAGE_SIZE {
+		t.Fatalf("Expected %d pages on disk, got %d bytes", len(pgnos)+1, len(raw))
+	}
+	if raw[pc.pageOffset(pgnos[0])+OF_DATA] != 0xff {
+		t.Fatal("Pinned dirty page was not flushed")
+	}
+	for i, pgno := range pgnos[1:] {
+		page := raw[pc.pageOffset(pgno) : pc.pageOffset(pgno)+DEFAULT_PAGE_SIZE]
+		if !bytes.Equal(page[OF_DATA:64], bytes.Repeat([]byte{byte(i + 1)}, 64-OF_DATA)) {
+			t.Fatalf("Page %d has wrong content on disk", pgno)
+		}
+	}
+	pinned.Release()
+	pc.Close()
+
+	// 重新打开后数据仍然存在
+	pc2, err := Open(path, DEFAULT_PAGE_SIZE*MEM_MIN_LIM)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer pc2.Close()
+	if pc2.GetPageNumber() != len(pgnos)+1 {
+		t.Fatalf("Expected %d pages, got %d", len(pgnos)+1, pc2.GetPageNumber())
+	}
+}
+
+func TestSequentialReadAhead(t *testing.T) {
+	pc, path := newTestPageCache(t)
+	const n = 3 * READ_AHEAD_PAGES
+	for i := 2; i <= n; i++ {
+		pgno, _ := pc.NewPage(InitRawX(DEFAULT_PAGE_SIZE))
+		fillPage(pc, pgno, byte(pgno))
+	}
+	pc.Close()
+
+	pc, err := Open(path, DEFAULT_PAGE_SIZE*MEM_MIN_LIM)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer pc.Close()
+
+	for pgno := 1; pgno <= READ_AHEAD_TRIGGER+1; pgno++ {
+		pg, err := pc.GetPage(pgno)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pg.Release()
+	}
+	pc.readAhead.wg.Wait()
+	if pc.readAhead.take(READ_AHEAD_TRIGGER+2) == nil {
+		t.Fatal("Sequential access did not trigger read-ahead")
+	}
+
+	// 剩下的页面顺序读取, 数据必须正确
+	for pgno := READ_AHEAD_TRIGGER + 2; pgno <= n; pgno++ {
+		pg, err := pc.GetPage(pgno)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pg.GetData()[OF_DATA] != byte(pgno) {
+			t.Fatalf("Page %d has wrong content", pgno)
+		}
+		pg.Release()
+	}
+}
+
+func TestReadAheadSkipsBufferedWrites(t *testing.T) {
+	pc, _ := newTestPageCache(t)
+	defer pc.Close()
+	for i := 1; i < 20; i++ {
+		pc.NewPage(InitRawX(DEFAULT_PAGE_SIZE))
+	}
+	if err := pc.FlushAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 第12页的新版本还在写缓冲中, 预读不能读到磁盘上的旧版本
+	fillPage(pc, 12, 0x77)
+	pc.Prefetch(10, 5)
+	pc.readAhead.wg.Wait()
+	if err := pc.FlushAll(); err != nil {
+		t.Fatal(err)
+	}
+	pg, err := pc.GetPage(12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pg.Release()
+	if pg.GetData()[OF_DATA] != 0x77 {
+		t.Fatal("Read-ahead returned a stale page")
+	}
+}
+
+func TestPageSizeIsPersisted(t *testing.T) {
+	pageSize := 1 << 14
+	pc, path := newTestPageCacheWithSize(t, pageSize)
+	pgno, _ := pc.NewPage(InitRawX(pageSize))
+	pc.Close()
+
+	pc, err := Open(path, int64(pageSize*MEM_MIN_LIM))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer pc.Close()
+	if pc.PageSize() != pageSize {
+		t.Fatalf("Expected page size %d, got %d", pageSize, pc.PageSize())
+	}
+	pg, err := pc.GetPage(pgno)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pg.Release()
+	if len(pg.GetData()) != pageSize || GetFreeSpace(pg) != MaxFreeSpace(pageSize) {
+		t.Fatal("Reopened page does not use the stored page size")
+	}
+}
+
+func TestInvalidPageSize(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "dm_test")
+	defer os.RemoveAll(dir)
+	for _, size := range []int{0, 1 << 11, 5000, 1 << 17} {
+		if _, err := Create(filepath.Join(dir, "bad"), 1<<20, size); err != common.ErrInvalidPageSize {
+			t.Fatalf("Expected ErrInvalidPageSize for %d, got %v", size, err)
+		}
+	}
+}
+
+func TestCorruptedPageIsDetected(t *testing.T) {
+	pc, path := newTestPageCache(t)
+	var pgnos []int
+	for i := 0; i < 4; i++ {
+		pgno, _ := pc.NewPage(InitRawX(DEFAULT_PAGE_SIZE))
+		fillPage(pc, pgno, 0x11)
+		pgnos = append(pgnos, pgno)
+	}
+	pc.Close()
+
+	// 模拟磁盘上的位翻转, 去掉双写文件, 否则损坏的页会在打开时被恢复
+	os.Remove(path + DWB_SUFFIX)
+	f, err := os.OpenFile(path+DB_SUFFIX, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := pgnos[2]
+	if _, err := f.WriteAt([]byte{0xee}, int64(bad-1)*DEFAULT_PAGE_SIZE+100); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	corrupted, err := Fsck(path)
+	if err != nil {
+		t.Fatalf("Fsck failed: %v", err)
+	}
+	if len(corrupted) != 1 || corrupted[0] != bad {
+		t.Fatalf("Expected page %d to be reported, got %v", bad, corrupted)
+	}
+
+	pc, err = Open(path, DEFAULT_PAGE_SIZE*MEM_MIN_LIM)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer pc.Close()
+	if _, err := pc.GetPage(bad); !errors.Is(err, common.ErrPageCorrupted) {
+		t.Fatalf("Expected ErrPageCorrupted, got %v", err)
+	}
+	if pg, err := pc.GetPage(pgnos[1]); err != nil {
+		t.Fatalf("Intact page failed to load: %v", err)
+	} else {
+		pg.Release()
+	}
+	if corrupted, _ := pc.VerifyPages(); len(corrupted) != 1 || corrupted[0] != bad {
+		t.Fatalf("VerifyPages reported %v", corrupted)
+	}
+}
+
+func TestTornPageRestoredFromDoubleWrite(t *testing.T) {
+	pc, path := newTestPageCache(t)
+	var pgnos []int
+	for i := 0; i < 3; i++ {
+		pgno, _ := pc.NewPage(InitRawX(DEFAULT_PAGE_SIZE))
+		pgnos = append(pgnos, pgno)
+	}
+	if err := pc.FlushAll(); err != nil {
+		t.Fatal(err)
+	}
+	// 最后一批只包含这一页, 它会留在双写文件中
+	torn := pgnos[1]
+	fillPage(pc, torn, 0x42)
+	if err := pc.FlushAll(); err != nil {
+		t.Fatal(err)
+	}
+	pc.Close()
+
+	// 模拟原地写入只完成了前半页
+	f, err := os.OpenFile(path+DB_SUFFIX, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	half := bytes.Repeat([]byte{0xff}, DEFAULT_PAGE_SIZE/2)
+	if _, err := f.WriteAt(half, int64(torn)*DEFAULT_PAGE_SIZE-int64(len(half))); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if corrupted, _ := Fsck(path); len(corrupted) != 1 || corrupted[0] != torn {
+		t.Fatalf("Expected torn page %d, got %v", torn, corrupted)
+	}
+
+	pc, err = Open(path, DEFAULT_PAGE_SIZE*MEM_MIN_LIM)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer pc.Close()
+	pg, err := pc.GetPage(torn)
+	if err != nil {
+		t.Fatalf("Torn page was not restored: %v", err)
+	}
+	defer pg.Release()
+	if pg.GetData()[OF_DATA] != 0x42 {
+		t.Fatal("Restored page has wrong content")
+	}
+}
+
+func TestMmapBackend(t *testing.T) {
+	pc, path := newTestPageCache(t)
+	pgno, _ := pc.NewPage(InitRawX(DEFAULT_PAGE_SIZE))
+	fillPage(pc, pgno, 0x31)
+	pc.Close()
+
+	mpc, err := OpenMmap(path, DEFAULT_PAGE_SIZE*MEM_MIN_LIM, Config{})
+	if errors.Is(err, common.ErrMmapUnsupported) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatalf("OpenMmap failed: %v", err)
+	}
+	pg, err := mpc.GetPage(pgno)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pg.GetData()[OF_DATA] != 0x31 {
+		t.Fatal("Mapped page has wrong content")
+	}
+	// 读入的页面直接引用映射, 修改时才拷贝, 进行中的修改还没有写日志, 不能出现在映射中
+	mpc.lock.Lock()
+	view := mpc.pageData(pgno)
+	mpc.lock.Unlock()
+	if &pg.GetData()[0] != &view[0] {
+		t.Fatal("Page was copied out of the mapping")
+	}
+	pg.BeginUpdate()
+	pg.GetData()[OF_DATA] = 0x30
+	if &pg.GetData()[0] == &view[0] || view[OF_DATA] != 0x31 {
+		t.Fatal("Unlogged change reached the mapping")
+	}
+	pg.EndUpdate()
+	pg.Release()
+	fillPage(mpc, pgno, 0x32)
+	newPgno, _ := mpc.NewPage(InitRawX(DEFAULT_PAGE_SIZE))
+	fillPage(mpc, newPgno, 0x33)
+
+	// 修改在刷盘时拷回映射, 之后文件中就是新的内容和校验和
+	pg, _ = mpc.GetPage(pgno)
+	mpc.FlushPage(pg)
+	pg.Release()
+	if corrupted, err := mpc.VerifyPages(); err != nil || len(corrupted) != 0 {
+		t.Fatalf("VerifyPages reported %v, %v", corrupted, err)
+	}
+	raw, err := os.ReadFile(path + DB_SUFFIX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw[mpc.pageOffset(pgno)+OF_DATA] != 0x32 || raw[mpc.pageOffset(newPgno)+OF_DATA] != 0x33 {
+		t.Fatal("Mapped writes did not reach the file")
+	}
+	mpc.Close()
+
+	// 写回时经过双写文件, 内核写了一半的页面在打开时被修复
+	corrupt := func() {
+		raw, err := os.ReadFile(path + DB_SUFFIX)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw[mpc.pageOffset(pgno)+OF_DATA] ^= 0xff
+		if err := os.WriteFile(path+DB_SUFFIX, raw, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	corrupt()
+	if mpc, err = OpenMmap(path, DEFAULT_PAGE_SIZE*MEM_MIN_LIM, Config{}); err != nil {
+		t.Fatal(err)
+	}
+	if pg, err = mpc.GetPage(pgno); err != nil || pg.GetData()[OF_DATA] != 0x32 {
+		t.Fatalf("Torn page was not restored from the double-write file: %v", err)
+	}
+	pg.Release()
+	mpc.Close()
+
+	// 双写文件中也没有副本时, 读入页面和普通的文件访问方式一样校验
+	corrupt()
+	if err := os.Remove(path + DWB_SUFFIX); err != nil {
+		t.Fatal(err)
+	}
+	if mpc, err = OpenMmap(path, DEFAULT_PAGE_SIZE*MEM_MIN_LIM, Config{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mpc.GetPage(pgno); !errors.Is(err, common.ErrPageCorrupted) {
+		t.Fatalf("Expected ErrPageCorrupted, got %v", err)
+	}
+	mpc.Close()
+
+	// 换回普通的文件访问方式仍然能读到
+	pc, err = Open(path, DEFAULT_PAGE_SIZE*MEM_MIN_LIM)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer pc.Close()
+	if pc.GetPageNumber() != newPgno {
+		t.Fatalf("Expected %d pages, got %d", newPgno, pc.GetPageNumber())
+	}
+	pg, err = pc.GetPage(newPgno)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pg.Release()
+	if pg.GetData()[OF_DATA] != 0x33 {
+		t.Fatal("Page written through the mapping has wrong content")
+	}
+}
+
+// fileRegion 不依赖文件描述符的映射, 用来在CrashFS上测试内存映射的方式.
+// 拷回映射的页面立即写入文件但不fsync, 相当于内核随时可能把修改写回
+type fileRegion struct {
+	f   vfs.File
+	off int64
+	b   []byte
+}
+
+func mapTestRegion(f vfs.File, offset int64, length int, writable bool) (mmapRegion, error) {
+	b := make([]byte, length)
+	if _, err := f.ReadAt(b, offset); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return &fileRegion{f: f, off: offset, b: b}, nil
+}
+
+func (r *fileRegion) bytes() []byte { return r.b }
+
+func (r *fileRegion) write(off int, b []byte) error {
+	copy(r.b[off:], b)
+	_, err := r.f.WriteAt(b, r.off+int64(off))
+	return err
+}
+
+func (r *fileRegion) sync(off int, length int) error { return r.f.Sync() }
+func (r *fileRegion) willNeed(off int, length int)   {}
+func (r *fileRegion) unmap() error                   { return nil }
+
+func TestPageCacheOnMemFS(t *testing.T) {
+	fsys := vfs.NewMemFS()
+	pc, err := CreateWithConfig("test", DEFAULT_PAGE_SIZE*MEM_MIN_LIM, Config{FS: fsys})
+	if err != nil {
+		t.Fatalf("CreateWithConfig failed: %v", err)
+	}
+	pc.NewPage(InitRawO(DEFAULT_PAGE_SIZE))
+	pgno, _ := pc.NewPage(InitRawX(DEFAULT_PAGE_SIZE))
+	fillPage(pc, pgno, 0x66)
+	pc.Close()
+
+	pc, err = OpenWithConfig("test", DEFAULT_PAGE_SIZE*MEM_MIN_LIM, Config{FS: fsys})
+	if err != nil {
+		t.Fatalf("OpenWithConfig failed: %v", err)
+	}
+	defer pc.Close()
+	pg, err := pc.GetPage(pgno)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pg.Release()
+	if pg.GetData()[OF_DATA] != 0x66 {
+		t.Fatal("Page read back from MemFS has wrong content")
+	}
+	if corrupted, err := FsckWithConfig("test", Config{FS: fsys}); err != nil || len(corrupted) != 0 {
+		t.Fatalf("FsckWithConfig reported %v, %v", corrupted, err)
+	}
+}
+
+func TestCompressedPageCache(t *testing.T) {
+	fsys := vfs.NewMemFS()
+	cfg := Config{FS: fsys, Compress: true}
+	pc, err := CreateWithConfig("test", DEFAULT_PAGE_SIZE*MEM_MIN_LIM, cfg)
+	if err != nil {
+		t.Fatalf("CreateWithConfig failed: %v", err)
+	}
+	pc.NewPage(InitRawO(DEFAULT_PAGE_SIZE))
+	const pages = 50
+	for i := 0; i < pages; i++ {
+		pgno, _ := pc.NewPage(InitRawX(DEFAULT_PAGE_SIZE))
+		fillPage(pc, pgno, byte(pgno))
+	}
+	// 每页重写一次, 旧的扇区应该被再次利用
+	if err := pc.FlushAll(); err != nil {
+		t.Fatal(err)
+	}
+	for pgno := 2; pgno <= pages+1; pgno++ {
+		fillPage(pc, pgno, byte(pgno)+1)
+	}
+	pc.Close()
+
+	fi, err := fsys.Stat("test" + DB_SUFFIX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() > int64(pages*DEFAULT_PAGE_SIZE/4) {
+		t.Fatalf("Compressed file is %d bytes, expected far less than %d", fi.Size(), pages*DEFAULT_PAGE_SIZE)
+	}
+
+	pc, err = OpenWithConfig("test", DEFAULT_PAGE_SIZE*MEM_MIN_LIM, Config{FS: fsys})
+	if err != nil {
+		t.Fatalf("OpenWithConfig failed: %v", err)
+	}
+	if pc.GetPageNumber() != pages+1 {
+		t.Fatalf("Expected %d pages, got %d", pages+1, pc.GetPageNumber())
+	}
+	for pgno := 2; pgno <= pages+1; pgno++ {
+		pg, err := pc.GetPage(pgno)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pg.GetData()[OF_DATA] != byte(pgno)+1 {
+			t.Fatalf("Page %d has wrong content", pgno)
+		}
+		pg.Release()
+	}
+	pc.TruncateByPgno(10)
+	pc.Close()
+
+	if corrupted, err := FsckWithConfig("test", cfg); err != nil || len(corrupted) != 0 {
+		t.Fatalf("FsckWithConfig reported %v, %v", corrupted, err)
+	}
+	if _, err := OpenMmap("test", DEFAULT_PAGE_SIZE*MEM_MIN_LIM, cfg); !errors.Is(err, common.ErrMmapIncompatible) {
+		t.Fatalf("Expected ErrMmapIncompatible for a compressed database, got %v", err)
+	}
+}
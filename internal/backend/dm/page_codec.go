@@ -0,0 +1,155 @@
+package dm
+
+import (
+	"encoding/binary"
+
+	"github.com/herveyleaf/GoDB/internal/backend/utils"
+	"github.com/herveyleaf/GoDB/pkg/common"
+)
+
+const (
+	// 从主密钥派生页面密钥时使用的标签
+	PAGE_KEY_LABEL = "GoDB page"
+	// 密钥校验值是用页面密钥加密的一段0, 附加数据用来和页面的密文区分开
+	KEY_CHECK_AD = "GoDB key check"
+)
+
+// pageCodec 页面在内存中和在磁盘上的表示之间的转换, 页面在内存中总是pageSize字节的明文,
+// 在磁盘上占slotSize字节. 第一页的文件头在打开时要先于密钥读出, 所以第一页总是以明文保存
+type pageCodec interface {
+	pageSize() int
+	slotSize() int
+	// encode 返回页面写入磁盘的数据, 不修改page
+	encode(pgno int, page []byte) []byte
+	// decode 从磁盘上的数据还原出页面, 数据损坏或者密钥不对时返回false
+	decode(pgno int, raw []byte) ([]byte, bool)
+	// seal和open加解密变长的数据, 用于压缩之后的页面
+	seal(pgno int, b []byte) []byte
+	open(pgno int, raw []byte) ([]byte, bool)
+	// initHeader 在新建的第一页的文件头中记录加密信息
+	initHeader(raw []byte)
+}
+
+// plainCodec 不加密, 磁盘上的数据就是页面本身
+type plainCodec struct {
+	size int
+}
+
+func (c plainCodec) pageSize() int {
+	return c.size
+}
+
+func (c plainCodec) slotSize() int {
+	return c.size
+}
+
+func (c plainCodec) encode(pgno int, page []byte) []byte {
+	return page
+}
+
+func (c plainCodec) decode(pgno int, raw []byte) ([]byte, bool) {
+	return raw, checkPageChecksum(raw)
+}
+
+func (c plainCodec) seal(pgno int, b []byte) []byte {
+	return b
+}
+
+func (c plainCodec) open(pgno int, raw []byte) ([]byte, bool) {
+	return raw, true
+}
+
+func (c plainCodec) initHeader(raw []byte) {}
+
+// gcmCodec 用AES-GCM加密除第一页以外的页面, 每页在磁盘上是[Nonce][Ciphertext][Tag],
+// 页号参与认证, 整页被挪到别的位置也能发现. 第一页以明文保存, 末尾补0对齐到slotSize
+type gcmCodec struct {
+	size int
+	aead *utils.GCM
+}
+
+func newGCMCodec(pageSize int, key []byte) (*gcmCodec, error) {
+	aead, err := utils.NewGCM(key, PAGE_KEY_LABEL)
+	if err != nil {
+		return nil, err
+	}
+	return &gcmCodec{size: pageSize, aead: aead}, nil
+}
+
+func (c *gcmCodec) pageSize() int {
+	return c.size
+}
+
+func (c *gcmCodec) slotSize() int {
+	return c.size + utils.SEAL_OVERHEAD
+}
+
+func (c *gcmCodec) encode(pgno int, page []byte) []byte {
+	if pgno == 1 {
+		raw := make([]byte, c.slotSize())
+		copy(raw, page)
+		return raw
+	}
+	return c.seal(pgno, page)
+}
+
+func (c *gcmCodec) decode(pgno int, raw []byte) ([]byte, bool) {
+	if pgno == 1 {
+		page := raw[:c.size:c.size]
+		return page, checkPageChecksum(page)
+	}
+	return c.open(pgno, raw)
+}
+
+func (c *gcmCodec) seal(pgno int, b []byte) []byte {
+	return utils.Seal(c.aead, b, pageAD(pgno))
+}
+
+func (c *gcmCodec) open(pgno int, raw []byte) ([]byte, bool) {
+	b, err := utils.Open(c.aead, raw, pageAD(pgno))
+	if err != nil {
+		return nil, false
+	}
+	return b, true
+}
+
+func (c *gcmCodec) initHeader(raw []byte) {
+	flags := binary.BigEndian.Uint16(raw[OF_DB_FLAGS:])
+	binary.BigEndian.PutUint16(raw[OF_DB_FLAGS:], flags|DB_FLAG_ENCRYPTED)
+	copy(raw[OF_DB_KEY_CHECK:], utils.Seal(c.aead, make([]byte, LEN_KEY_CHECK_PLAIN), []byte(KEY_CHECK_AD)))
+}
+
+func pageAD(pgno int) []byte {
+	ad := make([]byte, 4)
+	binary.BigEndian.PutUint32(ad, uint32(pgno))
+	return ad
+}
+
+// newPageCodec 按密钥创建新数据库使用的转换方式, key为nil时不加密
+func newPageCodec(pageSize int, key []byte) (pageCodec, error) {
+	if key == nil {
+		return plainCodec{size: pageSize}, nil
+	}
+	return newGCMCodec(pageSize, key)
+}
+
+// openPageCodec 按文件头中的标志选择转换方式, 并用密钥校验值检查密钥是否正确
+func openPageCodec(h dbHeader, key []byte) (pageCodec, error) {
+	if h.flags&DB_FLAG_ENCRYPTED == 0 {
+		if key != nil {
+			return nil, common.ErrNotEncrypted
+		}
+		return plainCodec{size: h.pageSize}, nil
+	}
+	if key == nil {
+		return nil, common.ErrBadEncryptionKey
+	}
+	c, err := newGCMCodec(h.pageSize, key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := utils.Open(c.aead, h.keyCheck, []byte(KEY_CHECK_AD)); err != nil {
+		return nil, common.ErrBadEncryptionKey
+	}
+	return c, nil
+}
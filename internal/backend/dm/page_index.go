@@ -6,36 +6,104 @@ import (
 
 const (
 	INTERVALS_NO int = 40
-	THRESHOLD    int = PAGE_SIZE / INTERVALS_NO
+)
+
+// SelectStrategy 插入时从PageIndex中选择页面的方式
+type SelectStrategy int
+
+const (
+	// 从能放下数据的最小区间开始, 取第一个页面
+	SELECT_FIRST_FIT SelectStrategy = iota
+	// 取能放下数据的页面中空闲空间最小的一个, 页面填得更满, 但要遍历区间中的页面
+	SELECT_BEST_FIT
+	// 只使用最近一次放回索引的页面, 放不下时分配新页, 适合批量导入, 数据大致按插入顺序排列
+	SELECT_APPEND_ONLY
 )
 
 type PageIndex struct {
-	lock  sync.Mutex
-	lists [][]PageInfo
+	lock      sync.Mutex
+	lists     [][]PageInfo
+	threshold int // 每个区间的大小, 由页面大小决定
+	strategy  SelectStrategy
+	last      int // 最近一次放回索引的页号, SELECT_APPEND_ONLY只使用这一页
 }
 
-func NewPageIndex() *PageIndex {
+func NewPageIndex(pageSize int) *PageIndex {
 	tmp := make([][]PageInfo, INTERVALS_NO+1)
 	for i := 0; i < INTERVALS_NO+1; i++ {
 		tmp[i] = make([]PageInfo, 0)
 	}
 	return &PageIndex{
-		lock:  sync.Mutex{},
-		lists: tmp,
+		lock:      sync.Mutex{},
+		lists:     tmp,
+		threshold: pageSize / INTERVALS_NO,
 	}
 }
 
+func (pidx *PageIndex) SetStrategy(strategy SelectStrategy) {
+	pidx.lock.Lock()
+	defer pidx.lock.Unlock()
+	pidx.strategy = strategy
+}
+
 func (pidx *PageIndex) Add(pgno int, freeSpace int) {
 	pidx.lock.Lock()
 	defer pidx.lock.Unlock()
-	number := freeSpace / THRESHOLD
+	number := freeSpace / pidx.threshold
 	pidx.lists[number] = append(pidx.lists[number], NewPageInfo(pgno, freeSpace))
+	pidx.last = pgno
 }
 
+// Select 按设置的策略选择一个至少有spaceSize字节空闲空间的页面并从索引中取出, 没有合适的页面时返回空的PageInfo
 func (pidx *PageIndex) Select(spaceSize int) PageInfo {
 	pidx.lock.Lock()
 	defer pidx.lock.Unlock()
-	number := spaceSize / THRESHOLD
+	switch pidx.strategy {
+	case SELECT_BEST_FIT:
+		return pidx.selectBestFit(spaceSize)
+	case SELECT_APPEND_ONLY:
+		return pidx.selectLast(spaceSize)
+	}
+	return pidx.selectFirstFit(spaceSize)
+}
+
+// SelectNear 选择能放下数据的页面中页号离pgno最近的一个, 用来把相关的数据放在相邻的页面中
+func (pidx *PageIndex) SelectNear(spaceSize int, pgno int) PageInfo {
+	pidx.lock.Lock()
+	defer pidx.lock.Unlock()
+	best, bestI, bestJ := -1, 0, 0
+	for i := spaceSize / pidx.threshold; i <= INTERVALS_NO; i++ {
+		for j, pi := range pidx.lists[i] {
+			if pi.FreeSpace < spaceSize {
+				continue
+			}
+			if d := max(pi.Pgno-pgno, pgno-pi.Pgno); best < 0 || d < best {
+				best, bestI, bestJ = d, i, j
+			}
+		}
+	}
+	if best < 0 {
+		return PageInfo{}
+	}
+	return pidx.take(bestI, bestJ)
+}
+
+// Remove 从索引中取出指定的页面, 页面正在被插入而不在索引中时返回false
+func (pidx *PageIndex) Remove(pgno int) (PageInfo, bool) {
+	pidx.lock.Lock()
+	defer pidx.lock.Unlock()
+	for i := range pidx.lists {
+		for j, pi := range pidx.lists[i] {
+			if pi.Pgno == pgno {
+				return pidx.take(i, j), true
+			}
+		}
+	}
+	return PageInfo{}, false
+}
+
+func (pidx *PageIndex) selectFirstFit(spaceSize int) PageInfo {
+	number := spaceSize / pidx.threshold
 	if number < INTERVALS_NO {
 		number++
 	}
@@ -44,9 +112,41 @@ func (pidx *PageIndex) Select(spaceSize int) PageInfo {
 			number++
 			continue
 		}
-		page := pidx.lists[number][0]
-		pidx.lists[number] = pidx.lists[number][1:]
-		return page
+		return pidx.take(number, 0)
+	}
+	return PageInfo{}
+}
+
+// selectBestFit 第一个有合适页面的区间中空闲空间最小的页面就是全局最小的
+func (pidx *PageIndex) selectBestFit(spaceSize int) PageInfo {
+	for i := spaceSize / pidx.threshold; i <= INTERVALS_NO; i++ {
+		best := -1
+		for j, pi := range pidx.lists[i] {
+			if pi.FreeSpace >= spaceSize && (best < 0 || pi.FreeSpace < pidx.lists[i][best].FreeSpace) {
+				best = j
+			}
+		}
+		if best >= 0 {
+			return pidx.take(i, best)
+		}
 	}
 	return PageInfo{}
 }
+
+func (pidx *PageIndex) selectLast(spaceSize int) PageInfo {
+	for i := spaceSize / pidx.threshold; i <= INTERVALS_NO; i++ {
+		for j, pi := range pidx.lists[i] {
+			if pi.Pgno == pidx.last && pi.FreeSpace >= spaceSize {
+				return pidx.take(i, j)
+			}
+		}
+	}
+	return PageInfo{}
+}
+
+// take 从索引中取出第i个区间的第j个页面, 写完之后由调用方重新加入
+func (pidx *PageIndex) take(i int, j int) PageInfo {
+	page := pidx.lists[i][j]
+	pidx.lists[i] = append(pidx.lists[i][:j], pidx.lists[i][j+1:]...)
+	return page
+}
@@ -0,0 +1,42 @@
+package dm
+
+import "testing"
+
+func TestPageIndexStrategies(t *testing.T) {
+	fill := func(strategy SelectStrategy) *PageIndex {
+		pidx := NewPageIndex(MIN_PAGE_SIZE)
+		pidx.SetStrategy(strategy)
+		for pgno, free := range map[int]int{2: 3000, 3: 1500, 4: 1200, 5: 4000, 6: 1010} {
+			pidx.Add(pgno, free)
+		}
+		return pidx
+	}
+
+	// 1000和1010字节都落在第9个区间, 首次适应从第10个区间开始找到4号页, 最佳适应会找到同一区间中的6号页
+	if pi := fill(SELECT_BEST_FIT).Select(1000); pi.Pgno != 6 {
+		t.Fatalf("Best fit selected page %d, expected 6", pi.Pgno)
+	}
+	if pi := fill(SELECT_FIRST_FIT).Select(1000); pi.Pgno != 4 {
+		t.Fatalf("First fit selected page %d, expected 4", pi.Pgno)
+	}
+	if pi := fill(SELECT_BEST_FIT).Select(5000); pi != (PageInfo{}) {
+		t.Fatalf("Expected no page for 5000 bytes, got %d", pi.Pgno)
+	}
+
+	pidx := fill(SELECT_APPEND_ONLY)
+	pidx.Add(7, 500)
+	if pi := pidx.Select(1000); pi != (PageInfo{}) {
+		t.Fatalf("Append only should not reuse page %d", pi.Pgno)
+	}
+	if pi := pidx.Select(400); pi.Pgno != 7 {
+		t.Fatalf("Append only selected page %d, expected 7", pi.Pgno)
+	}
+
+	pidx = fill(SELECT_FIRST_FIT)
+	if pi := pidx.SelectNear(1000, 5); pi.Pgno != 5 {
+		t.Fatalf("Near selected page %d, expected 5", pi.Pgno)
+	}
+	if pi := pidx.SelectNear(1000, 5); pi.Pgno != 4 && pi.Pgno != 6 {
+		t.Fatalf("Near selected page %d, expected 4 or 6", pi.Pgno)
+	}
+}
@@ -0,0 +1,235 @@
+package dm
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/herveyleaf/GoDB/internal/backend/vfs"
+	"github.com/herveyleaf/GoDB/pkg/common"
+)
+
+const (
+	PMAP_SUFFIX         = ".pmap"
+	PMAP_COMPACT_SUFFIX = ".pmap.tmp"
+
+	// 页面映射文件的格式: [Magic][Batch1]...[Batchn]
+	// 每批: [Count][Checksum][Entry1]...[Entryn], Checksum是Count和所有Entry的CRC32C
+	// Entry: [Pgno][Sector][Length], Length为0表示页面被丢弃
+	PMAP_MAGIC      = "GPMP"
+	LEN_PMAP_HEADER = 4
+	OF_PMAP_COUNT   = 0
+	OF_PMAP_CHECK   = OF_PMAP_COUNT + 4
+	LEN_PMAP_BATCH  = OF_PMAP_CHECK + 4
+	LEN_PMAP_ENTRY  = 12
+
+	// 映射文件超过这个大小, 并且是当前映射所需大小的PMAP_COMPACT_RATIO倍以上时重写
+	PMAP_COMPACT_MIN   = 1 << 20
+	PMAP_COMPACT_RATIO = 4
+)
+
+// pageEntry 一页压缩后的数据在数据区中的位置
+type pageEntry struct {
+	sector int
+	length int
+}
+
+func (e pageEntry) sectors() int {
+	return (e.length + SECTOR_SIZE - 1) / SECTOR_SIZE
+}
+
+// pageMap 页号到页面数据位置的映射, 以追加批次的方式保存, 每批追加之后fsync,
+// 打开时按顺序重放所有完整的批次, 写了一半的最后一批被截掉
+type pageMap struct {
+	fsys    vfs.FS
+	path    string
+	file    vfs.File
+	size    int64
+	entries map[int]pageEntry
+}
+
+func createPageMap(fsys vfs.FS, path string) (*pageMap, error) {
+	f, err := fsys.OpenFile(path+PMAP_SUFFIX, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		if os.IsExist(err) {
+			return nil, common.ErrFileExists
+		}
+		return nil, err
+	}
+	if _, err := f.WriteAt([]byte(PMAP_MAGIC), 0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &pageMap{fsys: fsys, path: path, file: f, size: LEN_PMAP_HEADER, entries: make(map[int]pageEntry)}, nil
+}
+
+// openPageMap 重放映射文件, readOnly为false时截掉末尾写了一半的批次
+func openPageMap(fsys vfs.FS, path string, readOnly bool) (*pageMap, error) {
+	flag := os.O_RDWR
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+	f, err := fsys.OpenFile(path+PMAP_SUFFIX, flag, 0600)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, common.ErrBadDBFile
+		}
+		return nil, err
+	}
+	pm := &pageMap{fsys: fsys, path: path, file: f, entries: make(map[int]pageEntry)}
+	if err := pm.replay(readOnly); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return pm, nil
+}
+
+func (pm *pageMap) replay(readOnly bool) error {
+	fi, err := pm.file.Stat()
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, fi.Size())
+	if _, err := pm.file.ReadAt(buf, 0); err != nil && err != io.EOF {
+		return err
+	}
+	if len(buf) < LEN_PMAP_HEADER || string(buf[:LEN_PMAP_HEADER]) != PMAP_MAGIC {
+		return common.ErrBadDBFile
+	}
+
+	pos := LEN_PMAP_HEADER
+	for pos+LEN_PMAP_BATCH <= len(buf) {
+		count := int(binary.BigEndian.Uint32(buf[pos+OF_PMAP_COUNT:]))
+		end := pos + LEN_PMAP_BATCH + count*LEN_PMAP_ENTRY
+		if end > len(buf) || binary.BigEndian.Uint32(buf[pos+OF_PMAP_CHECK:]) != batchChecksum(buf[pos:end]) {
+			break
+		}
+		for i := pos + LEN_PMAP_BATCH; i < end; i += LEN_PMAP_ENTRY {
+			pgno, e := parsePageEntry(buf[i:])
+			if e.length == 0 {
+				delete(pm.entries, pgno)
+			} else {
+				pm.entries[pgno] = e
+			}
+		}
+		pos = end
+	}
+	pm.size = int64(pos)
+	if pos == len(buf) || readOnly {
+		return nil
+	}
+	// 截掉的批次对应的页面数据可能已经落盘, 但它们的空间在重放之后被当作空闲, 不会被引用
+	if err := pm.file.Truncate(pm.size); err != nil {
+		return err
+	}
+	return pm.file.Sync()
+}
+
+func batchChecksum(batch []byte) uint32 {
+	crc := crc32.Update(0, crcTable, batch[OF_PMAP_COUNT:OF_PMAP_CHECK])
+	return crc32.Update(crc, crcTable, batch[LEN_PMAP_BATCH:])
+}
+
+func parsePageEntry(raw []byte) (int, pageEntry) {
+	return int(binary.BigEndian.Uint32(raw)), pageEntry{
+		sector: int(binary.BigEndian.Uint32(raw[4:])),
+		length: int(binary.BigEndian.Uint32(raw[8:])),
+	}
+}
+
+// encodeBatch 按页号顺序编码一批映射的修改
+func encodeBatch(updates map[int]pageEntry) []byte {
+	pgnos := make([]int, 0, len(updates))
+	for pgno := range updates {
+		pgnos = append(pgnos, pgno)
+	}
+	sort.Ints(pgnos)
+	buf := make([]byte, LEN_PMAP_BATCH+len(pgnos)*LEN_PMAP_ENTRY)
+	binary.BigEndian.PutUint32(buf[OF_PMAP_COUNT:], uint32(len(pgnos)))
+	for i, pgno := range pgnos {
+		pos := LEN_PMAP_BATCH + i*LEN_PMAP_ENTRY
+		e := updates[pgno]
+		binary.BigEndian.PutUint32(buf[pos:], uint32(pgno))
+		binary.BigEndian.PutUint32(buf[pos+4:], uint32(e.sector))
+		binary.BigEndian.PutUint32(buf[pos+8:], uint32(e.length))
+	}
+	binary.BigEndian.PutUint32(buf[OF_PMAP_CHECK:], batchChecksum(buf))
+	return buf
+}
+
+// apply 追加一批修改并fsync, 返回后这批修改在崩溃后仍然有效
+func (pm *pageMap) apply(updates map[int]pageEntry) error {
+	batch := encodeBatch(updates)
+	if _, err := pm.file.WriteAt(batch, pm.size); err != nil {
+		return err
+	}
+	if err := pm.file.Sync(); err != nil {
+		return err
+	}
+	pm.size += int64(len(batch))
+	for pgno, e := range updates {
+		if e.length == 0 {
+			delete(pm.entries, pgno)
+		} else {
+			pm.entries[pgno] = e
+		}
+	}
+	return nil
+}
+
+// maybeCompact 映射文件中过时的批次太多时重写
+func (pm *pageMap) maybeCompact() error {
+	if pm.size > PMAP_COMPACT_MIN && pm.size > PMAP_COMPACT_RATIO*pm.snapshotSize() {
+		return pm.compact()
+	}
+	return nil
+}
+
+func (pm *pageMap) snapshotSize() int64 {
+	return int64(LEN_PMAP_HEADER + LEN_PMAP_BATCH + len(pm.entries)*LEN_PMAP_ENTRY)
+}
+
+// compact 把当前的映射作为一批写入新文件, fsync之后替换原来的映射文件
+func (pm *pageMap) compact() error {
+	tmp := pm.path + PMAP_COMPACT_SUFFIX
+	f, err := pm.fsys.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	buf := append([]byte(PMAP_MAGIC), encodeBatch(pm.entries)...)
+	if _, err := f.WriteAt(buf, 0); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := pm.fsys.Rename(tmp, pm.path+PMAP_SUFFIX); err != nil {
+		f.Close()
+		return err
+	}
+	pm.file.Close()
+	pm.file = f
+	pm.size = int64(len(buf))
+	return nil
+}
+
+// maxPgno 映射中最大的页号
+func (pm *pageMap) maxPgno() int {
+	maxPgno := 0
+	for pgno := range pm.entries {
+		maxPgno = max(maxPgno, pgno)
+	}
+	return maxPgno
+}
+
+func (pm *pageMap) close() error {
+	return pm.file.Close()
+}
@@ -0,0 +1,149 @@
+package dm
+
+import (
+	"sync"
+)
+
+const (
+	// 连续多少次顺序缺页后开始预读
+	READ_AHEAD_TRIGGER = 2
+	// 每次预读的页数
+	READ_AHEAD_PAGES = 32
+	// 预读缓冲最多保存的页数
+	READ_AHEAD_MAX_BUFFERED = READ_AHEAD_PAGES * 4
+)
+
+// readAhead 检测顺序的缺页访问, 并在后台一次性读入之后的若干页
+type readAhead struct {
+	pc *PageCacheImpl
+
+	lock       sync.Mutex
+	lastMiss   int            // 上一次缺页的页号
+	sequential int            // 连续顺序缺页的次数
+	buffer     map[int][]byte // 预读到但还没被使用的页
+	inflight   map[int]bool   // 正在预读的页, 被写入后会从这里移除
+	closed     bool
+	wg         sync.WaitGroup
+}
+
+func newReadAhead(pc *PageCacheImpl) *readAhead {
+	return &readAhead{
+		pc:       pc,
+		buffer:   make(map[int][]byte),
+		inflight: make(map[int]bool),
+	}
+}
+
+// take 取出预读缓冲中的页面
+func (ra *readAhead) take(pgno int) []byte {
+	ra.lock.Lock()
+	defer ra.lock.Unlock()
+
+	data, exists := ra.buffer[pgno]
+	if exists {
+		delete(ra.buffer, pgno)
+	}
+	return data
+}
+
+// onMiss 记录一次缺页, 如果是顺序访问则触发预读
+func (ra *readAhead) onMiss(pgno int) {
+	ra.lock.Lock()
+	if pgno == ra.lastMiss+1 {
+		ra.sequential++
+	} else {
+		ra.sequential = 0
+	}
+	ra.lastMiss = pgno
+	trigger := ra.sequential >= READ_AHEAD_TRIGGER
+	ra.lock.Unlock()
+
+	if trigger {
+		ra.prefetch(pgno+1, READ_AHEAD_PAGES)
+	}
+}
+
+// prefetch 在后台读入从start开始的count页, 已经预读过的部分会被跳过
+func (ra *readAhead) prefetch(start int, count int) {
+	ra.lock.Lock()
+	defer ra.lock.Unlock()
+
+	// 前面已经预读了超过半个窗口时不需要再发起预读
+	first := start
+	for ra.covered(first) {
+		first++
+	}
+	if first > start+count/2 {
+		return
+	}
+	start = first
+	maxPgno := ra.pc.GetPageNumber()
+	if start > maxPgno {
+		return
+	}
+	end := start
+	for end < start+count-1 && end < maxPgno && !ra.covered(end+1) {
+		end++
+	}
+
+	// 顺序扫描已经越过的页不会再被用到
+	for pgno := range ra.buffer {
+		if pgno <= ra.lastMiss {
+			delete(ra.buffer, pgno)
+		}
+	}
+	if ra.closed || len(ra.buffer) >= READ_AHEAD_MAX_BUFFERED {
+		return
+	}
+	for pgno := start; pgno <= end; pgno++ {
+		ra.inflight[pgno] = true
+	}
+
+	ra.wg.Add(1)
+	go func() {
+		defer ra.wg.Done()
+		pages := ra.pc.readRange(start, end)
+		ra.lock.Lock()
+		defer ra.lock.Unlock()
+		for pgno := start; pgno <= end; pgno++ {
+			// 读取期间被写过的页面已经从inflight中移除, 不能再使用读到的旧数据
+			if data, ok := pages[pgno]; ok && ra.inflight[pgno] {
+				ra.buffer[pgno] = data
+			}
+			delete(ra.inflight, pgno)
+		}
+	}()
+}
+
+func (ra *readAhead) covered(pgno int) bool {
+	_, buffered := ra.buffer[pgno]
+	return buffered || ra.inflight[pgno]
+}
+
+// invalidate 页面有了新的版本, 丢弃预读到的旧数据
+func (ra *readAhead) invalidate(pgno int) {
+	ra.lock.Lock()
+	defer ra.lock.Unlock()
+
+	delete(ra.buffer, pgno)
+	delete(ra.inflight, pgno)
+}
+
+// reset 丢弃所有预读的数据, 用于截断数据库文件
+func (ra *readAhead) reset() {
+	ra.lock.Lock()
+	defer ra.lock.Unlock()
+
+	ra.buffer = make(map[int][]byte)
+	ra.inflight = make(map[int]bool)
+	ra.lastMiss = 0
+	ra.sequential = 0
+}
+
+// close 等待所有预读结束
+func (ra *readAhead) close() {
+	ra.lock.Lock()
+	ra.closed = true
+	ra.lock.Unlock()
+	ra.wg.Wait()
+}
@@ -0,0 +1,137 @@
+package dm
+
+import (
+	"errors"
+	"io"
+
+	"github.com/herveyleaf/GoDB/internal/backend/vfs"
+	"github.com/herveyleaf/GoDB/pkg/common"
+)
+
+// pageStore 页面在数据库文件中的存放方式, 除了打开和关闭, 调用方都需要持有PageCacheImpl.fileLock
+type pageStore interface {
+	// read 读出一页的明文, 损坏或者从没写入过的页面返回ErrPageCorrupted
+	read(pgno int) ([]byte, error)
+	// readRange 读出[start, end]范围内完好的页面, 损坏的页面留到真正访问时再报错
+	readRange(start int, end int) map[int][]byte
+	// write 写入一批按页号排好序的页面, 返回时这批页面已经落盘
+	write(batch []dirtyPage) error
+	// truncate 丢弃页号大于maxPgno的页面
+	truncate(maxPgno int) error
+	// pages 打开时文件中已有的页数
+	pages() int
+	// initHeader 在新建的第一页的文件头中记录存放方式
+	initHeader(raw []byte)
+	close() error
+}
+
+// slotStore 每页在文件中占用固定大小的位置, 第pgno页在(pgno-1)*slotSize处, 原地更新并用双写文件保护
+type slotStore struct {
+	file  vfs.File
+	dwb   *doubleWriteBuffer // 只读打开时为nil
+	codec pageCodec
+}
+
+func newSlotStore(file vfs.File, dwb *doubleWriteBuffer, codec pageCodec) *slotStore {
+	return &slotStore{file: file, dwb: dwb, codec: codec}
+}
+
+func (s *slotStore) offset(pgno int) int64 {
+	return int64(pgno-1) * int64(s.codec.slotSize())
+}
+
+func (s *slotStore) read(pgno int) ([]byte, error) {
+	raw := make([]byte, s.codec.slotSize())
+	if _, err := s.file.ReadAt(raw, s.offset(pgno)); err != nil {
+		return nil, err
+	}
+	data, ok := s.codec.decode(pgno, raw)
+	if !ok {
+		return nil, corruptedPageError(pgno)
+	}
+	return data, nil
+}
+
+// readRange 相邻的页面在文件中也相邻, 一次读入整个范围
+func (s *slotStore) readRange(start int, end int) map[int][]byte {
+	size := s.codec.slotSize()
+	buf := make([]byte, (end-start+1)*size)
+	n, err := s.file.ReadAt(buf, s.offset(start))
+	if err != nil && err != io.EOF {
+		return nil
+	}
+	pages := make(map[int][]byte)
+	for i := 0; (i+1)*size <= n; i++ {
+		if page, ok := s.codec.decode(start+i, buf[i*size:(i+1)*size:(i+1)*size]); ok {
+			pages[start+i] = page
+		}
+	}
+	return pages
+}
+
+// write 每批先写双写文件并fsync, 再原地写入并fsync, 两个文件中保存的都是页面在磁盘上的数据
+func (s *slotStore) write(batch []dirtyPage) error {
+	encoded := make([]dirtyPage, len(batch))
+	for i, dp := range batch {
+		encoded[i] = dirtyPage{pgno: dp.pgno, data: s.codec.encode(dp.pgno, dp.data)}
+	}
+	batch = encoded
+
+	for len(batch) > 0 {
+		n := min(len(batch), DWB_MAX_PAGES)
+		if err := s.dwb.write(batch[:n]); err != nil {
+			return err
+		}
+		for _, dp := range batch[:n] {
+			if _, err := s.file.WriteAt(dp.data, s.offset(dp.pgno)); err != nil {
+				return err
+			}
+		}
+		if err := s.file.Sync(); err != nil {
+			return err
+		}
+		batch = batch[n:]
+	}
+	return nil
+}
+
+func (s *slotStore) truncate(maxPgno int) error {
+	if err := s.file.Truncate(s.offset(maxPgno + 1)); err != nil {
+		return err
+	}
+	// 被截断的页面不能再从双写文件中恢复出来
+	return s.dwb.reset()
+}
+
+func (s *slotStore) pages() int {
+	fi, err := s.file.Stat()
+	if err != nil {
+		return 0
+	}
+	return int(fi.Size() / int64(s.codec.slotSize()))
+}
+
+func (s *slotStore) initHeader(raw []byte) {
+	s.codec.initHeader(raw)
+}
+
+func (s *slotStore) close() error {
+	if s.dwb != nil {
+		s.dwb.close()
+	}
+	return s.file.Close()
+}
+
+// verifyPages 逐页读出并校验, 返回损坏的页号
+func verifyPages(store pageStore, pageNumber int) ([]int, error) {
+	corrupted := []int{}
+	for pgno := 1; pgno <= pageNumber; pgno++ {
+		if _, err := store.read(pgno); err != nil {
+			if !errors.Is(err, common.ErrPageCorrupted) {
+				return nil, err
+			}
+			corrupted = append(corrupted, pgno)
+		}
+	}
+	return corrupted, nil
+}
@@ -0,0 +1,301 @@
+package dm
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/herveyleaf/GoDB/internal/backend/vfs"
+)
+
+const (
+	// 压缩后的页面以扇区为单位存放在第一页之后的数据区中
+	SECTOR_SIZE = 512
+
+	// 压缩后的页面: [Flag][Data], 压缩不能变小的页面按原样保存
+	PAGE_STORED_RAW   = 0
+	PAGE_STORED_FLATE = 1
+)
+
+var flateWriters = sync.Pool{
+	New: func() any {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+// compressPage 返回页面压缩后的数据
+func compressPage(page []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(PAGE_STORED_FLATE)
+	w := flateWriters.Get().(*flate.Writer)
+	w.Reset(&buf)
+	w.Write(page)
+	w.Close()
+	flateWriters.Put(w)
+	if buf.Len() > len(page) {
+		return append([]byte{PAGE_STORED_RAW}, page...)
+	}
+	return buf.Bytes()
+}
+
+// decompressPage 还原出pageSize字节的页面, 数据不完整时返回false
+func decompressPage(image []byte, pageSize int) ([]byte, bool) {
+	if len(image) == 0 {
+		return nil, false
+	}
+	switch image[0] {
+	case PAGE_STORED_RAW:
+		if len(image)-1 != pageSize {
+			return nil, false
+		}
+		return image[1:], true
+	case PAGE_STORED_FLATE:
+		page := make([]byte, pageSize)
+		r := flate.NewReader(bytes.NewReader(image[1:]))
+		defer r.Close()
+		if _, err := io.ReadFull(r, page); err != nil {
+			return nil, false
+		}
+		return page, true
+	}
+	return nil, false
+}
+
+// extent 数据区中一段连续的扇区
+type extent struct {
+	sector int
+	count  int
+}
+
+// compressedStore 除第一页以外的页面压缩(和加密)之后写入数据区中空闲的扇区, 由pageMap记录每页的位置.
+// 页面从不原地覆盖: 新的数据先写入并fsync, 再追加并fsync映射, 之后旧的扇区才能被再次分配,
+// 所以崩溃时映射总是指向完整的数据, 不需要双写文件. 第一页仍然原地写入, 用双写文件保护
+type compressedStore struct {
+	file      vfs.File
+	dwb       *doubleWriteBuffer // 只读打开时为nil
+	codec     pageCodec
+	pmap      *pageMap
+	dataStart int64
+	free      []extent // 按扇区号排序的空闲扇区
+	end       int      // 数据区中最后一个被使用的扇区之后的扇区号
+	count     int
+}
+
+func newCompressedStore(file vfs.File, dwb *doubleWriteBuffer, codec pageCodec, pmap *pageMap) (*compressedStore, error) {
+	slot := int64(codec.slotSize())
+	s := &compressedStore{
+		file:      file,
+		dwb:       dwb,
+		codec:     codec,
+		pmap:      pmap,
+		dataStart: (slot + SECTOR_SIZE - 1) / SECTOR_SIZE * SECTOR_SIZE,
+		count:     pmap.maxPgno(),
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if s.count == 0 && fi.Size() >= slot {
+		s.count = 1
+	}
+
+	// 没有被映射引用的扇区都是空闲的, 包括崩溃前写入了数据但映射还没有落盘的扇区
+	used := make([]extent, 0, len(pmap.entries))
+	for _, e := range pmap.entries {
+		used = append(used, extent{sector: e.sector, count: e.sectors()})
+	}
+	sort.Slice(used, func(i, j int) bool { return used[i].sector < used[j].sector })
+	for _, u := range used {
+		if u.sector > s.end {
+			s.free = append(s.free, extent{sector: s.end, count: u.sector - s.end})
+		}
+		s.end = max(s.end, u.sector+u.count)
+	}
+	return s, nil
+}
+
+func (s *compressedStore) sectorOffset(sector int) int64 {
+	return s.dataStart + int64(sector)*SECTOR_SIZE
+}
+
+// alloc 分配n个连续的扇区, 没有足够大的空闲段时追加到数据区末尾
+func (s *compressedStore) alloc(n int) int {
+	for i, e := range s.free {
+		if e.count < n {
+			continue
+		}
+		if e.count == n {
+			s.free = slices.Delete(s.free, i, i+1)
+		} else {
+			s.free[i] = extent{sector: e.sector + n, count: e.count - n}
+		}
+		return e.sector
+	}
+	sector := s.end
+	s.end += n
+	return sector
+}
+
+// release 归还一段扇区, 并和相邻的空闲段合并
+func (s *compressedStore) release(sector int, n int) {
+	i := sort.Search(len(s.free), func(i int) bool { return s.free[i].sector > sector })
+	s.free = slices.Insert(s.free, i, extent{sector: sector, count: n})
+	if i+1 < len(s.free) && s.free[i].sector+s.free[i].count == s.free[i+1].sector {
+		s.free[i].count += s.free[i+1].count
+		s.free = slices.Delete(s.free, i+1, i+2)
+	}
+	if i > 0 && s.free[i-1].sector+s.free[i-1].count == s.free[i].sector {
+		s.free[i-1].count += s.free[i].count
+		s.free = slices.Delete(s.free, i, i+1)
+	}
+}
+
+func (s *compressedStore) read(pgno int) ([]byte, error) {
+	if pgno == 1 {
+		raw := make([]byte, s.codec.slotSize())
+		if _, err := s.file.ReadAt(raw, 0); err != nil {
+			return nil, err
+		}
+		data, ok := s.codec.decode(1, raw)
+		if !ok {
+			return nil, corruptedPageError(pgno)
+		}
+		return data, nil
+	}
+	// 没有写入过的页面和固定位置存放时全是0的页面一样, 当作损坏
+	e, ok := s.pmap.entries[pgno]
+	if !ok {
+		return nil, corruptedPageError(pgno)
+	}
+	raw := make([]byte, e.length)
+	if _, err := s.file.ReadAt(raw, s.sectorOffset(e.sector)); err != nil {
+		if err == io.EOF {
+			return nil, corruptedPageError(pgno)
+		}
+		return nil, err
+	}
+	image, ok := s.codec.open(pgno, raw)
+	if !ok {
+		return nil, corruptedPageError(pgno)
+	}
+	page, ok := decompressPage(image, s.codec.pageSize())
+	if !ok || !checkPageChecksum(page) {
+		return nil, corruptedPageError(pgno)
+	}
+	return page, nil
+}
+
+// readRange 页面在文件中不一定相邻, 逐页读入
+func (s *compressedStore) readRange(start int, end int) map[int][]byte {
+	pages := make(map[int][]byte)
+	for pgno := start; pgno <= end; pgno++ {
+		if page, err := s.read(pgno); err == nil {
+			pages[pgno] = page
+		}
+	}
+	return pages
+}
+
+func (s *compressedStore) write(batch []dirtyPage) error {
+	updates := make(map[int]pageEntry)
+	var pageOne []byte
+	for _, dp := range batch {
+		if dp.pgno == 1 {
+			pageOne = s.codec.encode(1, dp.data)
+			continue
+		}
+		raw := s.codec.seal(dp.pgno, compressPage(dp.data))
+		e := pageEntry{length: len(raw)}
+		e.sector = s.alloc(e.sectors())
+		updates[dp.pgno] = e
+		if _, err := s.file.WriteAt(raw, s.sectorOffset(e.sector)); err != nil {
+			s.releaseAll(updates)
+			return err
+		}
+	}
+	if pageOne != nil {
+		if err := s.dwb.write([]dirtyPage{{pgno: 1, data: pageOne}}); err != nil {
+			s.releaseAll(updates)
+			return err
+		}
+		if _, err := s.file.WriteAt(pageOne, 0); err != nil {
+			s.releaseAll(updates)
+			return err
+		}
+	}
+	if err := s.file.Sync(); err != nil {
+		s.releaseAll(updates)
+		return err
+	}
+	if len(updates) == 0 {
+		return nil
+	}
+
+	old := make([]pageEntry, 0, len(updates))
+	for pgno := range updates {
+		if e, ok := s.pmap.entries[pgno]; ok {
+			old = append(old, e)
+		}
+	}
+	// 映射是否落盘不确定时新分配的扇区可能已经被引用, 不能归还
+	if err := s.pmap.apply(updates); err != nil {
+		return err
+	}
+	for _, e := range old {
+		s.release(e.sector, e.sectors())
+	}
+	return s.pmap.maybeCompact()
+}
+
+// releaseAll 归还还没有被映射引用的扇区
+func (s *compressedStore) releaseAll(updates map[int]pageEntry) {
+	for _, e := range updates {
+		s.release(e.sector, e.sectors())
+	}
+}
+
+func (s *compressedStore) truncate(maxPgno int) error {
+	updates := make(map[int]pageEntry)
+	for pgno := range s.pmap.entries {
+		if pgno > maxPgno {
+			updates[pgno] = pageEntry{}
+		}
+	}
+	if len(updates) == 0 {
+		return nil
+	}
+	old := make([]pageEntry, 0, len(updates))
+	for pgno := range updates {
+		old = append(old, s.pmap.entries[pgno])
+	}
+	if err := s.pmap.apply(updates); err != nil {
+		return err
+	}
+	for _, e := range old {
+		s.release(e.sector, e.sectors())
+	}
+	return s.pmap.maybeCompact()
+}
+
+func (s *compressedStore) pages() int {
+	return s.count
+}
+
+func (s *compressedStore) initHeader(raw []byte) {
+	s.codec.initHeader(raw)
+	flags := binary.BigEndian.Uint16(raw[OF_DB_FLAGS:])
+	binary.BigEndian.PutUint16(raw[OF_DB_FLAGS:], flags|DB_FLAG_COMPRESSED)
+}
+
+func (s *compressedStore) close() error {
+	if s.dwb != nil {
+		s.dwb.close()
+	}
+	s.pmap.close()
+	return s.file.Close()
+}
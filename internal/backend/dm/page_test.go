@@ -0,0 +1,53 @@
+package dm
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSlottedPageCompaction(t *testing.T) {
+	pg := NewPageImpl(2, InitRawX(MIN_PAGE_SIZE), nil)
+	items := [][]byte{
+		WrapDataItemRaw(bytes.Repeat([]byte{1}, 300)),
+		WrapDataItemRaw(bytes.Repeat([]byte{2}, 500)),
+		WrapDataItemRaw(bytes.Repeat([]byte{3}, 200)),
+	}
+	for i, raw := range items {
+		if slot := Insert(pg, raw); slot != i {
+			t.Fatalf("Item %d inserted into slot %d", i, slot)
+		}
+	}
+
+	// 中间的DataItem失效后, 它占用的空间要整理之后才能连续使用
+	raw := pg.GetData()
+	offset, _ := itemOffset(raw, 1)
+	SetDataItemRawInvalid(raw[offset:])
+	if free, contiguous := GetFreeSpace(pg), contiguousSpace(raw); free != contiguous+len(items[1]) {
+		t.Fatalf("Expected %d reclaimable bytes, got %d", contiguous+len(items[1]), free)
+	}
+
+	compacted := compactPage(raw, nil)
+	if free := freeSpace(compacted); free != contiguousSpace(compacted) {
+		t.Fatalf("Free space is still fragmented after compaction: %d/%d", contiguousSpace(compacted), free)
+	}
+	if _, ok := itemOffset(compacted, 1); ok {
+		t.Fatalf("Invalid item survived compaction")
+	}
+	for _, slot := range []int{0, 2} {
+		offset, ok := itemOffset(compacted, slot)
+		if !ok || !bytes.Equal(compacted[offset:offset+len(items[slot])], items[slot]) {
+			t.Fatalf("Item in slot %d moved incorrectly", slot)
+		}
+	}
+
+	// 空出来的槽被下一次插入重新使用, 末尾失效的DataItem连同槽一起去掉
+	copy(raw, compacted)
+	if slot := Insert(pg, items[1]); slot != 1 {
+		t.Fatalf("Expected the empty slot to be reused, got %d", slot)
+	}
+	offset, _ = itemOffset(raw, 2)
+	SetDataItemRawInvalid(raw[offset:])
+	if count := getSlotCount(compactPage(raw, nil)); count != 2 {
+		t.Fatalf("Expected trailing empty slots to be trimmed, got %d slots", count)
+	}
+}
@@ -0,0 +1,203 @@
+package dm
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// 后台刷盘的最长间隔
+	FLUSH_INTERVAL = 200 * time.Millisecond
+	// 脏页达到该数量时立即唤醒后台刷盘
+	DIRTY_BATCH_SIZE = 64
+)
+
+// dirtyPage 等待写回的页面快照
+type dirtyPage struct {
+	pgno int
+	data []byte
+}
+
+// pageWriter 缓冲被释放的脏页, 由后台goroutine按批写回, 每批只fsync一次
+type pageWriter struct {
+	pc *PageCacheImpl
+
+	bufLock  sync.Mutex
+	flushed  *sync.Cond     // 每批写完后通知等待空间的goroutine
+	dirty    map[int][]byte // 等待写回的脏页
+	flushing map[int][]byte // 正在写回的脏页
+	maxDirty int            // 缓冲的脏页上限, 超过后释放脏页的goroutine需要等待
+	err      error          // 后台写回遇到的第一个错误
+
+	flushLock sync.Mutex // 保证同一时间只有一批脏页在写回
+	wake      chan struct{}
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+func newPageWriter(pc *PageCacheImpl, maxDirty int) *pageWriter {
+	if maxDirty < DIRTY_BATCH_SIZE {
+		maxDirty = DIRTY_BATCH_SIZE
+	}
+	pw := &pageWriter{
+		pc:       pc,
+		dirty:    make(map[int][]byte),
+		flushing: make(map[int][]byte),
+		maxDirty: maxDirty,
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	pw.flushed = sync.NewCond(&pw.bufLock)
+	go pw.run()
+	return pw
+}
+
+func (pw *pageWriter) run() {
+	defer close(pw.done)
+	ticker := time.NewTicker(FLUSH_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-pw.stop:
+			return
+		case <-pw.wake:
+		case <-ticker.C:
+		}
+		if err := pw.flush(); err != nil {
+			pw.bufLock.Lock()
+			if pw.err == nil {
+				pw.err = err
+			}
+			pw.bufLock.Unlock()
+		}
+	}
+}
+
+// enqueue 接管data, 新的快照会覆盖同一页面旧的快照
+func (pw *pageWriter) enqueue(pgno int, data []byte) {
+	// 进入缓冲后的快照不再被修改, 所以在这里计算校验和
+	setPageChecksum(data)
+	pw.bufLock.Lock()
+	defer pw.bufLock.Unlock()
+
+	for len(pw.dirty) >= pw.maxDirty && pw.err == nil {
+		if _, exists := pw.dirty[pgno]; exists {
+			break
+		}
+		pw.signal()
+		pw.flushed.Wait()
+	}
+	pw.dirty[pgno] = data
+	pw.pc.readAhead.invalidate(pgno)
+	if len(pw.dirty) >= DIRTY_BATCH_SIZE {
+		pw.signal()
+	}
+}
+
+func (pw *pageWriter) signal() {
+	select {
+	case pw.wake <- struct{}{}:
+	default:
+	}
+}
+
+// lookup 返回页面尚未落盘的最新数据的拷贝
+func (pw *pageWriter) lookup(pgno int) []byte {
+	pw.bufLock.Lock()
+	defer pw.bufLock.Unlock()
+
+	data, exists := pw.dirty[pgno]
+	if !exists {
+		data, exists = pw.flushing[pgno]
+	}
+	if !exists {
+		return nil
+	}
+	buf := make([]byte, len(data))
+	copy(buf, data)
+	return buf
+}
+
+// contains 页面是否有尚未落盘的新版本
+func (pw *pageWriter) contains(pgno int) bool {
+	pw.bufLock.Lock()
+	defer pw.bufLock.Unlock()
+
+	_, inDirty := pw.dirty[pgno]
+	_, inFlushing := pw.flushing[pgno]
+	return inDirty || inFlushing
+}
+
+// discardAfter 丢弃页号大于maxPgno的脏页, 用于截断数据库文件
+func (pw *pageWriter) discardAfter(maxPgno int) {
+	pw.flushLock.Lock()
+	defer pw.flushLock.Unlock()
+	pw.bufLock.Lock()
+	defer pw.bufLock.Unlock()
+
+	for pgno := range pw.dirty {
+		if pgno > maxPgno {
+			delete(pw.dirty, pgno)
+		}
+	}
+}
+
+// flush 把当前缓冲的所有脏页按偏移排序后写回, 并只fsync一次
+func (pw *pageWriter) flush() error {
+	pw.flushLock.Lock()
+	defer pw.flushLock.Unlock()
+
+	pw.bufLock.Lock()
+	if len(pw.dirty) == 0 {
+		pw.bufLock.Unlock()
+		return nil
+	}
+	pw.flushing, pw.dirty = pw.dirty, make(map[int][]byte)
+	batch := make([]dirtyPage, 0, len(pw.flushing))
+	for pgno, data := range pw.flushing {
+		batch = append(batch, dirtyPage{pgno: pgno, data: data})
+	}
+	pw.bufLock.Unlock()
+
+	sort.Slice(batch, func(i, j int) bool {
+		return batch[i].pgno < batch[j].pgno
+	})
+	err := pw.pc.writePages(batch)
+
+	pw.bufLock.Lock()
+	defer pw.bufLock.Unlock()
+	if err != nil {
+		// 写回失败的页面放回缓冲, 除非期间又有了更新的快照
+		for pgno, data := range pw.flushing {
+			if _, exists := pw.dirty[pgno]; !exists {
+				pw.dirty[pgno] = data
+			}
+		}
+	}
+	pw.flushing = make(map[int][]byte)
+	pw.flushed.Broadcast()
+	return err
+}
+
+// close 停止后台goroutine并写回所有剩余的脏页
+func (pw *pageWriter) close() error {
+	close(pw.stop)
+	<-pw.done
+	if err := pw.flush(); err != nil {
+		return err
+	}
+	pw.bufLock.Lock()
+	defer pw.bufLock.Unlock()
+	return pw.err
+}
+
+// takeErr 返回并清除后台写回遇到的错误
+func (pw *pageWriter) takeErr() error {
+	pw.bufLock.Lock()
+	defer pw.bufLock.Unlock()
+	err := pw.err
+	pw.err = nil
+	return err
+}
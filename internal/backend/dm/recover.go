@@ -1,39 +1,66 @@
 package dm
 
 import (
+	"errors"
 	"fmt"
 
 	"github.com/herveyleaf/GoDB/internal/backend/tm"
 	"github.com/herveyleaf/GoDB/internal/backend/utils"
+	"github.com/herveyleaf/GoDB/pkg/common"
 )
 
 const (
 	LOG_TYPE_INSERT byte = 0
 	LOG_TYPE_UPDATE byte = 1
-	REDO            int  = 0
-	UNDO            int  = 1
+	// 页面级日志, 都以超级事务的名义记录, 重做时总是执行
+	LOG_TYPE_FREE     byte = 2 // 页面被放入空闲页链表
+	LOG_TYPE_ALLOC    byte = 3 // 空闲页被取出重新使用
+	LOG_TYPE_TRUNCATE byte = 4 // 文件被截断到Pgno页
+	// 溢出页日志属于插入数据的事务, 格式和页面级日志相同, 后面跟着页面的内容
+	LOG_TYPE_OVERFLOW byte = 5
+	// 整页日志, 以超级事务的名义记录页面整理之后或者撤销更新之后的整个页面
+	LOG_TYPE_COMPACT byte = 6
+	// 批量插入日志, 一条日志记录插入同一个页面的多条数据
+	LOG_TYPE_BATCH byte = 7
+	// 每个日志段的第一条日志, 记录换日志段时的页数. 之前的日志段删除之后, 恢复时用它确定文件应有的页数
+	LOG_TYPE_SEGMENT byte = 8
+	REDO             int  = 0
+	UNDO             int  = 1
 
-	OF_TYPE       int = 0
-	OF_XID        int = OF_TYPE + 1
-	OF_UPDATE_UID int = OF_XID + 8
-	OF_UPDATE_RAW int = OF_UPDATE_UID + 8
+	OF_TYPE int = 0
+	OF_XID  int = OF_TYPE + 1
 
+	// 更新日志: [LogType][XID][UID][Offset][OldLength][OldRaw][NewRaw], Offset是NewRaw写入的位置.
+	// 更新前后的长度可以不同, 长度变大时DataItem可能换了位置
+	OF_UPDATE_UID     int = OF_XID + 8
+	OF_UPDATE_OFFSET  int = OF_UPDATE_UID + 8
+	OF_UPDATE_OLD_LEN int = OF_UPDATE_OFFSET + 2
+	OF_UPDATE_RAW     int = OF_UPDATE_OLD_LEN + 2
+
+	// 插入日志: [LogType][XID][Pgno][Slot][Offset][Raw]
 	OF_INSERT_PGNO   int = OF_XID + 8
-	OF_INSERT_OFFSET int = OF_INSERT_PGNO + 4
+	OF_INSERT_SLOT   int = OF_INSERT_PGNO + 4
+	OF_INSERT_OFFSET int = OF_INSERT_SLOT + 2
 	OF_INSERT_RAW        = OF_INSERT_OFFSET + 2
+
+	// 页面级日志: [LogType][XID][Pgno]
+	OF_PAGE_PGNO int = OF_XID + 8
+	LEN_PAGE_LOG int = OF_PAGE_PGNO + 4
 )
 
 type InsertLogInfo struct {
 	xid    int64
 	pgno   int
-	offset int16
+	slot   int
+	offset int
 	raw    []byte
 }
 
 type UpdateLogInfo struct {
 	xid    int64
 	pgno   int
-	offset int16
+	slot   int
+	offset int
 	oldRaw []byte
 	newRaw []byte
 }
@@ -46,174 +73,359 @@ func NewUpdateLogInfo() *UpdateLogInfo {
 	return &UpdateLogInfo{}
 }
 
-func Recover(tm tm.TransactionManager, lg Logger, pc PageCache) {
-	fmt.Println("Recovering...")
+// Recover 重做已经结束的事务, 撤销崩溃时仍然活跃的事务. 出错时数据库仍然处于需要恢复的状态, 下次打开时重新恢复.
+// logf不为nil时用来输出恢复的进度
+func Recover(tm tm.TransactionManager, lg Logger, pc PageCache, logf func(format string, args ...any)) error {
+	if logf == nil {
+		logf = func(string, ...any) {}
+	}
+	logf("recovering")
 
 	lg.Rewind()
-	maxPgno := 0
+	// maxPgno是日志中出现过的最大页号, finalPgno是考虑了截断之后最后应有的页数
+	maxPgno, finalPgno := 1, 1
 	for {
-		log := lg.Next()
+		log, err := lg.Next()
+		if err != nil {
+			return err
+		}
 		if log == nil {
 			break
 		}
-		var pgno int
-		if isInsertLog(log) {
-			li := parseInsertLog(log)
-			pgno = li.pgno
+		_, pgno := parseLogTarget(log)
+		maxPgno = max(maxPgno, pgno)
+		if log[OF_TYPE] == LOG_TYPE_TRUNCATE || log[OF_TYPE] == LOG_TYPE_SEGMENT {
+			finalPgno = pgno
 		} else {
-			li := parseUpdateLog(log)
-			pgno = li.pgno
-		}
-		if pgno > maxPgno {
-			maxPgno = pgno
+			finalPgno = max(finalPgno, pgno)
 		}
 	}
-	if maxPgno == 0 {
-		maxPgno = 1
+	if err := pc.TruncateByPgno(maxPgno); err != nil {
+		return err
+	}
+	logf("truncate to %d pages", maxPgno)
+	if err := resetBrokenPages(pc, maxPgno); err != nil {
+		return err
+	}
+	if err := redoTransactions(tm, lg, pc, maxPgno); err != nil {
+		return err
+	}
+	logf("redo transactions over")
+	if err := undoTransactions(tm, lg, pc); err != nil {
+		return err
 	}
-	pc.TruncateByPgno(maxPgno)
-	fmt.Println("Truncate to ", maxPgno, " pages.")
-	redoTransactions(tm, lg, pc)
-	fmt.Println("Redo Transactions Over.")
-	undoTransactions(tm, lg, pc)
-	fmt.Println("Undo Transactions Over")
+	logf("undo transactions over")
+	if finalPgno < maxPgno {
+		if err := pc.TruncateByPgno(finalPgno); err != nil {
+			return err
+		}
+	}
+
+	logf("recovery over")
+	return nil
+}
 
-	fmt.Println("Recovery Over.")
+// resetBrokenPages 崩溃前还没有写回过的页面在文件中全是0, 撕裂了又无法从双写文件恢复的页面校验和不匹配.
+// 旧的日志段只在其中的修改都已经写回并且有双写文件保护时才会删除, 这些页面上的每一次修改都还在日志中,
+// 所以把它们重置为空页后可以完全由重做重建
+func resetBrokenPages(pc PageCache, maxPgno int) error {
+	for pgno := 2; pgno <= maxPgno; pgno++ {
+		pg, err := pc.GetPage(pgno)
+		if err == nil {
+			pg.Release()
+			continue
+		}
+		if !errors.Is(err, common.ErrPageCorrupted) {
+			return err
+		}
+		pc.ResetPage(pgno, InitRawX(pc.PageSize()))
+	}
+	return nil
 }
 
-func redoTransactions(tm tm.TransactionManager, lg Logger, pc PageCache) {
+// redoTransactions 按顺序重做所有已经结束的事务的日志, 包括撤销时写入的补偿日志和页面级日志
+func redoTransactions(tm tm.TransactionManager, lg Logger, pc PageCache, maxPgno int) error {
 	lg.Rewind()
 	for {
-		log := lg.Next()
+		log, err := lg.Next()
+		if err != nil {
+			return err
+		}
 		if log == nil {
-			break
+			return nil
 		}
-		if isInsertLog(log) {
-			li := parseInsertLog(log)
-			xid := li.xid
-			if !tm.IsActive(xid) {
-				doInsertLog(pc, log, REDO)
-			}
-		} else {
-			xi := parseUpdateLog(log)
-			xid := xi.xid
-			if !tm.IsActive(xid) {
-				doUpdateLog(pc, log, REDO)
-			}
+		xid, _ := parseLogTarget(log)
+		active, err := tm.IsActive(xid)
+		if err != nil {
+			return err
+		}
+		if active {
+			continue
+		}
+		if err := redoLog(pc, log, maxPgno); err != nil {
+			return err
 		}
 	}
 }
 
-func undoTransactions(tm tm.TransactionManager, lg Logger, pc PageCache) {
-	logCache := make(map[int64][][]byte)
+// redoLog 按日志的类型重做一条日志
+func redoLog(pc PageCache, log []byte, maxPgno int) error {
+	switch log[OF_TYPE] {
+	case LOG_TYPE_INSERT:
+		return doInsertLog(pc, log, REDO)
+	case LOG_TYPE_UPDATE:
+		return doUpdateLog(pc, log, REDO)
+	case LOG_TYPE_OVERFLOW:
+		doOverflowLog(pc, log)
+		return nil
+	case LOG_TYPE_COMPACT:
+		doCompactLog(pc, log)
+		return nil
+	case LOG_TYPE_BATCH:
+		return doBatchLog(pc, log)
+	default:
+		return doPageLog(pc, log, maxPgno)
+	}
+}
+
+// undoTransactions 倒序撤销崩溃时仍然活跃的事务的所有日志, 然后把它们标记为回滚
+func undoTransactions(tm tm.TransactionManager, lg Logger, pc PageCache) error {
+	var logs [][]byte
+	var losers []int64
+	seen := make(map[int64]bool)
 	lg.Rewind()
 	for {
-		log := lg.Next()
+		log, err := lg.Next()
+		if err != nil {
+			return err
+		}
 		if log == nil {
 			break
 		}
-		if isInsertLog(log) {
-			li := parseInsertLog(log)
-			xid := li.xid
-			if tm.IsActive(xid) {
-				if _, exists := logCache[xid]; !exists {
-					logCache[xid] = [][]byte{}
-				}
-				logCache[xid] = append(logCache[xid], log)
-			}
+		// 只有插入和更新需要撤销, 溢出页在描述失效之后由恢复后的扫描回收
+		if log[OF_TYPE] != LOG_TYPE_INSERT && log[OF_TYPE] != LOG_TYPE_UPDATE && log[OF_TYPE] != LOG_TYPE_BATCH {
+			continue
+		}
+		xid, _ := parseLogTarget(log)
+		active, err := tm.IsActive(xid)
+		if err != nil {
+			return err
+		}
+		if !active {
+			continue
+		}
+		logs = append(logs, log)
+		if !seen[xid] {
+			seen[xid] = true
+			losers = append(losers, xid)
 		}
 	}
 
-	for xid, logs := range logCache {
-		for i := len(logs) - 1; i >= 0; i-- {
-			log := logs[i]
-			if isInsertLog(log) {
-				doInsertLog(pc, log, UNDO)
-			} else {
-				doUpdateLog(pc, log, UNDO)
+	for i := len(logs) - 1; i >= 0; i-- {
+		clr, err := compensationLog(pc, logs[i], nil)
+		if err != nil {
+			return err
+		}
+		if err := lg.Log(clr); err != nil {
+			return err
+		}
+		if err := redoLog(pc, clr, 0); err != nil {
+			return err
+		}
+	}
+	// 补偿日志落盘之后才能标记回滚, 否则重做时会重做被撤销的事务而没有对应的补偿
+	if err := lg.Flush(); err != nil {
+		return err
+	}
+	for _, xid := range losers {
+		if err := tm.Abort(xid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compensationLog 撤销一条日志时写入的补偿日志, 以超级事务的名义记录撤销之后的内容.
+// 事务被标记为回滚后它的日志还会被重做, 排在后面的补偿日志保证重做的结果仍然是撤销之后的.
+// 插入之后页面可能被整理过, 补偿日志记录的是DataItem现在的位置. 撤销更新时旧的内容不一定还能放回原处,
+// 补偿日志记录的是换回旧内容之后的整个页面, 整理页面时keep要求的槽不会被丢弃
+func compensationLog(pc PageCache, log []byte, keep func(slot int) bool) ([]byte, error) {
+	if log[OF_TYPE] == LOG_TYPE_BATCH {
+		return batchCompensationLog(pc, log)
+	}
+	if isInsertLog(log) {
+		li := parseInsertLog(log)
+		raw := make([]byte, len(li.raw))
+		copy(raw, li.raw)
+		SetDataItemRawInvalid(raw)
+		offset := li.offset
+		if pg, err := pc.GetPage(li.pgno); err == nil {
+			if current, ok := itemOffset(pg.GetData(), li.slot); ok {
+				offset = current
 			}
+			pg.Release()
 		}
-		tm.Abort(xid)
+		return insertLogRaw(tm.SUPER_XID, li.pgno, li.slot, offset, raw), nil
+	}
+	xi := parseUpdateLog(log)
+	pg, err := pc.GetPage(xi.pgno)
+	if err != nil {
+		return nil, err
+	}
+	defer pg.Release()
+	image, ok := restoreItem(pg.GetData(), xi.slot, xi.oldRaw, keep)
+	if !ok {
+		return nil, fmt.Errorf("%w: no room to undo update of %d", common.ErrBadDBFile, utils.AddressToUid(xi.pgno, xi.slot))
 	}
+	return CompactLog(xi.pgno, image), nil
+}
+
+// CompactLog 页面整理日志: [LogType][XID][Pgno][Image], 重做时整页重建
+func CompactLog(pgno int, image []byte) []byte {
+	return append(PageLog(LOG_TYPE_COMPACT, pgno), image...)
+}
+
+func doCompactLog(pc PageCache, log []byte) {
+	_, pgno := parseLogTarget(log)
+	image := make([]byte, pc.PageSize())
+	copy(image, log[LEN_PAGE_LOG:])
+	pc.ResetPage(pgno, image)
 }
 
 func isInsertLog(log []byte) bool {
 	return log[0] == LOG_TYPE_INSERT
 }
 
+// parseLogTarget 返回任意一条日志所属的事务和修改的页面
+func parseLogTarget(log []byte) (int64, int) {
+	switch log[OF_TYPE] {
+	case LOG_TYPE_INSERT:
+		li := parseInsertLog(log)
+		return li.xid, li.pgno
+	case LOG_TYPE_UPDATE:
+		xi := parseUpdateLog(log)
+		return xi.xid, xi.pgno
+	}
+	return utils.ParseLong(log[OF_XID:OF_PAGE_PGNO]), utils.ParseInt(log[OF_PAGE_PGNO:LEN_PAGE_LOG])
+}
+
+// PageLog 页面级日志, 页面的内容在重做时整页重建, 不需要记录修改前后的数据
+func PageLog(logType byte, pgno int) []byte {
+	logTypeRaw := []byte{logType}
+	xidRaw := utils.Long2Byte(tm.SUPER_XID)
+	pgnoRaw := utils.Int2Byte(pgno)
+	return append(append(logTypeRaw, xidRaw...), pgnoRaw...)
+}
+
+// doPageLog 重做页面级日志. 页面被释放或截断之前的日志在重做时仍然会写入页面,
+// 这里把页面重置, 让之后的日志从空页开始重建
+func doPageLog(pc PageCache, log []byte, maxPgno int) error {
+	_, pgno := parseLogTarget(log)
+	switch log[OF_TYPE] {
+	case LOG_TYPE_FREE:
+		pc.ResetPage(pgno, InitRawFree(pc.PageSize(), 0))
+	case LOG_TYPE_ALLOC:
+		pc.ResetPage(pgno, InitRawX(pc.PageSize()))
+	case LOG_TYPE_TRUNCATE:
+		for p := pgno + 1; p <= maxPgno; p++ {
+			pc.ResetPage(p, InitRawX(pc.PageSize()))
+		}
+	case LOG_TYPE_SEGMENT:
+	default:
+		return common.ErrBadLogFile
+	}
+	return nil
+}
+
+// UpdateLog 原地修改的日志, 记录的是数据实际所在的位置
 func UpdateLog(xid int64, di DataItem) []byte {
+	dii := di.(*DataItemImpl)
+	return updateLogRaw(xid, dii.loc, dii.offset, di.GetOldRaw(), di.GetRaw())
+}
+
+func updateLogRaw(xid int64, uid int64, offset int, oldRaw []byte, newRaw []byte) []byte {
 	logType := []byte{LOG_TYPE_UPDATE}
 	xidRaw := utils.Long2Byte(xid)
-	uidRaw := utils.Long2Byte(di.GetUid())
-	oldRaw := di.GetOldRaw()
-	newRaw := di.GetRaw()
-	return append(append(append(append(logType, xidRaw...), uidRaw...), oldRaw...), newRaw...)
+	uidRaw := utils.Long2Byte(uid)
+	offsetRaw := utils.Short2Byte(int16(offset))
+	oldLenRaw := utils.Short2Byte(int16(len(oldRaw)))
+	return append(append(append(append(append(append(logType, xidRaw...), uidRaw...), offsetRaw...), oldLenRaw...), oldRaw...), newRaw...)
 }
 
 func parseUpdateLog(log []byte) *UpdateLogInfo {
 	li := NewUpdateLogInfo()
 	li.xid = utils.ParseLong(log[OF_XID:OF_UPDATE_UID])
-	uid := utils.ParseLong(log[OF_UPDATE_UID:OF_UPDATE_RAW])
-	li.offset = int16(uid & ((int64(1) << 16) - 1))
-	uid = int64(uint64(uid) >> 32)
-	li.pgno = int(uid & ((int64(1) << 32) - 1))
-	length := (len(log) - OF_UPDATE_RAW) / 2
+	li.pgno, li.slot = utils.UidToAddress(utils.ParseLong(log[OF_UPDATE_UID:OF_UPDATE_RAW]))
+	li.offset = int(uint16(utils.ParseShort(log[OF_UPDATE_OFFSET:OF_UPDATE_OLD_LEN])))
+	length := int(uint16(utils.ParseShort(log[OF_UPDATE_OLD_LEN:OF_UPDATE_RAW])))
 	li.oldRaw = log[OF_UPDATE_RAW : OF_UPDATE_RAW+length]
-	li.newRaw = log[OF_UPDATE_RAW+length : OF_UPDATE_RAW+length*2]
+	li.newRaw = log[OF_UPDATE_RAW+length:]
 	return li
 }
 
-func doUpdateLog(pc PageCache, log []byte, flag int) {
+func doUpdateLog(pc PageCache, log []byte, flag int) error {
 	var pgno int
-	var offset int16
+	var slot int
+	var offset int
 	var raw []byte
 	if flag == REDO {
 		xi := parseUpdateLog(log)
 		pgno = xi.pgno
+		slot = xi.slot
 		offset = xi.offset
 		raw = xi.newRaw
 	} else {
 		xi := parseUpdateLog(log)
 		pgno = xi.pgno
+		slot = xi.slot
 		offset = xi.offset
 		raw = xi.oldRaw
 	}
 	var pg Page = nil
 	var err error
 	if pg, err = pc.GetPage(pgno); err != nil {
-		panic(err)
+		return err
 	}
 	defer pg.Release()
-	RecoverUpdate(pg, raw, offset)
+	RecoverUpdate(pg, slot, raw, offset)
+	return nil
 }
 
+// InsertLog 记录Insert将要使用的槽和位置
 func InsertLog(xid int64, pg Page, raw []byte) []byte {
+	return insertLogRaw(xid, pg.GetPageNumber(), nextSlot(pg.GetData()), GetFSO(pg), raw)
+}
+
+func insertLogRaw(xid int64, pgno int, slot int, offset int, raw []byte) []byte {
 	logTypeRaw := []byte{LOG_TYPE_INSERT}
 	xidRaw := utils.Long2Byte(xid)
-	pgnoRaw := utils.Int2Byte(pg.GetPageNumber())
-	offsetRaw := utils.Short2Byte(GetFSO(pg))
-	return append(append(append(append(logTypeRaw, xidRaw...), pgnoRaw...), offsetRaw...), raw...)
+	pgnoRaw := utils.Int2Byte(pgno)
+	slotRaw := utils.Short2Byte(int16(slot))
+	offsetRaw := utils.Short2Byte(int16(offset))
+	return append(append(append(append(append(logTypeRaw, xidRaw...), pgnoRaw...), slotRaw...), offsetRaw...), raw...)
 }
 
 func parseInsertLog(log []byte) *InsertLogInfo {
 	li := NewInsertLogInfo()
 	li.xid = utils.ParseLong(log[OF_XID:OF_INSERT_PGNO])
-	li.pgno = utils.ParseInt(log[OF_INSERT_PGNO:OF_INSERT_OFFSET])
-	li.offset = utils.ParseShort(log[OF_INSERT_PGNO:OF_INSERT_OFFSET])
+	li.pgno = utils.ParseInt(log[OF_INSERT_PGNO:OF_INSERT_SLOT])
+	li.slot = int(uint16(utils.ParseShort(log[OF_INSERT_SLOT:OF_INSERT_OFFSET])))
+	li.offset = int(uint16(utils.ParseShort(log[OF_INSERT_OFFSET:OF_INSERT_RAW])))
 	li.raw = log[OF_INSERT_RAW:]
 	return li
 }
 
-func doInsertLog(pc PageCache, log []byte, flag int) {
+func doInsertLog(pc PageCache, log []byte, flag int) error {
 	li := parseInsertLog(log)
 	var pg Page = nil
 	var err error
 	if pg, err = pc.GetPage(li.pgno); err != nil {
-		panic(err)
+		return err
 	}
 	defer pg.Release()
 	if flag == UNDO {
 		SetDataItemRawInvalid(li.raw)
 	}
-	RecoverInsert(pg, li.raw, li.offset)
+	RecoverInsert(pg, li.slot, li.raw, li.offset)
+	return nil
 }
@@ -0,0 +1,440 @@
+package dm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"slices"
+	"sort"
+	"testing"
+
+	"github.com/herveyleaf/GoDB/internal/backend/tm"
+	"github.com/herveyleaf/GoDB/internal/backend/utils"
+	"github.com/herveyleaf/GoDB/internal/backend/vfs/vfstest"
+)
+
+// 崩溃恢复测试: 在CrashFS上随机执行事务, 在任意一次文件操作时断电, 重新打开后检查
+// 已经提交的事务的数据都还在, 没有提交的事务的插入和更新都被撤销
+
+const (
+	CRASH_TEST_PATH   = "crash"
+	CRASH_TEST_ROUNDS = 3
+	CRASH_TEST_TXNS   = 30
+)
+
+// workloadOp 一次成功返回的插入、更新或者删除, 删除时data为nil
+type workloadOp struct {
+	xid    int64
+	uid    int64
+	insert bool
+	data   []byte
+}
+
+type crashWorkload struct {
+	t      *testing.T
+	rnd    *rand.Rand
+	fsys   *vfstest.CrashFS
+	tm     tm.TransactionManager
+	dm     DataManager
+	ops    []workloadOp
+	since  int            // 本轮开始时ops的长度, 之前的轮次中被撤销的数据所在的页面可能已经被重新使用
+	key    []byte         // 偶数的种子加密数据库
+	comp   bool           // 种子是3的倍数时压缩页面
+	mmap   bool           // 种子除以4余1并且不压缩时通过内存映射访问数据库文件
+	sync   SyncMode       // 种子除以5余0或1时只在提交和写回页面之前fsync日志
+	logSeg int64          // 种子除以3余1时使用很小的日志段, 频繁地换日志段和删除旧的日志段
+	commit map[int64]bool // Commit已经返回的事务
+	uids   []int64        // 已提交的可以被更新的数据
+	locked map[int64]bool // 被未结束的事务更新过的数据, 其它事务不能再更新
+	large  map[int64]bool // 存放在溢出页中的数据, 不能原地更新
+}
+
+func TestCrashRecovery(t *testing.T) {
+	for seed := int64(1); seed <= 30; seed++ {
+		t.Run(fmt.Sprintf("seed%d", seed), func(t *testing.T) {
+			runCrashRecovery(t, seed)
+		})
+	}
+}
+
+// 断电之后的操作返回错误而不是panic, 数据库在重新打开时恢复
+func TestErrorsAfterPowerLoss(t *testing.T) {
+	fsys := vfstest.NewCrashFS(1)
+	tmgr, err := tm.CreateWithConfig("power", tm.Config{FS: fsys, Locked: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := CreateDMWithConfig("power", MIN_PAGE_SIZE*MEM_MIN_LIM, tmgr, Config{PageSize: MIN_PAGE_SIZE, FS: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	xid, _ := tmgr.Begin()
+	uid, _ := d.Insert(xid, []byte("abc"))
+	fsys.Crash()
+
+	if _, err := d.Insert(xid, []byte("def")); !errors.Is(err, vfstest.ErrPowerLoss) {
+		t.Fatalf("Expected Insert to fail with ErrPowerLoss, got %v", err)
+	}
+	if err := d.Update(xid, uid, bytes.Repeat([]byte{1}, 100)); !errors.Is(err, vfstest.ErrPowerLoss) {
+		t.Fatalf("Expected Update to fail with ErrPowerLoss, got %v", err)
+	}
+	if err := tmgr.Commit(xid); !errors.Is(err, vfstest.ErrPowerLoss) {
+		t.Fatalf("Expected Commit to fail with ErrPowerLoss, got %v", err)
+	}
+	if err := d.Close(); err == nil {
+		t.Fatalf("Expected Close to fail after power loss")
+	}
+	tmgr.Close()
+	fsys.Restart()
+
+	if tmgr, err = tm.OpenWithConfig("power", tm.Config{FS: fsys, Locked: true}); err != nil {
+		t.Fatal(err)
+	}
+	defer tmgr.Close()
+	if d, err = OpenDMWithConfig("power", MIN_PAGE_SIZE*MEM_MIN_LIM, tmgr, Config{FS: fsys}); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if di, err := d.Read(uid); err != nil || di != nil {
+		t.Fatalf("Uncommitted insert survived recovery: %v", err)
+	}
+}
+
+func runCrashRecovery(t *testing.T, seed int64) {
+	w := &crashWorkload{
+		t:      t,
+		rnd:    rand.New(rand.NewSource(seed)),
+		fsys:   vfstest.NewCrashFS(seed),
+		commit: make(map[int64]bool),
+		locked: make(map[int64]bool),
+		large:  make(map[int64]bool),
+	}
+	if seed%2 == 0 {
+		w.key = bytes.Repeat([]byte{byte(seed)}, 16)
+	}
+	w.comp = seed%3 == 0
+	if seed%5 < 2 {
+		w.sync = SYNC_COMMIT
+	}
+	if seed%3 == 1 {
+		w.logSeg = 1 << 10
+	}
+	if w.mmap = seed%4 == 1 && !w.comp; w.mmap {
+		mapRegion = mapTestRegion
+		defer func() { mapRegion = mapFileRegion }()
+	}
+	var err error
+	if w.tm, err = tm.CreateWithConfig(CRASH_TEST_PATH, w.tmConfig()); err != nil {
+		t.Fatal(err)
+	}
+	if w.dm, err = CreateDMWithConfig(CRASH_TEST_PATH, MIN_PAGE_SIZE*MEM_MIN_LIM, w.tm, w.config()); err != nil {
+		t.Fatal(err)
+	}
+
+	for round := 0; round < CRASH_TEST_ROUNDS; round++ {
+		// 先估计一轮大概有多少次文件操作, 在其中随机选一个断电点
+		w.fsys.CrashAfter(w.rnd.Intn(CRASH_TEST_TXNS*12) + 1)
+		w.since = len(w.ops)
+		if !w.runTxns() {
+			w.fsys.Crash()
+		}
+		w.closeAfterCrash()
+		w.fsys.Restart()
+		w.reopen()
+		w.verify()
+	}
+
+	// 最后正常关闭再打开一次
+	w.dm.Close()
+	w.tm.Close()
+	w.reopen()
+	w.verify()
+	w.dm.Close()
+	w.tm.Close()
+}
+
+func (w *crashWorkload) config() Config {
+	return Config{PageSize: MIN_PAGE_SIZE, FS: w.fsys, EncryptionKey: w.key, Compress: w.comp, Mmap: w.mmap, Sync: w.sync, LogSegmentSize: w.logSeg}
+}
+
+func (w *crashWorkload) tmConfig() tm.Config {
+	// TM和DM共用数据库的锁, 由DM加锁
+	return tm.Config{FS: w.fsys, EncryptionKey: w.key, Locked: true}
+}
+
+// runTxns 执行一轮事务, 断电时返回true
+func (w *crashWorkload) runTxns() (crashed bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			if !w.fsys.Crashed() {
+				panic(r)
+			}
+			crashed = true
+		}
+	}()
+
+	for i := 0; i < CRASH_TEST_TXNS; i++ {
+		xid, err := w.tm.Begin()
+		if err != nil {
+			panic(err)
+		}
+		var inserted, updated, deleted []int64
+		for n := w.rnd.Intn(4) + 1; n > 0; n-- {
+			if uid, ok := w.pickUpdate(); ok && w.rnd.Intn(8) == 0 {
+				w.delete(xid, uid)
+				deleted = append(deleted, uid)
+			} else if ok && w.rnd.Intn(3) == 0 {
+				w.update(xid, uid)
+				updated = append(updated, uid)
+			} else {
+				inserted = append(inserted, w.insert(xid))
+			}
+		}
+		if w.rnd.Intn(5) == 0 {
+			if err := w.dm.Checkpoint(); err != nil {
+				panic(err)
+			}
+		}
+		if w.rnd.Intn(10) == 0 {
+			if _, err := w.dm.Shrink(); err != nil {
+				panic(err)
+			}
+		}
+		// 一部分事务一直不结束, 崩溃后应该被撤销; 一部分在运行时回滚, 之后可以再被修改
+		switch w.rnd.Intn(8) {
+		case 0, 1:
+			continue
+		case 2:
+			if err := w.dm.Abort(xid); err != nil {
+				panic(err)
+			}
+			if err := w.tm.Abort(xid); err != nil {
+				panic(err)
+			}
+			for _, uid := range append(updated, deleted...) {
+				delete(w.locked, uid)
+			}
+			continue
+		}
+		if err := w.dm.SyncLog(); err != nil {
+			panic(err)
+		}
+		if err := w.tm.Commit(xid); err != nil {
+			panic(err)
+		}
+		w.commit[xid] = true
+		w.uids = append(w.uids, inserted...)
+		for _, uid := range updated {
+			delete(w.locked, uid)
+		}
+		// 删掉的数据仍然留在locked中, 不会再被选中
+		uids := w.uids[:0]
+		for _, uid := range w.uids {
+			if !slices.Contains(deleted, uid) {
+				uids = append(uids, uid)
+			}
+		}
+		w.uids = uids
+	}
+	return false
+}
+
+func (w *crashWorkload) pickUpdate() (int64, bool) {
+	if len(w.uids) == 0 {
+		return 0, false
+	}
+	uid := w.uids[w.rnd.Intn(len(w.uids))]
+	return uid, !w.locked[uid] && !w.large[uid]
+}
+
+func (w *crashWorkload) insert(xid int64) int64 {
+	data := make([]byte, w.rnd.Intn(300)+4)
+	if w.rnd.Intn(20) == 0 {
+		data = make([]byte, w.rnd.Intn(3*MIN_PAGE_SIZE)+MIN_PAGE_SIZE)
+	}
+	w.rnd.Read(data)
+	uid, err := w.dm.Insert(xid, data)
+	if err != nil {
+		panic(err)
+	}
+	if len(data) >= MIN_PAGE_SIZE {
+		w.large[uid] = true
+	}
+	w.ops = append(w.ops, workloadOp{xid: xid, uid: uid, insert: true, data: data})
+	return uid
+}
+
+func (w *crashWorkload) update(xid int64, uid int64) {
+	di, err := w.dm.Read(uid)
+	if err != nil {
+		panic(err)
+	}
+	w.locked[uid] = true
+	// 一半的更新改变数据的长度, 有时会把数据搬到别的页面
+	if w.rnd.Intn(2) == 0 {
+		di.Release()
+		data := make([]byte, w.rnd.Intn(300)+1)
+		if w.rnd.Intn(5) == 0 {
+			data = make([]byte, w.rnd.Intn(MIN_PAGE_SIZE/2)+1)
+		}
+		w.rnd.Read(data)
+		if err := w.dm.Update(xid, uid, data); err != nil {
+			panic(err)
+		}
+		w.ops = append(w.ops, workloadOp{xid: xid, uid: uid, data: data})
+		return
+	}
+	data := make([]byte, len(di.Data()))
+	w.rnd.Read(data)
+	if err := di.Before(); err != nil {
+		panic(err)
+	}
+	copy(di.Data(), data)
+	err = di.After(xid)
+	di.Release()
+	if err != nil {
+		panic(err)
+	}
+	w.ops = append(w.ops, workloadOp{xid: xid, uid: uid, data: data})
+}
+
+func (w *crashWorkload) delete(xid int64, uid int64) {
+	w.locked[uid] = true
+	if err := w.dm.Delete(xid, uid); err != nil {
+		panic(err)
+	}
+	w.ops = append(w.ops, workloadOp{xid: xid, uid: uid})
+}
+
+// closeAfterCrash 断电后关闭旧的实例, 让后台goroutine退出, 关闭时写文件会遇到断电的错误
+func (w *crashWorkload) closeAfterCrash() {
+	if w.dm != nil {
+		if err := w.dm.Close(); !errors.Is(err, vfstest.ErrPowerLoss) {
+			w.t.Fatalf("Expected ErrPowerLoss from Close after a crash, got %v", err)
+		}
+	}
+	if w.tm != nil {
+		w.tm.Close()
+	}
+}
+
+// reopen 重新打开数据库, 有时会在恢复过程中再次断电
+func (w *crashWorkload) reopen() {
+	for {
+		if w.rnd.Intn(3) == 0 {
+			w.fsys.CrashAfter(w.rnd.Intn(60) + 1)
+		}
+		if w.tryOpen() {
+			w.fsys.CrashAfter(0)
+			// 打开之后后台的检查点可能已经用掉了断电点
+			if !w.fsys.Crashed() {
+				break
+			}
+			w.closeAfterCrash()
+		}
+		w.fsys.Restart()
+	}
+
+	// 恢复之后所有没有提交的事务都已经结束, 它们锁住的数据可以再被更新
+	w.locked = make(map[int64]bool)
+	w.uids = w.uids[:0]
+	for uid := range w.expected() {
+		w.uids = append(w.uids, uid)
+	}
+	sort.Slice(w.uids, func(i, j int) bool { return w.uids[i] < w.uids[j] })
+}
+
+func (w *crashWorkload) tryOpen() (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			if !w.fsys.Crashed() {
+				panic(r)
+			}
+			w.closeAfterCrash()
+			ok = false
+		}
+	}()
+	w.dm, w.tm = nil, nil
+	var err error
+	if w.tm, err = tm.OpenWithConfig(CRASH_TEST_PATH, w.tmConfig()); err != nil {
+		panic(err)
+	}
+	if w.dm, err = OpenDMWithConfig(CRASH_TEST_PATH, MIN_PAGE_SIZE*MEM_MIN_LIM, w.tm, w.config()); err != nil {
+		panic(err)
+	}
+	return true
+}
+
+func (w *crashWorkload) committed(xid int64) bool {
+	committed, err := w.tm.IsCommitted(xid)
+	if err != nil {
+		w.t.Fatal(err)
+	}
+	return committed
+}
+
+// expected 按当前事务状态计算每条已提交数据应有的内容
+func (w *crashWorkload) expected() map[int64][]byte {
+	values := make(map[int64][]byte)
+	for _, op := range w.ops {
+		if !w.committed(op.xid) {
+			continue
+		}
+		if op.data == nil {
+			delete(values, op.uid)
+		} else {
+			values[op.uid] = op.data
+		}
+	}
+	return values
+}
+
+func (w *crashWorkload) verify() {
+	t := w.t
+	for xid := range w.commit {
+		if !w.committed(xid) {
+			t.Fatalf("Committed transaction %d was lost", xid)
+		}
+	}
+	values := w.expected()
+	for uid, data := range values {
+		di, err := w.dm.Read(uid)
+		if err != nil {
+			t.Fatalf("Read %d failed: %v", uid, err)
+		}
+		if di == nil {
+			t.Fatalf("Committed item %d vanished", uid)
+		}
+		if !bytes.Equal(di.Data(), data) {
+			t.Fatalf("Item %d has wrong content after recovery", uid)
+		}
+		di.Release()
+	}
+	pages := w.dm.(*DataManagerImpl).pc.GetPageNumber()
+	for _, op := range w.ops[w.since:] {
+		if !op.insert || w.committed(op.xid) {
+			continue
+		}
+		// 运行时回滚的插入腾出来的槽可以被之后的插入或者搬过来的数据重新使用
+		if _, ok := values[op.uid]; ok {
+			continue
+		}
+		// SYNC_COMMIT时没有落盘的插入可能连同新分配的页面一起丢失
+		if pgno, _ := utils.UidToAddress(op.uid); pgno > pages {
+			continue
+		}
+		di, err := w.dm.Read(op.uid)
+		if err != nil {
+			t.Fatalf("Read %d failed: %v", op.uid, err)
+		}
+		if di != nil {
+			moved := di.(*DataItemImpl).raw()[OF_VALID]&DATAITEM_MOVED != 0
+			di.Release()
+			if moved {
+				continue
+			}
+			t.Fatalf("Uncommitted item %d survived recovery", op.uid)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package dm
+
+import (
+	"errors"
+	"os"
+
+	"github.com/herveyleaf/GoDB/internal/backend/tm"
+	"github.com/herveyleaf/GoDB/internal/backend/utils"
+	"github.com/herveyleaf/GoDB/internal/backend/vfs"
+	"github.com/herveyleaf/GoDB/pkg/common"
+)
+
+const (
+	// 换密钥时新文件先写到path+REKEY_SUFFIX+后缀, 全部写完后创建path+REKEY_SUFFIX作为标记
+	REKEY_SUFFIX = ".rekey"
+)
+
+// 换密钥时需要重新加密的文件, 双写文件在开始前就已经删除, 不需要替换
+var rekeyFiles = []string{DB_SUFFIX, PMAP_SUFFIX, LOG_SUFFIX, tm.XID_SUFFIX}
+
+// Rekey 离线把数据库的.db、.log和.xid文件从cfg.EncryptionKey换成newKey重新加密, 数据库必须已经关闭, 否则返回common.ErrDatabaseLocked.
+// 两个密钥都可以为nil, 用来给没有加密的数据库加密或者去掉加密.
+// 新的文件先完整写到临时文件并fsync, 然后创建标记文件, 最后逐个替换原文件,
+// 中途失败时用同样的参数重新执行即可: 有标记文件时只需要完成剩下的替换
+func Rekey(path string, cfg Config, newKey []byte) error {
+	fsys := vfs.Or(cfg.FS)
+	fileLock, err := cfg.lock(path, false)
+	if err != nil {
+		return err
+	}
+	defer closeLock(fileLock)
+
+	if _, err := fsys.Stat(path + REKEY_SUFFIX); err == nil {
+		return finishRekey(fsys, path)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if newKey != nil && !utils.ValidKey(newKey) {
+		return common.ErrBadEncryptionKey
+	}
+
+	if err := rekeyDB(fsys, path, cfg.EncryptionKey, newKey); err != nil {
+		return err
+	}
+	if err := rekeyLog(fsys, path, cfg.EncryptionKey, newKey); err != nil {
+		return err
+	}
+	if err := rekeyXID(fsys, path, cfg.EncryptionKey, newKey); err != nil {
+		return err
+	}
+
+	marker, err := fsys.OpenFile(path+REKEY_SUFFIX, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	err = marker.Sync()
+	marker.Close()
+	if err != nil {
+		return err
+	}
+	return finishRekey(fsys, path)
+}
+
+// finishRekey 用临时文件替换还没有被替换的原文件, 再删除用旧密钥加密的旧日志段, 最后删除标记文件
+func finishRekey(fsys vfs.FS, path string) error {
+	for _, suffix := range rekeyFiles {
+		tmp := path + REKEY_SUFFIX + suffix
+		if _, err := fsys.Stat(tmp); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := fsys.Rename(tmp, path+suffix); err != nil {
+			return err
+		}
+	}
+	if err := RemoveOldSegments(fsys, path); err != nil {
+		return err
+	}
+	return fsys.Remove(path + REKEY_SUFFIX)
+}
+
+// createRekeyFile 创建临时文件, 覆盖上一次没有完成的尝试留下的文件
+func createRekeyFile(fsys vfs.FS, path string, suffix string) (vfs.File, error) {
+	return fsys.OpenFile(path+REKEY_SUFFIX+suffix, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+}
+
+func rekeyDB(fsys vfs.FS, path string, oldKey []byte, newKey []byte) error {
+	// 打开时会用双写文件修复写了一半的页面, 之后其中的副本就没有用了, 新文件的页面大小也可能不同
+	old, oldCodec, err := openPageStore(fsys, path, oldKey, false)
+	if err != nil {
+		return err
+	}
+	defer old.close()
+	if err := fsys.Remove(path + DWB_SUFFIX); err != nil {
+		return err
+	}
+	// 空闲空间映射是用旧密钥加密的, 删除后下次打开时重建
+	if err := fsys.Remove(path + FSM_SUFFIX); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	newCodec, err := newPageCodec(oldCodec.pageSize(), newKey)
+	if err != nil {
+		return err
+	}
+	tmp := path + REKEY_SUFFIX
+	for _, suffix := range []string{DB_SUFFIX, DWB_SUFFIX, PMAP_SUFFIX} {
+		if err := fsys.Remove(tmp + suffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	_, compressed := old.(*compressedStore)
+	out, err := createPageStore(fsys, tmp, newCodec, compressed)
+	if err != nil {
+		return err
+	}
+	// 新文件只在最后替换原文件, 不需要它的双写文件
+	defer fsys.Remove(tmp + DWB_SUFFIX)
+	defer out.close()
+
+	batch := []dirtyPage{}
+	for pgno := 1; pgno <= old.pages(); pgno++ {
+		page, err := old.read(pgno)
+		if err != nil {
+			// 崩溃前没有写完的页面本来就会在恢复时被重置, 在新文件中同样保持损坏
+			if pgno > 1 && errors.Is(err, common.ErrPageCorrupted) {
+				continue
+			}
+			return err
+		}
+		if pgno == 1 {
+			header := make([]byte, len(page))
+			copy(header, page)
+			clear(header[OF_DB_FLAGS:LEN_DB_HEADER])
+			out.initHeader(header)
+			page = header
+		}
+		setPageChecksum(page)
+		batch = append(batch, dirtyPage{pgno: pgno, data: page})
+		if len(batch) == DWB_MAX_PAGES {
+			if err := out.write(batch); err != nil {
+				return err
+			}
+			batch = []dirtyPage{}
+		}
+	}
+	return out.write(batch)
+}
+
+// rekeyLog 把所有日志段合并成一个新的日志段, 编号和原来当前的日志段相同, 替换之后旧的日志段都可以删除
+func rekeyLog(fsys vfs.FS, path string, oldKey []byte, newKey []byte) error {
+	src, err := openLogger(path, Config{FS: fsys, EncryptionKey: oldKey})
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmp := path + REKEY_SUFFIX
+	if err := fsys.Remove(tmp + LOG_SUFFIX); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	dst, err := createLogger(tmp, src.segment, Config{FS: fsys, EncryptionKey: newKey})
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	// 整个文件只在最后写一次总校验和并fsync
+	for {
+		data, err := src.Next()
+		if err != nil {
+			return err
+		}
+		if data == nil {
+			break
+		}
+		log, err := dst.appendLog(data)
+		if err != nil {
+			return err
+		}
+		dst.xChecksum = dst.calChecksum(dst.xChecksum, log)
+	}
+	return dst.writeXChecksum()
+}
+
+// rekeyXID XID文件按块加密, 逐段读出明文后再用新密钥写入新文件
+func rekeyXID(fsys vfs.FS, path string, oldKey []byte, newKey []byte) error {
+	src, err := fsys.OpenFile(path+tm.XID_SUFFIX, os.O_RDONLY, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return common.ErrFileNotExists
+		}
+		return err
+	}
+	defer src.Close()
+	out, err := createRekeyFile(fsys, path, tm.XID_SUFFIX)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	var in, dst vfs.File = src, out
+	if oldKey != nil {
+		if in, err = tm.SealXIDFile(src, oldKey); err != nil {
+			return err
+		}
+	}
+	if newKey != nil {
+		if dst, err = tm.SealXIDFile(out, newKey); err != nil {
+			return err
+		}
+	}
+
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 1<<16)
+	for off := int64(0); off < fi.Size(); off += int64(len(buf)) {
+		n := int(min(int64(len(buf)), fi.Size()-off))
+		if _, err := in.ReadAt(buf[:n], off); err != nil {
+			return err
+		}
+		if _, err := dst.WriteAt(buf[:n], off); err != nil {
+			return err
+		}
+	}
+	return dst.Sync()
+}
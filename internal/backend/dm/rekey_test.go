@@ -0,0 +1,218 @@
+package dm
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/herveyleaf/GoDB/internal/backend/tm"
+	"github.com/herveyleaf/GoDB/internal/backend/utils"
+	"github.com/herveyleaf/GoDB/internal/backend/vfs"
+	"github.com/herveyleaf/GoDB/pkg/common"
+)
+
+var secret = []byte("attack at dawn, attack at dawn!!")
+
+func readAll(t *testing.T, fsys vfs.FS, name string) []byte {
+	f, err := fsys.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fi, _ := f.Stat()
+	buf := make([]byte, fi.Size())
+	if _, err := f.ReadAt(buf, 0); err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func openEncrypted(t *testing.T, fsys vfs.FS, key []byte) (tm.TransactionManager, DataManager) {
+	tmgr, err := tm.OpenWithConfig("test", tm.Config{FS: fsys, EncryptionKey: key, Locked: true})
+	if err != nil {
+		t.Fatalf("Open tm failed: %v", err)
+	}
+	dm, err := OpenDMWithConfig("test", DEFAULT_PAGE_SIZE*MEM_MIN_LIM, tmgr, Config{FS: fsys, EncryptionKey: key})
+	if err != nil {
+		t.Fatalf("Open dm failed: %v", err)
+	}
+	return tmgr, dm
+}
+
+func TestEncryptionAndRekey(t *testing.T) {
+	fsys := vfs.NewMemFS()
+	oldKey := bytes.Repeat([]byte{1}, 32)
+	newKey := bytes.Repeat([]byte{2}, 16)
+
+	tmgr, err := tm.CreateWithConfig("test", tm.Config{FS: fsys, EncryptionKey: oldKey, Locked: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dm, err := CreateDMWithConfig("test", DEFAULT_PAGE_SIZE*MEM_MIN_LIM, tmgr, Config{FS: fsys, EncryptionKey: oldKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	xid, _ := tmgr.Begin()
+	uid, err := dm.Insert(xid, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmgr.Commit(xid)
+	dm.Close()
+	tmgr.Close()
+
+	for _, suffix := range []string{DB_SUFFIX, LOG_SUFFIX} {
+		if bytes.Contains(readAll(t, fsys, "test"+suffix), secret) {
+			t.Fatalf("Plaintext found in %s file", suffix)
+		}
+	}
+	cfg := Config{FS: fsys, EncryptionKey: newKey}
+	if _, err := OpenWithConfig("test", DEFAULT_PAGE_SIZE*MEM_MIN_LIM, cfg); !errors.Is(err, common.ErrBadEncryptionKey) {
+		t.Fatalf("Expected ErrBadEncryptionKey for wrong key, got %v", err)
+	}
+	if _, err := OpenWithConfig("test", DEFAULT_PAGE_SIZE*MEM_MIN_LIM, Config{FS: fsys}); !errors.Is(err, common.ErrBadEncryptionKey) {
+		t.Fatalf("Expected ErrBadEncryptionKey without key, got %v", err)
+	}
+
+	if err := Rekey("test", Config{FS: fsys, EncryptionKey: oldKey}, newKey); err != nil {
+		t.Fatalf("Rekey failed: %v", err)
+	}
+	if _, err := OpenWithConfig("test", DEFAULT_PAGE_SIZE*MEM_MIN_LIM, Config{FS: fsys, EncryptionKey: oldKey}); !errors.Is(err, common.ErrBadEncryptionKey) {
+		t.Fatalf("Old key still accepted after rekey: %v", err)
+	}
+	tmgr, dm = openEncrypted(t, fsys, newKey)
+	if committed, err := tmgr.IsCommitted(xid); err != nil || !committed {
+		t.Fatal("Transaction state lost after rekey")
+	}
+	di, err := dm.Read(uid)
+	if err != nil || di == nil {
+		t.Fatalf("Read after rekey failed: %v", err)
+	}
+	if !bytes.Equal(di.Data(), secret) {
+		t.Fatal("Data changed after rekey")
+	}
+	di.Release()
+	dm.Close()
+	tmgr.Close()
+
+	// 去掉加密之后不带密钥也能打开
+	if err := Rekey("test", Config{FS: fsys, EncryptionKey: newKey}, nil); err != nil {
+		t.Fatalf("Rekey to plaintext failed: %v", err)
+	}
+	tmgr, dm = openEncrypted(t, fsys, nil)
+	defer tmgr.Close()
+	defer dm.Close()
+	if committed, err := tmgr.IsCommitted(xid); err != nil || !committed {
+		t.Fatal("Transaction state lost after decrypting")
+	}
+}
+
+// 换密钥删掉了用旧密钥加密的空闲空间映射, 压缩并设置了选择策略的数据库打开时要从页面重建它
+func TestRekeyCompressedSelect(t *testing.T) {
+	fsys := vfs.NewMemFS()
+	oldKey := bytes.Repeat([]byte{1}, 32)
+	newKey := bytes.Repeat([]byte{2}, 16)
+	cfg := Config{FS: fsys, EncryptionKey: oldKey, Compress: true, Select: SELECT_BEST_FIT}
+
+	tmgr, err := tm.CreateWithConfig("test", tm.Config{FS: fsys, EncryptionKey: oldKey, Locked: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := CreateDMWithConfig("test", DEFAULT_PAGE_SIZE*MEM_MIN_LIM, tmgr, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xid, _ := tmgr.Begin()
+	uids := map[int64][]byte{}
+	for i := 0; i < 7; i++ {
+		data := bytes.Repeat([]byte{byte(i)}, DEFAULT_PAGE_SIZE/3)
+		uid, err := d.Insert(xid, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		uids[uid] = data
+	}
+	tmgr.Commit(xid)
+	d.Close()
+	tmgr.Close()
+	if _, err := fsys.Stat("test" + FSM_SUFFIX); err != nil {
+		t.Fatalf("Free space map should be saved on close: %v", err)
+	}
+
+	if err := Rekey("test", cfg, newKey); err != nil {
+		t.Fatalf("Rekey failed: %v", err)
+	}
+	if _, err := fsys.Stat("test" + FSM_SUFFIX); !os.IsNotExist(err) {
+		t.Fatalf("Free space map sealed with the old key should be removed, got %v", err)
+	}
+	cfg.EncryptionKey = newKey
+	if tmgr, err = tm.OpenWithConfig("test", tm.Config{FS: fsys, EncryptionKey: newKey, Locked: true}); err != nil {
+		t.Fatal(err)
+	}
+	defer tmgr.Close()
+	if d, err = OpenDMWithConfig("test", DEFAULT_PAGE_SIZE*MEM_MIN_LIM, tmgr, cfg); err != nil {
+		t.Fatalf("Open after rekey failed: %v", err)
+	}
+	defer d.Close()
+	dm := d.(*DataManagerImpl)
+	pages := dm.pc.GetPageNumber()
+	for pgno := 2; pgno <= pages; pgno++ {
+		pg, err := dm.pc.GetPage(pgno)
+		if err != nil {
+			t.Fatal(err)
+		}
+		space := freeSpace(pg.GetData())
+		pg.Release()
+		if got := dm.fsm.get(pgno); got > space || space-got >= dm.fsm.unit {
+			t.Fatalf("Free space of page %d rebuilt as %d, page has %d", pgno, got, space)
+		}
+	}
+	for uid, data := range uids {
+		di, err := d.Read(uid)
+		if err != nil || di == nil || !bytes.Equal(di.Data(), data) {
+			t.Fatalf("Read %d after rekey failed: %v", uid, err)
+		}
+		di.Release()
+	}
+	// 重建之后的映射能找到已有页面上的空间, 不用新建页面
+	xid, _ = tmgr.Begin()
+	uid, err := d.Insert(xid, []byte("small"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmgr.Commit(xid)
+	if pgno := int(uint64(uid) >> 32); pgno > pages || dm.pc.GetPageNumber() != pages {
+		t.Fatalf("Small item went to page %d of %d instead of an existing page", pgno, dm.pc.GetPageNumber())
+	}
+}
+
+// 同一次打开加密的页面共用一个纪元的盐, 计数不重复; 重新打开之后换新的盐, 之前的页面仍然能解密
+func TestPageNonces(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	page := make([]byte, MIN_PAGE_SIZE)
+	c, err := newGCMCodec(MIN_PAGE_SIZE, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, second := c.encode(2, page), c.encode(2, page)
+	if !bytes.Equal(first[:utils.LEN_EPOCH_SALT], second[:utils.LEN_EPOCH_SALT]) {
+		t.Fatal("Pages sealed in one epoch should share the salt")
+	}
+	if bytes.Equal(first[:utils.LEN_NONCE], second[:utils.LEN_NONCE]) {
+		t.Fatal("Nonce reused for the same page")
+	}
+	reopened, err := newGCMCodec(MIN_PAGE_SIZE, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third := reopened.encode(2, page); bytes.Equal(first[:utils.LEN_EPOCH_SALT], third[:utils.LEN_EPOCH_SALT]) {
+		t.Fatal("Reopened codec should start a new epoch")
+	}
+	for _, raw := range [][]byte{first, second} {
+		if b, ok := reopened.decode(2, raw); !ok || !bytes.Equal(b, page) {
+			t.Fatal("Page sealed in an earlier epoch cannot be opened")
+		}
+	}
+}
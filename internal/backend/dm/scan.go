@@ -0,0 +1,107 @@
+package dm
+
+import "github.com/herveyleaf/GoDB/internal/backend/utils"
+
+// ScanItem 遍历得到的一条数据. Pgno和Offset是uid所在的页面和槽当前指向的位置,
+// 数据被搬走或者存放在溢出页中时, Data是读出来的完整数据
+type ScanItem struct {
+	Uid    int64
+	Pgno   int
+	Offset int
+	Data   []byte
+}
+
+// Scanner 按页号和槽号的顺序遍历所有有效的数据, 同一时间只持有一个页面.
+// 遍历过程中其它事务插入、更新和删除的数据可能被看到, 也可能看不到
+type Scanner struct {
+	dm   *DataManagerImpl
+	pg   Page
+	pgno int
+	slot int
+	err  error
+}
+
+// Scan 从第二页开始遍历, 跳过空闲页和溢出页. 搬到别的页面的数据只在它的uid处出现一次
+func (dm *DataManagerImpl) Scan() *Scanner {
+	return &Scanner{dm: dm, pgno: 1}
+}
+
+// Next 返回下一条数据, 遍历结束或者出错时返回nil
+func (s *Scanner) Next() *ScanItem {
+	for s.err == nil {
+		if s.pg == nil && !s.nextPage() {
+			return nil
+		}
+		uid, offset, ok := s.nextSlot()
+		if !ok {
+			s.pg.Release()
+			s.pg = nil
+			continue
+		}
+		di, err := s.dm.Read(uid)
+		if err != nil {
+			s.err = err
+			return nil
+		}
+		// 在这之前被删掉了
+		if di == nil {
+			continue
+		}
+		di.RLock()
+		data := make([]byte, len(di.Data()))
+		copy(data, di.Data())
+		di.RUnLock()
+		di.Release()
+		return &ScanItem{Uid: uid, Pgno: s.pgno, Offset: offset, Data: data}
+	}
+	return nil
+}
+
+// nextPage 读入下一个存放数据的页面
+func (s *Scanner) nextPage() bool {
+	for s.pgno < s.dm.pc.GetPageNumber() {
+		s.pgno++
+		pg, err := s.dm.pc.GetPage(s.pgno)
+		if err != nil {
+			s.err = err
+			return false
+		}
+		if raw := pg.GetData(); isFreePage(raw) || isOverflowPage(raw) {
+			pg.Release()
+			continue
+		}
+		s.pg, s.slot = pg, 0
+		return true
+	}
+	return false
+}
+
+// nextSlot 在当前页面中找到下一个有效的槽. 从别的页面搬过来的数据由转发项代表, 这里跳过
+func (s *Scanner) nextSlot() (uid int64, offset int, ok bool) {
+	s.dm.locked(s.pgno, func() {
+		raw := s.pg.GetData()
+		for ; s.slot < getSlotCount(raw); s.slot++ {
+			off, exist := itemOffset(raw, s.slot)
+			if !exist || raw[off+OF_VALID]&(DATAITEM_INVALID|DATAITEM_MOVED) != 0 {
+				continue
+			}
+			uid, offset, ok = utils.AddressToUid(s.pgno, s.slot), off, true
+			s.slot++
+			return
+		}
+	})
+	return
+}
+
+// Err 返回遍历中遇到的错误
+func (s *Scanner) Err() error {
+	return s.err
+}
+
+// Close 释放当前持有的页面, 遍历中途停止时必须调用
+func (s *Scanner) Close() {
+	if s.pg != nil {
+		s.pg.Release()
+		s.pg = nil
+	}
+}
@@ -0,0 +1,70 @@
+package dm
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/herveyleaf/GoDB/internal/backend/tm"
+	"github.com/herveyleaf/GoDB/internal/backend/vfs"
+)
+
+func TestScan(t *testing.T) {
+	fsys := vfs.NewMemFS()
+	tmgr, err := tm.CreateWithConfig("scan", tm.Config{FS: fsys, Locked: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tmgr.Close()
+	d, err := CreateDMWithConfig("scan", MIN_PAGE_SIZE*MEM_MIN_LIM, tmgr, Config{PageSize: MIN_PAGE_SIZE, FS: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// 普通的数据、溢出页中的大数据、搬到别的页面的数据各出现一次, 删掉的数据不出现
+	xid, _ := tmgr.Begin()
+	expected := make(map[int64][]byte)
+	for i := 0; i < 20; i++ {
+		data := bytes.Repeat([]byte{byte(i)}, 300)
+		uid, _ := d.Insert(xid, data)
+		expected[uid] = data
+	}
+	large := bytes.Repeat([]byte{100}, MIN_PAGE_SIZE*3)
+	uid, _ := d.Insert(xid, large)
+	expected[uid] = large
+	tmgr.Commit(xid)
+
+	xid, _ = tmgr.Begin()
+	var deleted, moved int64
+	for uid := range expected {
+		if deleted == 0 {
+			deleted = uid
+		} else if moved == 0 && len(expected[uid]) == 300 {
+			moved = uid
+		}
+	}
+	d.Delete(xid, deleted)
+	delete(expected, deleted)
+	expected[moved] = bytes.Repeat([]byte{101}, MIN_PAGE_SIZE/2)
+	if err := d.Update(xid, moved, expected[moved]); err != nil {
+		t.Fatal(err)
+	}
+	tmgr.Commit(xid)
+
+	s := d.Scan()
+	defer s.Close()
+	last := int64(-1)
+	for item := s.Next(); item != nil; item = s.Next() {
+		if item.Uid <= last {
+			t.Fatalf("Items out of order: %d after %d", item.Uid, last)
+		}
+		last = item.Uid
+		if !bytes.Equal(item.Data, expected[item.Uid]) {
+			t.Fatalf("Item %d scanned wrong", item.Uid)
+		}
+		delete(expected, item.Uid)
+	}
+	if s.Err() != nil || len(expected) != 0 {
+		t.Fatalf("%d items missing from the scan: %v", len(expected), s.Err())
+	}
+}
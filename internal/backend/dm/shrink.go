@@ -0,0 +1,202 @@
+package dm
+
+import (
+	"errors"
+	"slices"
+
+	"github.com/herveyleaf/GoDB/internal/backend/tm"
+	"github.com/herveyleaf/GoDB/internal/backend/utils"
+	"github.com/herveyleaf/GoDB/pkg/common"
+)
+
+// Shrink 先处理已经结束的事务删掉的数据, 再把文件末尾的页面腾空, 最后截掉文件末尾连续的空闲页
+func (dm *DataManagerImpl) Shrink() (int, error) {
+	if dm.readOnly {
+		return 0, common.ErrReadOnly
+	}
+	if err := dm.reclaim(); err != nil {
+		return 0, err
+	}
+	if err := dm.evacuate(); err != nil {
+		return 0, err
+	}
+	return dm.free.shrink()
+}
+
+// evacuate 从最后一页往前, 把只存放着从别的页面搬过来的数据的页面腾空并放入空闲页链表. 数据和更新时一样用relocate
+// 以超级事务的名义搬到前面的页面, uid处的转发项改为指向新的位置, UID不变. 遇到存放UID本身的槽(包括转发项)的页面、
+// 溢出页、还有未结束的事务写过的页面时停止, 它们和之前的页面都截不掉
+func (dm *DataManagerImpl) evacuate() error {
+	var tail []int
+	for pgno := dm.pc.GetPageNumber(); pgno > 1; pgno-- {
+		if dm.free.contains(pgno) {
+			continue
+		}
+		ok, err := dm.movable(pgno)
+		if err != nil {
+			return err
+		}
+		// 不在索引中的页面正在被插入
+		if !ok {
+			break
+		}
+		if _, ok := dm.pIndex.Remove(pgno); !ok {
+			break
+		}
+		tail = append(tail, pgno)
+	}
+	if len(tail) == 0 {
+		return nil
+	}
+	start := tail[len(tail)-1]
+	homes, err := dm.forwards(start)
+	if err != nil {
+		dm.returnPages(tail)
+		return err
+	}
+	for i, pgno := range tail {
+		moved, err := dm.evacuatePage(pgno, start, homes)
+		if err != nil || !moved {
+			dm.returnPages(tail[i:])
+			return err
+		}
+	}
+	return nil
+}
+
+// returnPages 没有腾空的页面放回PageIndex
+func (dm *DataManagerImpl) returnPages(pgnos []int) {
+	for _, pgno := range pgnos {
+		pg, err := dm.pc.GetPage(pgno)
+		if err != nil {
+			// 页面读不出来时只能按没有空闲空间放回
+			dm.addPage(pgno, 0)
+			continue
+		}
+		dm.locked(pgno, func() {
+			dm.addPage(pgno, dm.available(pg))
+		})
+		pg.Release()
+	}
+}
+
+// movable 页面上的有效数据都是从别的页面搬过来的, 删掉的数据也都已经不需要保留
+func (dm *DataManagerImpl) movable(pgno int) (bool, error) {
+	if dm.touched(pgno) {
+		return false, nil
+	}
+	pg, err := dm.pc.GetPage(pgno)
+	if err != nil {
+		return false, err
+	}
+	defer pg.Release()
+	ok := true
+	dm.locked(pgno, func() {
+		raw := pg.GetData()
+		if isFreePage(raw) || isOverflowPage(raw) {
+			ok = false
+			return
+		}
+		reserved, keep := dm.reservedSpace(pgno)
+		if reserved > 0 {
+			ok = false
+			return
+		}
+		for slot := 0; slot < getSlotCount(raw); slot++ {
+			offset, exists := itemOffset(raw, slot)
+			if !exists {
+				continue
+			}
+			if flag := raw[offset+OF_VALID]; (flag&DATAITEM_INVALID != 0 && keep(slot)) ||
+				(flag&DATAITEM_INVALID == 0 && flag&DATAITEM_MOVED == 0) {
+				ok = false
+				return
+			}
+		}
+	})
+	return ok, nil
+}
+
+// forwards 找出指向页号不小于start的位置的转发项, 返回新位置到UID的映射
+func (dm *DataManagerImpl) forwards(start int) (map[int64]int64, error) {
+	homes := make(map[int64]int64)
+	for pgno := 2; pgno < start; pgno++ {
+		pg, err := dm.pc.GetPage(pgno)
+		if err != nil {
+			return nil, err
+		}
+		dm.locked(pgno, func() {
+			raw := pg.GetData()
+			if isFreePage(raw) || isOverflowPage(raw) {
+				return
+			}
+			for slot := 0; slot < getSlotCount(raw); slot++ {
+				offset, ok := itemOffset(raw, slot)
+				if !ok || raw[offset+OF_VALID] != DATAITEM_FORWARD {
+					continue
+				}
+				loc := utils.ParseLong(raw[offset+OF_DATA_DATAITEM:])
+				if p, _ := utils.UidToAddress(loc); p >= start {
+					homes[loc] = utils.AddressToUid(pgno, slot)
+				}
+			}
+		})
+		pg.Release()
+	}
+	return homes, nil
+}
+
+// evacuatePage 把页面上的数据都搬到start之前, 页面腾空之后放入空闲页链表. 有数据搬不走或者页面不能释放时返回false
+func (dm *DataManagerImpl) evacuatePage(pgno int, start int, homes map[int64]int64) (bool, error) {
+	pg, err := dm.pc.GetPage(pgno)
+	if err != nil {
+		return false, err
+	}
+	defer pg.Release()
+	var locs []int64
+	dm.locked(pgno, func() {
+		raw := pg.GetData()
+		for slot := 0; slot < getSlotCount(raw); slot++ {
+			if offset, ok := itemOffset(raw, slot); ok && raw[offset+OF_VALID]&DATAITEM_INVALID == 0 {
+				locs = append(locs, utils.AddressToUid(pgno, slot))
+			}
+		}
+	})
+	for _, loc := range locs {
+		home, ok := homes[loc]
+		if !ok {
+			return false, nil
+		}
+		if moved, err := dm.moveForward(home, loc, start); err != nil || !moved {
+			return false, err
+		}
+	}
+	// 页面已经不在索引中, 不能释放时放回索引
+	return dm.freeIfEmpty(pg)
+}
+
+// moveForward 把uid搬到loc处的数据重新搬到start之前的页面. uid已经不指向loc、或者loc所在的页面
+// 又被未结束的事务写过时不搬. 持有DataItem的锁, 搬动期间不会有事务更新它
+func (dm *DataManagerImpl) moveForward(uid int64, loc int64, start int) (bool, error) {
+	obj, err := dm.parent.Get(uid)
+	if errors.Is(err, common.ErrNullEntry) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	di := obj.(*DataItemImpl)
+	defer di.Release()
+	di.Lock()
+	defer di.Unlock()
+	pgno, _ := utils.UidToAddress(loc)
+	if !di.IsValid() || di.loc != loc || dm.touched(pgno) {
+		return false, nil
+	}
+	if err := dm.relocate(tm.SUPER_XID, di, slices.Clone(di.raw())); err != nil {
+		return false, err
+	}
+	// 没有别的地方能放下时新位置可能还在末尾
+	newPgno, _ := utils.UidToAddress(di.loc)
+	return newPgno < start, nil
+}
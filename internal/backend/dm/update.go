@@ -0,0 +1,222 @@
+package dm
+
+import (
+	"sync"
+
+	"github.com/herveyleaf/GoDB/internal/backend/utils"
+	"github.com/herveyleaf/GoDB/pkg/common"
+)
+
+// reservation 事务在页面上预留的空间. slot不为-1时表示事务删掉了这个槽中的DataItem,
+// 整理页面时要保留它, 撤销时才能放回原来的槽
+type reservation struct {
+	xid  int64
+	size int
+	slot int
+}
+
+func (dm *DataManagerImpl) appendLock(pgno int) *sync.Mutex {
+	lock, _ := dm.appendLocks.LoadOrStore(pgno, &sync.Mutex{})
+	return lock.(*sync.Mutex)
+}
+
+// locked 持有页面的追加锁执行f, f返回之后释放锁. f中的错误由f自己记录到外层变量中返回给调用方
+func (dm *DataManagerImpl) locked(pgno int, f func()) {
+	lock := dm.appendLock(pgno)
+	lock.Lock()
+	defer lock.Unlock()
+	f()
+}
+
+func (dm *DataManagerImpl) reserve(pgno int, xid int64, size int, slot int) {
+	dm.spaceLock.Lock()
+	defer dm.spaceLock.Unlock()
+	dm.reserved[pgno] = append(dm.reserved[pgno], reservation{xid: xid, size: size, slot: slot})
+}
+
+// reservedSpace 返回页面上仍然有效的预留空间和需要保留的槽, 顺便去掉已经结束的事务的预留.
+// 读不出事务状态时保留预留, 少用一些空间总是安全的
+func (dm *DataManagerImpl) reservedSpace(pgno int) (int, func(slot int) bool) {
+	dm.spaceLock.Lock()
+	defer dm.spaceLock.Unlock()
+	size := 0
+	kept := make(map[int]bool)
+	rs := dm.reserved[pgno][:0]
+	for _, r := range dm.reserved[pgno] {
+		if active, err := dm.tm.IsActive(r.xid); !active && err == nil {
+			continue
+		}
+		rs = append(rs, r)
+		size += r.size
+		if r.slot >= 0 {
+			kept[r.slot] = true
+		}
+	}
+	if len(rs) == 0 {
+		delete(dm.reserved, pgno)
+	} else {
+		dm.reserved[pgno] = rs
+	}
+	return size, func(slot int) bool { return kept[slot] }
+}
+
+// available 页面上扣除预留之后还能放下的最大的DataItem
+func (dm *DataManagerImpl) available(pg Page) int {
+	reserved, _ := dm.reservedSpace(pg.GetPageNumber())
+	return max(GetFreeSpace(pg)-reserved, 0)
+}
+
+// writeItem 把槽slot的内容换成raw并写日志, move为true时写到FSO处, 否则原地写入, 返回新的偏移.
+// 调用方持有页面的追加锁, 并保证空间足够
+func (dm *DataManagerImpl) writeItem(xid int64, pg Page, slot int, raw []byte, move bool) (int, error) {
+	data := pg.GetData()
+	offset, _ := itemOffset(data, slot)
+	oldRaw := make([]byte, dataItemLength(data, offset))
+	copy(oldRaw, data[offset:])
+	if move {
+		offset = getFSO(data)
+	}
+	release := dm.logger.Hold()
+	defer release()
+	log := updateLogRaw(xid, utils.AddressToUid(pg.GetPageNumber(), slot), offset, oldRaw, raw)
+	if err := dm.logger.Log(log); err != nil {
+		return 0, err
+	}
+	dm.track(xid, log)
+	if move {
+		return Move(pg, slot, raw), nil
+	}
+	pg.BeginUpdate()
+	copy(pg.GetData()[offset:], raw)
+	pg.EndUpdate()
+	return offset, nil
+}
+
+// replaceInPage 在页面中把槽slot的内容换成raw: 不比原来长时原地写入, 多出来的空间预留到事务结束;
+// 否则写到FSO处, 必要时先整理页面. 页面上的空间不够时返回false. 调用方持有页面的追加锁,
+// pinned是调用方自己在这个页面上持有的DataItem个数
+func (dm *DataManagerImpl) replaceInPage(xid int64, pg Page, slot int, raw []byte, pinned int) (int, bool, error) {
+	offset, _ := itemOffset(pg.GetData(), slot)
+	length := dataItemLength(pg.GetData(), offset)
+	if len(raw) <= length {
+		dm.reserve(pg.GetPageNumber(), xid, length-len(raw), -1)
+		offset, err := dm.writeItem(xid, pg, slot, raw, false)
+		return offset, err == nil, err
+	}
+	// 撤销时旧的内容可以放回更长的新位置, 不需要预留
+	if dm.available(pg) < len(raw) {
+		return 0, false, nil
+	}
+	if appendSpace(pg.GetData()) < len(raw) {
+		if ok, err := dm.compact(pg, pinned); !ok || err != nil || appendSpace(pg.GetData()) < len(raw) {
+			return 0, false, err
+		}
+	}
+	offset, err := dm.writeItem(xid, pg, slot, raw, true)
+	return offset, err == nil, err
+}
+
+// invalidate 删掉槽slot中的DataItem. 它占用的空间和槽要到事务结束才能重新使用
+func (dm *DataManagerImpl) invalidate(xid int64, pg Page, slot int) error {
+	offset, _ := itemOffset(pg.GetData(), slot)
+	raw := make([]byte, dataItemLength(pg.GetData(), offset))
+	copy(raw, pg.GetData()[offset:])
+	SetDataItemRawInvalid(raw)
+	dm.reserve(pg.GetPageNumber(), xid, len(raw), slot)
+	_, err := dm.writeItem(xid, pg, slot, raw, false)
+	return err
+}
+
+// Update 先尝试在数据所在的页面中完成更新, 放不下时把数据搬到别的页面, uid处留下指向新位置的转发项.
+// 已经被搬走的数据再次搬家时, 转发项改为指向最新的位置, 中间的位置被删掉, 所以最多只有一次转发
+func (dm *DataManagerImpl) Update(xid int64, uid int64, data []byte) error {
+	if dm.readOnly {
+		return common.ErrReadOnly
+	}
+	raw := WrapDataItemRaw(data)
+	if len(raw) > MaxFreeSpace(dm.pc.PageSize()) {
+		return common.ErrDataTooLarge
+	}
+	obj, err := dm.parent.Get(uid)
+	if err != nil {
+		return err
+	}
+	di := obj.(*DataItemImpl)
+	defer di.Release()
+	di.Lock()
+	defer di.Unlock()
+	if !di.IsValid() {
+		return common.ErrNullEntry
+	}
+	if di.overflow != nil {
+		return common.ErrOverflowUpdate
+	}
+	raw[OF_VALID] = di.raw()[OF_VALID]
+
+	pgno, slot := utils.UidToAddress(di.loc)
+	var ok bool
+	dm.locked(pgno, func() {
+		var offset int
+		if offset, ok, err = dm.replaceInPage(xid, di.pg, slot, raw, 1); !ok {
+			// 页面可能已经整理过, DataItem的位置要重新读
+			offset, _ = itemOffset(di.pg.GetData(), slot)
+		}
+		di.setLocation(di.pg, di.loc, offset)
+	})
+	if ok || err != nil {
+		return err
+	}
+	return dm.relocate(xid, di, raw)
+}
+
+// relocate 把数据插入到离uid所在页面最近的页面中, 再让uid处的转发项指向它
+func (dm *DataManagerImpl) relocate(xid int64, di *DataItemImpl, raw []byte) error {
+	homePgno, homeSlot := utils.UidToAddress(di.uid)
+	moved := make([]byte, len(raw))
+	copy(moved, raw)
+	moved[OF_VALID] |= DATAITEM_MOVED
+	loc, err := dm.insertRaw(xid, moved, homePgno, nil)
+	if err != nil {
+		return err
+	}
+	pgno, slot := utils.UidToAddress(loc)
+	pg, err := dm.pc.GetPage(pgno)
+	if err != nil {
+		return err
+	}
+	dm.pin(pgno)
+
+	// 每个DataItem都至少和转发项一样长, 转发项总是原地写入
+	home := di.pg
+	if di.loc != di.uid {
+		if home, err = dm.pc.GetPage(homePgno); err != nil {
+			dm.unpin(pgno)
+			pg.Release()
+			return err
+		}
+		defer home.Release()
+	}
+	dm.locked(homePgno, func() {
+		_, _, err = dm.replaceInPage(xid, home, homeSlot, ForwardRaw(loc), 0)
+	})
+	// 已经被搬走过的数据, 中间的位置被删掉
+	if err == nil && di.loc != di.uid {
+		oldPgno, oldSlot := utils.UidToAddress(di.loc)
+		dm.locked(oldPgno, func() {
+			err = dm.invalidate(xid, di.pg, oldSlot)
+		})
+	}
+	// 新位置上插入的数据属于这个事务, 事务回滚之后不会再被使用, 这里只需要放开新页面
+	if err != nil {
+		dm.unpin(pgno)
+		pg.Release()
+		return err
+	}
+
+	offset, _ := dm.lookup(pg, slot)
+	old := di.pg
+	di.setLocation(pg, loc, offset)
+	dm.unpin(old.GetPageNumber())
+	old.Release()
+	return nil
+}
@@ -0,0 +1,84 @@
+package dm
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/herveyleaf/GoDB/internal/backend/tm"
+	"github.com/herveyleaf/GoDB/internal/backend/vfs/vfstest"
+)
+
+func TestVariableLengthUpdate(t *testing.T) {
+	fsys := vfstest.NewCrashFS(1)
+	tmCfg := tm.Config{FS: fsys, Locked: true}
+	cfg := Config{PageSize: MIN_PAGE_SIZE, FS: fsys}
+	tmgr, err := tm.CreateWithConfig("update", tmCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := CreateDMWithConfig("update", MIN_PAGE_SIZE*MEM_MIN_LIM, tmgr, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(uid int64, data []byte) {
+		di, err := d.Read(uid)
+		if err != nil || di == nil || !bytes.Equal(di.Data(), data) {
+			t.Fatalf("Item %d read back wrong: %v", uid, err)
+		}
+		di.Release()
+	}
+	xid, _ := tmgr.Begin()
+	uid, _ := d.Insert(xid, []byte("abc"))
+	filler, _ := d.Insert(xid, bytes.Repeat([]byte{1}, MIN_PAGE_SIZE/2))
+	tmgr.Commit(xid)
+
+	// 变长之后先在本页中换位置, 本页放不下时搬到别的页面, 再次搬家时转发项指向最新的位置
+	steps := [][]byte{
+		bytes.Repeat([]byte{2}, 1000),
+		bytes.Repeat([]byte{3}, 2000),
+		bytes.Repeat([]byte{4}, 3000),
+		[]byte("x"),
+	}
+	for i, data := range steps {
+		xid, _ = tmgr.Begin()
+		if err := d.Update(xid, uid, data); err != nil {
+			t.Fatal(err)
+		}
+		tmgr.Commit(xid)
+		check(uid, data)
+		di, _ := d.Read(uid)
+		if moved := di.(*DataItemImpl).loc != uid; moved != (i >= 1) {
+			t.Fatalf("Step %d: expected the item to be moved: %v, got %v", i, i >= 1, moved)
+		}
+		di.Release()
+	}
+	check(filler, bytes.Repeat([]byte{1}, MIN_PAGE_SIZE/2))
+
+	// 没有提交的搬家在恢复时被撤销, uid重新读到提交过的内容
+	xid, _ = tmgr.Begin()
+	if err := d.Update(xid, uid, bytes.Repeat([]byte{5}, 3500)); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Update(xid, filler, []byte("y")); err != nil {
+		t.Fatal(err)
+	}
+	fsys.Crash()
+	if err := d.Close(); !errors.Is(err, vfstest.ErrPowerLoss) {
+		t.Fatalf("Expected ErrPowerLoss from Close after a crash, got %v", err)
+	}
+	tmgr.Close()
+	fsys.Restart()
+
+	if tmgr, err = tm.OpenWithConfig("update", tmCfg); err != nil {
+		t.Fatal(err)
+	}
+	defer tmgr.Close()
+	if d, err = OpenDMWithConfig("update", MIN_PAGE_SIZE*MEM_MIN_LIM, tmgr, cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	check(uid, []byte("x"))
+	check(filler, bytes.Repeat([]byte{1}, MIN_PAGE_SIZE/2))
+}
@@ -1,11 +1,13 @@
 package tm
 
 import (
-	"encoding/binary"
+	"fmt"
+	"io"
 	"os"
 	"sync"
 
 	"github.com/herveyleaf/GoDB/internal/backend/utils"
+	"github.com/herveyleaf/GoDB/internal/backend/vfs"
 	"github.com/herveyleaf/GoDB/pkg/common"
 )
 
@@ -25,92 +27,194 @@ const (
 	SUPER_XID = 0
 
 	XID_SUFFIX = ".xid"
+
+	// 从主密钥派生XID文件密钥时使用的标签
+	XID_KEY_LABEL = "GoDB xid"
 )
 
 // TransactionManager接口
+// 读写XID文件失败时返回错误, 这时事务的状态不确定, 调用方不能当作成功处理
 type TransactionManager interface {
-	Begin() int64
-	Commit(xid int64)
-	Abort(xid int64)
-	IsActive(xid int64) bool
-	IsCommitted(xid int64) bool
-	IsAborted(xid int64) bool
-	Close()
+	Begin() (int64, error)
+	Commit(xid int64) error
+	Abort(xid int64) error
+	IsActive(xid int64) (bool, error)
+	IsCommitted(xid int64) (bool, error)
+	IsAborted(xid int64) (bool, error)
+	Close() error
 }
 
 type TransactionManagerImpl struct {
-	file        *os.File
+	file        vfs.File
 	xidCounter  int64
 	counterLock *sync.Mutex
+	readOnly    bool
+	fileLock    io.Closer // 数据库的锁, 防止被多个进程同时打开. 调用方已经持有锁时为nil
 }
 
-func NewTransactionManagerImpl(file *os.File) *TransactionManagerImpl {
+func NewTransactionManagerImpl(file vfs.File) (*TransactionManagerImpl, error) {
 	tm := &TransactionManagerImpl{
 		file:        file,
 		counterLock: &sync.Mutex{},
 	}
-	tm.checkXIDCounter()
-	return tm
+	if err := tm.checkXIDCounter(); err != nil {
+		return nil, err
+	}
+	return tm, nil
+}
+
+// Config 创建或打开事务管理器时的可选配置
+type Config struct {
+	// XID文件所在的文件系统, 为nil时使用操作系统的文件系统
+	FS vfs.FS
+	// 不为nil时XID文件按块用AES-GCM加密, 长度必须是16、24或32字节.
+	// 和dm.Config.EncryptionKey一样按纪元派生加密用的密钥, 不受一个密钥只能加密约2^32次的限制
+	EncryptionKey []byte
+	// 只读打开, 持有共享锁, 可以和其它只读打开同时存在. 只能查询事务状态
+	ReadOnly bool
+	// 调用方已经用vfs.LockDatabase锁住了数据库, TM不再加锁. 为false时TM自己锁住数据库, 关闭时释放
+	Locked bool
+}
+
+// lock cfg.Locked为false时锁住数据库, 否则返回nil
+func (cfg Config) lock(path string, shared bool) (io.Closer, error) {
+	if cfg.Locked {
+		return nil, nil
+	}
+	return vfs.LockDatabase(vfs.Or(cfg.FS), path, shared)
+}
+
+func closeLock(l io.Closer) {
+	if l != nil {
+		l.Close()
+	}
 }
 
 // 创建新的事务管理器
 func Create(path string) (TransactionManager, error) {
+	return CreateWithConfig(path, Config{})
+}
+
+// 按cfg创建新的事务管理器
+func CreateWithConfig(path string, cfg Config) (TransactionManager, error) {
+	if cfg.ReadOnly {
+		return nil, fmt.Errorf("%w: cannot create a database", common.ErrReadOnly)
+	}
+	fsys := vfs.Or(cfg.FS)
 	filePath := path + XID_SUFFIX
 
 	// 检查文件是否存在
-	if _, err := os.Stat(filePath); err == nil {
+	if _, err := fsys.Stat(filePath); err == nil {
 		return nil, common.ErrFileExists
 	}
 
-	// 创建文件并设置读写权限
-	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	fileLock, err := cfg.lock(path, false)
 	if err != nil {
 		return nil, err
 	}
 
+	// 创建文件并设置读写权限, O_EXCL保证两个进程同时创建时只有一个成功
+	file, err := fsys.OpenFile(filePath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		closeLock(fileLock)
+		return nil, err
+	}
+	if file, err = wrapXIDFile(file, cfg.EncryptionKey); err != nil {
+		closeLock(fileLock)
+		return nil, err
+	}
+
 	// 写入空XID文件头
-	if _, err := file.Write(make([]byte, LEN_XID_HEADER_LENGTH)); err != nil {
+	if _, err := file.WriteAt(make([]byte, LEN_XID_HEADER_LENGTH), 0); err != nil {
 		file.Close()
+		closeLock(fileLock)
 		return nil, err
 	}
 
 	// 确保文件写入磁盘
 	if err := file.Sync(); err != nil {
 		file.Close()
+		closeLock(fileLock)
 		return nil, err
 	}
 
 	return &TransactionManagerImpl{
-		file:       file,
-		xidCounter: 0,
+		file:        file,
+		xidCounter:  0,
+		counterLock: &sync.Mutex{},
+		fileLock:    fileLock,
 	}, nil
 }
 
 // 打开现有的事务管理器
 func Open(path string) (TransactionManager, error) {
+	return OpenWithConfig(path, Config{})
+}
+
+// 按cfg打开现有的事务管理器
+func OpenWithConfig(path string, cfg Config) (TransactionManager, error) {
+	fsys := vfs.Or(cfg.FS)
 	filePath := path + XID_SUFFIX
 
 	// 检查文件是否存在
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+	if _, err := fsys.Stat(filePath); os.IsNotExist(err) {
 		return nil, common.ErrFileNotExists
 	}
 
+	fileLock, err := cfg.lock(path, cfg.ReadOnly)
+	if err != nil {
+		return nil, err
+	}
+
 	// 打开文件
-	file, err := os.OpenFile(filePath, os.O_RDWR, 0600)
+	flag := os.O_RDWR
+	if cfg.ReadOnly {
+		flag = os.O_RDONLY
+	}
+	file, err := fsys.OpenFile(filePath, flag, 0600)
 	if err != nil {
+		closeLock(fileLock)
+		return nil, err
+	}
+	if file, err = wrapXIDFile(file, cfg.EncryptionKey); err != nil {
+		closeLock(fileLock)
 		return nil, err
 	}
 
-	// 验证文件有效性
-	tm := &TransactionManagerImpl{file: file}
+	// 验证文件有效性, 密钥错误时在wrapXIDFile中已经返回了common.ErrBadEncryptionKey
+	tm := &TransactionManagerImpl{file: file, counterLock: &sync.Mutex{}, readOnly: cfg.ReadOnly, fileLock: fileLock}
 	if err := tm.checkXIDCounter(); err != nil {
 		file.Close()
+		closeLock(fileLock)
 		return nil, err
 	}
 
 	return tm, nil
 }
 
+// wrapXIDFile 有密钥时返回加密的文件, 失败时关闭file
+func wrapXIDFile(file vfs.File, key []byte) (vfs.File, error) {
+	if key == nil {
+		return file, nil
+	}
+	sealed, err := SealXIDFile(file, key)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return sealed, nil
+}
+
+// SealXIDFile 返回用key加解密file的文件. 状态字节所在的块每次更新都用新的随机数整块重新加密,
+// 密钥不对时返回common.ErrBadEncryptionKey
+func SealXIDFile(file vfs.File, key []byte) (vfs.File, error) {
+	aead, err := utils.NewGCM(key, XID_KEY_LABEL)
+	if err != nil {
+		return nil, err
+	}
+	return vfs.NewSealedFile(file, aead)
+}
+
 func (tm *TransactionManagerImpl) checkXIDCounter() error {
 	// 获取文件大小
 	fileInfo, err := tm.file.Stat()
@@ -130,12 +234,27 @@ func (tm *TransactionManagerImpl) checkXIDCounter() error {
 		return err
 	}
 
-	// 解析计数器
-	tm.xidCounter = int64(binary.LittleEndian.Uint64(header))
+	// 解析计数器, 与incrXIDCounter写入时一样使用大端序
+	tm.xidCounter = utils.ParseLong(header)
 
-	// 验证文件大小是否正确
+	// Begin先写入新事务的状态并fsync, 再更新头部计数器, 在两次写入之间崩溃时文件比计数器多一个状态,
+	// 这时修正计数器. 其它长度说明文件已经损坏
 	expectedSize := LEN_XID_HEADER_LENGTH + tm.xidCounter*XID_FIELD_SIZE
-	if fileLen != expectedSize {
+	switch fileLen {
+	case expectedSize:
+	case expectedSize + XID_FIELD_SIZE:
+		tm.xidCounter++
+		// 只读时不写文件, 留给下次读写打开时修正
+		if tm.readOnly {
+			return nil
+		}
+		if _, err := tm.file.WriteAt(utils.Long2Byte(tm.xidCounter), 0); err != nil {
+			return err
+		}
+		if err := tm.file.Sync(); err != nil {
+			return err
+		}
+	default:
 		return common.ErrBadXIDFile
 	}
 
@@ -148,33 +267,46 @@ func (tm *TransactionManagerImpl) getXidPosition(xid int64) int64 {
 }
 
 // 更新事务状态
-func (tm *TransactionManagerImpl) updateXID(xid int64, status byte) {
+func (tm *TransactionManagerImpl) updateXID(xid int64, status byte) error {
 	// 计算文件位置
 	offset := tm.getXidPosition(xid)
 
-	// 写入状态字节
-	tm.file.WriteAt([]byte{status}, offset)
+	// 写入状态字节, 失败时事务的状态不确定, 不能当作成功返回
+	if _, err := tm.file.WriteAt([]byte{status}, offset); err != nil {
+		return fmt.Errorf("update xid %d: %w", xid, err)
+	}
 
 	// 确保数据写入磁盘
-	tm.file.Sync()
+	if err := tm.file.Sync(); err != nil {
+		return fmt.Errorf("update xid %d: %w", xid, err)
+	}
+	return nil
 }
 
 // 增加XID计数器并更新文件头部
-func (tm *TransactionManagerImpl) incrXIDCounter() {
+func (tm *TransactionManagerImpl) incrXIDCounter() error {
 	tm.xidCounter++
 
 	// 将新计数器转换为字节
 	buf := utils.Long2Byte(tm.xidCounter)
 
-	// 写入文件头部
-	tm.file.WriteAt(buf, 0)
+	// 写入文件头部. 失败时新事务的状态已经落盘, 下次打开时按文件长度修正计数器
+	if _, err := tm.file.WriteAt(buf, 0); err != nil {
+		return fmt.Errorf("update xid counter: %w", err)
+	}
 
 	// 确保数据写入磁盘
-	tm.file.Sync()
+	if err := tm.file.Sync(); err != nil {
+		return fmt.Errorf("update xid counter: %w", err)
+	}
+	return nil
 }
 
 // 开始一个新事务
-func (tm *TransactionManagerImpl) Begin() int64 {
+func (tm *TransactionManagerImpl) Begin() (int64, error) {
+	if tm.readOnly {
+		return 0, common.ErrReadOnly
+	}
 	tm.counterLock.Lock()
 	defer tm.counterLock.Unlock()
 
@@ -182,65 +314,78 @@ func (tm *TransactionManagerImpl) Begin() int64 {
 	newXID := tm.xidCounter + 1
 
 	// 更新事务状态
-	tm.updateXID(newXID, FIELD_TRAN_ACTIVE)
+	if err := tm.updateXID(newXID, FIELD_TRAN_ACTIVE); err != nil {
+		return 0, err
+	}
 
 	// 增加计数器
-	tm.incrXIDCounter()
+	if err := tm.incrXIDCounter(); err != nil {
+		return 0, err
+	}
 
-	return newXID
+	return newXID, nil
 }
 
 // 提交XID事务
-func (tm *TransactionManagerImpl) Commit(xid int64) {
+func (tm *TransactionManagerImpl) Commit(xid int64) error {
 	if xid == SUPER_XID {
-		return
+		return nil
+	}
+	if tm.readOnly {
+		return common.ErrReadOnly
 	}
-	tm.updateXID(xid, FIELD_TRAN_COMMITTED)
+	return tm.updateXID(xid, FIELD_TRAN_COMMITTED)
 }
 
 // 回滚XID事务
-func (tm *TransactionManagerImpl) Abort(xid int64) {
+func (tm *TransactionManagerImpl) Abort(xid int64) error {
 	if xid == SUPER_XID {
-		return
+		return nil
+	}
+	if tm.readOnly {
+		return common.ErrReadOnly
 	}
-	tm.updateXID(xid, FIELD_TRAN_ABORTED)
+	return tm.updateXID(xid, FIELD_TRAN_ABORTED)
 }
 
 // 检查事务状态
-func (tm *TransactionManagerImpl) checkXID(xid int64, status byte) bool {
+func (tm *TransactionManagerImpl) checkXID(xid int64, status byte) (bool, error) {
 	// 计算文件位置
 	offset := tm.getXidPosition(xid)
 
 	// 读取状态字节
 	buf := make([]byte, XID_FIELD_SIZE)
 	if _, err := tm.file.ReadAt(buf, offset); err != nil {
-		panic(err)
+		return false, fmt.Errorf("read xid %d: %w", xid, err)
 	}
 
-	return buf[0] == status
+	return buf[0] == status, nil
 }
 
-func (tm *TransactionManagerImpl) IsActive(xid int64) bool {
+func (tm *TransactionManagerImpl) IsActive(xid int64) (bool, error) {
 	if xid == SUPER_XID {
-		return false
+		return false, nil
 	}
 	return tm.checkXID(xid, FIELD_TRAN_ACTIVE)
 }
 
-func (tm *TransactionManagerImpl) IsCommitted(xid int64) bool {
+func (tm *TransactionManagerImpl) IsCommitted(xid int64) (bool, error) {
 	if xid == SUPER_XID {
-		return true
+		return true, nil
 	}
 	return tm.checkXID(xid, FIELD_TRAN_COMMITTED)
 }
 
-func (tm *TransactionManagerImpl) IsAborted(xid int64) bool {
+func (tm *TransactionManagerImpl) IsAborted(xid int64) (bool, error) {
 	if xid == SUPER_XID {
-		return false
+		return false, nil
 	}
 	return tm.checkXID(xid, FIELD_TRAN_ABORTED)
 }
 
-func (tm *TransactionManagerImpl) Close() {
-	tm.file.Close()
+// Close 关闭XID文件之后释放锁
+func (tm *TransactionManagerImpl) Close() error {
+	err := tm.file.Close()
+	closeLock(tm.fileLock)
+	return err
 }
@@ -1,16 +1,19 @@
 package tm
 
 import (
+	"errors"
 	"os"
 	"path/filepath"
 	"sync"
 	"testing"
 
+	"github.com/herveyleaf/GoDB/internal/backend/vfs"
+	"github.com/herveyleaf/GoDB/internal/backend/vfs/vfstest"
 	"github.com/herveyleaf/GoDB/pkg/common"
 )
 
 func TestCreateAndOpen(t *testing.T) {
-	dir, err := os.MkdirTemp("D:\\temp", "tm_test")
+	dir, err := os.MkdirTemp("", "tm_test")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -20,7 +23,6 @@ func TestCreateAndOpen(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Create failed: %v", err)
 	}
-	defer tm1.Close()
 
 	// 验证文件创建
 	if _, err := os.Stat(path + XID_SUFFIX); os.IsNotExist(err) {
@@ -32,12 +34,36 @@ func TestCreateAndOpen(t *testing.T) {
 		t.Fatalf("Expected ErrorFileExists, got %v", err)
 	}
 
+	// 已经打开时不能再次打开
+	if _, err := Open(path); !errors.Is(err, common.ErrDatabaseLocked) {
+		t.Fatalf("Expected ErrDatabaseLocked, got %v", err)
+	}
+	tm1.Close()
+
 	// 测试打开
 	tm2, err := Open(path)
 	if err != nil {
 		t.Fatalf("Open failed: %v", err)
 	}
-	defer tm2.Close()
+	tm2.Close()
+
+	// 只读打开可以同时存在, 但不能和读写打开同时存在
+	ro1, err := OpenWithConfig(path, Config{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Read-only open failed: %v", err)
+	}
+	defer ro1.Close()
+	ro2, err := OpenWithConfig(path, Config{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Second read-only open failed: %v", err)
+	}
+	defer ro2.Close()
+	if _, err := Open(path); !errors.Is(err, common.ErrDatabaseLocked) {
+		t.Fatalf("Expected ErrDatabaseLocked while opened read-only, got %v", err)
+	}
+	if _, err := ro1.Begin(); !errors.Is(err, common.ErrReadOnly) {
+		t.Fatalf("Expected ErrReadOnly, got %v", err)
+	}
 
 	// 测试打开不存在的文件
 	if _, err := Open(filepath.Join(dir, "nonexistent")); err != common.ErrFileNotExists {
@@ -48,10 +74,12 @@ func TestCreateAndOpen(t *testing.T) {
 func TestSuperXID(t *testing.T) {
 	tm := &TransactionManagerImpl{} // 用于测试状态方法
 
-	if !tm.IsCommitted(SUPER_XID) {
+	if committed, _ := tm.IsCommitted(SUPER_XID); !committed {
 		t.Fatal("SUPER_XID should be committed")
 	}
-	if tm.IsActive(SUPER_XID) || tm.IsAborted(SUPER_XID) {
+	active, _ := tm.IsActive(SUPER_XID)
+	aborted, _ := tm.IsAborted(SUPER_XID)
+	if active || aborted {
 		t.Fatal("SUPER_XID should not be active or aborted")
 	}
 }
@@ -68,16 +96,31 @@ func TestErrorCases(t *testing.T) {
 		t.Fatalf("Expected ErrorBadXIDFile, got %v", err)
 	}
 
+	// Begin在更新计数器之前崩溃时只会多出一个状态, 多出更多说明文件已经损坏
+	os.WriteFile(corruptPath+XID_SUFFIX, make([]byte, LEN_XID_HEADER_LENGTH+1), 0600)
+	tm1, err := Open(corruptPath)
+	if err != nil {
+		t.Fatalf("Open with one extra status failed: %v", err)
+	}
+	if xid, err := tm1.Begin(); err != nil || xid != 2 {
+		t.Fatalf("Expected xid 2 after repairing the counter, got %d, %v", xid, err)
+	}
+	tm1.Close()
+	os.WriteFile(corruptPath+XID_SUFFIX, make([]byte, LEN_XID_HEADER_LENGTH+2), 0600)
+	if _, err := Open(corruptPath); err != common.ErrBadXIDFile {
+		t.Fatalf("Expected ErrorBadXIDFile for two extra statuses, got %v", err)
+	}
+
 	// 测试无效文件访问
 	tm, _ := Create(path)
 	tm.Close() // 关闭后操作应失败
 
-	defer func() {
-		if r := recover(); r == nil {
-			t.Fatal("Expected panic after close")
-		}
-	}()
-	tm.IsActive(1) // 应触发panic
+	if _, err := tm.IsActive(1); err == nil {
+		t.Fatal("Expected an error after close")
+	}
+	if _, err := tm.Begin(); err == nil {
+		t.Fatal("Expected an error after close")
+	}
 }
 
 func TestConcurrentBegin(t *testing.T) {
@@ -97,7 +140,11 @@ func TestConcurrentBegin(t *testing.T) {
 	for i := 0; i < n; i++ {
 		go func() {
 			defer wg.Done()
-			ch <- tm.Begin()
+			xid, err := tm.Begin()
+			if err != nil {
+				t.Error(err)
+			}
+			ch <- xid
 		}()
 	}
 	wg.Wait()
@@ -119,7 +166,7 @@ func TestConcurrentBegin(t *testing.T) {
 
 	// 验证事务状态
 	for xid := range xids {
-		if !tm.IsActive(xid) {
+		if active, err := tm.IsActive(xid); err != nil || !active {
 			t.Fatalf("Transaction %d should be active", xid)
 		}
 	}
@@ -138,7 +185,7 @@ func TestFileOperations(t *testing.T) {
 	tm2, _ := Open(path)
 
 	// 开始事务
-	xid := tm2.Begin()
+	xid, _ := tm2.Begin()
 	tm2.Commit(xid)
 	tm2.Close()
 
@@ -146,7 +193,7 @@ func TestFileOperations(t *testing.T) {
 	tm3, _ := Open(path)
 	defer tm3.Close()
 
-	if !tm3.IsCommitted(xid) {
+	if committed, err := tm3.IsCommitted(xid); err != nil || !committed {
 		t.Fatal("Committed transaction not persisted")
 	}
 }
@@ -162,11 +209,82 @@ func TestInvalidStateReading(t *testing.T) {
 	// 获取一个无效xid
 	invalidXid := int64(9999999)
 
-	// 测试读取无效状态应触发panic
-	defer func() {
-		if r := recover(); r == nil {
-			t.Fatal("Expected panic for invalid xid position")
+	// 测试读取无效状态应返回错误
+	if _, err := tm.IsActive(invalidXid); err == nil {
+		t.Fatal("Expected an error for invalid xid position")
+	}
+}
+
+func TestMemFS(t *testing.T) {
+	fsys := vfs.NewMemFS()
+	tm1, err := CreateWithConfig("test", Config{FS: fsys})
+	if err != nil {
+		t.Fatalf("CreateWithConfig failed: %v", err)
+	}
+	xid, _ := tm1.Begin()
+	tm1.Abort(xid)
+	tm1.Close()
+
+	if _, err := CreateWithConfig("test", Config{FS: fsys}); err != common.ErrFileExists {
+		t.Fatalf("Expected ErrorFileExists, got %v", err)
+	}
+	tm2, err := OpenWithConfig("test", Config{FS: fsys})
+	if err != nil {
+		t.Fatalf("OpenWithConfig failed: %v", err)
+	}
+	defer tm2.Close()
+	if aborted, err := tm2.IsAborted(xid); err != nil || !aborted {
+		t.Fatal("Aborted transaction not persisted")
+	}
+	if _, err := os.Stat("test" + XID_SUFFIX); !os.IsNotExist(err) {
+		t.Fatal("MemFS should not touch the real file system")
+	}
+}
+
+func TestEncryptedXID(t *testing.T) {
+	key := make([]byte, 16)
+	fsys := vfs.NewMemFS()
+	tm1, err := CreateWithConfig("test", Config{FS: fsys, EncryptionKey: key})
+	if err != nil {
+		t.Fatalf("CreateWithConfig failed: %v", err)
+	}
+	xid, _ := tm1.Begin()
+	tm1.Commit(xid)
+	tm1.Close()
+	if _, err := OpenWithConfig("test", Config{FS: fsys, EncryptionKey: make([]byte, 32)}); !errors.Is(err, common.ErrBadEncryptionKey) {
+		t.Fatalf("Expected ErrBadEncryptionKey, got %v", err)
+	}
+
+	// 更新状态时断电, 写了一半的块不能破坏同一块中其它事务的状态
+	for seed := int64(1); seed <= 50; seed++ {
+		fsys := vfstest.NewCrashFS(seed)
+		cfg := Config{FS: fsys, EncryptionKey: key}
+		tm1, err := CreateWithConfig("test", cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		committed := map[int64]bool{}
+		fsys.CrashAfter(int(seed))
+		for {
+			xid, err := tm1.Begin()
+			if err != nil {
+				break
+			}
+			if err := tm1.Commit(xid); err != nil {
+				break
+			}
+			committed[xid] = true
+		}
+		fsys.Restart()
+		tm2, err := OpenWithConfig("test", cfg)
+		if err != nil {
+			t.Fatalf("seed %d: reopen failed: %v", seed, err)
 		}
-	}()
-	tm.IsActive(invalidXid)
+		for xid := range committed {
+			if ok, err := tm2.IsCommitted(xid); err != nil || !ok {
+				t.Fatalf("seed %d: committed transaction %d lost: %v", seed, xid, err)
+			}
+		}
+		tm2.Close()
+	}
 }
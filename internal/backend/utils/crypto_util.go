@@ -0,0 +1,131 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"sync"
+
+	"github.com/herveyleaf/GoDB/pkg/common"
+)
+
+const (
+	// AES-GCM的随机数和认证标签长度, 每段密文比明文多SEAL_OVERHEAD个字节
+	LEN_NONCE     = 12
+	LEN_TAG       = 16
+	SEAL_OVERHEAD = LEN_NONCE + LEN_TAG
+
+	// 随机数的前8个字节是纪元的盐, 后4个字节是纪元内的计数, 一个纪元最多加密2^32次
+	LEN_EPOCH_SALT    = 8
+	MAX_EPOCH_SEALS   = 1 << 32
+	MAX_CACHED_EPOCHS = 64
+	EPOCH_KEY_LABEL   = "epoch:"
+)
+
+// ValidKey 主密钥的长度必须是16、24或32字节
+func ValidKey(key []byte) bool {
+	switch len(key) {
+	case 16, 24, 32:
+		return true
+	}
+	return false
+}
+
+// DeriveKey 用HMAC-SHA256从主密钥派生出不同用途的子密钥, 页面、日志和XID文件互不共用密钥
+func DeriveKey(key []byte, label string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)[:len(key)]
+}
+
+// GCM 用label派生出的子密钥加密的AES-GCM. 随机的96位随机数在同一个密钥下最多只能用2^32次,
+// 所以每个纪元用随机的盐派生一个新的纪元密钥, 随机数是[盐][纪元内的计数], 计数用完时换一个纪元.
+// 同一个纪元密钥下随机数不会重复, 纪元密钥由64位的盐区分
+type GCM struct {
+	key   []byte // label派生出的子密钥
+	lock  sync.Mutex
+	salt  []byte      // 当前纪元的盐
+	aead  cipher.AEAD // 当前纪元的密钥
+	count uint64      // 当前纪元已经加密的次数
+	// 解密时按盐缓存纪元密钥
+	epochs map[string]cipher.AEAD
+}
+
+// NewGCM 用label派生出的子密钥创建AES-GCM
+func NewGCM(key []byte, label string) (*GCM, error) {
+	if !ValidKey(key) {
+		return nil, common.ErrBadEncryptionKey
+	}
+	return &GCM{key: DeriveKey(key, label), epochs: make(map[string]cipher.AEAD)}, nil
+}
+
+// epoch 返回盐对应的纪元密钥, 调用方持有锁
+func (g *GCM) epoch(salt []byte) (cipher.AEAD, error) {
+	if aead, ok := g.epochs[string(salt)]; ok {
+		return aead, nil
+	}
+	block, err := aes.NewCipher(DeriveKey(g.key, EPOCH_KEY_LABEL+string(salt)))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(g.epochs) >= MAX_CACHED_EPOCHS {
+		clear(g.epochs)
+	}
+	g.epochs[string(salt)] = aead
+	return aead, nil
+}
+
+// next 分配下一个随机数, 当前纪元的计数用完或者还没有纪元时用新的盐开始一个纪元
+func (g *GCM) next(nonce []byte) (cipher.AEAD, error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.aead == nil || g.count >= MAX_EPOCH_SEALS {
+		salt := make([]byte, LEN_EPOCH_SALT)
+		rand.Read(salt)
+		aead, err := g.epoch(salt)
+		if err != nil {
+			return nil, err
+		}
+		g.salt, g.aead, g.count = salt, aead, 0
+	}
+	copy(nonce, g.salt)
+	binary.BigEndian.PutUint32(nonce[LEN_EPOCH_SALT:], uint32(g.count))
+	g.count++
+	return g.aead, nil
+}
+
+// Seal 加密并认证plain, 结果为[Nonce][Ciphertext][Tag], ad参与认证但不加密
+func Seal(g *GCM, plain []byte, ad []byte) []byte {
+	nonce := make([]byte, LEN_NONCE, LEN_NONCE+len(plain)+LEN_TAG)
+	aead, err := g.next(nonce)
+	if err != nil {
+		// 子密钥的长度已经检查过, 不会出错
+		panic(err)
+	}
+	return aead.Seal(nonce, nonce, plain, ad)
+}
+
+// Open 解密Seal的结果, 密钥不对或者数据被篡改时返回错误
+func Open(g *GCM, sealed []byte, ad []byte) ([]byte, error) {
+	if len(sealed) < SEAL_OVERHEAD {
+		return nil, common.ErrBadEncryptionKey
+	}
+	g.lock.Lock()
+	aead, err := g.epoch(sealed[:LEN_EPOCH_SALT])
+	g.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	plain, err := aead.Open(nil, sealed[:LEN_NONCE], sealed[LEN_NONCE:], ad)
+	if err != nil {
+		return nil, common.ErrBadEncryptionKey
+	}
+	return plain, nil
+}
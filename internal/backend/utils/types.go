@@ -1,7 +1,13 @@
 package utils
 
-func AddressToUid(pgno int, offset int16) int64 {
+// AddressToUid UID的高32位是页号, 低32位是页内的槽号
+func AddressToUid(pgno int, slot int) int64 {
 	u0 := int64(pgno)
-	u1 := int64(offset)
+	u1 := int64(uint32(slot))
 	return (u0 << 32) | u1
 }
+
+// UidToAddress 把UID拆成页号和页内的槽号
+func UidToAddress(uid int64) (int, int) {
+	return int(uint64(uid) >> 32), int(uid & ((int64(1) << 32) - 1))
+}
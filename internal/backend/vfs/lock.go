@@ -0,0 +1,102 @@
+package vfs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/herveyleaf/GoDB/pkg/common"
+)
+
+// LOCK_SUFFIX 锁文件的后缀, 一个数据库的DM和TM共用path.lock
+const LOCK_SUFFIX = ".lock"
+
+// LockDatabase 锁住path处的数据库, 已经被其它进程打开时返回common.ErrDatabaseLocked.
+// 共享锁不创建锁文件, 锁文件不存在时返回common.ErrReadOnly, 需要先读写打开一次
+func LockDatabase(fsys FS, path string, shared bool) (io.Closer, error) {
+	l, err := fsys.Lock(path+LOCK_SUFFIX, shared)
+	if shared && os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: lock file %s does not exist", common.ErrReadOnly, path+LOCK_SUFFIX)
+	}
+	return l, err
+}
+
+// LockTable 内存文件系统中的建议锁, 和flock一样, 同一个名字上可以有多个共享锁或者一个独占锁.
+// 零值可以直接使用, 测试用的文件系统也用它实现Lock
+type LockTable struct {
+	lock sync.Mutex
+	held map[string]*heldLock
+}
+
+type heldLock struct {
+	shared    int
+	exclusive bool
+}
+
+// Acquire 给fsys中的name加锁, 冲突时返回common.ErrDatabaseLocked.
+// 和操作系统的实现一样, 独占锁在name不存在时创建它, 共享锁要求name已经存在
+func (t *LockTable) Acquire(fsys FS, name string, shared bool) (io.Closer, error) {
+	if shared {
+		if _, err := fsys.Stat(name); err != nil {
+			return nil, err
+		}
+	} else {
+		f, err := fsys.OpenFile(name, os.O_RDWR|os.O_CREATE, 0666)
+		if err != nil {
+			return nil, err
+		}
+		f.Close()
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.held == nil {
+		t.held = make(map[string]*heldLock)
+	}
+	h, ok := t.held[name]
+	if !ok {
+		h = &heldLock{}
+		t.held[name] = h
+	}
+	if h.exclusive || (!shared && h.shared > 0) {
+		return nil, fmt.Errorf("%w: %s", common.ErrDatabaseLocked, name)
+	}
+	if shared {
+		h.shared++
+	} else {
+		h.exclusive = true
+	}
+	return &memLock{table: t, name: name, h: h, shared: shared}, nil
+}
+
+// Reset 模拟进程退出, 之前的锁都失效, 旧的锁关闭时不再影响新的锁
+func (t *LockTable) Reset() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.held = nil
+}
+
+type memLock struct {
+	table  *LockTable
+	name   string
+	h      *heldLock
+	shared bool
+	once   sync.Once
+}
+
+func (l *memLock) Close() error {
+	l.once.Do(func() {
+		t := l.table
+		t.lock.Lock()
+		defer t.lock.Unlock()
+		if l.shared {
+			l.h.shared--
+		} else {
+			l.h.exclusive = false
+		}
+		if t.held[l.name] == l.h && l.h.shared == 0 && !l.h.exclusive {
+			delete(t.held, l.name)
+		}
+	})
+	return nil
+}
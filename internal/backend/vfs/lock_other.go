@@ -0,0 +1,16 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd || windows)
+
+package vfs
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+
+	"github.com/herveyleaf/GoDB/pkg/common"
+)
+
+// Lock 这些平台上没有可用的文件锁, 不加锁就打开可能让两个进程同时写同一个数据库, 所以返回错误
+func (osFS) Lock(name string, shared bool) (io.Closer, error) {
+	return nil, fmt.Errorf("%w: file locking on %s", common.ErrNotSupported, runtime.GOOS)
+}
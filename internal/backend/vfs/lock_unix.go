@@ -0,0 +1,37 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+
+	"github.com/herveyleaf/GoDB/pkg/common"
+)
+
+// Lock 用flock锁住name, 不等待. 关闭返回的文件就释放锁, 进程退出时操作系统也会释放
+func (osFS) Lock(name string, shared bool) (io.Closer, error) {
+	flag := os.O_RDWR | os.O_CREATE
+	if shared {
+		flag = os.O_RDONLY
+	}
+	f, err := os.OpenFile(name, flag, 0666)
+	if err != nil {
+		return nil, err
+	}
+	how := syscall.LOCK_EX
+	if shared {
+		how = syscall.LOCK_SH
+	}
+	if err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, fmt.Errorf("%w: %s", common.ErrDatabaseLocked, name)
+		}
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,49 @@
+//go:build windows
+
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/herveyleaf/GoDB/pkg/common"
+)
+
+const (
+	LOCKFILE_FAIL_IMMEDIATELY = 0x1
+	LOCKFILE_EXCLUSIVE_LOCK   = 0x2
+
+	ERROR_LOCK_VIOLATION syscall.Errno = 33
+)
+
+var procLockFileEx = syscall.NewLazyDLL("kernel32.dll").NewProc("LockFileEx")
+
+// Lock 用LockFileEx锁住name的第一个字节, 不等待. 关闭返回的文件就释放锁, 进程退出时操作系统也会释放
+func (osFS) Lock(name string, shared bool) (io.Closer, error) {
+	flag := os.O_RDWR | os.O_CREATE
+	if shared {
+		flag = os.O_RDONLY
+	}
+	f, err := os.OpenFile(name, flag, 0666)
+	if err != nil {
+		return nil, err
+	}
+	flags := uint32(LOCKFILE_FAIL_IMMEDIATELY)
+	if !shared {
+		flags |= LOCKFILE_EXCLUSIVE_LOCK
+	}
+	ol := new(syscall.Overlapped)
+	r, _, err := procLockFileEx.Call(f.Fd(), uintptr(flags), 0, 1, 0, uintptr(unsafe.Pointer(ol)))
+	if r == 0 {
+		f.Close()
+		if errors.Is(err, ERROR_LOCK_VIOLATION) {
+			return nil, fmt.Errorf("%w: %s", common.ErrDatabaseLocked, name)
+		}
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,194 @@
+package vfs
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// MemFS 完全在内存中的文件系统, 用于测试
+type MemFS struct {
+	lock  sync.Mutex
+	files map[string]*memData
+	locks LockTable
+}
+
+func NewMemFS() *MemFS {
+	return &MemFS{files: make(map[string]*memData)}
+}
+
+// memData 文件的内容, 同一个文件的多个句柄共享
+type memData struct {
+	lock    sync.RWMutex
+	data    []byte
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (m *MemFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	d, exists := m.files[name]
+	if exists && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	}
+	if !exists {
+		if flag&os.O_CREATE == 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		d = &memData{mode: perm, modTime: time.Now()}
+		m.files[name] = d
+	}
+	if flag&os.O_TRUNC != 0 {
+		d.lock.Lock()
+		d.data = nil
+		d.lock.Unlock()
+	}
+	return &memFile{name: name, d: d, readOnly: flag&(os.O_WRONLY|os.O_RDWR) == 0}, nil
+}
+
+func (m *MemFS) Lock(name string, shared bool) (io.Closer, error) {
+	return m.locks.Acquire(m, name, shared)
+}
+
+func (m *MemFS) Stat(name string) (os.FileInfo, error) {
+	m.lock.Lock()
+	d, exists := m.files[name]
+	m.lock.Unlock()
+	if !exists {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return d.stat(name), nil
+}
+
+func (m *MemFS) Remove(name string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, exists := m.files[name]; !exists {
+		return &os.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	delete(m.files, name)
+	return nil
+}
+
+func (m *MemFS) Rename(oldname string, newname string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	d, exists := m.files[oldname]
+	if !exists {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: fs.ErrNotExist}
+	}
+	delete(m.files, oldname)
+	m.files[newname] = d
+	return nil
+}
+
+func (d *memData) stat(name string) os.FileInfo {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return &memFileInfo{name: filepath.Base(name), size: int64(len(d.data)), mode: d.mode, modTime: d.modTime}
+}
+
+type memFile struct {
+	name     string
+	d        *memData
+	readOnly bool
+	closed   bool
+	lock     sync.Mutex
+}
+
+func (f *memFile) check(op string, write bool) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed {
+		return &os.PathError{Op: op, Path: f.name, Err: os.ErrClosed}
+	}
+	if write && f.readOnly {
+		return &os.PathError{Op: op, Path: f.name, Err: os.ErrPermission}
+	}
+	return nil
+}
+
+func (f *memFile) ReadAt(b []byte, off int64) (int, error) {
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	f.d.lock.RLock()
+	defer f.d.lock.RUnlock()
+	if off >= int64(len(f.d.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, f.d.data[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) WriteAt(b []byte, off int64) (int, error) {
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	f.d.lock.Lock()
+	defer f.d.lock.Unlock()
+	if end := off + int64(len(b)); end > int64(len(f.d.data)) {
+		f.d.data = append(f.d.data, make([]byte, end-int64(len(f.d.data)))...)
+	}
+	copy(f.d.data[off:], b)
+	f.d.modTime = time.Now()
+	return len(b), nil
+}
+
+func (f *memFile) Sync() error {
+	return f.check("sync", false)
+}
+
+func (f *memFile) Truncate(size int64) error {
+	if err := f.check("truncate", true); err != nil {
+		return err
+	}
+	f.d.lock.Lock()
+	defer f.d.lock.Unlock()
+	if size <= int64(len(f.d.data)) {
+		f.d.data = f.d.data[:size:size]
+	} else {
+		f.d.data = append(f.d.data, make([]byte, size-int64(len(f.d.data)))...)
+	}
+	f.d.modTime = time.Now()
+	return nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	if err := f.check("stat", false); err != nil {
+		return nil, err
+	}
+	return f.d.stat(f.name), nil
+}
+
+func (f *memFile) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed {
+		return &os.PathError{Op: "close", Path: f.name, Err: os.ErrClosed}
+	}
+	f.closed = true
+	return nil
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (fi *memFileInfo) Name() string       { return fi.name }
+func (fi *memFileInfo) Size() int64        { return fi.size }
+func (fi *memFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *memFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *memFileInfo) IsDir() bool        { return false }
+func (fi *memFileInfo) Sys() any           { return nil }
@@ -0,0 +1,249 @@
+package vfs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/herveyleaf/GoDB/internal/backend/utils"
+	"github.com/herveyleaf/GoDB/pkg/common"
+)
+
+const (
+	// 每块的明文长度
+	SEALED_BLOCK_SIZE = 256
+
+	// 块中的明文: [Seq] 8字节 [Len] 2字节 [Data] SEALED_BLOCK_SIZE字节
+	OF_SEALED_SEQ  = 0
+	OF_SEALED_LEN  = OF_SEALED_SEQ + 8
+	OF_SEALED_DATA = OF_SEALED_LEN + 2
+
+	// 每个槽位是一份Seal之后的块, 每块有两个槽位
+	LEN_SEALED_SLOT = OF_SEALED_DATA + SEALED_BLOCK_SIZE + utils.SEAL_OVERHEAD
+)
+
+// sealedFile 按固定大小的块用AEAD加密的文件, 可以在任意位置读写.
+// 每次写入都用新的随机数重新加密整块, 块的编号参与认证, 所以块之间不能互换.
+// 每块有两个槽位, 写入时写到不是最近一次Sync的版本所在的槽位, 断电撕裂时另一个槽位中仍然有Sync过的版本,
+// 打开时取能够认证并且序号最大的槽位. 明文都缓存在内存中, XID文件每个事务只占一个字节
+type sealedFile struct {
+	file File
+	aead *utils.GCM
+
+	lock   sync.Mutex
+	blocks []sealedBlock
+	size   int64        // 明文的长度
+	dirty  map[int]bool // 上次Sync之后写过的块
+}
+
+type sealedBlock struct {
+	data   []byte // 明文, 长度是块中有效数据的长度
+	seq    uint64
+	slot   int // 最新版本所在的槽位, -1表示两个槽位都无效
+	synced int // 最近一次Sync的版本所在的槽位
+}
+
+// NewSealedFile 读出f中所有的块并返回用aead加解密的文件. 只有最后一块允许两个槽位都无效(追加时断电),
+// 其它块无效时说明密钥不对或者文件被篡改, 返回common.ErrBadEncryptionKey
+func NewSealedFile(f File, aead *utils.GCM) (File, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	sf := &sealedFile{file: f, aead: aead, dirty: make(map[int]bool)}
+	n := int((fi.Size() + 2*LEN_SEALED_SLOT - 1) / (2 * LEN_SEALED_SLOT))
+	buf := make([]byte, 2*LEN_SEALED_SLOT)
+	for i := 0; i < n; i++ {
+		m, err := f.ReadAt(buf, int64(i)*2*LEN_SEALED_SLOT)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		b := sf.openBlock(i, buf[:m])
+		if b.slot < 0 && i != n-1 {
+			return nil, fmt.Errorf("%w: block %d cannot be authenticated", common.ErrBadEncryptionKey, i)
+		}
+		if b.slot >= 0 && i > 0 && len(sf.blocks[i-1].data) != SEALED_BLOCK_SIZE {
+			return nil, fmt.Errorf("%w: block %d follows a partial block", common.ErrBadEncryptionKey, i)
+		}
+		sf.blocks = append(sf.blocks, b)
+	}
+	if n > 0 && sf.blocks[0].slot < 0 {
+		// 唯一的一块也无效, 和写了一半的新块区分不开, 按密钥错误处理
+		return nil, fmt.Errorf("%w: no block can be authenticated", common.ErrBadEncryptionKey)
+	}
+	if n > 0 && sf.blocks[n-1].slot < 0 {
+		sf.blocks[n-1].data = nil
+	}
+	for _, b := range sf.blocks {
+		sf.size += int64(len(b.data))
+	}
+	return sf, nil
+}
+
+// openBlock 解密第i块的两个槽位, 取认证通过并且序号最大的版本
+func (sf *sealedFile) openBlock(i int, raw []byte) sealedBlock {
+	b := sealedBlock{slot: -1, synced: -1}
+	for s := 0; s < 2; s++ {
+		start := s * LEN_SEALED_SLOT
+		if len(raw) < start+LEN_SEALED_SLOT {
+			break
+		}
+		plain, err := utils.Open(sf.aead, raw[start:start+LEN_SEALED_SLOT], blockAD(i))
+		if err != nil {
+			continue
+		}
+		seq := binary.BigEndian.Uint64(plain[OF_SEALED_SEQ:])
+		length := int(binary.BigEndian.Uint16(plain[OF_SEALED_LEN:]))
+		if length > SEALED_BLOCK_SIZE || (b.slot >= 0 && seq <= b.seq) {
+			continue
+		}
+		b = sealedBlock{data: plain[OF_SEALED_DATA : OF_SEALED_DATA+length], seq: seq, slot: s, synced: s}
+	}
+	return b
+}
+
+func blockAD(i int) []byte {
+	ad := make([]byte, 8)
+	binary.BigEndian.PutUint64(ad, uint64(i))
+	return ad
+}
+
+// writeBlock 用新的随机数加密第i块的新内容, 写到不是最近一次Sync的版本所在的槽位
+func (sf *sealedFile) writeBlock(i int, data []byte) error {
+	for len(sf.blocks) <= i {
+		sf.blocks = append(sf.blocks, sealedBlock{slot: -1, synced: -1})
+	}
+	b := &sf.blocks[i]
+	slot := 0
+	if b.synced >= 0 {
+		slot = 1 - b.synced
+	} else if b.slot >= 0 {
+		slot = 1 - b.slot
+	}
+	plain := make([]byte, OF_SEALED_DATA+SEALED_BLOCK_SIZE)
+	binary.BigEndian.PutUint64(plain[OF_SEALED_SEQ:], b.seq+1)
+	binary.BigEndian.PutUint16(plain[OF_SEALED_LEN:], uint16(len(data)))
+	copy(plain[OF_SEALED_DATA:], data)
+	sealed := utils.Seal(sf.aead, plain, blockAD(i))
+	if _, err := sf.file.WriteAt(sealed, int64(i)*2*LEN_SEALED_SLOT+int64(slot)*LEN_SEALED_SLOT); err != nil {
+		return err
+	}
+	b.data, b.seq, b.slot = data, b.seq+1, slot
+	sf.dirty[i] = true
+	return nil
+}
+
+func (sf *sealedFile) ReadAt(p []byte, off int64) (int, error) {
+	sf.lock.Lock()
+	defer sf.lock.Unlock()
+	if off >= sf.size {
+		return 0, io.EOF
+	}
+	n := 0
+	for n < len(p) && off+int64(n) < sf.size {
+		pos := off + int64(n)
+		b := sf.blocks[pos/SEALED_BLOCK_SIZE]
+		n += copy(p[n:], b.data[pos%SEALED_BLOCK_SIZE:])
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (sf *sealedFile) WriteAt(p []byte, off int64) (int, error) {
+	sf.lock.Lock()
+	defer sf.lock.Unlock()
+	if err := sf.writeAt(p, off); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (sf *sealedFile) writeAt(p []byte, off int64) error {
+	if len(p) == 0 {
+		return nil
+	}
+	end := off + int64(len(p))
+	// 从原来的最后一块到写入结束的每一块都可能变化, 写入位置之前的空洞补零
+	first := int(min(off, sf.size) / SEALED_BLOCK_SIZE)
+	last := int((end - 1) / SEALED_BLOCK_SIZE)
+	for i := first; i <= last; i++ {
+		start := int64(i) * SEALED_BLOCK_SIZE
+		data := make([]byte, min(SEALED_BLOCK_SIZE, max(end, sf.size)-start))
+		if i < len(sf.blocks) {
+			copy(data, sf.blocks[i].data)
+		}
+		if lo, hi := max(off, start), min(end, start+SEALED_BLOCK_SIZE); lo < hi {
+			copy(data[lo-start:], p[lo-off:hi-off])
+		}
+		if err := sf.writeBlock(i, data); err != nil {
+			return err
+		}
+	}
+	sf.size = max(sf.size, end)
+	return nil
+}
+
+// Sync 之后写过的块的最新版本成为Sync过的版本, 下次写入换到另一个槽位
+func (sf *sealedFile) Sync() error {
+	sf.lock.Lock()
+	defer sf.lock.Unlock()
+	if err := sf.file.Sync(); err != nil {
+		return err
+	}
+	for i := range sf.dirty {
+		sf.blocks[i].synced = sf.blocks[i].slot
+	}
+	clear(sf.dirty)
+	return nil
+}
+
+func (sf *sealedFile) Truncate(size int64) error {
+	sf.lock.Lock()
+	defer sf.lock.Unlock()
+	if size >= sf.size {
+		return sf.writeAt(make([]byte, size-sf.size), sf.size)
+	}
+	n := int((size + SEALED_BLOCK_SIZE - 1) / SEALED_BLOCK_SIZE)
+	if rest := size % SEALED_BLOCK_SIZE; rest > 0 {
+		if err := sf.writeBlock(n-1, sf.blocks[n-1].data[:rest:rest]); err != nil {
+			return err
+		}
+	}
+	if err := sf.file.Truncate(int64(n) * 2 * LEN_SEALED_SLOT); err != nil {
+		return err
+	}
+	for i := n; i < len(sf.blocks); i++ {
+		delete(sf.dirty, i)
+	}
+	sf.blocks = sf.blocks[:n]
+	sf.size = size
+	return nil
+}
+
+// Stat 返回的长度是明文的长度
+func (sf *sealedFile) Stat() (os.FileInfo, error) {
+	fi, err := sf.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	sf.lock.Lock()
+	defer sf.lock.Unlock()
+	return sealedFileInfo{FileInfo: fi, size: sf.size}, nil
+}
+
+func (sf *sealedFile) Close() error {
+	return sf.file.Close()
+}
+
+type sealedFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (fi sealedFileInfo) Size() int64 {
+	return fi.size
+}
@@ -0,0 +1,62 @@
+package vfs
+
+import (
+	"io"
+	"os"
+)
+
+// File 存储文件需要支持的操作, *os.File满足这个接口
+type File interface {
+	io.ReaderAt
+	io.WriterAt
+	Sync() error
+	Truncate(size int64) error
+	Stat() (os.FileInfo, error)
+	Close() error
+}
+
+// FS 存储文件所在的文件系统, DM和TM都通过它打开文件,
+// 可以替换成内存文件系统、故障注入或者加密的实现
+type FS interface {
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Stat(name string) (os.FileInfo, error)
+	Remove(name string) error
+	// Rename 原子地用oldname替换newname
+	Rename(oldname string, newname string) error
+	// Lock 给name加建议锁, shared为true时是共享锁, 已经被锁住时返回common.ErrDatabaseLocked.
+	// 独占锁在name不存在时创建它, 共享锁只读打开已经存在的name. 关闭返回的Closer释放锁
+	Lock(name string, shared bool) (io.Closer, error)
+}
+
+// OS 直接使用操作系统的文件系统
+var OS FS = osFS{}
+
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) Rename(oldname string, newname string) error {
+	return os.Rename(oldname, newname)
+}
+
+// Or fs为nil时返回OS
+func Or(fs FS) FS {
+	if fs == nil {
+		return OS
+	}
+	return fs
+}
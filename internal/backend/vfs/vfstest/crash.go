@@ -0,0 +1,349 @@
+// Package vfstest 提供测试崩溃恢复用的文件系统, 只应该在测试中使用
+package vfstest
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/herveyleaf/GoDB/internal/backend/vfs"
+)
+
+// ErrPowerLoss 断电之后文件操作返回的错误
+var ErrPowerLoss = errors.New("simulated power loss")
+
+// CrashFS 模拟断电的内存文件系统, 用于测试崩溃恢复.
+// 每个文件都记录最近一次Sync时的内容和之后的写入, 断电时每个没有Sync的写入都可能生效、丢失,
+// 或者只有任意长度的前缀生效(撕裂), 截断也可能丢失. 断电之后所有文件操作都返回ErrPowerLoss,
+// 直到调用Restart, 之前打开的文件句柄在重启后也不能再使用
+type CrashFS struct {
+	lock    sync.Mutex
+	files   map[string]*crashData
+	rnd     *rand.Rand
+	ops     int // 已经执行的文件操作数
+	crashAt int // 执行到第几个操作时断电, 0表示不会断电
+	crashed bool
+	boot    int // 每次重启加1, 用来让旧的文件句柄失效
+	locks   vfs.LockTable
+}
+
+type crashData struct {
+	synced  []byte
+	data    []byte
+	pending []crashOp
+	mode    os.FileMode
+	modTime time.Time
+}
+
+// crashOp 最近一次Sync之后的写入或者截断
+type crashOp struct {
+	truncate bool
+	off      int64
+	b        []byte
+}
+
+func NewCrashFS(seed int64) *CrashFS {
+	return &CrashFS{
+		files: make(map[string]*crashData),
+		rnd:   rand.New(rand.NewSource(seed)),
+	}
+}
+
+// CrashAfter 在之后的第n个文件操作时断电, 这个操作本身不会生效, n不大于0时取消断电
+func (c *CrashFS) CrashAfter(n int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if n <= 0 {
+		c.crashAt = 0
+		return
+	}
+	c.crashAt = c.ops + n
+}
+
+// Crash 立即断电
+func (c *CrashFS) Crash() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.powerLoss()
+}
+
+func (c *CrashFS) Crashed() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.crashed
+}
+
+// Ops 返回到目前为止执行过的文件操作数
+func (c *CrashFS) Ops() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.ops
+}
+
+// Restart 断电之后重新上电, 文件内容是断电时随机决定的结果. 断电前的锁都被释放
+func (c *CrashFS) Restart() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.crashed = false
+	c.crashAt = 0
+	c.boot++
+	c.locks.Reset()
+}
+
+func (c *CrashFS) Lock(name string, shared bool) (io.Closer, error) {
+	return c.locks.Acquire(c, name, shared)
+}
+
+// step 记录一次文件操作, 到达断电点时返回ErrPowerLoss, 调用方需要持有lock
+func (c *CrashFS) step() error {
+	if c.crashed {
+		return ErrPowerLoss
+	}
+	c.ops++
+	if c.crashAt > 0 && c.ops >= c.crashAt {
+		c.powerLoss()
+		return ErrPowerLoss
+	}
+	return nil
+}
+
+func (c *CrashFS) powerLoss() {
+	if c.crashed {
+		return
+	}
+	c.crashed = true
+	for _, d := range c.files {
+		data := append([]byte(nil), d.synced...)
+		for _, op := range d.pending {
+			switch c.rnd.Intn(3) {
+			case 0:
+				// 丢失
+				continue
+			case 1:
+				// 完整生效
+				data = applyCrashOp(data, op, len(op.b))
+			case 2:
+				// 只有前缀生效, 截断没有撕裂的说法, 直接生效
+				data = applyCrashOp(data, op, c.rnd.Intn(len(op.b)+1))
+			}
+		}
+		d.synced = data
+		d.data = append([]byte(nil), data...)
+		d.pending = nil
+	}
+}
+
+func applyCrashOp(data []byte, op crashOp, n int) []byte {
+	if op.truncate {
+		return resize(data, op.off)
+	}
+	if n == 0 {
+		return data
+	}
+	if end := op.off + int64(n); end > int64(len(data)) {
+		data = resize(data, end)
+	}
+	copy(data[op.off:], op.b[:n])
+	return data
+}
+
+func resize(data []byte, size int64) []byte {
+	if size <= int64(len(data)) {
+		return data[:size:size]
+	}
+	return append(data, make([]byte, size-int64(len(data)))...)
+}
+
+func (c *CrashFS) OpenFile(name string, flag int, perm os.FileMode) (vfs.File, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := c.step(); err != nil {
+		return nil, err
+	}
+
+	d, exists := c.files[name]
+	if exists && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	}
+	if !exists {
+		if flag&os.O_CREATE == 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		// 目录项的持久性不在模拟范围内, 新建的文件断电后总是存在
+		d = &crashData{mode: perm, modTime: time.Now()}
+		c.files[name] = d
+	}
+	if flag&os.O_TRUNC != 0 {
+		d.data = resize(d.data, 0)
+		d.pending = append(d.pending, crashOp{truncate: true, off: 0})
+	}
+	return &crashFile{
+		c:        c,
+		name:     name,
+		d:        d,
+		boot:     c.boot,
+		readOnly: flag&(os.O_WRONLY|os.O_RDWR) == 0,
+	}, nil
+}
+
+func (c *CrashFS) Stat(name string) (os.FileInfo, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := c.step(); err != nil {
+		return nil, err
+	}
+	d, exists := c.files[name]
+	if !exists {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return d.stat(name), nil
+}
+
+func (c *CrashFS) Remove(name string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := c.step(); err != nil {
+		return err
+	}
+	if _, exists := c.files[name]; !exists {
+		return &os.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	delete(c.files, name)
+	return nil
+}
+
+// Rename 和新建文件一样, 目录项的变化在返回后就不会再丢失
+func (c *CrashFS) Rename(oldname string, newname string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := c.step(); err != nil {
+		return err
+	}
+	d, exists := c.files[oldname]
+	if !exists {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: fs.ErrNotExist}
+	}
+	delete(c.files, oldname)
+	c.files[newname] = d
+	return nil
+}
+
+func (d *crashData) stat(name string) os.FileInfo {
+	return &fileInfo{name: filepath.Base(name), size: int64(len(d.data)), mode: d.mode, modTime: d.modTime}
+}
+
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *fileInfo) IsDir() bool        { return false }
+func (fi *fileInfo) Sys() any           { return nil }
+
+type crashFile struct {
+	c        *CrashFS
+	name     string
+	d        *crashData
+	boot     int
+	readOnly bool
+	closed   bool
+}
+
+// begin 检查句柄并记录一次文件操作, 成功时返回后仍然持有lock
+func (f *crashFile) begin(op string, write bool) error {
+	f.c.lock.Lock()
+	if f.closed {
+		f.c.lock.Unlock()
+		return &os.PathError{Op: op, Path: f.name, Err: os.ErrClosed}
+	}
+	if f.boot != f.c.boot {
+		f.c.lock.Unlock()
+		return &os.PathError{Op: op, Path: f.name, Err: ErrPowerLoss}
+	}
+	if write && f.readOnly {
+		f.c.lock.Unlock()
+		return &os.PathError{Op: op, Path: f.name, Err: os.ErrPermission}
+	}
+	if err := f.c.step(); err != nil {
+		f.c.lock.Unlock()
+		return &os.PathError{Op: op, Path: f.name, Err: err}
+	}
+	return nil
+}
+
+func (f *crashFile) ReadAt(b []byte, off int64) (int, error) {
+	if err := f.begin("read", false); err != nil {
+		return 0, err
+	}
+	defer f.c.lock.Unlock()
+	if off >= int64(len(f.d.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, f.d.data[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *crashFile) WriteAt(b []byte, off int64) (int, error) {
+	if err := f.begin("write", true); err != nil {
+		return 0, err
+	}
+	defer f.c.lock.Unlock()
+	op := crashOp{off: off, b: append([]byte(nil), b...)}
+	f.d.data = applyCrashOp(f.d.data, op, len(b))
+	f.d.pending = append(f.d.pending, op)
+	f.d.modTime = time.Now()
+	return len(b), nil
+}
+
+func (f *crashFile) Sync() error {
+	if err := f.begin("sync", false); err != nil {
+		return err
+	}
+	defer f.c.lock.Unlock()
+	f.d.synced = append([]byte(nil), f.d.data...)
+	f.d.pending = nil
+	return nil
+}
+
+func (f *crashFile) Truncate(size int64) error {
+	if err := f.begin("truncate", true); err != nil {
+		return err
+	}
+	defer f.c.lock.Unlock()
+	f.d.data = resize(f.d.data, size)
+	f.d.pending = append(f.d.pending, crashOp{truncate: true, off: size})
+	f.d.modTime = time.Now()
+	return nil
+}
+
+func (f *crashFile) Stat() (os.FileInfo, error) {
+	if err := f.begin("stat", false); err != nil {
+		return nil, err
+	}
+	defer f.c.lock.Unlock()
+	return f.d.stat(f.name), nil
+}
+
+func (f *crashFile) Close() error {
+	f.c.lock.Lock()
+	defer f.c.lock.Unlock()
+	if f.closed {
+		return &os.PathError{Op: "close", Path: f.name, Err: os.ErrClosed}
+	}
+	f.closed = true
+	return nil
+}
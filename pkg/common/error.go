@@ -8,14 +8,26 @@ var (
 	ErrFileExists    = errors.New("file already exists")
 	ErrFileNotExists = errors.New("file does not exist")
 	ErrFileCannotRW  = errors.New("file cannot read or write")
+
+	ErrBadEncryptionKey = errors.New("missing or wrong encryption key")
+	ErrNotEncrypted     = errors.New("file is not encrypted")
+
+	ErrDatabaseLocked = errors.New("database is locked")
+	ErrDatabaseClosed = errors.New("database is closed")
+	ErrReadOnly       = errors.New("database is opened read-only")
 )
 
 // 数据管理器(DM)错误
 var (
-	ErrBadLogFile   = errors.New("bad log file")
-	ErrMemTooSmall  = errors.New("memory too small")
-	ErrDataTooLarge = errors.New("data too large")
-	ErrDatabaseBusy = errors.New("database is busy")
+	ErrBadLogFile       = errors.New("bad log file")
+	ErrMemTooSmall      = errors.New("memory too small")
+	ErrDataTooLarge     = errors.New("data too large")
+	ErrOverflowUpdate   = errors.New("overflow data item cannot be updated in place")
+	ErrBadDBFile        = errors.New("bad database file")
+	ErrInvalidPageSize  = errors.New("invalid page size")
+	ErrPageCorrupted    = errors.New("page checksum mismatch")
+	ErrMmapUnsupported  = errors.New("mmap is not supported on this platform")
+	ErrMmapIncompatible = errors.New("mmap cannot be used with encryption or compression")
 )
 
 // 事务管理器(TM)错误
@@ -56,9 +68,12 @@ var (
 var (
 	ErrNestedTransaction = errors.New("nested transaction not supported")
 	ErrNoTransaction     = errors.New("not in transaction")
+	ErrTxDone            = errors.New("transaction has already been committed or rolled back")
+	ErrNotSupported      = errors.New("not supported")
 )
 
 // 启动器错误
 var (
-	ErrInvalidMem = errors.New("invalid memory")
+	ErrInvalidMem     = errors.New("invalid memory")
+	ErrInvalidOptions = errors.New("invalid options")
 )
@@ -0,0 +1,198 @@
+package godb
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/herveyleaf/GoDB/internal/backend/dm"
+	"github.com/herveyleaf/GoDB/pkg/common"
+)
+
+// 还没有SQL层, Exec和Query执行的语句是数据API的命令, 参数都用?表示, 命令不区分大小写:
+//
+//	insert ?      插入数据, 返回UID
+//	update ? ?    把UID处的数据换成新的数据
+//	delete ?      删除UID处的数据
+//	read ?        读出UID处的数据, 数据不存在时没有行
+//	scan          按UID的顺序读出所有数据
+//
+// UID是整数, 数据是[]byte或者string
+
+// 每个命令的参数个数
+var commandInputs = map[string]int{"insert": 1, "update": 2, "delete": 1, "read": 1, "scan": 0}
+
+// parseCommand 返回语句的命令, 语句的格式不对时返回common.ErrInvalidCommand
+func parseCommand(query string) (string, error) {
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return "", fmt.Errorf("%w: empty statement", common.ErrInvalidCommand)
+	}
+	op := strings.ToLower(fields[0])
+	inputs, ok := commandInputs[op]
+	if !ok || inputs != len(fields)-1 {
+		return "", fmt.Errorf("%w: %q", common.ErrInvalidCommand, query)
+	}
+	for _, f := range fields[1:] {
+		if f != "?" {
+			return "", fmt.Errorf("%w: %q", common.ErrInvalidCommand, query)
+		}
+	}
+	return op, nil
+}
+
+// isQuery read和scan返回行, 其它命令不返回
+func isQuery(op string) bool {
+	return op == "read" || op == "scan"
+}
+
+func checkArgs(op string, args []any) error {
+	if len(args) != commandInputs[op] {
+		return fmt.Errorf("%w: %s takes %d arguments, got %d", common.ErrInvalidCommand, op, commandInputs[op], len(args))
+	}
+	return nil
+}
+
+// Exec 执行写命令insert、update或delete, insert返回插入的数据的UID, 其它命令返回0
+func (tx *Tx) Exec(query string, args ...any) (int64, error) {
+	op, err := parseCommand(query)
+	if err != nil {
+		return 0, err
+	}
+	if isQuery(op) {
+		return 0, fmt.Errorf("%w: %s returns rows, use Query", common.ErrInvalidCommand, op)
+	}
+	if err := checkArgs(op, args); err != nil {
+		return 0, err
+	}
+	switch op {
+	case "insert":
+		data, err := dataArg(args[0])
+		if err != nil {
+			return 0, err
+		}
+		return tx.Insert(data)
+	case "update":
+		uid, err := uidArg(args[0])
+		if err != nil {
+			return 0, err
+		}
+		data, err := dataArg(args[1])
+		if err != nil {
+			return 0, err
+		}
+		return 0, tx.Update(uid, data)
+	default:
+		uid, err := uidArg(args[0])
+		if err != nil {
+			return 0, err
+		}
+		return 0, tx.Delete(uid)
+	}
+}
+
+// Query 执行读命令read或scan, 每行是一条数据的UID和内容
+func (tx *Tx) Query(query string, args ...any) (*Rows, error) {
+	if err := tx.use(func() error { return nil }); err != nil {
+		return nil, err
+	}
+	return tx.db.Query(query, args...)
+}
+
+// Query 不在事务中执行读命令read或scan, 和DB.Read、DB.Scan一样不需要事务
+func (db *DB) Query(query string, args ...any) (*Rows, error) {
+	op, err := parseCommand(query)
+	if err != nil {
+		return nil, err
+	}
+	if !isQuery(op) {
+		return nil, fmt.Errorf("%w: %s returns no rows, use Exec", common.ErrInvalidCommand, op)
+	}
+	if err := checkArgs(op, args); err != nil {
+		return nil, err
+	}
+	if op == "scan" {
+		return &Rows{scanner: db.dm.Scan()}, nil
+	}
+	uid, err := uidArg(args[0])
+	if err != nil {
+		return nil, err
+	}
+	data, err := db.Read(uid)
+	if err != nil {
+		return nil, err
+	}
+	r := &Rows{}
+	if data != nil {
+		r.items = []dm.ScanItem{{Uid: uid, Data: data}}
+	}
+	return r, nil
+}
+
+func uidArg(v any) (int64, error) {
+	switch uid := v.(type) {
+	case int64:
+		return uid, nil
+	case int:
+		return int64(uid), nil
+	}
+	return 0, fmt.Errorf("%w: uid must be an integer, got %T", common.ErrInvalidCommand, v)
+}
+
+func dataArg(v any) ([]byte, error) {
+	switch data := v.(type) {
+	case []byte:
+		return data, nil
+	case string:
+		return []byte(data), nil
+	}
+	return nil, fmt.Errorf("%w: data must be []byte or string, got %T", common.ErrInvalidCommand, v)
+}
+
+// Rows Query的结果, 用Next逐行读出, 用完之后要Close. read的结果在items中, scan的结果由scanner逐条读出
+type Rows struct {
+	items   []dm.ScanItem
+	scanner *dm.Scanner
+	cur     dm.ScanItem
+}
+
+// Next 读出下一行, 没有更多的行或者出错时返回false, 错误由Err返回
+func (r *Rows) Next() bool {
+	if r.scanner != nil {
+		next := r.scanner.Next()
+		if next == nil {
+			return false
+		}
+		r.cur = *next
+		return true
+	}
+	if len(r.items) == 0 {
+		return false
+	}
+	r.cur, r.items = r.items[0], r.items[1:]
+	return true
+}
+
+// UID 当前行的数据的UID
+func (r *Rows) UID() int64 {
+	return r.cur.Uid
+}
+
+// Data 当前行的数据
+func (r *Rows) Data() []byte {
+	return r.cur.Data
+}
+
+// Err 返回遍历时遇到的错误
+func (r *Rows) Err() error {
+	if r.scanner != nil {
+		return r.scanner.Err()
+	}
+	return nil
+}
+
+func (r *Rows) Close() error {
+	if r.scanner != nil {
+		r.scanner.Close()
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+// Package godb 是打开GoDB数据库的入口, 按Options把事务管理器和数据管理器组装在一起.
+// 事务可以按UID插入、读取、更新、删除和遍历数据, 也可以用Exec和Query执行同样的数据API命令;
+// 版本管理、表管理和SQL解析还不在这个仓库中, 所以没有隔离, 也不能执行SQL. 导入这个包同时会注册database/sql驱动"godb"
+package godb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/herveyleaf/GoDB/internal/backend/dm"
+	"github.com/herveyleaf/GoDB/internal/backend/tm"
+	"github.com/herveyleaf/GoDB/internal/backend/vfs"
+	"github.com/herveyleaf/GoDB/pkg/common"
+)
+
+// DB 一个打开的数据库, path下有.db、.log、.xid等文件
+type DB struct {
+	path string
+	opts Options
+	tm   tm.TransactionManager
+	dm   dm.DataManager
+	// 整个数据库只锁一次, TM和DM打开时不再加锁
+	fileLock io.Closer
+
+	lock   sync.Mutex
+	active map[*Tx]struct{} // 还没有结束的事务, 关闭时回滚
+	closed bool
+}
+
+// Open 打开path处的数据库, 不存在时按opts创建. opts为nil时使用默认配置.
+// 数据库已经被其它进程打开时返回common.ErrDatabaseLocked
+func Open(path string, opts *Options) (*DB, error) {
+	var o Options
+	if opts != nil {
+		o = *opts
+	}
+	o, err := o.validate()
+	if err != nil {
+		return nil, err
+	}
+	fsys := vfs.Or(o.FS)
+	// 共享锁不创建锁文件, 只读打开不存在的数据库时先报告文件不存在
+	if o.ReadOnly {
+		if found, err := exists(fsys, path); err != nil {
+			return nil, err
+		} else if !found {
+			return nil, common.ErrFileNotExists
+		}
+	}
+	// 先加锁再检查文件是否存在, 两个进程同时打开时不会都去创建
+	fileLock, err := vfs.LockDatabase(fsys, path, o.ReadOnly)
+	if err != nil {
+		return nil, err
+	}
+	found, err := exists(fsys, path)
+	var db *DB
+	if err == nil {
+		if found {
+			db, err = open(path, o)
+		} else {
+			db, err = create(path, o)
+		}
+	}
+	if err != nil {
+		fileLock.Close()
+		return nil, err
+	}
+	db.fileLock = fileLock
+	return db, nil
+}
+
+// exists .xid和.db文件有一个存在就按已有的数据库打开, 缺少的文件在打开时报错, 不会在残缺的数据库上重新创建
+func exists(fsys vfs.FS, path string) (bool, error) {
+	for _, suffix := range []string{tm.XID_SUFFIX, dm.DB_SUFFIX} {
+		if _, err := fsys.Stat(path + suffix); err == nil {
+			return true, nil
+		} else if !os.IsNotExist(err) {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// create 创建数据管理器失败时删除已经创建的XID文件, 之后可以重新创建
+func create(path string, o Options) (*DB, error) {
+	tmgr, err := tm.CreateWithConfig(path, o.tmConfig())
+	if err != nil {
+		return nil, err
+	}
+	dmgr, err := dm.CreateDMWithConfig(path, o.Memory, tmgr, o.dmConfig())
+	if err != nil {
+		tmgr.Close()
+		vfs.Or(o.FS).Remove(path + tm.XID_SUFFIX)
+		return nil, memError(err, o)
+	}
+	return newDB(path, o, tmgr, dmgr), nil
+}
+
+func open(path string, o Options) (*DB, error) {
+	tmgr, err := tm.OpenWithConfig(path, o.tmConfig())
+	if err != nil {
+		return nil, err
+	}
+	dmgr, err := dm.OpenDMWithConfig(path, o.Memory, tmgr, o.dmConfig())
+	if err != nil {
+		tmgr.Close()
+		return nil, memError(err, o)
+	}
+	return newDB(path, o, tmgr, dmgr), nil
+}
+
+func newDB(path string, o Options, tmgr tm.TransactionManager, dmgr dm.DataManager) *DB {
+	return &DB{path: path, opts: o, tm: tmgr, dm: dmgr, active: make(map[*Tx]struct{})}
+}
+
+// memError 打开时才知道文件头中的页面大小, 内存放不下足够的页面时也报告为配置错误
+func memError(err error, o Options) error {
+	if errors.Is(err, common.ErrMemTooSmall) {
+		return fmt.Errorf("%w: memory %d is too small for the page size of this database: %w",
+			common.ErrInvalidOptions, o.Memory, err)
+	}
+	return err
+}
+
+// Path 返回数据库文件的路径, 不带后缀
+func (db *DB) Path() string {
+	return db.path
+}
+
+// Options 返回填上默认值之后的配置
+func (db *DB) Options() Options {
+	return db.opts
+}
+
+// Close 回滚还没有结束的事务, 再关闭数据管理器和事务管理器, 返回遇到的第一个错误.
+// 已经关闭过时返回common.ErrDatabaseClosed
+func (db *DB) Close() error {
+	db.lock.Lock()
+	if db.closed {
+		db.lock.Unlock()
+		return common.ErrDatabaseClosed
+	}
+	db.closed = true
+	active := make([]*Tx, 0, len(db.active))
+	for tx := range db.active {
+		active = append(active, tx)
+	}
+	db.lock.Unlock()
+	var err error
+	for _, tx := range active {
+		if txErr := tx.Rollback(); err == nil && !errors.Is(txErr, common.ErrTxDone) {
+			err = txErr
+		}
+	}
+	if dmErr := db.dm.Close(); err == nil {
+		err = dmErr
+	}
+	if tmErr := db.tm.Close(); err == nil {
+		err = tmErr
+	}
+	db.fileLock.Close()
+	return err
+}
+
+// Read 不在事务中读出uid处的数据, 数据不存在或者已经删除时返回nil. 只读打开时不能开始事务, 用它读数据
+func (db *DB) Read(uid int64) ([]byte, error) {
+	di, err := db.dm.Read(uid)
+	if err != nil || di == nil {
+		return nil, err
+	}
+	defer di.Release()
+	di.RLock()
+	defer di.RUnLock()
+	data := make([]byte, len(di.Data()))
+	copy(data, di.Data())
+	return data, nil
+}
+
+// Scan 不在事务中按UID的顺序对每条数据调用f, f返回错误时停止并返回这个错误.
+// 遍历过程中其它事务的修改可能被看到, 也可能看不到
+func (db *DB) Scan(f func(uid int64, data []byte) error) error {
+	s := db.dm.Scan()
+	defer s.Close()
+	for item := s.Next(); item != nil; item = s.Next() {
+		if err := f(item.Uid, item.Data); err != nil {
+			return err
+		}
+	}
+	return s.Err()
+}
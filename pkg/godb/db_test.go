@@ -0,0 +1,78 @@
+package godb
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/herveyleaf/GoDB/pkg/common"
+)
+
+func TestOpenOptions(t *testing.T) {
+	fsys := NewMemFS()
+	bad := []Options{
+		{FS: fsys, PageSize: 5000},
+		{FS: fsys, Memory: MIN_PAGE_SIZE},
+		{FS: fsys, PageSize: MAX_PAGE_SIZE, Memory: MAX_PAGE_SIZE},
+		{FS: fsys, EncryptionKey: []byte("short")},
+		{FS: fsys, Mmap: true, Compress: true},
+		{FS: fsys, Select: 42},
+		{FS: fsys, Sync: 7},
+		{FS: fsys, LogSegmentSize: -1},
+	}
+	for i, opts := range bad {
+		if _, err := Open("bad", &opts); !errors.Is(err, common.ErrInvalidOptions) {
+			t.Fatalf("Options %d: expected ErrInvalidOptions, got %v", i, err)
+		}
+	}
+	if _, err := fsys.Stat("bad.xid"); err == nil {
+		t.Fatalf("Invalid options should not create any file")
+	}
+
+	// 第一次打开时创建, 之后按文件头中的页面大小打开
+	key := make([]byte, 16)
+	db, err := Open("db", &Options{FS: fsys, PageSize: MAX_PAGE_SIZE, Memory: MAX_PAGE_SIZE * MIN_CACHED_PAGES, EncryptionKey: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = Open("db", &Options{FS: fsys, EncryptionKey: key}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open("db", &Options{FS: fsys, EncryptionKey: key}); !errors.Is(err, common.ErrDatabaseLocked) {
+		t.Fatalf("Expected ErrDatabaseLocked, got %v", err)
+	}
+	if db.Options().PageSize != 0 || db.Close() != nil {
+		t.Fatalf("Reopen should keep the options and close cleanly")
+	}
+
+	// 只读打开不能开始事务, 也不会创建不存在的数据库
+	if db, err = Open("db", &Options{FS: fsys, EncryptionKey: key, ReadOnly: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Begin(); !errors.Is(err, common.ErrReadOnly) {
+		t.Fatalf("Expected ErrReadOnly, got %v", err)
+	}
+	db.Close()
+	if _, err := Open("missing", &Options{FS: fsys, ReadOnly: true}); !errors.Is(err, common.ErrFileNotExists) {
+		t.Fatalf("Expected ErrFileNotExists, got %v", err)
+	}
+	_, err = Open("db", &Options{FS: fsys, Memory: DEFAULT_PAGE_SIZE * MIN_CACHED_PAGES, EncryptionKey: key})
+	if !errors.Is(err, common.ErrInvalidOptions) {
+		t.Fatalf("Expected ErrInvalidOptions for too little memory, got %v", err)
+	}
+
+	// 创建数据管理器失败时不留下XID文件, 改正配置之后可以重新创建
+	_, err = Open("retry", &Options{FS: fsys, Memory: MIN_PAGE_SIZE * MIN_CACHED_PAGES})
+	if !errors.Is(err, common.ErrInvalidOptions) {
+		t.Fatalf("Expected ErrInvalidOptions for too little memory, got %v", err)
+	}
+	if _, err := fsys.Stat("retry.xid"); err == nil {
+		t.Fatalf("Failed create left the XID file behind")
+	}
+	if db, err = Open("retry", &Options{FS: fsys}); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+}
@@ -0,0 +1,354 @@
+package godb
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/herveyleaf/GoDB/pkg/common"
+)
+
+// DRIVER_NAME database/sql中注册的驱动名
+const DRIVER_NAME = "godb"
+
+func init() {
+	sql.Register(DRIVER_NAME, &Driver{dbs: make(map[string]*sharedDB)})
+}
+
+// Driver database/sql驱动. DSN是数据库文件的路径, 不带后缀, 后面可以用?name=value&...带上Options,
+// 也可以写成godb:///path?name=value&...或者godb://host:port/path?name=value&.... 参数有memory、page_size、mmap、
+// key(十六进制)、compress、select(first_fit、best_fit、append_only)、read_only、sync(full、commit)和log_segment_size.
+// 同一个路径的所有连接共用一个DB, 必须使用相同的参数, 最后一个连接关闭时才关闭数据库.
+// 还没有SQL层, 语句是数据API的命令, 见Prepare; 也还没有服务器, 带主机的DSN能解析但连接时返回common.ErrNotSupported
+type Driver struct {
+	lock sync.Mutex
+	dbs  map[string]*sharedDB
+}
+
+type sharedDB struct {
+	db    *DB
+	query string // 打开时的参数, 同一个路径只能用相同的参数打开
+	refs  int
+}
+
+// dsn 解析之后的DSN
+type dsn struct {
+	host  string
+	path  string
+	query string
+	opts  Options
+}
+
+// parseDSN 解析DSN, 参数的名字和Options的字段对应, 错误都包装了common.ErrInvalidOptions
+func parseDSN(s string) (dsn, error) {
+	var d dsn
+	if strings.HasPrefix(s, DRIVER_NAME+"://") {
+		u, err := url.Parse(s)
+		if err != nil {
+			return d, fmt.Errorf("%w: %w", common.ErrInvalidOptions, err)
+		}
+		d.host, d.path, d.query = u.Host, u.Path, u.RawQuery
+		// 有主机时路径是服务器上的数据库, 去掉开头的斜杠
+		if d.host != "" {
+			d.path = strings.TrimPrefix(d.path, "/")
+		}
+	} else {
+		d.path, d.query, _ = strings.Cut(s, "?")
+	}
+	if d.path == "" {
+		return d, fmt.Errorf("%w: DSN %q has no path", common.ErrInvalidOptions, s)
+	}
+	values, err := url.ParseQuery(d.query)
+	if err != nil {
+		return d, fmt.Errorf("%w: %w", common.ErrInvalidOptions, err)
+	}
+	for name := range values {
+		if err := d.opts.set(name, values.Get(name)); err != nil {
+			return d, err
+		}
+	}
+	return d, nil
+}
+
+// set 按DSN中的一个参数设置配置
+func (o *Options) set(name string, value string) error {
+	var err error
+	switch name {
+	case "memory":
+		o.Memory, err = strconv.ParseInt(value, 10, 64)
+	case "page_size":
+		o.PageSize, err = strconv.Atoi(value)
+	case "mmap":
+		o.Mmap, err = strconv.ParseBool(value)
+	case "key":
+		o.EncryptionKey, err = hex.DecodeString(value)
+	case "compress":
+		o.Compress, err = strconv.ParseBool(value)
+	case "select":
+		o.Select, err = parseSelect(value)
+	case "read_only":
+		o.ReadOnly, err = strconv.ParseBool(value)
+	case "sync":
+		o.Sync, err = parseSync(value)
+	case "log_segment_size":
+		o.LogSegmentSize, err = strconv.ParseInt(value, 10, 64)
+	default:
+		return fmt.Errorf("%w: unknown DSN parameter %q", common.ErrInvalidOptions, name)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: DSN parameter %s: %w", common.ErrInvalidOptions, name, err)
+	}
+	return nil
+}
+
+func parseSelect(value string) (SelectStrategy, error) {
+	switch value {
+	case "first_fit":
+		return SelectFirstFit, nil
+	case "best_fit":
+		return SelectBestFit, nil
+	case "append_only":
+		return SelectAppendOnly, nil
+	}
+	return 0, fmt.Errorf("unknown select strategy %q", value)
+}
+
+func parseSync(value string) (SyncMode, error) {
+	switch value {
+	case "full":
+		return SyncFull, nil
+	case "commit":
+		return SyncCommit, nil
+	}
+	return 0, fmt.Errorf("unknown sync mode %q", value)
+}
+
+func (d *Driver) Open(name string) (driver.Conn, error) {
+	ds, err := parseDSN(name)
+	if err != nil {
+		return nil, err
+	}
+	if ds.host != "" {
+		return nil, fmt.Errorf("%w: connecting to server %s", common.ErrNotSupported, ds.host)
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	s, ok := d.dbs[ds.path]
+	if !ok {
+		db, err := Open(ds.path, &ds.opts)
+		if err != nil {
+			return nil, err
+		}
+		s = &sharedDB{db: db, query: ds.query}
+		d.dbs[ds.path] = s
+	} else if s.query != ds.query {
+		return nil, fmt.Errorf("%w: %s is already open with %q", common.ErrInvalidOptions, ds.path, s.query)
+	}
+	s.refs++
+	return &conn{driver: d, path: ds.path, db: s.db}, nil
+}
+
+// release 连接关闭时调用, 引用计数为0时关闭数据库
+func (d *Driver) release(path string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	s := d.dbs[path]
+	if s.refs--; s.refs > 0 {
+		return nil
+	}
+	delete(d.dbs, path)
+	return s.db.Close()
+}
+
+type conn struct {
+	driver *Driver
+	path   string
+	db     *DB
+	tx     *connTx
+}
+
+// Prepare 语句是数据API的命令, 和Tx.Exec、Tx.Query执行的相同. insert的LastInsertId是UID,
+// read和scan的结果有uid和data两列. 不在事务中执行时, 写命令各自在一个事务中执行并提交
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *conn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	op, err := parseCommand(query)
+	if err != nil {
+		return nil, err
+	}
+	return &stmt{conn: c, query: query, op: op}, nil
+}
+
+func (c *conn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+// BeginTx 版本管理还不在这个仓库中, 没有办法保证任何隔离级别, 只接受默认级别.
+// 只读事务不在XID文件中开始事务, 其中的写命令返回common.ErrReadOnly, 只读打开的数据库也可以使用
+func (c *conn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if sql.IsolationLevel(opts.Isolation) != sql.LevelDefault {
+		return nil, fmt.Errorf("%w: isolation level %v", common.ErrNotSupported, sql.IsolationLevel(opts.Isolation))
+	}
+	if c.tx != nil {
+		return nil, common.ErrNestedTransaction
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	t := &connTx{conn: c, readOnly: opts.ReadOnly}
+	if !opts.ReadOnly {
+		tx, err := c.db.Begin()
+		if err != nil {
+			return nil, err
+		}
+		t.tx = tx
+	}
+	c.tx = t
+	return t, nil
+}
+
+// Close 回滚连接上没有结束的事务
+func (c *conn) Close() error {
+	var err error
+	if c.tx != nil {
+		err = c.tx.Rollback()
+	}
+	if releaseErr := c.driver.release(c.path); err == nil {
+		err = releaseErr
+	}
+	return err
+}
+
+// connTx 只读事务的tx为nil
+type connTx struct {
+	conn     *conn
+	tx       *Tx
+	readOnly bool
+}
+
+func (t *connTx) Commit() error {
+	t.conn.tx = nil
+	if t.tx == nil {
+		return nil
+	}
+	return t.tx.Commit()
+}
+
+func (t *connTx) Rollback() error {
+	t.conn.tx = nil
+	if t.tx == nil {
+		return nil
+	}
+	return t.tx.Rollback()
+}
+
+type stmt struct {
+	conn  *conn
+	query string
+	op    string
+}
+
+func (s *stmt) Close() error {
+	return nil
+}
+
+func (s *stmt) NumInput() int {
+	return commandInputs[s.op]
+}
+
+func (s *stmt) Exec(args []driver.Value) (driver.Result, error) {
+	if isQuery(s.op) {
+		return nil, fmt.Errorf("%w: %s returns rows, use Query", common.ErrInvalidCommand, s.op)
+	}
+	t := s.conn.tx
+	if t != nil && t.readOnly {
+		return nil, common.ErrReadOnly
+	}
+	if t != nil {
+		return s.exec(t.tx, args)
+	}
+	// 不在事务中时单独开始一个事务, 出错时回滚
+	tx, err := s.conn.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.exec(tx, args)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return res, tx.Commit()
+}
+
+func (s *stmt) exec(tx *Tx, args []driver.Value) (driver.Result, error) {
+	uid, err := tx.Exec(s.query, values(args)...)
+	if err != nil {
+		return nil, err
+	}
+	return result{uid: uid}, nil
+}
+
+// Query 读数据不需要事务, 事务已经结束时同样返回common.ErrTxDone
+func (s *stmt) Query(args []driver.Value) (driver.Rows, error) {
+	var r *Rows
+	var err error
+	if t := s.conn.tx; t != nil && t.tx != nil {
+		r, err = t.tx.Query(s.query, values(args)...)
+	} else {
+		r, err = s.conn.db.Query(s.query, values(args)...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &rows{r}, nil
+}
+
+func values(args []driver.Value) []any {
+	vs := make([]any, len(args))
+	for i, arg := range args {
+		vs[i] = arg
+	}
+	return vs
+}
+
+// result 插入时LastInsertId是UID, 每个写命令只影响一条数据
+type result struct {
+	uid int64
+}
+
+func (r result) LastInsertId() (int64, error) {
+	return r.uid, nil
+}
+
+func (r result) RowsAffected() (int64, error) {
+	return 1, nil
+}
+
+// rows 把Rows包装成driver.Rows
+type rows struct {
+	*Rows
+}
+
+func (r *rows) Columns() []string {
+	return []string{"uid", "data"}
+}
+
+func (r *rows) Next(dest []driver.Value) error {
+	if !r.Rows.Next() {
+		if err := r.Err(); err != nil {
+			return err
+		}
+		return io.EOF
+	}
+	dest[0], dest[1] = r.UID(), r.Data()
+	return nil
+}
@@ -0,0 +1,138 @@
+package godb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/herveyleaf/GoDB/pkg/common"
+)
+
+func TestDriver(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "driver")
+	sqlDB, err := sql.Open(DRIVER_NAME, path+"?sync=commit&page_size=4096")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 两个连接共用同一个数据库
+	ctx := context.Background()
+	tx1, err := sqlDB.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx2, err := sqlDB.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := tx1.Exec("insert ?", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	uid, _ := res.LastInsertId()
+	if _, err := tx2.Exec("insert ?", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx1.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx2.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 不在事务中的写命令自动提交
+	if _, err := sqlDB.Exec("UPDATE ? ?", uid, []byte("aa")); err != nil {
+		t.Fatal(err)
+	}
+	var data string
+	if err := sqlDB.QueryRow("read ?", uid).Scan(new(int64), &data); err != nil || data != "aa" {
+		t.Fatalf("read returned %q, %v", data, err)
+	}
+	rows, err := sqlDB.Query("scan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for rows.Next() {
+		n++
+	}
+	if err := rows.Err(); err != nil || n != 2 {
+		t.Fatalf("scan returned %d rows, %v", n, err)
+	}
+	rows.Close()
+	if _, err := sqlDB.Exec("delete ?", uid); err != nil {
+		t.Fatal(err)
+	}
+	if err := sqlDB.QueryRow("read ?", uid).Scan(new(int64), &data); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("Expected no rows after delete, got %v", err)
+	}
+
+	// 回滚的事务插入的数据读不到
+	tx, err := sqlDB.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, err = tx.Exec("insert ?", "rolled back"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	rolledBack, _ := res.LastInsertId()
+	if err := sqlDB.QueryRow("read ?", rolledBack).Scan(new(int64), &data); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("Expected no rows after rollback, got %v", err)
+	}
+
+	// 没有版本管理, 任何隔离级别都不能保证
+	for _, level := range []sql.IsolationLevel{sql.LevelReadUncommitted, sql.LevelReadCommitted, sql.LevelRepeatableRead, sql.LevelSerializable} {
+		if _, err := sqlDB.BeginTx(ctx, &sql.TxOptions{Isolation: level}); !errors.Is(err, common.ErrNotSupported) {
+			t.Fatalf("Expected ErrNotSupported for %v, got %v", level, err)
+		}
+	}
+	for _, query := range []string{"select 1", "insert", "read ? ?", "scan ?"} {
+		if _, err := sqlDB.Exec(query); !errors.Is(err, common.ErrInvalidCommand) {
+			t.Fatalf("Expected ErrInvalidCommand for %q, got %v", query, err)
+		}
+	}
+	// 只读事务不能写
+	ro, err := sqlDB.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ro.Exec("insert ?", "c"); !errors.Is(err, common.ErrReadOnly) {
+		t.Fatalf("Expected ErrReadOnly, got %v", err)
+	}
+	ro.Rollback()
+	if err := sqlDB.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 所有连接关闭后数据库也关闭了, 可以再次打开; 同一个路径不能用不同的参数打开
+	db, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	a, _ := sql.Open(DRIVER_NAME, "godb://"+path+"?read_only=true")
+	defer a.Close()
+	b, _ := sql.Open(DRIVER_NAME, path)
+	defer b.Close()
+	if err := a.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Ping(); !errors.Is(err, common.ErrInvalidOptions) {
+		t.Fatalf("Expected ErrInvalidOptions for different options, got %v", err)
+	}
+
+	for dsn, want := range map[string]error{
+		"godb://localhost:9999/db": common.ErrNotSupported,
+		path + "?sync=sometimes":   common.ErrInvalidOptions,
+		path + "?colour=red":       common.ErrInvalidOptions,
+	} {
+		bad, _ := sql.Open(DRIVER_NAME, dsn)
+		if err := bad.Ping(); !errors.Is(err, want) {
+			t.Fatalf("DSN %q: expected %v, got %v", dsn, want, err)
+		}
+	}
+}
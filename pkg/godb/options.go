@@ -0,0 +1,172 @@
+package godb
+
+import (
+	"fmt"
+
+	"github.com/herveyleaf/GoDB/internal/backend/dm"
+	"github.com/herveyleaf/GoDB/internal/backend/tm"
+	"github.com/herveyleaf/GoDB/internal/backend/utils"
+	"github.com/herveyleaf/GoDB/internal/backend/vfs"
+	"github.com/herveyleaf/GoDB/pkg/common"
+)
+
+const (
+	// 默认的页面缓存大小
+	DEFAULT_MEMORY = 64 << 20
+
+	// 页面大小的范围和默认值
+	MIN_PAGE_SIZE     = dm.MIN_PAGE_SIZE
+	MAX_PAGE_SIZE     = dm.MAX_PAGE_SIZE
+	DEFAULT_PAGE_SIZE = dm.DEFAULT_PAGE_SIZE
+	// 页面缓存至少要放得下的页面数
+	MIN_CACHED_PAGES = dm.MEM_MIN_LIM
+)
+
+// FS 数据库的所有文件所在的文件系统, 可以传入自己的实现, 比如加上故障注入或者统计
+type FS = vfs.FS
+
+// File FS打开的文件
+type File = vfs.File
+
+// NewMemFS 返回一个内存中的文件系统, 关闭数据库之后内容仍然保留, 适合测试
+func NewMemFS() FS {
+	return vfs.NewMemFS()
+}
+
+// SelectStrategy 插入时选择页面的策略
+type SelectStrategy int
+
+const (
+	// 从一定能放下数据的页面中取第一个
+	SelectFirstFit SelectStrategy = iota
+	// 取能放下数据的页面中空闲空间最小的一个
+	SelectBestFit
+	// 只使用最近插入过的页面, 放不下就分配新页, 适合批量导入
+	SelectAppendOnly
+)
+
+// SyncMode 日志落盘的时机
+type SyncMode int
+
+const (
+	// 每次写日志都fsync
+	SyncFull SyncMode = iota
+	// 只在提交事务和写回页面之前fsync, 写多个数据的事务快很多. 崩溃时已经提交的事务不会丢失
+	SyncCommit
+)
+
+// Logger 接收数据库输出的信息, 比如崩溃恢复的进度. *log.Logger满足这个接口
+type Logger interface {
+	Printf(format string, v ...any)
+}
+
+// Options 打开数据库时的配置, 零值表示使用默认值
+type Options struct {
+	// 页面缓存使用的内存字节数, 至少要放得下MIN_CACHED_PAGES个页面, 默认是DEFAULT_MEMORY
+	Memory int64
+	// 页面大小, 必须是4KB到64KB之间的2的幂, 只在创建数据库时生效, 打开时以文件头中记录的为准
+	PageSize int
+	// 通过内存映射访问数据库文件, 只在Linux上可用, 不能和加密、压缩一起使用. 写回页面时同样经过双写文件, 旧的日志段照常删除
+	Mmap bool
+	// 数据库的所有文件所在的文件系统, 为nil时使用操作系统的文件系统
+	FS FS
+	// 不为nil时加密页面、日志和XID文件, 长度必须是16、24或32字节. AES-GCM的随机数随机选取时一个密钥最多只能加密约2^32次,
+	// 所以加密时每个纪元用随机的盐派生新的密钥, 一个纪元最多加密2^32次, 不受这个限制
+	EncryptionKey []byte
+	// 压缩除第一页以外的页面, 只在创建数据库时生效
+	Compress bool
+	// 插入时选择页面的策略, 默认是SelectFirstFit
+	Select SelectStrategy
+	// 只读打开已有的数据库, 可以被多个进程同时只读打开, 但不能开始事务
+	ReadOnly bool
+	// 日志落盘的时机, 默认是SyncFull
+	Sync SyncMode
+	// 日志段的大小, 当前的日志段超过这个大小时换新的日志段并删除不再需要的旧日志段, 默认是64MB
+	LogSegmentSize int64
+	// 不为nil时接收崩溃恢复的进度, 默认不输出
+	Logger Logger
+}
+
+// validate 检查配置并填上默认值, 错误都包装了common.ErrInvalidOptions
+func (o Options) validate() (Options, error) {
+	if o.Memory == 0 {
+		o.Memory = DEFAULT_MEMORY
+	}
+	pageSize := o.PageSize
+	if pageSize == 0 {
+		pageSize = dm.DEFAULT_PAGE_SIZE
+	}
+	if !dm.ValidPageSize(pageSize) {
+		return o, fmt.Errorf("%w: page size %d must be a power of two between %d and %d",
+			common.ErrInvalidOptions, o.PageSize, dm.MIN_PAGE_SIZE, dm.MAX_PAGE_SIZE)
+	}
+	// 打开已有的数据库时页面大小取自文件头, 这里按最小页面检查, 剩下的由页面缓存检查
+	minPages := int64(MIN_CACHED_PAGES)
+	if o.Memory < minPages*dm.MIN_PAGE_SIZE || (o.PageSize != 0 && o.Memory < minPages*int64(pageSize)) {
+		return o, fmt.Errorf("%w: memory %d cannot hold %d pages of %d bytes",
+			common.ErrInvalidOptions, o.Memory, minPages, pageSize)
+	}
+	if o.EncryptionKey != nil && !utils.ValidKey(o.EncryptionKey) {
+		return o, fmt.Errorf("%w: encryption key must be 16, 24 or 32 bytes, got %d",
+			common.ErrInvalidOptions, len(o.EncryptionKey))
+	}
+	if o.Mmap && (o.EncryptionKey != nil || o.Compress) {
+		return o, fmt.Errorf("%w: %w", common.ErrInvalidOptions, common.ErrMmapIncompatible)
+	}
+	switch o.Select {
+	case SelectFirstFit, SelectBestFit, SelectAppendOnly:
+	default:
+		return o, fmt.Errorf("%w: unknown select strategy %d", common.ErrInvalidOptions, o.Select)
+	}
+	if o.Sync != SyncFull && o.Sync != SyncCommit {
+		return o, fmt.Errorf("%w: unknown sync mode %d", common.ErrInvalidOptions, o.Sync)
+	}
+	if o.LogSegmentSize < 0 {
+		return o, fmt.Errorf("%w: log segment size %d is negative", common.ErrInvalidOptions, o.LogSegmentSize)
+	}
+	return o, nil
+}
+
+func (o Options) dmConfig() dm.Config {
+	return dm.Config{
+		PageSize:       o.PageSize,
+		Mmap:           o.Mmap,
+		FS:             o.FS,
+		EncryptionKey:  o.EncryptionKey,
+		Compress:       o.Compress,
+		Select:         o.selectStrategy(),
+		ReadOnly:       o.ReadOnly,
+		Sync:           o.syncMode(),
+		Logf:           o.logf(),
+		LogSegmentSize: o.LogSegmentSize,
+		Locked:         true,
+	}
+}
+
+func (o Options) syncMode() dm.SyncMode {
+	if o.Sync == SyncCommit {
+		return dm.SYNC_COMMIT
+	}
+	return dm.SYNC_FULL
+}
+
+func (o Options) logf() func(format string, args ...any) {
+	if o.Logger == nil {
+		return nil
+	}
+	return o.Logger.Printf
+}
+
+func (o Options) selectStrategy() dm.SelectStrategy {
+	switch o.Select {
+	case SelectBestFit:
+		return dm.SELECT_BEST_FIT
+	case SelectAppendOnly:
+		return dm.SELECT_APPEND_ONLY
+	}
+	return dm.SELECT_FIRST_FIT
+}
+
+func (o Options) tmConfig() tm.Config {
+	return tm.Config{FS: o.FS, EncryptionKey: o.EncryptionKey, ReadOnly: o.ReadOnly, Locked: true}
+}
@@ -0,0 +1,146 @@
+package godb
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/herveyleaf/GoDB/pkg/common"
+)
+
+// Tx 一个事务, 只能提交或者回滚一次, 之后的调用都返回common.ErrTxDone.
+// 数据的读写以事务的名义交给数据管理器, 同一个事务的调用是串行的
+type Tx struct {
+	db    *DB
+	xid   int64
+	level IsolationLevel
+	lock  sync.Mutex
+	done  bool
+}
+
+// IsolationLevel 事务的隔离级别, 对应版本管理的两种模式. 版本管理还不在这个仓库中, 现在只记录事务要求的级别,
+// 读写都直接交给数据管理器, 能看到其它事务还没有提交的修改
+type IsolationLevel int
+
+const (
+	ReadCommitted IsolationLevel = iota
+	RepeatableRead
+)
+
+// Begin 以ReadCommitted开始一个新事务
+func (db *DB) Begin() (*Tx, error) {
+	return db.BeginTx(ReadCommitted)
+}
+
+// BeginTx 以level开始一个新事务
+func (db *DB) BeginTx(level IsolationLevel) (*Tx, error) {
+	if level != ReadCommitted && level != RepeatableRead {
+		return nil, fmt.Errorf("%w: unknown isolation level %d", common.ErrNotSupported, level)
+	}
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.closed {
+		return nil, common.ErrDatabaseClosed
+	}
+	xid, err := db.tm.Begin()
+	if err != nil {
+		return nil, err
+	}
+	tx := &Tx{db: db, xid: xid, level: level}
+	db.active[tx] = struct{}{}
+	return tx, nil
+}
+
+// XID 返回事务的编号
+func (tx *Tx) XID() int64 {
+	return tx.xid
+}
+
+// Isolation 返回开始事务时要求的隔离级别
+func (tx *Tx) Isolation() IsolationLevel {
+	return tx.level
+}
+
+// Commit 提交事务, 事务的日志先落盘, 之后才在XID文件中标记提交
+func (tx *Tx) Commit() error {
+	return tx.finish(func(xid int64) error {
+		if err := tx.db.dm.SyncLog(); err != nil {
+			return err
+		}
+		return tx.db.tm.Commit(xid)
+	})
+}
+
+// Rollback 回滚事务, 数据管理器撤销这个事务的所有修改, 补偿日志落盘之后才在XID文件中标记回滚.
+// 撤销失败时事务仍然是活跃的, 下次打开时由恢复撤销
+func (tx *Tx) Rollback() error {
+	return tx.finish(func(xid int64) error {
+		if err := tx.db.dm.Abort(xid); err != nil {
+			return err
+		}
+		return tx.db.tm.Abort(xid)
+	})
+}
+
+// finish 事务结束后就不能再使用, 即使写XID文件失败, 状态也交给下次打开时的恢复处理
+func (tx *Tx) finish(f func(int64) error) error {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	if tx.done {
+		return common.ErrTxDone
+	}
+	tx.done = true
+	tx.db.lock.Lock()
+	delete(tx.db.active, tx)
+	tx.db.lock.Unlock()
+	return f(tx.xid)
+}
+
+// use 在事务还没有结束时执行f
+func (tx *Tx) use(f func() error) error {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	if tx.done {
+		return common.ErrTxDone
+	}
+	return f()
+}
+
+// Insert 插入一条数据, 返回它的UID
+func (tx *Tx) Insert(data []byte) (uid int64, err error) {
+	err = tx.use(func() error {
+		uid, err = tx.db.dm.Insert(tx.xid, data)
+		return err
+	})
+	return
+}
+
+// Read 读出uid处的数据, 数据不存在或者已经删除时返回nil
+func (tx *Tx) Read(uid int64) (data []byte, err error) {
+	err = tx.use(func() error {
+		data, err = tx.db.Read(uid)
+		return err
+	})
+	return
+}
+
+// Update 把uid处的数据换成data, 长度可以和原来不同
+func (tx *Tx) Update(uid int64, data []byte) error {
+	return tx.use(func() error {
+		return tx.db.dm.Update(tx.xid, uid, data)
+	})
+}
+
+// Delete 删除uid处的数据
+func (tx *Tx) Delete(uid int64) error {
+	return tx.use(func() error {
+		return tx.db.dm.Delete(tx.xid, uid)
+	})
+}
+
+// Scan 按UID的顺序对每条数据调用f, f返回错误时停止并返回这个错误. f中可以继续用这个事务读写数据
+func (tx *Tx) Scan(f func(uid int64, data []byte) error) error {
+	if err := tx.use(func() error { return nil }); err != nil {
+		return err
+	}
+	return tx.db.Scan(f)
+}
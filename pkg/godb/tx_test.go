@@ -0,0 +1,175 @@
+package godb
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/herveyleaf/GoDB/internal/backend/tm"
+	"github.com/herveyleaf/GoDB/pkg/common"
+)
+
+func TestTx(t *testing.T) {
+	fsys := NewMemFS()
+	db, err := Open("tx", &Options{FS: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	committed, _ := db.Begin()
+	aborted, _ := db.Begin()
+	open, _ := db.Begin()
+	if err := committed.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := committed.Rollback(); !errors.Is(err, common.ErrTxDone) {
+		t.Fatalf("Expected ErrTxDone, got %v", err)
+	}
+	uid, err := aborted.Insert([]byte("aborted"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := aborted.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := db.Read(uid); err != nil || data != nil {
+		t.Fatalf("Data of a rolled back transaction is still readable: %q %v", data, err)
+	}
+	// 关闭时回滚没有结束的事务, 关闭之后不能再使用
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); !errors.Is(err, common.ErrDatabaseClosed) {
+		t.Fatalf("Expected ErrDatabaseClosed, got %v", err)
+	}
+	if _, err := db.Begin(); !errors.Is(err, common.ErrDatabaseClosed) {
+		t.Fatalf("Expected ErrDatabaseClosed, got %v", err)
+	}
+
+	tmgr, err := tm.OpenWithConfig("tx", tm.Config{FS: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tmgr.Close()
+	for _, c := range []struct {
+		tx      *Tx
+		check   func(int64) (bool, error)
+		message string
+	}{
+		{committed, tmgr.IsCommitted, "committed"},
+		{aborted, tmgr.IsAborted, "aborted"},
+		{open, tmgr.IsAborted, "aborted on close"},
+	} {
+		if ok, err := c.check(c.tx.XID()); err != nil || !ok {
+			t.Fatalf("Transaction %d should be %s", c.tx.XID(), c.message)
+		}
+	}
+}
+
+func TestTxData(t *testing.T) {
+	fsys := NewMemFS()
+	db, err := Open("data", &Options{FS: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, _ := db.Begin()
+	a, err := tx.Insert([]byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := tx.Insert([]byte("b"))
+	if err := tx.Update(a, []byte("aa")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Delete(b); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := tx.Read(b); err != nil || data != nil {
+		t.Fatalf("Deleted data is still readable: %q %v", data, err)
+	}
+	// 遍历时可以用同一个事务写入
+	var seen []string
+	err = tx.Scan(func(uid int64, data []byte) error {
+		seen = append(seen, string(data))
+		return tx.Update(uid, []byte("aaa"))
+	})
+	if err != nil || len(seen) != 1 || seen[0] != "aa" {
+		t.Fatalf("Scan returned %q, %v", seen, err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Insert([]byte("c")); !errors.Is(err, common.ErrTxDone) {
+		t.Fatalf("Expected ErrTxDone, got %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 只读打开时不在事务中读数据
+	if db, err = Open("data", &Options{FS: fsys, ReadOnly: true}); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if data, err := db.Read(a); err != nil || string(data) != "aaa" {
+		t.Fatalf("Read after reopen returned %q, %v", data, err)
+	}
+}
+
+func TestTxExecQuery(t *testing.T) {
+	db, err := Open("exec", &Options{FS: NewMemFS()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	tx, _ := db.Begin()
+	a, err := tx.Exec("insert ?", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := tx.Exec("INSERT ?", []byte("b"))
+	if _, err := tx.Exec("update ? ?", a, "aa"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec("delete ?", b); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		query string
+		args  []any
+	}{
+		{"read ?", []any{a}},
+		{"insert", nil},
+		{"insert ?", []any{a}},
+		{"update ? ?", []any{a}},
+	} {
+		if _, err := tx.Exec(c.query, c.args...); !errors.Is(err, common.ErrInvalidCommand) {
+			t.Fatalf("Exec(%q) should fail with ErrInvalidCommand, got %v", c.query, err)
+		}
+	}
+
+	rows, err := tx.Query("read ?", a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rows.Next() || rows.UID() != a || string(rows.Data()) != "aa" || rows.Next() {
+		t.Fatalf("read returned wrong rows")
+	}
+	rows.Close()
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Query("scan"); !errors.Is(err, common.ErrTxDone) {
+		t.Fatalf("Expected ErrTxDone, got %v", err)
+	}
+	rows, err = db.Query("scan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var seen []int64
+	for rows.Next() {
+		seen = append(seen, rows.UID())
+	}
+	if rows.Err() != nil || len(seen) != 1 || seen[0] != a {
+		t.Fatalf("scan returned %v, %v", seen, rows.Err())
+	}
+}